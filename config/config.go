@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -708,6 +709,248 @@ type StateSyncConfig struct {
 	TrustHeight   int64         `mapstructure:"trust_height"`
 	TrustHash     string        `mapstructure:"trust_hash"`
 	DiscoveryTime time.Duration `mapstructure:"discovery_time"`
+
+	// Time to wait for a snapshot chunk to be applied, while chunk requests are outstanding and
+	// peers are available, before the sync is considered stalled and fails. 0 disables the check.
+	StallTimeout time.Duration `mapstructure:"stall_timeout"`
+
+	// UNSAFE: proceed with state sync even if the app already has state, i.e. reports a height
+	// above 0, restoring the snapshot over it. This may corrupt the app's state, and is only
+	// useful if the app is known to discard its existing state when offered a snapshot.
+	UnsafeForceSync bool `mapstructure:"unsafe_force_sync"`
+
+	// Sign snapshot advertisements with the node key, allowing syncing peers to detect tampered
+	// advertisements. Signed advertisements are always verified, and unsigned ones are accepted.
+	SignSnapshots bool `mapstructure:"sign_snapshots"`
+
+	// Maximum size of a snapshot chunk received from peers, in bytes. Peers sending larger chunks
+	// are disconnected. 0 uses the maximum chunk message size of the p2p channel (16 MB), which
+	// also caps any larger value.
+	MaxChunkBytes int `mapstructure:"max_chunk_bytes"`
+
+	// Maximum size of snapshot metadata, in bytes. Peers advertising snapshots with larger metadata
+	// are disconnected, and local snapshots with larger metadata aren't advertised. 0 uses the p2p
+	// channel's maximum snapshot message size (4 MB), which also caps it.
+	MaxMetadataBytes int `mapstructure:"max_metadata_bytes"`
+
+	// Total number of chunk retries allowed for a snapshot, as a multiple of its chunk count,
+	// before the snapshot is rejected and the next one is tried. Retries include chunk request
+	// timeouts and refetches or reapplications requested by the app. 0 disables the limit.
+	ChunkRetryBudget float64 `mapstructure:"chunk_retry_budget"`
+
+	// Maximum number of times a single chunk can be refetched at the app's request, e.g. because
+	// it failed verification, before the snapshot is rejected as likely being bad itself.
+	// Refetches prefer peers that haven't already sent a bad copy of the chunk. 0 disables the
+	// limit.
+	ChunkRefetchLimit int `mapstructure:"chunk_refetch_limit"`
+
+	// Minimum interval between re-broadcasts of snapshot requests to all peers, which are sent when
+	// a peer advertises a snapshot higher than any seen so far before a snapshot has been chosen.
+	// This lets other peers with the new snapshot advertise it too, such that it has more peers to
+	// fetch chunks from. 0 disables re-broadcasts.
+	DiscoveryRebroadcastInterval time.Duration `mapstructure:"discovery_rebroadcast_interval"`
+
+	// Scale the snapshot discovery time with the number of connected peers, instead of using the
+	// fixed discovery_time: it is discovery_time_max divided by the number of peers, but no less
+	// than discovery_time_min. Nodes with few peers thus wait longer to discover snapshots, and
+	// nodes with many peers can start restoring sooner.
+	DiscoveryTimeAdaptive bool          `mapstructure:"discovery_time_adaptive"`
+	DiscoveryTimeMin      time.Duration `mapstructure:"discovery_time_min"`
+	DiscoveryTimeMax      time.Duration `mapstructure:"discovery_time_max"`
+
+	// Maximum time to keep discovering snapshots if none were discovered once the discovery time
+	// elapses, e.g. because a freshly started node had no peers yet. Discovery ends as soon as a
+	// snapshot is discovered. This is done once per sync, and also applies when discovery is
+	// otherwise disabled, rather than failing right away. 0 disables the extension.
+	DiscoveryExtensionMax time.Duration `mapstructure:"discovery_extension_max"`
+
+	// Peers known to serve snapshots, as a list of id@host:port addresses, which are dialed when a
+	// state sync starts and asked for snapshots once connected, regardless of the regular peer set
+	// (e.g. persistent_peers and the address book). This allows a node with few or no snapshot
+	// serving peers to bootstrap from e.g. its operator's own nodes.
+	SnapshotPeers []string `mapstructure:"snapshot_peers"`
+
+	// Number of workers serving snapshot and chunk requests from peers, such that slow app
+	// responses don't hold up the state sync reactor. Peers are served in turn, such that a peer
+	// sending many requests can't starve others, and each peer's requests are answered in order.
+	// 0 serves requests inline in the reactor.
+	ServingWorkers int `mapstructure:"serving_workers"`
+
+	// Time for which snapshots discovered by a state sync are retained for later syncs, e.g. when
+	// retrying a failed sync, such that these can start restoring without waiting for discovery.
+	// Snapshots and peers rejected by a failed sync aren't reused. With a temp_dir, the catalog is
+	// also persisted there, such that a node restarted during discovery reuses the snapshots once
+	// their peers reconnect, and only waits for the remainder of discovery_time. 0 disables
+	// retention.
+	DiscoveryCatalogTTL time.Duration `mapstructure:"discovery_catalog_ttl"`
+
+	// Time for which snapshot states and commits verified via the light client are retained for
+	// later syncs, such that a retried sync which re-selects a snapshot doesn't verify it again.
+	// The cache is cleared when the trust options change. 0 disables caching.
+	VerificationCacheTTL time.Duration `mapstructure:"verification_cache_ttl"`
+
+	// Number of attempts to reconnect to the app and re-offer the snapshot if the app connection
+	// is lost while applying chunks, e.g. because the app restarted, before the sync fails. The
+	// restore resumes with the chunk that failed to apply. 0 disables reconnects.
+	AppReconnectAttempts int `mapstructure:"app_reconnect_attempts"`
+
+	// Snapshot formats to advertise to peers, e.g. to stop serving a deprecated format while
+	// still serving newer ones. Empty serves all formats.
+	ServingFormats []uint32 `mapstructure:"serving_formats"`
+
+	// Snapshot formats to restore when state syncing, independently of serving_formats. Snapshots
+	// in other formats are ignored. Empty restores all formats.
+	RestoreFormats []uint32 `mapstructure:"restore_formats"`
+
+	// Snapshot formats in order of preference, for apps whose format numbers don't increase with
+	// desirability. Among snapshots at the same height, listed formats are preferred in the given
+	// order over unlisted ones, then the greatest format is preferred. Listed formats must be
+	// restored, i.e. be in restore_formats if set. Empty prefers the greatest format.
+	FormatPriority []uint32 `mapstructure:"format_priority"`
+
+	// Restore differential snapshots advertised by peers, which contain only the changes since a
+	// base height, if the app is already at their base height. Diffs are preferred over full
+	// snapshots, which remain the fallback. The app must support applying diffs to its existing
+	// state.
+	DiffSnapshots bool `mapstructure:"diff_snapshots"`
+
+	// Break ties between otherwise equally ranked snapshots by preferring the one whose peers have
+	// the lowest estimated latency, based on the time taken to fetch chunks from them. Snapshots
+	// without latency estimates fall back to the default ordering.
+	LatencyTieBreak bool `mapstructure:"latency_tie_break"`
+
+	// Time after a state sync completes during which chunks still arriving from peers, e.g. in
+	// response to retried or parallel requests, are silently discarded and counted in the
+	// straggler_chunks metric, instead of being logged as unexpected. Likewise, responses to chunk
+	// requests left in flight by a finished restore are discarded by later restores of the same
+	// snapshot during this window. 0 disables the window.
+	StragglerChunkWindow time.Duration `mapstructure:"straggler_chunk_window"`
+
+	// Number of consecutive state provider (light client) failures after which its circuit breaker
+	// opens, failing verification immediately for state_provider_cooldown instead of waiting on an
+	// unhealthy provider. A sync with no verified snapshots fails while the breaker is open. Once
+	// the cooldown has passed, a single call probes the provider, closing the breaker if it
+	// succeeds. 0 disables the breaker.
+	StateProviderFailureThreshold int           `mapstructure:"state_provider_failure_threshold"`
+	StateProviderCooldown         time.Duration `mapstructure:"state_provider_cooldown"`
+
+	// Time to wait after the last snapshot chunk has been applied for the app to report the
+	// snapshot's height via Info, e.g. while it flushes the restored state, before the restored
+	// app hash is verified and the sync completes. 0 requires the app to report it immediately.
+	AppFlushTimeout time.Duration `mapstructure:"app_flush_timeout"`
+
+	// Minimum time between consecutive snapshot offers to the app, to protect apps that do heavy
+	// work on each offer when peers advertise many snapshots that the app rejects. 0 disables it.
+	OfferInterval time.Duration `mapstructure:"offer_interval"`
+
+	// Maximum number of snapshot offers to the app per state sync, including re-offers after app
+	// reconnects, beyond which the sync fails. 0 means unlimited.
+	MaxOffers int `mapstructure:"max_offers"`
+
+	// Time budget per snapshot chunk, from which a deadline for restoring a snapshot is derived in
+	// proportion to its chunk count. A warning is logged if the restore is pacing behind the
+	// deadline, and the snapshot is rejected once the deadline passes. 0 disables the deadline.
+	ChunkTimeBudget time.Duration `mapstructure:"chunk_time_budget"`
+
+	// Policy for serving chunk responses when a peer's chunk send queue is full. "backpressure"
+	// waits for the queue to drain, holding back the peer's further requests, while "drop" drops
+	// the response, and the peer will request the chunk again. Both count full queues in the
+	// chunk_send_queue_full metric, and dropped responses in the dropped_chunk_responses metric.
+	ChunkSendPolicy string `mapstructure:"chunk_send_policy"`
+
+	// What to do when the app hash of a restored snapshot doesn't match the app hash trusted via
+	// the light client. "next" rejects the snapshot and tries the next candidate, assuming that the
+	// snapshot is bad, while "abort" fails the state sync, assuming that the trust anchor
+	// (trust_height and trust_hash) is wrong. A single bad snapshot is more likely than a bad trust
+	// anchor, but with "next" a wrong trust anchor makes the node restore every snapshot in vain
+	// before giving up.
+	AppHashMismatch string `mapstructure:"app_hash_mismatch"`
+
+	// Minimum chunk download throughput, in bytes per second. If the throughput stays below it for
+	// min_throughput_window while chunks are outstanding, the snapshot is rejected and snapshots are
+	// rediscovered from all peers in search of a better peer set. 0 disables the minimum.
+	MinThroughput int64 `mapstructure:"min_throughput"`
+	// Window over which the chunk download throughput is measured for min_throughput.
+	MinThroughputWindow time.Duration `mapstructure:"min_throughput_window"`
+
+	// Retention policy for local snapshots served to peers: only snapshots at the
+	// snapshot_keep_recent most recent heights, and snapshots first seen within snapshot_keep_age,
+	// are advertised. Ages are tracked from when the node first lists a snapshot, and restart with
+	// the node. If the app integration provides a snapshot pruner, expired snapshots are also
+	// deleted from the app once no longer served to peers. 0 disables either limit.
+	SnapshotKeepRecent int           `mapstructure:"snapshot_keep_recent"`
+	SnapshotKeepAge    time.Duration `mapstructure:"snapshot_keep_age"`
+
+	// Window after advertising a local snapshot to a peer during which repeated snapshot requests
+	// from the peer don't advertise it again, relying on the peer to have cached the earlier
+	// advertisement, e.g. via discovery_catalog_ttl. New snapshots are still advertised, and a
+	// reconnecting peer starts afresh. 0 answers every request in full.
+	SnapshotAdvertiseWindow time.Duration `mapstructure:"snapshot_advertise_window"`
+
+	// Maximum number of distinct snapshots tracked per peer during discovery. Beyond it, the
+	// snapshot the peer least recently advertised is evicted, bounding the memory and influence of
+	// chatty or malicious peers. 0 uses the default of 10.
+	MaxSnapshotsPerPeer int `mapstructure:"max_snapshots_per_peer"`
+
+	// Maximum number of peers that chunks of the snapshot being restored are requested from. The
+	// active peers are the snapshot's peers with the lowest chunk fetch latencies, and further peers
+	// advertising the snapshot are kept as backups, promoted when an active peer disconnects, is
+	// rejected, or times out a chunk request. 0 uses all of the snapshot's peers.
+	MaxActivePeers int `mapstructure:"max_active_peers"`
+
+	// Maximum rate at which snapshot chunks are downloaded when restoring, in bytes/second, such
+	// that a restoring node doesn't saturate its own link. Chunk requests are held back while the
+	// rate of received chunks exceeds it. 0 disables the cap.
+	MaxDownloadRate int64 `mapstructure:"max_download_rate"`
+
+	// Time to retain the chunk reliability and latency of peers across state syncs, such that
+	// later syncs prefer known-good peers and avoid peers which failed most of their chunk
+	// requests, without re-learning their quality. It is persisted in temp_dir, if set, to
+	// survive restarts. Peers not seen within it are forgotten. 0 disables peer reputation.
+	PeerReputationTTL time.Duration `mapstructure:"peer_reputation_ttl"`
+
+	// How long to retain the state of peers which disconnected, e.g. their latency estimates,
+	// advertised snapshots and in-flight chunk requests, in case they reconnect. Peers which briefly
+	// flap then don't cause chunk requests to be rescheduled, but aren't sent new chunk requests
+	// while disconnected. 0 removes disconnected peers right away.
+	PeerReconnectGrace time.Duration `mapstructure:"peer_reconnect_grace"`
+
+	// Restore snapshots into a staging app instance rather than the live app, and only replace the
+	// live app state with the staging instance once the restored app hash and commit have been
+	// verified, such that a bad snapshot never corrupts the live app state. It requires the app's
+	// integration to provide a staging instance, see the state sync docs.
+	StagingRestore bool `mapstructure:"staging_restore"`
+
+	// Check that the directory buffering snapshot chunks (temp_dir, or the system temp dir) has
+	// enough free disk space for a snapshot before restoring it, refusing to restore it otherwise
+	// rather than failing partway with a full disk. The snapshot size is estimated by the app's
+	// integration, if supported, or else from the first chunk received.
+	CheckDiskSpace bool `mapstructure:"check_disk_space"`
+	// Extra free disk space required by check_disk_space, as a fraction of the estimated snapshot
+	// size, to allow for inaccurate estimates, e.g. 0.1 requires 10% more than the estimate.
+	DiskSpaceMargin float64 `mapstructure:"disk_space_margin"`
+
+	// How to handle statesync messages of unknown types, e.g. from peers running a newer protocol
+	// version, or of types unexpected on their channel. "ignore" logs and ignores them, while
+	// "disconnect" treats them as a protocol violation and disconnects the peer, to detect
+	// incompatible peers early on stricter networks.
+	UnknownMessages string `mapstructure:"unknown_messages"`
+
+	// How to handle snapshots in formats higher than any the app supports, e.g. advertised by peers
+	// running a newer app version. "skip" skips them during discovery, logging that a newer format
+	// exists, while "offer" offers them to the app like any other snapshot, for it to reject. The
+	// supported formats are provided by the app's integration, if supported, and are otherwise
+	// learned from the formats the app rejects.
+	FutureFormats string `mapstructure:"future_formats"`
+
+	// Hash of a snapshot obtained from a trusted source out-of-band, as a hex string, and optionally
+	// its height, to bootstrap reproducibly from a known good snapshot. With expected_snapshot_mode
+	// "require", only snapshots matching it are restored, failing the sync if none is discovered
+	// within discovery_time, while "prefer" ranks matching snapshots before any others, falling back
+	// to them if none is discovered.
+	ExpectedSnapshotHash   string `mapstructure:"expected_snapshot_hash"`
+	ExpectedSnapshotHeight int64  `mapstructure:"expected_snapshot_height"`
+	ExpectedSnapshotMode   string `mapstructure:"expected_snapshot_mode"`
 }
 
 func (cfg *StateSyncConfig) TrustHashBytes() []byte {
@@ -719,11 +962,74 @@ func (cfg *StateSyncConfig) TrustHashBytes() []byte {
 	return bytes
 }
 
+// ExpectedSnapshotHashBytes returns the expected snapshot hash, if any.
+func (cfg *StateSyncConfig) ExpectedSnapshotHashBytes() []byte {
+	// validated in ValidateBasic, so we can safely panic here
+	bytes, err := hex.DecodeString(cfg.ExpectedSnapshotHash)
+	if err != nil {
+		panic(err)
+	}
+	return bytes
+}
+
+// ServesFormat checks whether snapshots of the given format should be served to peers.
+func (cfg *StateSyncConfig) ServesFormat(format uint32) bool {
+	return containsFormat(cfg.ServingFormats, format)
+}
+
+// RestoresFormat checks whether snapshots of the given format should be restored.
+func (cfg *StateSyncConfig) RestoresFormat(format uint32) bool {
+	return containsFormat(cfg.RestoreFormats, format)
+}
+
+// containsFormat checks whether a snapshot format is in a set of formats, where an empty set
+// contains all formats.
+func containsFormat(formats []uint32, format uint32) bool {
+	if len(formats) == 0 {
+		return true
+	}
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
 // DefaultStateSyncConfig returns a default configuration for the state sync service
 func DefaultStateSyncConfig() *StateSyncConfig {
 	return &StateSyncConfig{
 		TrustPeriod:   168 * time.Hour,
 		DiscoveryTime: 15 * time.Second,
+		StallTimeout:  10 * time.Minute,
+
+		MaxMetadataBytes:  1 << 20,
+		ChunkRetryBudget:  3,
+		ChunkRefetchLimit: 5,
+
+		DiscoveryRebroadcastInterval: 5 * time.Second,
+
+		DiscoveryTimeMin: 5 * time.Second,
+		DiscoveryTimeMax: time.Minute,
+
+		ServingWorkers:       4,
+		AppReconnectAttempts: 3,
+		StragglerChunkWindow: 10 * time.Second,
+
+		StateProviderFailureThreshold: 5,
+		StateProviderCooldown:         30 * time.Second,
+		AppFlushTimeout:               10 * time.Second,
+		OfferInterval:                 100 * time.Millisecond,
+		ChunkSendPolicy:               "backpressure",
+		AppHashMismatch:               "next",
+		MinThroughputWindow:           5 * time.Minute,
+		MaxSnapshotsPerPeer:           10,
+		MaxActivePeers:                8,
+		CheckDiskSpace:                true,
+		DiskSpaceMargin:               0.1,
+		UnknownMessages:               "ignore",
+		FutureFormats:                 "skip",
+		ExpectedSnapshotMode:          "require",
 	}
 }
 
@@ -760,6 +1066,159 @@ func (cfg *StateSyncConfig) ValidateBasic() error {
 			return fmt.Errorf("invalid trusted_hash: %w", err)
 		}
 	}
+	if cfg.StallTimeout < 0 {
+		return errors.New("stall_timeout can't be negative")
+	}
+	if cfg.MaxChunkBytes < 0 {
+		return errors.New("max_chunk_bytes can't be negative")
+	}
+	if cfg.MaxMetadataBytes < 0 {
+		return errors.New("max_metadata_bytes can't be negative")
+	}
+	if cfg.ChunkRetryBudget < 0 {
+		return errors.New("chunk_retry_budget can't be negative")
+	}
+	if cfg.ChunkRefetchLimit < 0 {
+		return errors.New("chunk_refetch_limit can't be negative")
+	}
+	if cfg.DiscoveryRebroadcastInterval < 0 {
+		return errors.New("discovery_rebroadcast_interval can't be negative")
+	}
+	if cfg.DiscoveryTimeMin < 0 {
+		return errors.New("discovery_time_min can't be negative")
+	}
+	if cfg.DiscoveryTimeMax < 0 {
+		return errors.New("discovery_time_max can't be negative")
+	}
+	if cfg.DiscoveryExtensionMax < 0 {
+		return errors.New("discovery_extension_max can't be negative")
+	}
+	for _, peer := range cfg.SnapshotPeers {
+		if !strings.Contains(peer, "@") {
+			return fmt.Errorf("snapshot_peers entry %q must be of the form id@host:port", peer)
+		}
+	}
+	if cfg.ServingWorkers < 0 {
+		return errors.New("serving_workers can't be negative")
+	}
+	if cfg.VerificationCacheTTL < 0 {
+		return errors.New("verification_cache_ttl can't be negative")
+	}
+	if cfg.DiscoveryCatalogTTL < 0 {
+		return errors.New("discovery_catalog_ttl can't be negative")
+	}
+	if cfg.AppReconnectAttempts < 0 {
+		return errors.New("app_reconnect_attempts can't be negative")
+	}
+	if cfg.StragglerChunkWindow < 0 {
+		return errors.New("straggler_chunk_window can't be negative")
+	}
+	if cfg.StateProviderFailureThreshold < 0 {
+		return errors.New("state_provider_failure_threshold can't be negative")
+	}
+	if cfg.StateProviderCooldown < 0 {
+		return errors.New("state_provider_cooldown can't be negative")
+	}
+	if cfg.AppFlushTimeout < 0 {
+		return errors.New("app_flush_timeout can't be negative")
+	}
+	if cfg.OfferInterval < 0 {
+		return errors.New("offer_interval can't be negative")
+	}
+	if cfg.MaxOffers < 0 {
+		return errors.New("max_offers can't be negative")
+	}
+	if cfg.ChunkTimeBudget < 0 {
+		return errors.New("chunk_time_budget can't be negative")
+	}
+	if cfg.MinThroughput < 0 {
+		return errors.New("min_throughput can't be negative")
+	}
+	if cfg.MinThroughputWindow < 0 {
+		return errors.New("min_throughput_window can't be negative")
+	}
+	if cfg.MinThroughput > 0 && cfg.MinThroughputWindow == 0 {
+		return errors.New("min_throughput_window is required with min_throughput")
+	}
+	if cfg.SnapshotKeepRecent < 0 {
+		return errors.New("snapshot_keep_recent can't be negative")
+	}
+	if cfg.SnapshotKeepAge < 0 {
+		return errors.New("snapshot_keep_age can't be negative")
+	}
+	if cfg.SnapshotAdvertiseWindow < 0 {
+		return errors.New("snapshot_advertise_window can't be negative")
+	}
+	if cfg.MaxSnapshotsPerPeer < 0 {
+		return errors.New("max_snapshots_per_peer can't be negative")
+	}
+	if cfg.MaxActivePeers < 0 {
+		return errors.New("max_active_peers can't be negative")
+	}
+	if cfg.MaxDownloadRate < 0 {
+		return errors.New("max_download_rate can't be negative")
+	}
+	if cfg.PeerReputationTTL < 0 {
+		return errors.New("peer_reputation_ttl can't be negative")
+	}
+	if cfg.PeerReconnectGrace < 0 {
+		return errors.New("peer_reconnect_grace can't be negative")
+	}
+	if cfg.DiskSpaceMargin < 0 {
+		return errors.New("disk_space_margin can't be negative")
+	}
+	seenFormats := make(map[uint32]bool, len(cfg.FormatPriority))
+	for _, format := range cfg.FormatPriority {
+		if seenFormats[format] {
+			return fmt.Errorf("duplicate format %v in format_priority", format)
+		}
+		seenFormats[format] = true
+		if !cfg.RestoresFormat(format) {
+			return fmt.Errorf("format_priority format %v is not in restore_formats", format)
+		}
+	}
+	switch cfg.ChunkSendPolicy {
+	case "backpressure", "drop":
+	default:
+		return fmt.Errorf("unknown chunk_send_policy %q", cfg.ChunkSendPolicy)
+	}
+	switch cfg.AppHashMismatch {
+	case "next", "abort":
+	default:
+		return fmt.Errorf("unknown app_hash_mismatch %q", cfg.AppHashMismatch)
+	}
+	switch cfg.UnknownMessages {
+	case "ignore", "disconnect":
+	default:
+		return fmt.Errorf("unknown unknown_messages %q", cfg.UnknownMessages)
+	}
+	switch cfg.FutureFormats {
+	case "skip", "offer":
+	default:
+		return fmt.Errorf("unknown future_formats %q", cfg.FutureFormats)
+	}
+	if _, err := hex.DecodeString(cfg.ExpectedSnapshotHash); err != nil {
+		return fmt.Errorf("invalid expected_snapshot_hash: %w", err)
+	}
+	if cfg.ExpectedSnapshotHeight < 0 {
+		return errors.New("expected_snapshot_height can't be negative")
+	}
+	if cfg.ExpectedSnapshotHeight > 0 && cfg.ExpectedSnapshotHash == "" {
+		return errors.New("expected_snapshot_height requires expected_snapshot_hash")
+	}
+	switch cfg.ExpectedSnapshotMode {
+	case "require", "prefer":
+	default:
+		return fmt.Errorf("unknown expected_snapshot_mode %q", cfg.ExpectedSnapshotMode)
+	}
+	if cfg.DiscoveryTimeAdaptive {
+		if cfg.DiscoveryTimeMax == 0 {
+			return errors.New("discovery_time_max is required with discovery_time_adaptive")
+		}
+		if cfg.DiscoveryTimeMin > cfg.DiscoveryTimeMax {
+			return errors.New("discovery_time_min can't be greater than discovery_time_max")
+		}
+	}
 	return nil
 }
 
@@ -126,6 +126,220 @@ func TestMempoolConfigValidateBasic(t *testing.T) {
 func TestStateSyncConfigValidateBasic(t *testing.T) {
 	cfg := TestStateSyncConfig()
 	require.NoError(t, cfg.ValidateBasic())
+
+	cfg.StallTimeout = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.StallTimeout = 0
+
+	cfg.MaxChunkBytes = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.MaxChunkBytes = 0
+
+	cfg.MaxMetadataBytes = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.MaxMetadataBytes = 0
+
+	cfg.ChunkRetryBudget = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.ChunkRetryBudget = 0
+
+	cfg.ChunkRefetchLimit = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.ChunkRefetchLimit = 0
+
+	cfg.DiscoveryRebroadcastInterval = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.DiscoveryRebroadcastInterval = 0
+
+	cfg.DiscoveryTimeMin = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.DiscoveryTimeMin = 0
+
+	cfg.DiscoveryTimeMax = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.DiscoveryTimeMax = 0
+
+	cfg.DiscoveryTimeAdaptive = true
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.DiscoveryTimeMin = 2 * time.Second
+	cfg.DiscoveryTimeMax = time.Second
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.DiscoveryTimeMax = 2 * time.Second
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.ServingWorkers = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.ServingWorkers = 0
+
+	cfg.DiscoveryCatalogTTL = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.DiscoveryCatalogTTL = 0
+
+	cfg.VerificationCacheTTL = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.VerificationCacheTTL = 0
+
+	cfg.AppReconnectAttempts = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.AppReconnectAttempts = 0
+
+	cfg.StragglerChunkWindow = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.StragglerChunkWindow = 0
+
+	cfg.StateProviderFailureThreshold = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.StateProviderFailureThreshold = 0
+
+	cfg.StateProviderCooldown = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.StateProviderCooldown = 0
+
+	cfg.AppFlushTimeout = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.AppFlushTimeout = 0
+
+	cfg.OfferInterval = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.OfferInterval = 0
+
+	cfg.MaxOffers = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.MaxOffers = 0
+
+	cfg.ChunkTimeBudget = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.ChunkTimeBudget = 0
+
+	cfg.ChunkSendPolicy = "drop"
+	assert.NoError(t, cfg.ValidateBasic())
+	cfg.ChunkSendPolicy = "block"
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.ChunkSendPolicy = "backpressure"
+
+	cfg.AppHashMismatch = "abort"
+	assert.NoError(t, cfg.ValidateBasic())
+	cfg.AppHashMismatch = "retry"
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.AppHashMismatch = "next"
+
+	cfg.UnknownMessages = "disconnect"
+	assert.NoError(t, cfg.ValidateBasic())
+	cfg.UnknownMessages = "panic"
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.UnknownMessages = "ignore"
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.FutureFormats = "reject"
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.FutureFormats = "offer"
+
+	cfg.ExpectedSnapshotHash = "zz"
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.ExpectedSnapshotHash = ""
+	cfg.ExpectedSnapshotHeight = 1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.ExpectedSnapshotHash = "0A0B"
+	assert.NoError(t, cfg.ValidateBasic())
+	cfg.ExpectedSnapshotHeight = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.ExpectedSnapshotHeight = 0
+	cfg.ExpectedSnapshotMode = "exclusive"
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.ExpectedSnapshotMode = "prefer"
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.MinThroughput = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.MinThroughput = 0
+
+	cfg.MinThroughputWindow = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.MinThroughputWindow = 0
+	assert.NoError(t, cfg.ValidateBasic())
+	cfg.MinThroughput = 1024
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.MinThroughput = 0
+
+	cfg.DiscoveryExtensionMax = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.DiscoveryExtensionMax = time.Minute
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.SnapshotPeers = []string{"d4b194d2b2f0a2c2ae0ed4e5b6ccf7d4fcd3a1e6@127.0.0.1:26656"}
+	assert.NoError(t, cfg.ValidateBasic())
+	cfg.SnapshotPeers = []string{"127.0.0.1:26656"}
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.SnapshotPeers = nil
+
+	cfg.SnapshotKeepRecent = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.SnapshotKeepRecent = 2
+
+	cfg.SnapshotKeepAge = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.SnapshotKeepAge = time.Hour
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.SnapshotAdvertiseWindow = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.SnapshotAdvertiseWindow = time.Minute
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.MaxSnapshotsPerPeer = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.MaxSnapshotsPerPeer = 0
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.MaxActivePeers = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.MaxActivePeers = 0
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.MaxDownloadRate = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.MaxDownloadRate = 1024
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.PeerReputationTTL = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.PeerReputationTTL = time.Hour
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.PeerReconnectGrace = -1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.PeerReconnectGrace = 5 * time.Second
+	assert.NoError(t, cfg.ValidateBasic())
+
+	cfg.DiskSpaceMargin = -0.1
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.DiskSpaceMargin = 0
+	assert.NoError(t, cfg.ValidateBasic())
+}
+
+func TestStateSyncConfigFormats(t *testing.T) {
+	cfg := TestStateSyncConfig()
+	assert.True(t, cfg.ServesFormat(0))
+	assert.True(t, cfg.RestoresFormat(0))
+
+	cfg.ServingFormats = []uint32{1, 2}
+	assert.False(t, cfg.ServesFormat(0))
+	assert.True(t, cfg.ServesFormat(2))
+	assert.True(t, cfg.RestoresFormat(0))
+
+	cfg.RestoreFormats = []uint32{0}
+	assert.True(t, cfg.RestoresFormat(0))
+	assert.False(t, cfg.RestoresFormat(1))
+
+	// Prioritized formats must be restored, and can't be listed twice.
+	cfg.FormatPriority = []uint32{0}
+	assert.NoError(t, cfg.ValidateBasic())
+	cfg.FormatPriority = []uint32{0, 1}
+	assert.Error(t, cfg.ValidateBasic())
+	cfg.RestoreFormats = nil
+	assert.NoError(t, cfg.ValidateBasic())
+	cfg.FormatPriority = []uint32{1, 0, 1}
+	assert.Error(t, cfg.ValidateBasic())
 }
 
 func TestFastSyncConfigValidateBasic(t *testing.T) {
@@ -363,8 +363,244 @@ trust_period = "{{ .StateSync.TrustPeriod }}"
 # Time to spend discovering snapshots before initiating a restore.
 discovery_time = "{{ .StateSync.DiscoveryTime }}"
 
+# Scale the discovery time with the number of connected peers instead of using discovery_time: it is
+# discovery_time_max divided by the number of peers, but no less than discovery_time_min. Nodes with
+# few peers thus wait longer to discover snapshots, and nodes with many peers can start sooner.
+discovery_time_adaptive = {{ .StateSync.DiscoveryTimeAdaptive }}
+discovery_time_min = "{{ .StateSync.DiscoveryTimeMin }}"
+discovery_time_max = "{{ .StateSync.DiscoveryTimeMax }}"
+
+# Maximum time to keep discovering snapshots if none were discovered once the discovery time
+# elapses, e.g. because a freshly started node had no peers yet. Discovery ends as soon as a
+# snapshot is discovered. This also applies when discovery_time is 0. 0 disables the extension.
+discovery_extension_max = "{{ .StateSync.DiscoveryExtensionMax }}"
+
+# Peers known to serve snapshots (comma-separated id@host:port addresses), which are dialed when a
+# state sync starts and asked for snapshots once connected, regardless of the regular peer set.
+snapshot_peers = "{{ StringsJoin .StateSync.SnapshotPeers "," }}"
+
+# Time to wait for a chunk to be applied while chunk requests are outstanding and peers are
+# available, before the sync is considered stalled and fails. 0 disables the check.
+stall_timeout = "{{ .StateSync.StallTimeout }}"
+
+# UNSAFE: proceed with the sync even if the app already has state, restoring the snapshot over it.
+# This may corrupt the app's state, only use this if the app discards its state on snapshot offers.
+unsafe_force_sync = {{ .StateSync.UnsafeForceSync }}
+
+# Sign snapshot advertisements sent to peers with the node key, allowing them to detect tampered
+# advertisements. Signed advertisements from peers are always verified.
+sign_snapshots = {{ .StateSync.SignSnapshots }}
+
+# Maximum size of a snapshot chunk received from peers, in bytes. Peers sending larger chunks are
+# disconnected. 0 uses the p2p channel's maximum chunk message size (16 MB), which also caps it.
+max_chunk_bytes = {{ .StateSync.MaxChunkBytes }}
+
+# Maximum size of snapshot metadata, in bytes. Peers advertising snapshots with larger metadata are
+# disconnected, and local snapshots with larger metadata aren't advertised. 0 uses the p2p channel's
+# maximum snapshot message size (4 MB), which also caps it.
+max_metadata_bytes = {{ .StateSync.MaxMetadataBytes }}
+
+# Total number of chunk retries allowed for a snapshot, as a multiple of its chunk count, before
+# the snapshot is rejected and the next one is tried. Retries include chunk request timeouts and
+# refetches requested by the app. 0 disables the limit.
+chunk_retry_budget = {{ .StateSync.ChunkRetryBudget }}
+
+# Maximum number of times a single chunk can be refetched at the app's request, e.g. because it
+# failed verification, before the snapshot is rejected. Refetches prefer peers that haven't already
+# sent a bad copy of the chunk. 0 disables the limit.
+chunk_refetch_limit = {{ .StateSync.ChunkRefetchLimit }}
+
+# Minimum interval between re-broadcasts of snapshot requests to all peers, which are sent when a
+# peer advertises a snapshot higher than any seen so far before a snapshot has been chosen. This
+# lets other peers advertise the new snapshot too. 0 disables re-broadcasts.
+discovery_rebroadcast_interval = "{{ .StateSync.DiscoveryRebroadcastInterval }}"
+
+# Number of workers serving snapshot and chunk requests from peers, such that slow app responses
+# don't hold up the state sync reactor. Peers are served in turn, such that a peer sending many
+# requests can't starve others, and each peer's requests are answered in order. 0 serves requests
+# inline in the reactor.
+serving_workers = {{ .StateSync.ServingWorkers }}
+
+# Time for which snapshots discovered by a state sync are retained for later syncs, e.g. when
+# retrying a failed sync, such that these can start restoring without waiting for discovery.
+# Snapshots and peers rejected by a failed sync aren't reused. With a temp_dir, the catalog is
+# also persisted there, such that a node restarted during discovery reuses the snapshots once their
+# peers reconnect, and only waits for the remainder of discovery_time. 0 disables retention.
+discovery_catalog_ttl = "{{ .StateSync.DiscoveryCatalogTTL }}"
+
+# Time for which snapshot states and commits verified via the light client are retained for later
+# syncs, such that a retried sync which re-selects a snapshot doesn't verify it again. The cache is
+# cleared when the trust options change. 0 disables caching.
+verification_cache_ttl = "{{ .StateSync.VerificationCacheTTL }}"
+
+# Number of attempts to reconnect to the app and re-offer the snapshot if the app connection is
+# lost while applying chunks, e.g. because the app restarted, before the sync fails. The restore
+# resumes with the chunk that failed to apply. 0 disables reconnects.
+app_reconnect_attempts = {{ .StateSync.AppReconnectAttempts }}
+
+# Snapshot formats to advertise to peers, e.g. to stop serving a deprecated format while still
+# serving newer ones. Empty serves all formats.
+serving_formats = [{{ range .StateSync.ServingFormats }}{{ printf "%v, " . }}{{end}}]
+
+# Snapshot formats to restore when state syncing, independently of serving_formats. Snapshots in
+# other formats are ignored. Empty restores all formats.
+restore_formats = [{{ range .StateSync.RestoreFormats }}{{ printf "%v, " . }}{{end}}]
+
+# Snapshot formats in order of preference, for apps whose format numbers don't increase with
+# desirability. Among snapshots at the same height, listed formats are preferred in the given order
+# over unlisted ones, then the greatest format. Listed formats must be in restore_formats, if set.
+# Empty prefers the greatest format.
+format_priority = [{{ range .StateSync.FormatPriority }}{{ printf "%v, " . }}{{end}}]
+
+# Restore differential snapshots advertised by peers, which contain only the changes since a base
+# height, if the app is already at their base height. Diffs are preferred over full snapshots,
+# which remain the fallback. The app must support applying diffs to its existing state.
+diff_snapshots = {{ .StateSync.DiffSnapshots }}
+
+# Break ties between otherwise equally ranked snapshots by preferring the one whose peers have the
+# lowest estimated latency, based on the time taken to fetch chunks from them. Snapshots without
+# latency estimates fall back to the default ordering.
+latency_tie_break = {{ .StateSync.LatencyTieBreak }}
+
+# Time after a state sync completes during which chunks still arriving from peers, e.g. in response
+# to retried or parallel requests, are silently discarded and counted in the straggler_chunks
+# metric, instead of being logged as unexpected. Likewise, responses to chunk requests left in flight
+# by a finished restore are discarded by later restores of the same snapshot during this window.
+# 0 disables the window.
+straggler_chunk_window = "{{ .StateSync.StragglerChunkWindow }}"
+
+# Number of consecutive state provider (light client) failures after which its circuit breaker
+# opens, failing verification immediately for state_provider_cooldown instead of waiting on an
+# unhealthy provider. A sync with no verified snapshots fails while the breaker is open. Once the
+# cooldown has passed, a single call probes the provider, closing the breaker if it succeeds.
+# 0 disables the breaker.
+state_provider_failure_threshold = {{ .StateSync.StateProviderFailureThreshold }}
+state_provider_cooldown = "{{ .StateSync.StateProviderCooldown }}"
+
+# Time to wait after the last snapshot chunk has been applied for the app to report the snapshot's
+# height via Info, e.g. while it flushes the restored state, before the restored app hash is verified
+# and the sync completes. 0 requires the app to report it immediately.
+app_flush_timeout = "{{ .StateSync.AppFlushTimeout }}"
+
+# Minimum time between consecutive snapshot offers to the app, to protect apps that do heavy work
+# on each offer when peers advertise many snapshots that the app rejects. 0 disables it.
+offer_interval = "{{ .StateSync.OfferInterval }}"
+
+# Maximum number of snapshot offers to the app per state sync, including re-offers after app
+# reconnects, beyond which the sync fails. 0 means unlimited.
+max_offers = {{ .StateSync.MaxOffers }}
+
+# Time budget per snapshot chunk, from which a deadline for restoring a snapshot is derived in
+# proportion to its chunk count. A warning is logged if the restore is pacing behind the
+# deadline, and the snapshot is rejected once the deadline passes. 0 disables the deadline.
+chunk_time_budget = "{{ .StateSync.ChunkTimeBudget }}"
+
+# Policy for serving chunk responses when a peer's chunk send queue is full. "backpressure"
+# waits for the queue to drain, holding back the peer's further requests, while "drop" drops
+# the response, and the peer will request the chunk again. Both count full queues in the
+# chunk_send_queue_full metric, and dropped responses in the dropped_chunk_responses metric.
+chunk_send_policy = "{{ .StateSync.ChunkSendPolicy }}"
+
+# What to do when the app hash of a restored snapshot doesn't match the app hash trusted via the
+# light client. "next" rejects the snapshot and tries the next candidate, assuming that the
+# snapshot is bad, while "abort" fails the state sync, assuming that the trust anchor (trust_height
+# and trust_hash) is wrong. A single bad snapshot is more likely than a bad trust anchor, but with
+# "next" a wrong trust anchor makes the node restore every snapshot in vain before giving up.
+app_hash_mismatch = "{{ .StateSync.AppHashMismatch }}"
+
+# Minimum chunk download throughput, in bytes per second. If the throughput stays below it for
+# min_throughput_window while chunks are outstanding, the snapshot is rejected and snapshots are
+# rediscovered from all peers in search of a better peer set. 0 disables the minimum.
+min_throughput = {{ .StateSync.MinThroughput }}
+
+# Window over which the chunk download throughput is measured for min_throughput.
+min_throughput_window = "{{ .StateSync.MinThroughputWindow }}"
+
+# Retention policy for local snapshots served to peers: only snapshots at the snapshot_keep_recent
+# most recent heights, and snapshots first seen within snapshot_keep_age, are advertised. Ages are
+# tracked from when the node first lists a snapshot, and restart with the node. If the app
+# integration provides a snapshot pruner, expired snapshots are also deleted from the app once no
+# longer served to peers. 0 disables either limit.
+snapshot_keep_recent = {{ .StateSync.SnapshotKeepRecent }}
+snapshot_keep_age = "{{ .StateSync.SnapshotKeepAge }}"
+
+# Window after advertising a local snapshot to a peer during which repeated snapshot requests from
+# the peer don't advertise it again, relying on the peer to have cached the earlier advertisement,
+# e.g. via discovery_catalog_ttl. New snapshots are still advertised, and a reconnecting peer starts
+# afresh. 0 answers every request in full.
+snapshot_advertise_window = "{{ .StateSync.SnapshotAdvertiseWindow }}"
+
+# Maximum number of distinct snapshots tracked per peer during discovery. Beyond it, the snapshot
+# the peer least recently advertised is evicted, bounding the memory and influence of chatty or
+# malicious peers. 0 uses the default of 10.
+max_snapshots_per_peer = {{ .StateSync.MaxSnapshotsPerPeer }}
+
+# Maximum number of peers that chunks of the snapshot being restored are requested from. The active
+# peers are the snapshot's peers with the lowest chunk fetch latencies, and further peers advertising
+# the snapshot are kept as backups, promoted when an active peer disconnects, is rejected, or times
+# out a chunk request. 0 uses all of the snapshot's peers.
+max_active_peers = {{ .StateSync.MaxActivePeers }}
+
+# Maximum rate at which snapshot chunks are downloaded when restoring, in bytes/second, such that a
+# restoring node doesn't saturate its own link. Chunk requests are held back while the rate of
+# received chunks exceeds it. 0 disables the cap.
+max_download_rate = {{ .StateSync.MaxDownloadRate }}
+
+# Time to retain the chunk reliability and latency of peers across state syncs, such that later
+# syncs prefer known-good peers and avoid peers which failed most of their chunk requests, without
+# re-learning their quality. It is persisted in temp_dir, if set, to survive restarts. Peers not
+# seen within it are forgotten. 0 disables peer reputation.
+peer_reputation_ttl = "{{ .StateSync.PeerReputationTTL }}"
+
+# How long to retain the state of peers which disconnected, e.g. their latency estimates, advertised
+# snapshots and in-flight chunk requests, in case they reconnect. Peers which briefly flap then don't
+# cause chunk requests to be rescheduled, but aren't sent new chunk requests while disconnected. 0
+# removes disconnected peers right away.
+peer_reconnect_grace = "{{ .StateSync.PeerReconnectGrace }}"
+
+# Restore snapshots into a staging app instance rather than the live app, and only replace the live
+# app state with the staging instance once the restored app hash and commit have been verified, such
+# that a bad snapshot never corrupts the live app state. It requires the app's integration to
+# provide a staging instance via the node's StagingApp option, see the state sync docs.
+staging_restore = {{ .StateSync.StagingRestore }}
+
+# Check that the directory buffering snapshot chunks (temp_dir, or the system temp dir) has enough
+# free disk space for a snapshot before restoring it, refusing to restore it otherwise rather than
+# failing partway with a full disk. The snapshot size is estimated by the app's integration, if
+# supported, or else from the first chunk received.
+check_disk_space = {{ .StateSync.CheckDiskSpace }}
+
+# Extra free disk space required by check_disk_space, as a fraction of the estimated snapshot size,
+# to allow for inaccurate estimates, e.g. 0.1 requires 10% more than the estimate.
+disk_space_margin = {{ .StateSync.DiskSpaceMargin }}
+
+# How to handle statesync messages of unknown types, e.g. from peers running a newer protocol
+# version, or of types unexpected on their channel. "ignore" logs and ignores them, while
+# "disconnect" treats them as a protocol violation and disconnects the peer, to detect incompatible
+# peers early on stricter networks.
+unknown_messages = "{{ .StateSync.UnknownMessages }}"
+
+# How to handle snapshots in formats higher than any the app supports, e.g. advertised by peers
+# running a newer app version. "skip" skips them during discovery, logging that a newer format
+# exists, while "offer" offers them to the app like any other snapshot, for it to reject. The
+# supported formats are provided by the app's integration, if supported, and are otherwise learned
+# from the formats the app rejects.
+future_formats = "{{ .StateSync.FutureFormats }}"
+
+# Hash of a snapshot obtained from a trusted source out-of-band, as a hex string, and optionally
+# its height, to bootstrap reproducibly from a known good snapshot. With expected_snapshot_mode
+# "require", only snapshots matching it are restored, failing the sync if none is discovered within
+# discovery_time, while "prefer" ranks matching snapshots before any others, falling back to them if
+# none is discovered.
+expected_snapshot_hash = "{{ .StateSync.ExpectedSnapshotHash }}"
+expected_snapshot_height = {{ .StateSync.ExpectedSnapshotHeight }}
+expected_snapshot_mode = "{{ .StateSync.ExpectedSnapshotMode }}"
+
 # Temporary directory for state sync snapshot chunks, defaults to the OS tempdir (typically /tmp).
-# Will create a new, randomly named directory within, and remove it when done.
+# Will create a new, randomly named directory within, and remove it when done. If set explicitly,
+# the restore progress and buffered chunks are kept here instead, allowing an interrupted restore
+# of the same snapshot to resume with the chunks already fetched. Invalid leftovers from unclean
+# shutdowns are removed at startup.
 temp_dir = "{{ .StateSync.TempDir }}"
 
 #######################################################
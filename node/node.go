@@ -3,6 +3,7 @@ package node
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
@@ -29,6 +30,7 @@ import (
 	"github.com/tendermint/tendermint/libs/log"
 	tmpubsub "github.com/tendermint/tendermint/libs/pubsub"
 	"github.com/tendermint/tendermint/libs/service"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
 	"github.com/tendermint/tendermint/light"
 	mempl "github.com/tendermint/tendermint/mempool"
 	"github.com/tendermint/tendermint/p2p"
@@ -108,20 +110,22 @@ func DefaultNewNode(config *cfg.Config, logger log.Logger) (*Node, error) {
 	)
 }
 
-// MetricsProvider returns a consensus, p2p and mempool Metrics.
-type MetricsProvider func(chainID string) (*cs.Metrics, *p2p.Metrics, *mempl.Metrics, *sm.Metrics)
+// MetricsProvider returns a consensus, p2p, mempool, state and statesync Metrics.
+type MetricsProvider func(chainID string) (*cs.Metrics, *p2p.Metrics, *mempl.Metrics, *sm.Metrics,
+	*statesync.Metrics)
 
 // DefaultMetricsProvider returns Metrics build using Prometheus client library
 // if Prometheus is enabled. Otherwise, it returns no-op Metrics.
 func DefaultMetricsProvider(config *cfg.InstrumentationConfig) MetricsProvider {
-	return func(chainID string) (*cs.Metrics, *p2p.Metrics, *mempl.Metrics, *sm.Metrics) {
+	return func(chainID string) (*cs.Metrics, *p2p.Metrics, *mempl.Metrics, *sm.Metrics, *statesync.Metrics) {
 		if config.Prometheus {
 			return cs.PrometheusMetrics(config.Namespace, "chain_id", chainID),
 				p2p.PrometheusMetrics(config.Namespace, "chain_id", chainID),
 				mempl.PrometheusMetrics(config.Namespace, "chain_id", chainID),
-				sm.PrometheusMetrics(config.Namespace, "chain_id", chainID)
+				sm.PrometheusMetrics(config.Namespace, "chain_id", chainID),
+				statesync.PrometheusMetrics(config.Namespace, "chain_id", chainID)
 		}
-		return cs.NopMetrics(), p2p.NopMetrics(), mempl.NopMetrics(), sm.NopMetrics()
+		return cs.NopMetrics(), p2p.NopMetrics(), mempl.NopMetrics(), sm.NopMetrics(), statesync.NopMetrics()
 	}
 }
 
@@ -168,6 +172,16 @@ func StateProvider(stateProvider statesync.StateProvider) Option {
 	}
 }
 
+// StagingApp sets the staging app instance which state sync restores snapshots into with
+// staging_restore, and which snapshots are verified in via unsafe_state_sync_verify_snapshot. The
+// node fails to start if staging_restore is enabled without one.
+// WARNING: this interface is considered unstable and subject to change.
+func StagingApp(app statesync.StagingApp) Option {
+	return func(n *Node) {
+		statesync.WithStagingApp(app)(n.stateSyncReactor)
+	}
+}
+
 //------------------------------------------------------------------------------
 
 // Node is the highest level interface to a full Tendermint node.
@@ -198,6 +212,7 @@ type Node struct {
 	stateSync         bool                    // whether the node should state sync on startup
 	stateSyncReactor  *statesync.Reactor      // for hosting and restoring state sync snapshots
 	stateSyncProvider statesync.StateProvider // provides state data for bootstrapping a node
+	stateSyncMtx      tmsync.Mutex            // guards stateSyncProvider once the node is built
 	stateSyncGenesis  sm.State                // provides the genesis state for state sync
 	consensusState    *cs.State               // latest consensus state
 	consensusReactor  *cs.Reactor             // for participating in the consensus
@@ -564,32 +579,23 @@ func createPEXReactorAndAddToSwitch(addrBook pex.AddrBook, config *cfg.Config,
 // startStateSync starts an asynchronous state sync process, then switches to fast sync mode.
 func startStateSync(ssR *statesync.Reactor, bcR fastSyncReactor, conR *cs.Reactor,
 	stateProvider statesync.StateProvider, config *cfg.StateSyncConfig, fastSync bool,
-	stateStore sm.Store, blockStore *store.BlockStore, state sm.State) error {
+	stateStore sm.Store, blockStore *store.BlockStore) error {
 	ssR.Logger.Info("Starting state sync")
 
-	if stateProvider == nil {
-		var err error
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		stateProvider, err = statesync.NewLightClientStateProvider(
-			ctx,
-			state.ChainID, state.Version, state.InitialHeight,
-			config.RPCServers, light.TrustOptions{
-				Period: config.TrustPeriod,
-				Height: config.TrustHeight,
-				Hash:   config.TrustHashBytes(),
-			}, ssR.Logger.With("module", "light"))
-		if err != nil {
-			return fmt.Errorf("failed to set up light client state provider: %w", err)
-		}
-	}
-
 	go func() {
-		state, commit, err := ssR.Sync(stateProvider, config.DiscoveryTime)
+		result, err := ssR.SyncSnapshot(stateProvider, config.DiscoveryTime)
+		if errors.Is(err, context.Canceled) {
+			ssR.Logger.Info("State sync interrupted by shutdown", "err", err)
+			return
+		}
 		if err != nil {
 			ssR.Logger.Error("State sync failed", "err", err)
 			return
 		}
+		state, commit := result.State, result.Commit
+		ssR.Logger.Info("State sync complete", "height", result.Height, "format", result.Format,
+			"app_hash", fmt.Sprintf("%X", result.AppHash), "chunks", result.Chunks, "peers", result.Peers,
+			"age", result.Age(), "network_height", result.NetworkHeight, "gap", result.Gap())
 		err = stateStore.Bootstrap(state)
 		if err != nil {
 			ssR.Logger.Error("Failed to bootstrap node with new state", "err", err)
@@ -706,7 +712,7 @@ func NewNode(config *cfg.Config,
 
 	logNodeStartupInfo(state, pubKey, logger, consensusLogger)
 
-	csMetrics, p2pMetrics, memplMetrics, smMetrics := metricsProvider(genDoc.ChainID)
+	csMetrics, p2pMetrics, memplMetrics, smMetrics, ssMetrics := metricsProvider(genDoc.ChainID)
 
 	// Make MempoolReactor
 	mempoolReactor, mempool := createMempoolAndMempoolReactor(config, proxyApp, state, memplMetrics, logger)
@@ -749,8 +755,8 @@ func NewNode(config *cfg.Config,
 	// FIXME The way we do phased startups (e.g. replay -> fast sync -> consensus) is very messy,
 	// we should clean this whole thing up. See:
 	// https://github.com/tendermint/tendermint/issues/4644
-	stateSyncReactor := statesync.NewReactor(proxyApp.Snapshot(), proxyApp.Query(),
-		config.StateSync.TempDir)
+	stateSyncReactor := statesync.NewReactor(config.StateSync, proxyApp.Snapshot(), proxyApp.Query(),
+		config.StateSync.TempDir, statesync.WithMetrics(ssMetrics), statesync.WithNodeKey(nodeKey.PrivKey))
 	stateSyncReactor.SetLogger(logger.With("module", "statesync"))
 
 	nodeInfo, err := makeNodeInfo(config, nodeKey, txIndexer, genDoc, state)
@@ -907,8 +913,14 @@ func (n *Node) OnStart() error {
 		if !ok {
 			return fmt.Errorf("this blockchain reactor does not support switching from state sync")
 		}
-		err := startStateSync(n.stateSyncReactor, bcR, n.consensusReactor, n.stateSyncProvider,
-			n.config.StateSync, n.config.FastSyncMode, n.stateStore, n.blockStore, n.stateSyncGenesis)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		stateProvider, err := n.stateSyncStateProvider(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to start state sync: %w", err)
+		}
+		err = startStateSync(n.stateSyncReactor, bcR, n.consensusReactor, stateProvider,
+			n.config.StateSync, n.config.FastSyncMode, n.stateStore, n.blockStore)
 		if err != nil {
 			return fmt.Errorf("failed to start state sync: %w", err)
 		}
@@ -969,6 +981,36 @@ func (n *Node) OnStop() {
 	}
 }
 
+// stateSyncStateProvider returns the state provider used by state sync, and for verifying
+// snapshots via RPC. Unless set via the StateProvider option, a light client state provider is
+// built from the [statesync] config on first use, and kept for later calls.
+func (n *Node) stateSyncStateProvider(ctx context.Context) (statesync.StateProvider, error) {
+	n.stateSyncMtx.Lock()
+	defer n.stateSyncMtx.Unlock()
+	if n.stateSyncProvider != nil {
+		return n.stateSyncProvider, nil
+	}
+	config := n.config.StateSync
+	trustHash, err := hex.DecodeString(config.TrustHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust_hash: %w", err)
+	}
+	state := n.stateSyncGenesis
+	stateProvider, err := statesync.NewLightClientStateProvider(
+		ctx,
+		state.ChainID, state.Version, state.InitialHeight,
+		config.RPCServers, light.TrustOptions{
+			Period: config.TrustPeriod,
+			Height: config.TrustHeight,
+			Hash:   trustHash,
+		}, n.stateSyncReactor.Logger.With("module", "light"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up light client state provider: %w", err)
+	}
+	n.stateSyncProvider = stateProvider
+	return stateProvider, nil
+}
+
 // ConfigureRPC makes sure RPC has all the objects it needs to operate.
 func (n *Node) ConfigureRPC() error {
 	pubKey, err := n.privValidator.GetPubKey()
@@ -986,12 +1028,14 @@ func (n *Node) ConfigureRPC() error {
 		P2PPeers:       n.sw,
 		P2PTransport:   n,
 
-		PubKey:           pubKey,
-		GenDoc:           n.genesisDoc,
-		TxIndexer:        n.txIndexer,
-		ConsensusReactor: n.consensusReactor,
-		EventBus:         n.eventBus,
-		Mempool:          n.mempool,
+		PubKey:            pubKey,
+		GenDoc:            n.genesisDoc,
+		TxIndexer:         n.txIndexer,
+		ConsensusReactor:  n.consensusReactor,
+		StateSyncReactor:  n.stateSyncReactor,
+		StateSyncProvider: n.stateSyncStateProvider,
+		EventBus:          n.eventBus,
+		Mempool:           n.mempool,
 
 		Logger: n.Logger.With("module", "rpc"),
 
@@ -2,6 +2,7 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -25,7 +26,11 @@ import (
 	p2pmock "github.com/tendermint/tendermint/p2p/mock"
 	"github.com/tendermint/tendermint/privval"
 	"github.com/tendermint/tendermint/proxy"
+	rpccore "github.com/tendermint/tendermint/rpc/core"
+	rpctypes "github.com/tendermint/tendermint/rpc/jsonrpc/types"
 	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync"
+	ssmocks "github.com/tendermint/tendermint/statesync/mocks"
 	"github.com/tendermint/tendermint/store"
 	"github.com/tendermint/tendermint/types"
 	tmtime "github.com/tendermint/tendermint/types/time"
@@ -410,6 +415,77 @@ func TestNodeNewNodeCustomReactors(t *testing.T) {
 	assert.Equal(t, customBlockchainReactor, n.Switch().Reactor("BLOCKCHAIN"))
 }
 
+// nopStagingApp is a state sync staging app which is never opened.
+type nopStagingApp struct{}
+
+func (nopStagingApp) Open() (proxy.AppConnSnapshot, proxy.AppConnQuery, error) {
+	return nil, nil, errors.New("not implemented")
+}
+func (nopStagingApp) Promote() error { return nil }
+func (nopStagingApp) Discard() error { return nil }
+
+// newStateSyncTestNode creates a node with staging_restore enabled and a short discovery time, in
+// its own test root.
+func newStateSyncTestNode(t *testing.T, root string, options ...Option) *Node {
+	config := cfg.ResetTestRoot(root)
+	t.Cleanup(func() { os.RemoveAll(config.RootDir) })
+	config.StateSync.StagingRestore = true
+	config.StateSync.DiscoveryTime = 100 * time.Millisecond
+	nodeKey, err := p2p.LoadOrGenNodeKey(config.NodeKeyFile())
+	require.NoError(t, err)
+	pval, err := privval.LoadOrGenFilePV(config.PrivValidatorKeyFile(), config.PrivValidatorStateFile())
+	require.NoError(t, err)
+	n, err := NewNode(config,
+		pval,
+		nodeKey,
+		proxy.DefaultClientCreator(config.ProxyApp, config.ABCI, config.DBDir()),
+		DefaultGenesisDocProviderFunc(config),
+		DefaultDBProvider,
+		DefaultMetricsProvider(config.Instrumentation),
+		log.TestingLogger(),
+		options...,
+	)
+	require.NoError(t, err)
+	return n
+}
+
+func TestNodeNewNodeStagingApp(t *testing.T) {
+	// Without a staging app, staging_restore fails the state sync reactor on start.
+	n := newStateSyncTestNode(t, "node_new_node_no_staging_app_test")
+	assert.Error(t, n.stateSyncReactor.Start())
+
+	n = newStateSyncTestNode(t, "node_new_node_staging_app_test", StagingApp(nopStagingApp{}))
+	require.NoError(t, n.Start())
+	defer n.Stop() //nolint:errcheck // ignore for tests
+	assert.True(t, n.stateSyncReactor.IsRunning())
+}
+
+func TestNodeStateSyncVerifySnapshot(t *testing.T) {
+	// Without a state provider, one is built from the [statesync] config, which has no RPC servers.
+	n := newStateSyncTestNode(t, "node_state_sync_verify_no_provider_test", StagingApp(nopStagingApp{}))
+	require.NoError(t, n.ConfigureRPC())
+	_, err := rpccore.UnsafeStateSyncVerifySnapshot(&rpctypes.Context{}, 1, 1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "light client state provider")
+
+	// With a state provider and a staging app, the verification runs, but no peer has the snapshot.
+	n = newStateSyncTestNode(t, "node_state_sync_verify_test", StagingApp(nopStagingApp{}),
+		StateProvider(&ssmocks.StateProvider{}))
+	require.NoError(t, n.Start())
+	defer n.Stop() //nolint:errcheck // ignore for tests
+	result, err := rpccore.UnsafeStateSyncVerifySnapshot(&rpctypes.Context{}, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, statesync.VerificationRunning, result.Status)
+	require.Eventually(t, func() bool {
+		result, err := rpccore.StateSyncVerification(&rpctypes.Context{})
+		return err == nil && result.Status != statesync.VerificationRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	result, err = rpccore.StateSyncVerification(&rpctypes.Context{})
+	require.NoError(t, err)
+	assert.Equal(t, statesync.VerificationFailed, result.Status)
+	assert.Contains(t, result.Error, "snapshot not found")
+}
+
 func state(nVals int, height int64) (sm.State, dbm.DB, []types.PrivValidator) {
 	privVals := make([]types.PrivValidator, nVals)
 	vals := make([]types.GenesisValidator, nVals)
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/tendermint/tendermint/proxy"
 	sm "github.com/tendermint/tendermint/state"
 	"github.com/tendermint/tendermint/state/txindex"
+	"github.com/tendermint/tendermint/statesync"
 	"github.com/tendermint/tendermint/types"
 )
 
@@ -83,8 +85,12 @@ type Environment struct {
 	GenDoc           *types.GenesisDoc // cache the genesis structure
 	TxIndexer        txindex.TxIndexer
 	ConsensusReactor *consensus.Reactor
-	EventBus         *types.EventBus // thread safe
-	Mempool          mempl.Mempool
+	StateSyncReactor *statesync.Reactor
+	// StateSyncProvider returns the state provider which verifies snapshots for
+	// unsafe_state_sync_verify_snapshot, built from the [statesync] config if needed.
+	StateSyncProvider func(ctx context.Context) (statesync.StateProvider, error)
+	EventBus          *types.EventBus // thread safe
+	Mempool           mempl.Mempool
 
 	Logger log.Logger
 
@@ -14,24 +14,28 @@ var Routes = map[string]*rpc.RPCFunc{
 	"unsubscribe_all": rpc.NewWSRPCFunc(UnsubscribeAll, ""),
 
 	// info API
-	"health":               rpc.NewRPCFunc(Health, ""),
-	"status":               rpc.NewRPCFunc(Status, ""),
-	"net_info":             rpc.NewRPCFunc(NetInfo, ""),
-	"blockchain":           rpc.NewRPCFunc(BlockchainInfo, "minHeight,maxHeight"),
-	"genesis":              rpc.NewRPCFunc(Genesis, ""),
-	"block":                rpc.NewRPCFunc(Block, "height"),
-	"block_by_hash":        rpc.NewRPCFunc(BlockByHash, "hash"),
-	"block_results":        rpc.NewRPCFunc(BlockResults, "height"),
-	"commit":               rpc.NewRPCFunc(Commit, "height"),
-	"check_tx":             rpc.NewRPCFunc(CheckTx, "tx"),
-	"tx":                   rpc.NewRPCFunc(Tx, "hash,prove"),
-	"tx_search":            rpc.NewRPCFunc(TxSearch, "query,prove,page,per_page,order_by"),
-	"validators":           rpc.NewRPCFunc(Validators, "height,page,per_page"),
-	"dump_consensus_state": rpc.NewRPCFunc(DumpConsensusState, ""),
-	"consensus_state":      rpc.NewRPCFunc(ConsensusState, ""),
-	"consensus_params":     rpc.NewRPCFunc(ConsensusParams, "height"),
-	"unconfirmed_txs":      rpc.NewRPCFunc(UnconfirmedTxs, "limit"),
-	"num_unconfirmed_txs":  rpc.NewRPCFunc(NumUnconfirmedTxs, ""),
+	"health":                     rpc.NewRPCFunc(Health, ""),
+	"status":                     rpc.NewRPCFunc(Status, ""),
+	"net_info":                   rpc.NewRPCFunc(NetInfo, ""),
+	"blockchain":                 rpc.NewRPCFunc(BlockchainInfo, "minHeight,maxHeight"),
+	"genesis":                    rpc.NewRPCFunc(Genesis, ""),
+	"block":                      rpc.NewRPCFunc(Block, "height"),
+	"block_by_hash":              rpc.NewRPCFunc(BlockByHash, "hash"),
+	"block_results":              rpc.NewRPCFunc(BlockResults, "height"),
+	"commit":                     rpc.NewRPCFunc(Commit, "height"),
+	"check_tx":                   rpc.NewRPCFunc(CheckTx, "tx"),
+	"tx":                         rpc.NewRPCFunc(Tx, "hash,prove"),
+	"tx_search":                  rpc.NewRPCFunc(TxSearch, "query,prove,page,per_page,order_by"),
+	"validators":                 rpc.NewRPCFunc(Validators, "height,page,per_page"),
+	"dump_consensus_state":       rpc.NewRPCFunc(DumpConsensusState, ""),
+	"consensus_state":            rpc.NewRPCFunc(ConsensusState, ""),
+	"consensus_params":           rpc.NewRPCFunc(ConsensusParams, "height"),
+	"unconfirmed_txs":            rpc.NewRPCFunc(UnconfirmedTxs, "limit"),
+	"num_unconfirmed_txs":        rpc.NewRPCFunc(NumUnconfirmedTxs, ""),
+	"state_sync_snapshots":       rpc.NewRPCFunc(StateSyncSnapshots, "page,per_page"),
+	"state_sync_local_snapshots": rpc.NewRPCFunc(StateSyncLocalSnapshots, ""),
+	"state_sync_chunks":          rpc.NewRPCFunc(StateSyncChunks, ""),
+	"state_sync_verification":    rpc.NewRPCFunc(StateSyncVerification, ""),
 
 	// tx broadcast API
 	"broadcast_tx_commit": rpc.NewRPCFunc(BroadcastTxCommit, "tx"),
@@ -52,4 +56,6 @@ func AddUnsafeRoutes() {
 	Routes["dial_seeds"] = rpc.NewRPCFunc(UnsafeDialSeeds, "seeds")
 	Routes["dial_peers"] = rpc.NewRPCFunc(UnsafeDialPeers, "peers,persistent,unconditional,private")
 	Routes["unsafe_flush_mempool"] = rpc.NewRPCFunc(UnsafeFlushMempool, "")
+	Routes["unsafe_state_sync_chunk_logging"] = rpc.NewRPCFunc(UnsafeStateSyncChunkLogging, "verbose")
+	Routes["unsafe_state_sync_verify_snapshot"] = rpc.NewRPCFunc(UnsafeStateSyncVerifySnapshot, "height,format")
 }
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	tmmath "github.com/tendermint/tendermint/libs/math"
+	ctypes "github.com/tendermint/tendermint/rpc/core/types"
+	rpctypes "github.com/tendermint/tendermint/rpc/jsonrpc/types"
+	"github.com/tendermint/tendermint/statesync"
+)
+
+// StateSyncSnapshots gets the catalog of snapshots discovered from peers by an in-progress state
+// sync. Candidate snapshots are ranked in the order the node will attempt to restore them,
+// followed by rejected snapshots along with the reason for rejection. If no state sync is in
+// progress, the result is empty. The result also lists any peers removed from the state sync, and
+// the reason for their removal, the deadline for restoring the snapshot being restored, if
+// chunk_time_budget is set, and why the last snapshot selected for restoration was selected.
+// While no snapshot is being restored, e.g. during discovery, it previews the snapshot which would
+// be selected if discovery ended now, such that operators can watch the selection converge.
+//
+// More: https://docs.tendermint.com/master/rpc/#/Info/state_sync_snapshots
+func StateSyncSnapshots(ctx *rpctypes.Context, pagePtr, perPagePtr *int) (*ctypes.ResultStateSyncSnapshots, error) {
+	var (
+		catalog   []ctypes.StateSyncSnapshot
+		removed   []ctypes.StateSyncRemovedPeer
+		syncing   bool
+		deadline  *time.Time
+		selection *ctypes.StateSyncSelection
+		preview   *ctypes.StateSyncSelection
+	)
+	if env.StateSyncReactor != nil {
+		snapshots, ok := env.StateSyncReactor.Snapshots()
+		syncing = ok
+		for _, s := range snapshots {
+			catalog = append(catalog, ctypes.StateSyncSnapshot{
+				Height:    s.Height,
+				Format:    s.Format,
+				Chunks:    s.Chunks,
+				Hash:      s.Hash,
+				Peers:     s.Peers,
+				Preferred: s.Preferred,
+				Rejected:  s.Rejected,
+			})
+		}
+		removals, _ := env.StateSyncReactor.PeerRemovals()
+		for peerID, reason := range removals {
+			removed = append(removed, ctypes.StateSyncRemovedPeer{PeerID: peerID, Reason: reason})
+		}
+		sort.Slice(removed, func(i, j int) bool { return removed[i].PeerID < removed[j].PeerID })
+		if state, ok := env.StateSyncReactor.SyncerState(); ok {
+			if state.Restoring != nil && !state.Progress.Deadline.IsZero() {
+				deadline = &state.Progress.Deadline
+			}
+			selection = stateSyncSelection(state.Progress.Selection)
+			preview = stateSyncSelection(state.Preview)
+		}
+	}
+
+	totalCount := len(catalog)
+	perPage := validatePerPage(perPagePtr)
+	page, err := validatePage(pagePtr, perPage, totalCount)
+	if err != nil {
+		return nil, err
+	}
+
+	skipCount := validateSkipCount(page, perPage)
+
+	snapshots := catalog[skipCount : skipCount+tmmath.MinInt(perPage, totalCount-skipCount)]
+
+	return &ctypes.ResultStateSyncSnapshots{
+		Syncing:   syncing,
+		Snapshots: snapshots,
+		Count:     len(snapshots),
+		Total:     totalCount,
+
+		RemovedPeers: removed,
+		Deadline:     deadline,
+		Selection:    selection,
+		Preview:      preview}, nil
+}
+
+// stateSyncSelection converts a snapshot selection decision to its RPC representation, if any.
+func stateSyncSelection(decision *statesync.SelectDecision) *ctypes.StateSyncSelection {
+	if decision == nil {
+		return nil
+	}
+	selection := &ctypes.StateSyncSelection{
+		Selected:   stateSyncCandidate(decision.Selected),
+		Reason:     decision.Reason,
+		Candidates: decision.Candidates,
+		Time:       decision.Time,
+	}
+	for _, c := range decision.RunnersUp {
+		selection.RunnersUp = append(selection.RunnersUp, stateSyncCandidate(c))
+	}
+	return selection
+}
+
+// stateSyncCandidate converts a snapshot considered for restoration to its RPC representation.
+func stateSyncCandidate(c statesync.SelectCandidate) ctypes.StateSyncCandidate {
+	return ctypes.StateSyncCandidate{
+		Height:    c.Height,
+		Format:    c.Format,
+		Chunks:    c.Chunks,
+		Hash:      c.Hash,
+		Peers:     c.Peers,
+		Preferred: c.Preferred,
+		Latency:   c.Latency,
+	}
+}
+
+// StateSyncChunks dumps the state of the chunks of the snapshot being restored by an in-progress
+// state sync: which chunks are pending, in flight, received, applied, and which failed and had to
+// be refetched. If no snapshot is being restored, the chunk lists are empty. Combined with
+// unsafe_state_sync_chunk_logging, this allows debugging a stuck state sync without restarting
+// the node.
+//
+// More: https://docs.tendermint.com/master/rpc/#/Info/state_sync_chunks
+func StateSyncChunks(ctx *rpctypes.Context) (*ctypes.ResultStateSyncChunks, error) {
+	if env.StateSyncReactor == nil {
+		return nil, errors.New("state sync reactor is not available")
+	}
+	result := &ctypes.ResultStateSyncChunks{VerboseLogging: env.StateSyncReactor.ChunkLogging()}
+	state, ok := env.StateSyncReactor.SyncerState()
+	result.Syncing = ok
+	if ok && state.Restoring != nil {
+		result.Height = state.Restoring.Height
+		result.Format = state.Restoring.Format
+		result.Chunks = state.Restoring.Chunks
+		result.Pending = state.ChunksPending
+		result.InFlight = state.ChunksInFlight
+		result.Received = state.ChunksReceived
+		result.Applied = state.ChunksAccepted
+		result.Failed = state.ChunksFailed
+	}
+	return result, nil
+}
+
+// UnsafeStateSyncChunkLogging enables or disables verbose per-chunk state sync logging at
+// runtime, logging chunk events at info level rather than debug level while enabled.
+//
+// More: https://docs.tendermint.com/master/rpc/#/Unsafe/unsafe_state_sync_chunk_logging
+func UnsafeStateSyncChunkLogging(ctx *rpctypes.Context, verbose bool) (*ctypes.ResultStateSyncChunkLogging, error) {
+	if env.StateSyncReactor == nil {
+		return nil, errors.New("state sync reactor is not available")
+	}
+	env.StateSyncReactor.SetChunkLogging(verbose)
+	return &ctypes.ResultStateSyncChunkLogging{Verbose: verbose}, nil
+}
+
+// UnsafeStateSyncVerifySnapshot starts verifying that the snapshot at the given height and format
+// is restorable, before committing a node to it: the snapshot is discovered from peers,
+// downloaded, restored into the staging app, and verified, and then discarded. This requires a
+// staging app, see the node's StagingApp option, and a state provider, which is built from the
+// [statesync] trust and rpc_servers config unless set via the node's StateProvider option. It
+// fails while a state sync is in progress, and the verification is cancelled if one starts. The
+// verification runs in the background, and its report is returned by state_sync_verification.
+//
+// More: https://docs.tendermint.com/master/rpc/#/Unsafe/unsafe_state_sync_verify_snapshot
+func UnsafeStateSyncVerifySnapshot(ctx *rpctypes.Context, height int64, format int) (
+	*ctypes.ResultStateSyncVerification, error) {
+	if env.StateSyncReactor == nil {
+		return nil, errors.New("state sync reactor is not available")
+	}
+	if height <= 0 {
+		return nil, fmt.Errorf("height must be greater than 0, but got %d", height)
+	}
+	if format < 0 || format > math.MaxUint32 {
+		return nil, fmt.Errorf("format %d is out of range", format)
+	}
+	if env.StateSyncProvider == nil {
+		return nil, errors.New("state sync state provider is not available")
+	}
+	providerCtx, cancel := context.WithTimeout(ctx.Context(), 10*time.Second)
+	stateProvider, err := env.StateSyncProvider(providerCtx)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	report, err := env.StateSyncReactor.VerifySnapshot(stateProvider, uint64(height), uint32(format))
+	if err != nil {
+		return nil, err
+	}
+	return stateSyncVerification(report), nil
+}
+
+// StateSyncVerification gets the report of the snapshot verification started via
+// unsafe_state_sync_verify_snapshot which is in progress, or of the last one: whether the
+// snapshot passed or failed verification and why, along with the result for each chunk.
+//
+// More: https://docs.tendermint.com/master/rpc/#/Info/state_sync_verification
+func StateSyncVerification(ctx *rpctypes.Context) (*ctypes.ResultStateSyncVerification, error) {
+	if env.StateSyncReactor == nil {
+		return nil, errors.New("state sync reactor is not available")
+	}
+	report, ok := env.StateSyncReactor.Verification()
+	if !ok {
+		return nil, errors.New("no snapshot has been verified")
+	}
+	return stateSyncVerification(report), nil
+}
+
+// stateSyncVerification converts a snapshot verification report to its RPC representation.
+func stateSyncVerification(report statesync.VerificationReport) *ctypes.ResultStateSyncVerification {
+	result := &ctypes.ResultStateSyncVerification{
+		Height:       report.Height,
+		Format:       report.Format,
+		Chunks:       report.Chunks,
+		Hash:         report.Hash,
+		Status:       report.Status,
+		Error:        report.Error,
+		Started:      report.Started,
+		ChunkResults: make([]ctypes.StateSyncChunkVerification, 0, len(report.ChunkResults)),
+	}
+	if !report.Ended.IsZero() {
+		result.Ended = &report.Ended
+	}
+	for _, c := range report.ChunkResults {
+		result.ChunkResults = append(result.ChunkResults, ctypes.StateSyncChunkVerification{
+			Index:     c.Index,
+			Sender:    c.Sender,
+			Accepted:  c.Accepted,
+			Refetches: c.Refetches,
+		})
+	}
+	return result
+}
+
+// StateSyncLocalSnapshots lists the snapshots produced by the local app, in the order they are
+// advertised to peers, along with their serving state. Snapshots which are not advertised to
+// peers are listed with the reason they are withheld.
+//
+// More: https://docs.tendermint.com/master/rpc/#/Info/state_sync_local_snapshots
+func StateSyncLocalSnapshots(ctx *rpctypes.Context) (*ctypes.ResultStateSyncLocalSnapshots, error) {
+	if env.StateSyncReactor == nil {
+		return nil, errors.New("state sync reactor is not available")
+	}
+	local, err := env.StateSyncReactor.LocalSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]ctypes.StateSyncLocalSnapshot, 0, len(local))
+	for _, s := range local {
+		snapshots = append(snapshots, ctypes.StateSyncLocalSnapshot{
+			Height:     s.Height,
+			Format:     s.Format,
+			Chunks:     s.Chunks,
+			Hash:       s.Hash,
+			Metadata:   s.Metadata,
+			Preferred:  s.Preferred,
+			BaseHeight: s.BaseHeight,
+			Withheld:   s.Withheld,
+			Peers:      s.Peers,
+			Pinned:     s.Pinned,
+		})
+	}
+	return &ctypes.ResultStateSyncLocalSnapshots{Snapshots: snapshots}, nil
+}
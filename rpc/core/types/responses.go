@@ -132,6 +132,146 @@ type ResultValidators struct {
 	Total int `json:"total"`
 }
 
+// State sync snapshots discovered from peers
+type ResultStateSyncSnapshots struct {
+	// Whether a state sync is in progress
+	Syncing   bool                `json:"syncing"`
+	Snapshots []StateSyncSnapshot `json:"snapshots"`
+	// Count of actual snapshots in this result
+	Count int `json:"count"`
+	// Total number of snapshots
+	Total int `json:"total"`
+	// Peers removed from the state sync, and the reason for their removal
+	RemovedPeers []StateSyncRemovedPeer `json:"removed_peers"`
+	// Deadline for restoring the snapshot being restored, if any
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Why the last snapshot selected for restoration was selected, if any
+	Selection *StateSyncSelection `json:"selection,omitempty"`
+	// Which snapshot would be selected if discovery ended now, while no snapshot is being restored
+	Preview *StateSyncSelection `json:"preview,omitempty"`
+}
+
+// Why a state sync selected a snapshot for restoration over the runners-up
+type StateSyncSelection struct {
+	Selected StateSyncCandidate `json:"selected"`
+	// Ranking criterion by which the selected snapshot beat the first runner-up
+	Reason    string               `json:"reason"`
+	RunnersUp []StateSyncCandidate `json:"runners_up"`
+	// Number of snapshots considered, including the selected one
+	Candidates int       `json:"candidates"`
+	Time       time.Time `json:"time"`
+}
+
+// Info about a snapshot considered for restoration by a state sync
+type StateSyncCandidate struct {
+	Height    uint64         `json:"height"`
+	Format    uint32         `json:"format"`
+	Chunks    uint32         `json:"chunks"`
+	Hash      bytes.HexBytes `json:"hash"`
+	Peers     int            `json:"peers"`
+	Preferred bool           `json:"preferred,omitempty"`
+	// Mean latency of the snapshot's peers, if known
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// Chunks of the snapshot being restored by a state sync
+type ResultStateSyncChunks struct {
+	// Whether a state sync is in progress
+	Syncing bool `json:"syncing"`
+	// Snapshot being restored, if any
+	Height uint64 `json:"height,omitempty"`
+	Format uint32 `json:"format,omitempty"`
+	Chunks uint32 `json:"chunks,omitempty"`
+	// Chunks neither requested nor received yet
+	Pending []uint32 `json:"pending"`
+	// Chunks requested but not received yet
+	InFlight []uint32 `json:"in_flight"`
+	// Chunks received and queued for the app
+	Received []uint32 `json:"received"`
+	// Chunks accepted by the app
+	Applied []uint32 `json:"applied"`
+	// Chunks which the app asked to refetch at least once
+	Failed []uint32 `json:"failed"`
+	// Whether verbose per-chunk logging is enabled
+	VerboseLogging bool `json:"verbose_logging"`
+}
+
+// Verbose state sync chunk logging setting
+type ResultStateSyncChunkLogging struct {
+	Verbose bool `json:"verbose"`
+}
+
+// State sync snapshot verification report
+type ResultStateSyncVerification struct {
+	Height uint64         `json:"height"`
+	Format uint32         `json:"format"`
+	Chunks uint32         `json:"chunks,omitempty"`
+	Hash   bytes.HexBytes `json:"hash,omitempty"`
+	// Verification status, i.e. running, passed, or failed
+	Status string `json:"status"`
+	// Reason verification failed, if it did
+	Error   string     `json:"error,omitempty"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	// Results for each chunk, once restoring the snapshot has started
+	ChunkResults []StateSyncChunkVerification `json:"chunk_results"`
+}
+
+// Verification result for a snapshot chunk
+type StateSyncChunkVerification struct {
+	Index uint32 `json:"index"`
+	// Peer the chunk was received from, if received
+	Sender p2p.ID `json:"sender,omitempty"`
+	// Whether the app accepted the chunk
+	Accepted bool `json:"accepted"`
+	// Number of times the app asked to refetch the chunk
+	Refetches int `json:"refetches,omitempty"`
+}
+
+// Snapshots produced by the local app
+type ResultStateSyncLocalSnapshots struct {
+	Snapshots []StateSyncLocalSnapshot `json:"snapshots"`
+}
+
+// Info about a snapshot produced by the local app
+type StateSyncLocalSnapshot struct {
+	Height   uint64         `json:"height"`
+	Format   uint32         `json:"format"`
+	Chunks   uint32         `json:"chunks"`
+	Hash     bytes.HexBytes `json:"hash"`
+	Metadata []byte         `json:"metadata,omitempty"`
+	// Whether the app prefers the snapshot
+	Preferred bool `json:"preferred,omitempty"`
+	// Base height of a diff snapshot, if any
+	BaseHeight uint64 `json:"base_height,omitempty"`
+	// Reason the snapshot is not advertised to peers, if any
+	Withheld string `json:"withheld,omitempty"`
+	// Number of peers the snapshot is actively being served to
+	Peers int `json:"peers"`
+	// Whether the snapshot's chunks are pinned in memory
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// Info about a peer removed from a state sync
+type StateSyncRemovedPeer struct {
+	PeerID p2p.ID `json:"peer_id"`
+	Reason string `json:"reason"`
+}
+
+// Info about a snapshot discovered from peers
+type StateSyncSnapshot struct {
+	Height uint64         `json:"height"`
+	Format uint32         `json:"format"`
+	Chunks uint32         `json:"chunks"`
+	Hash   bytes.HexBytes `json:"hash"`
+	// Number of peers known to have the snapshot
+	Peers int `json:"peers"`
+	// Whether any peer advertised the snapshot as preferred
+	Preferred bool `json:"preferred,omitempty"`
+	// Reason the snapshot was rejected, if any
+	Rejected string `json:"rejected,omitempty"`
+}
+
 // ConsensusParams for given height
 type ResultConsensusParams struct {
 	BlockHeight     int64                   `json:"block_height"`
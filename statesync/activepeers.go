@@ -0,0 +1,114 @@
+package statesync
+
+import (
+	"sort"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// activePeerSet bounds the peers that chunks of a snapshot are requested from to the
+// max_active_peers best candidates, keeping the remaining candidates as backups. Active peers keep
+// their slot for as long as they remain candidates, such that chunk requests aren't fanned out
+// across every peer advertising the snapshot. Vacancies, e.g. from peers that disconnected or were
+// rejected, are filled by promoting the backups with the lowest latency estimates. Peers that
+// failed, i.e. timed out a chunk request, are demoted and only promoted again once no other backups
+// remain. A nil *activePeerSet doesn't bound the peers.
+type activePeerSet struct {
+	tmsync.Mutex
+	max       int
+	latencies *peerLatencies
+	active    map[p2p.ID]bool
+	failed    map[p2p.ID]bool
+}
+
+// newActivePeerSet creates a new active peer set, or nil if max is 0.
+func newActivePeerSet(max int, latencies *peerLatencies) *activePeerSet {
+	if max <= 0 {
+		return nil
+	}
+	return &activePeerSet{
+		max:       max,
+		latencies: latencies,
+		active:    make(map[p2p.ID]bool),
+		failed:    make(map[p2p.ID]bool),
+	}
+}
+
+// Select returns the active peers among the candidates, in candidate order, after filling any
+// vacancies by promoting backups. It also returns the peers that were promoted.
+func (a *activePeerSet) Select(candidates []p2p.Peer) ([]p2p.Peer, []p2p.ID) {
+	if a == nil {
+		return candidates, nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	isCandidate := make(map[p2p.ID]bool, len(candidates))
+	for _, peer := range candidates {
+		isCandidate[peer.ID()] = true
+	}
+	for peerID := range a.active {
+		if !isCandidate[peerID] {
+			delete(a.active, peerID)
+		}
+	}
+
+	var promoted []p2p.ID
+	if len(a.active) < a.max {
+		backups := make([]p2p.ID, 0, len(candidates))
+		for _, peer := range candidates {
+			if !a.active[peer.ID()] {
+				backups = append(backups, peer.ID())
+			}
+		}
+		sort.SliceStable(backups, func(i, j int) bool { return a.precedes(backups[i], backups[j]) })
+		for _, peerID := range backups {
+			if len(a.active) >= a.max {
+				break
+			}
+			a.active[peerID] = true
+			promoted = append(promoted, peerID)
+		}
+	}
+
+	active := make([]p2p.Peer, 0, len(a.active))
+	for _, peer := range candidates {
+		if a.active[peer.ID()] {
+			active = append(active, peer)
+		}
+	}
+	return active, promoted
+}
+
+// precedes checks whether backup peer x is promoted before backup peer y: peers that haven't
+// failed first, then peers with lower latency estimates, then peers without estimates. The caller
+// must hold the mutex.
+func (a *activePeerSet) precedes(x, y p2p.ID) bool {
+	if a.failed[x] != a.failed[y] {
+		return !a.failed[x]
+	}
+	xLatency, xOK := a.latencies.Estimate(x)
+	yLatency, yOK := a.latencies.Estimate(y)
+	switch {
+	case xOK && yOK:
+		return xLatency < yLatency
+	default:
+		return xOK && !yOK
+	}
+}
+
+// Fail demotes an active peer to a backup, e.g. because it timed out a chunk request. It returns
+// true if the peer was active.
+func (a *activePeerSet) Fail(peerID p2p.ID) bool {
+	if a == nil || peerID == "" {
+		return false
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.failed[peerID] = true
+	if !a.active[peerID] {
+		return false
+	}
+	delete(a.active, peerID)
+	return true
+}
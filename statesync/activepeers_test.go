@@ -0,0 +1,58 @@
+package statesync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// peerIDs returns the IDs of the given peers.
+func peerIDs(peers []p2p.Peer) []p2p.ID {
+	ids := make([]p2p.ID, 0, len(peers))
+	for _, peer := range peers {
+		ids = append(ids, peer.ID())
+	}
+	return ids
+}
+
+func TestActivePeerSet(t *testing.T) {
+	a, b, c, d := simplePeer("a"), simplePeer("b"), simplePeer("c"), simplePeer("d")
+	assert.Nil(t, newActivePeerSet(0, nil))
+	var unbounded *activePeerSet
+	peers, promoted := unbounded.Select([]p2p.Peer{a, b, c, d})
+	assert.Equal(t, []p2p.ID{"a", "b", "c", "d"}, peerIDs(peers))
+	assert.Empty(t, promoted)
+	assert.False(t, unbounded.Fail("a"))
+
+	// The peers with the lowest latency estimates are promoted first, then peers without estimates.
+	latencies := newPeerLatencies()
+	latencies.Observe("c", time.Second)
+	latencies.Observe("d", 2*time.Second)
+	set := newActivePeerSet(2, latencies)
+	peers, promoted = set.Select([]p2p.Peer{a, b, c, d})
+	assert.Equal(t, []p2p.ID{"c", "d"}, peerIDs(peers))
+	assert.Equal(t, []p2p.ID{"c", "d"}, promoted)
+
+	// Active peers keep their slot, even if a backup becomes faster.
+	latencies.Observe("a", time.Millisecond)
+	peers, promoted = set.Select([]p2p.Peer{a, b, c, d})
+	assert.Equal(t, []p2p.ID{"c", "d"}, peerIDs(peers))
+	assert.Empty(t, promoted)
+
+	// Peers which are no longer candidates are replaced by the best backup.
+	peers, promoted = set.Select([]p2p.Peer{a, b, d})
+	assert.Equal(t, []p2p.ID{"a", "d"}, peerIDs(peers))
+	assert.Equal(t, []p2p.ID{"a"}, promoted)
+
+	// Failed peers are demoted, and only promoted again once no other backups remain.
+	assert.True(t, set.Fail("a"))
+	assert.False(t, set.Fail("a"))
+	peers, promoted = set.Select([]p2p.Peer{a, b, d})
+	assert.Equal(t, []p2p.ID{"b", "d"}, peerIDs(peers))
+	assert.Equal(t, []p2p.ID{"b"}, promoted)
+	peers, _ = set.Select([]p2p.Peer{a, d})
+	assert.Equal(t, []p2p.ID{"a", "d"}, peerIDs(peers))
+}
@@ -0,0 +1,68 @@
+package statesync
+
+import (
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// advertisementTracker records when local snapshots were last advertised to each peer, such that
+// repeated snapshot requests within the advertisement window only advertise snapshots the peer
+// hasn't been sent recently. Peers cache advertisements for the duration of their state sync, and
+// across syncs if they retain a discovery catalog, so re-sending them is redundant traffic.
+type advertisementTracker struct {
+	tmsync.Mutex
+	window time.Duration
+	peers  map[p2p.ID]map[servedSnapshot]time.Time // last advertisement time, by peer and snapshot
+}
+
+// newAdvertisementTracker creates a new advertisement tracker.
+func newAdvertisementTracker(window time.Duration) *advertisementTracker {
+	return &advertisementTracker{
+		window: window,
+		peers:  make(map[p2p.ID]map[servedSnapshot]time.Time),
+	}
+}
+
+// Advertise checks whether a snapshot should be advertised to a peer, i.e. it hasn't been
+// advertised to the peer within the window, and if so records it as advertised now.
+func (t *advertisementTracker) Advertise(peerID p2p.ID, height uint64, format uint32) bool {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	snapshots := t.peers[peerID]
+	if snapshots == nil {
+		snapshots = make(map[servedSnapshot]time.Time)
+		t.peers[peerID] = snapshots
+	}
+	for key, advertised := range snapshots {
+		if now.Sub(advertised) >= t.window {
+			delete(snapshots, key)
+		}
+	}
+	key := servedSnapshot{Height: height, Format: format}
+	if _, ok := snapshots[key]; ok {
+		return false
+	}
+	snapshots[key] = now
+	return true
+}
+
+// Record records a snapshot as advertised to a peer now, regardless of the window, e.g. when
+// pushing snapshots to peers.
+func (t *advertisementTracker) Record(peerID p2p.ID, height uint64, format uint32) {
+	t.Lock()
+	defer t.Unlock()
+	if t.peers[peerID] == nil {
+		t.peers[peerID] = make(map[servedSnapshot]time.Time)
+	}
+	t.peers[peerID][servedSnapshot{Height: height, Format: format}] = time.Now()
+}
+
+// RemovePeer forgets the advertisements sent to a peer.
+func (t *advertisementTracker) RemovePeer(peerID p2p.ID) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.peers, peerID)
+}
@@ -0,0 +1,171 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tendermint/tendermint/libs/log"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/types"
+)
+
+// errBreakerOpen is returned by state provider calls while the circuit breaker is open.
+var errBreakerOpen = errors.New("state provider circuit breaker is open")
+
+// breakerStateProvider wraps a StateProvider with a circuit breaker. After threshold consecutive
+// failed calls the breaker opens, failing calls immediately for the cooldown period rather than
+// waiting on an unhealthy provider. Once the cooldown has passed the breaker is half-open, letting
+// a single probe call through which closes the breaker if it succeeds and reopens it otherwise.
+// Cancelled calls don't count as failures.
+type breakerStateProvider struct {
+	provider  StateProvider
+	threshold int
+	cooldown  time.Duration
+	logger    log.Logger
+
+	tmsync.Mutex
+	failures  int       // number of consecutive failed calls
+	openUntil time.Time // the end of the cooldown, once the breaker has opened
+	probing   bool      // whether a half-open probe call is in progress
+	lastErr   error     // the last failure
+}
+
+var (
+	_ StateProviderChecker       = (*breakerStateProvider)(nil)
+	_ StateProviderNetworkHeight = (*breakerStateProvider)(nil)
+)
+
+// newBreakerStateProvider wraps a state provider with a circuit breaker.
+func newBreakerStateProvider(provider StateProvider, threshold int, cooldown time.Duration,
+	logger log.Logger) *breakerStateProvider {
+	return &breakerStateProvider{
+		provider:  provider,
+		threshold: threshold,
+		cooldown:  cooldown,
+		logger:    logger,
+	}
+}
+
+// AppHash implements StateProvider.
+func (b *breakerStateProvider) AppHash(ctx context.Context, height uint64) ([]byte, error) {
+	probe, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	appHash, err := b.provider.AppHash(ctx, height)
+	b.release(probe, err)
+	return appHash, err
+}
+
+// Commit implements StateProvider.
+func (b *breakerStateProvider) Commit(ctx context.Context, height uint64) (*types.Commit, error) {
+	probe, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := b.provider.Commit(ctx, height)
+	b.release(probe, err)
+	return commit, err
+}
+
+// State implements StateProvider.
+func (b *breakerStateProvider) State(ctx context.Context, height uint64) (sm.State, error) {
+	probe, err := b.acquire()
+	if err != nil {
+		return sm.State{}, err
+	}
+	state, err := b.provider.State(ctx, height)
+	b.release(probe, err)
+	return state, err
+}
+
+// CheckAvailable implements StateProviderChecker, by checking the wrapped provider if it
+// implements StateProviderChecker. The check bypasses the breaker.
+func (b *breakerStateProvider) CheckAvailable(ctx context.Context) error {
+	checker, ok := b.provider.(StateProviderChecker)
+	if !ok {
+		return nil
+	}
+	return checker.CheckAvailable(ctx)
+}
+
+// NetworkHeight implements StateProviderNetworkHeight, by querying the wrapped provider if it
+// implements StateProviderNetworkHeight, and returning 0 otherwise. The query bypasses the
+// breaker, since it is only used for reporting.
+func (b *breakerStateProvider) NetworkHeight(ctx context.Context) (uint64, error) {
+	reporter, ok := b.provider.(StateProviderNetworkHeight)
+	if !ok {
+		return 0, nil
+	}
+	return reporter.NetworkHeight(ctx)
+}
+
+// Err returns an error describing the breaker state if it is open, or nil if it is closed or
+// half-open. It is safe to call on a nil breaker.
+func (b *breakerStateProvider) Err() error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	if now := time.Now(); b.failures >= b.threshold && now.Before(b.openUntil) {
+		return b.openErr(now)
+	}
+	return nil
+}
+
+// acquire checks whether a call may proceed, returning an error if the breaker is open. It returns
+// true if the call is a half-open probe.
+func (b *breakerStateProvider) acquire() (bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < b.threshold {
+		return false, nil
+	}
+	now := time.Now()
+	switch {
+	case now.Before(b.openUntil):
+		return false, b.openErr(now)
+	case b.probing:
+		return false, fmt.Errorf("%w, half-open while probing the provider after %v consecutive failures: %v",
+			errBreakerOpen, b.failures, b.lastErr)
+	default:
+		b.probing = true
+		return true, nil
+	}
+}
+
+// release records the outcome of a call allowed by acquire.
+func (b *breakerStateProvider) release(probe bool, err error) {
+	b.Lock()
+	defer b.Unlock()
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case err == nil:
+		if b.failures >= b.threshold {
+			b.logger.Info("State provider recovered, closing circuit breaker")
+		}
+		b.failures = 0
+		b.lastErr = nil
+	case errors.Is(err, context.Canceled):
+	default:
+		b.failures++
+		b.lastErr = err
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.cooldown)
+			b.logger.Error("State provider is failing, opening circuit breaker", "failures", b.failures,
+				"cooldown", b.cooldown, "err", err)
+		}
+	}
+}
+
+// openErr returns the error for calls while the breaker is open. The caller must hold the mutex.
+func (b *breakerStateProvider) openErr(now time.Time) error {
+	return fmt.Errorf("%w after %v consecutive failures, retrying in %v: %v", errBreakerOpen,
+		b.failures, b.openUntil.Sub(now).Round(time.Millisecond), b.lastErr)
+}
@@ -0,0 +1,103 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync/mocks"
+)
+
+func TestBreakerStateProvider(t *testing.T) {
+	ctx := context.Background()
+	boom := errors.New("boom")
+	provider := &mocks.StateProvider{}
+	breaker := newBreakerStateProvider(provider, 2, 50*time.Millisecond, log.NewNopLogger())
+
+	// Cancelled calls and failures interrupted by a success don't open the breaker.
+	provider.On("AppHash", mock.Anything, uint64(1)).Once().Return(nil, boom)
+	provider.On("AppHash", mock.Anything, uint64(1)).Once().Return(nil, context.Canceled)
+	provider.On("AppHash", mock.Anything, uint64(1)).Once().Return([]byte{1}, nil)
+	provider.On("AppHash", mock.Anything, uint64(1)).Once().Return(nil, boom)
+	for i := 0; i < 2; i++ {
+		_, err := breaker.AppHash(ctx, 1)
+		require.Error(t, err)
+	}
+	appHash, err := breaker.AppHash(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1}, appHash)
+	_, err = breaker.AppHash(ctx, 1)
+	assert.Equal(t, boom, err)
+	require.NoError(t, breaker.Err())
+
+	// The second consecutive failure opens the breaker, failing calls without calling the
+	// provider until the cooldown has passed.
+	provider.On("Commit", mock.Anything, uint64(1)).Once().Return(nil, boom)
+	_, err = breaker.Commit(ctx, 1)
+	assert.Equal(t, boom, err)
+	for _, err := range []error{breaker.Err(), callState(ctx, breaker)} {
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, errBreakerOpen))
+		assert.Contains(t, err.Error(), "after 2 consecutive failures")
+		assert.Contains(t, err.Error(), "boom")
+	}
+	provider.AssertExpectations(t)
+
+	// Once the cooldown has passed, a failed probe reopens the breaker.
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, breaker.Err())
+	provider.On("State", mock.Anything, uint64(1)).Once().Return(sm.State{}, boom)
+	err = callState(ctx, breaker)
+	assert.Equal(t, boom, err)
+	err = breaker.Err()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "after 3 consecutive failures")
+
+	// A successful probe closes it.
+	time.Sleep(50 * time.Millisecond)
+	provider.On("AppHash", mock.Anything, uint64(2)).Once().Return([]byte{2}, nil)
+	appHash, err = breaker.AppHash(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{2}, appHash)
+	require.NoError(t, breaker.Err())
+	provider.AssertExpectations(t)
+}
+
+func callState(ctx context.Context, provider StateProvider) error {
+	_, err := provider.State(ctx, 1)
+	return err
+}
+
+func TestSyncer_SyncAny_breakerOpen(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return(nil, errors.New("boom"))
+	config := cfg.TestStateSyncConfig()
+	config.StateProviderFailureThreshold = 1
+	config.StateProviderCooldown = time.Minute
+	syncer := newSyncer(config, log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, stateProvider, "")
+
+	// Once snapshots fail verification, the sync fails after discovery instead of waiting for
+	// further snapshots.
+	_, err := syncer.AddSnapshot(simplePeer("a"), &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}})
+	require.Error(t, err)
+	_, err = syncer.AddSnapshot(simplePeer("b"), &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errBreakerOpen))
+	stateProvider.AssertNumberOfCalls(t, "AppHash", 1)
+
+	start := time.Now()
+	_, err = syncer.SyncAny(10 * time.Millisecond)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errBreakerOpen))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
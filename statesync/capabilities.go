@@ -0,0 +1,99 @@
+package statesync
+
+import (
+	cfg "github.com/tendermint/tendermint/config"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+)
+
+const (
+	// protocolVersion is the state sync protocol version advertised to peers in Hello messages.
+	// Peers which don't send a Hello are assumed to speak the baseline protocol, version 0.
+	protocolVersion = 1
+	// maxHelloFeatures is the maximum number of features a peer may advertise.
+	maxHelloFeatures = 64
+)
+
+// Optional protocol features, advertised to peers in Hello messages. Behaviors which legacy peers
+// would misinterpret are only used with peers that advertise the corresponding feature.
+const (
+	// featureDiffSnapshots indicates that the node can restore diff snapshots. Peers which don't
+	// advertise it would mistake a diff snapshot for a full one, so they are only sent full ones.
+	featureDiffSnapshots = "diff_snapshots"
+	// featureChunkProofs indicates that the node can serve chunk proofs, as requested via
+	// ChunkRequest.Proof. Proofs are only requested from peers that advertise it.
+	featureChunkProofs = "chunk_proofs"
+)
+
+// makeHello builds the Hello message advertising our protocol version and features.
+//
+// Legacy nodes disconnect peers sending them unknown message types, so we never send a standalone
+// Hello unprompted. Instead, it is embedded in our snapshot requests, which legacy nodes decode
+// while ignoring the unknown field, and a standalone Hello is only sent in reply to peers which
+// embedded one.
+func makeHello(config *cfg.StateSyncConfig) *ssproto.Hello {
+	hello := &ssproto.Hello{Version: protocolVersion}
+	if config.DiffSnapshots {
+		hello.Features = append(hello.Features, featureDiffSnapshots)
+	}
+	return hello
+}
+
+// peerCapabilities are the protocol capabilities advertised by a peer.
+type peerCapabilities struct {
+	version  uint32
+	features map[string]bool
+}
+
+// capabilityTracker tracks the protocol capabilities advertised by peers via Hello messages.
+// Peers which haven't sent a Hello are treated as baseline peers without any optional features.
+type capabilityTracker struct {
+	tmsync.Mutex
+	peers map[p2p.ID]peerCapabilities
+}
+
+// newCapabilityTracker creates a new capability tracker.
+func newCapabilityTracker() *capabilityTracker {
+	return &capabilityTracker{
+		peers: make(map[p2p.ID]peerCapabilities),
+	}
+}
+
+// Set records the capabilities advertised by a peer, replacing any previous ones. It returns true
+// if this is the first Hello received from the peer.
+func (t *capabilityTracker) Set(peerID p2p.ID, hello *ssproto.Hello) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, seen := t.peers[peerID]
+	caps := peerCapabilities{
+		version:  hello.Version,
+		features: make(map[string]bool, len(hello.Features)),
+	}
+	for _, feature := range hello.Features {
+		caps.features[feature] = true
+	}
+	t.peers[peerID] = caps
+	return !seen
+}
+
+// Version returns the protocol version advertised by a peer, or 0 if it hasn't sent a Hello.
+func (t *capabilityTracker) Version(peerID p2p.ID) uint32 {
+	t.Lock()
+	defer t.Unlock()
+	return t.peers[peerID].version
+}
+
+// Supports checks whether a peer has advertised the given feature.
+func (t *capabilityTracker) Supports(peerID p2p.ID, feature string) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.peers[peerID].features[feature]
+}
+
+// RemovePeer forgets a peer's capabilities.
+func (t *capabilityTracker) RemovePeer(peerID p2p.ID) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.peers, peerID)
+}
@@ -0,0 +1,286 @@
+package statesync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	tmjson "github.com/tendermint/tendermint/libs/json"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/libs/tempfile"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+const (
+	// catalogFile is the name of the file in the state sync temp dir which persists the snapshot
+	// catalog, such that a node restarted during discovery can resume it.
+	catalogFile = "statesync-catalog.json"
+	// catalogFlushInterval is the interval at which snapshots added to the catalog are persisted.
+	catalogFlushInterval = time.Second
+)
+
+// catalogKey identifies a snapshot advertised by a peer.
+type catalogKey struct {
+	peerID p2p.ID
+	key    snapshotKey
+}
+
+// catalogEntry is a snapshot advertised by a peer, along with the time it was advertised. The peer
+// is nil for entries loaded from disk, until the peer advertises the snapshot again.
+type catalogEntry struct {
+	peerID   p2p.ID
+	peer     p2p.Peer
+	snapshot snapshot
+	seen     time.Time
+}
+
+// catalogRecord is the persisted form of the snapshot catalog.
+type catalogRecord struct {
+	// Started is the time the discovery of the current state sync started, if any.
+	Started time.Time            `json:"started"`
+	Entries []catalogRecordEntry `json:"entries"`
+}
+
+// catalogRecordEntry is the persisted form of a catalog entry.
+type catalogRecordEntry struct {
+	PeerID     p2p.ID    `json:"peer_id"`
+	Height     uint64    `json:"height"`
+	Format     uint32    `json:"format"`
+	Chunks     uint32    `json:"chunks"`
+	Hash       []byte    `json:"hash"`
+	Metadata   []byte    `json:"metadata"`
+	Preferred  bool      `json:"preferred"`
+	BaseHeight uint64    `json:"base_height"`
+	Seen       time.Time `json:"seen"`
+}
+
+// snapshotCatalog retains the snapshots discovered from peers across state syncs within the
+// reactor's lifetime, such that a sync retried after a failure can start restoring immediately
+// rather than discovering snapshots from scratch. Entries expire after the TTL, and the snapshots,
+// formats and peers rejected by a failed sync are removed from the catalog.
+//
+// If loaded from a temp dir, the catalog is also persisted there along with the start time of the
+// current discovery, such that a node restarted during discovery can reuse the snapshots it
+// discovered before the restart, and only waits for the remainder of the discovery time. Snapshots
+// are added from the reactor's message handler, so they're persisted in batches via Flush(),
+// rather than writing the catalog to disk for each advertisement.
+type snapshotCatalog struct {
+	tmsync.Mutex
+	ttl     time.Duration
+	entries map[catalogKey]*catalogEntry
+	path    string    // file to persist the catalog to, if any
+	started time.Time // start of the current discovery, if any
+	resumed time.Time // start of the discovery interrupted by a restart, if any
+	dirty   bool      // whether entries were added since the catalog was last persisted
+
+	// saveMtx serializes writes and removals of the persisted catalog, which are done without
+	// holding the main lock.
+	saveMtx tmsync.Mutex
+}
+
+// newSnapshotCatalog creates a new snapshot catalog.
+func newSnapshotCatalog(ttl time.Duration) *snapshotCatalog {
+	return &snapshotCatalog{
+		ttl:     ttl,
+		entries: make(map[catalogKey]*catalogEntry),
+	}
+}
+
+// Add records a snapshot advertised by a peer, or refreshes it if already recorded. Peers can only
+// have recentSnapshots snapshots in the catalog. New entries are persisted by the next Flush(), if
+// enabled.
+func (c *snapshotCatalog) Add(peer p2p.Peer, s *snapshot) {
+	c.Lock()
+	defer c.Unlock()
+	key := catalogKey{peerID: peer.ID(), key: s.Key()}
+	if entry, ok := c.entries[key]; ok {
+		entry.peer = peer
+		entry.seen = time.Now()
+		return
+	}
+	count := 0
+	for key := range c.entries {
+		if key.peerID == peer.ID() {
+			count++
+		}
+	}
+	if count >= recentSnapshots {
+		return
+	}
+	entry := &catalogEntry{peerID: peer.ID(), peer: peer, snapshot: *s, seen: time.Now()}
+	entry.snapshot.trustedAppHash = nil // must be verified again by each sync
+	c.entries[key] = entry
+	c.dirty = c.path != ""
+}
+
+// Entries returns the unexpired entries in the catalog, removing any expired ones.
+func (c *snapshotCatalog) Entries() []catalogEntry {
+	c.Lock()
+	defer c.Unlock()
+	cutoff := time.Now().Add(-c.ttl)
+	entries := make([]catalogEntry, 0, len(c.entries))
+	for key, entry := range c.entries {
+		if entry.seen.Before(cutoff) {
+			delete(c.entries, key)
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// RemovePeer removes all snapshots advertised by a peer.
+func (c *snapshotCatalog) RemovePeer(peerID p2p.ID) {
+	c.Lock()
+	defer c.Unlock()
+	for key := range c.entries {
+		if key.peerID == peerID {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// RemoveBlacklisted removes all entries which have been blacklisted by a snapshot pool, i.e.
+// rejected snapshots, snapshots with rejected formats, and snapshots from rejected peers.
+func (c *snapshotCatalog) RemoveBlacklisted(pool *snapshotPool) {
+	c.Lock()
+	defer c.Unlock()
+	for key, entry := range c.entries {
+		if pool.IsBlacklisted(entry.peerID, &entry.snapshot) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Load loads the catalog persisted in a temp dir, if any, and persists the catalog there from
+// now on. Expired entries are discarded. If the persisted catalog was saved during a discovery
+// which hasn't expired, the next discovery resumes it, see StartDiscovery().
+func (c *snapshotCatalog) Load(tempDir string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.path = filepath.Join(tempDir, catalogFile)
+	bz, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read snapshot catalog %v: %w", c.path, err)
+	}
+	record := &catalogRecord{}
+	if err := tmjson.Unmarshal(bz, record); err != nil {
+		return fmt.Errorf("failed to decode snapshot catalog %v: %w", c.path, err)
+	}
+	cutoff := time.Now().Add(-c.ttl)
+	for _, e := range record.Entries {
+		if e.Seen.Before(cutoff) || e.Seen.After(time.Now()) {
+			continue
+		}
+		entry := &catalogEntry{peerID: e.PeerID, seen: e.Seen, snapshot: snapshot{
+			Height:     e.Height,
+			Format:     e.Format,
+			Chunks:     e.Chunks,
+			Hash:       e.Hash,
+			Metadata:   e.Metadata,
+			Preferred:  e.Preferred,
+			BaseHeight: e.BaseHeight,
+		}}
+		c.entries[catalogKey{peerID: e.PeerID, key: entry.snapshot.Key()}] = entry
+	}
+	if !record.Started.Before(cutoff) && !record.Started.After(time.Now()) {
+		c.resumed = record.Started
+	}
+	return nil
+}
+
+// StartDiscovery records the start of a state sync's discovery, and returns the discovery time
+// which already elapsed before a restart, if the discovery resumes one interrupted by a restart.
+// Only the first discovery after loading the catalog can be resumed. The catalog is persisted
+// along with the start time, if enabled.
+func (c *snapshotCatalog) StartDiscovery() (time.Duration, error) {
+	c.Lock()
+	var elapsed time.Duration
+	c.started = time.Now()
+	if !c.resumed.IsZero() {
+		elapsed = c.started.Sub(c.resumed)
+		c.started = c.resumed
+		c.resumed = time.Time{}
+	}
+	c.dirty = c.path != ""
+	c.Unlock()
+	return elapsed, c.Flush()
+}
+
+// SyncCompleted records the completion of a state sync, such that a later discovery is not
+// resumed, and removes the persisted catalog, if any.
+func (c *snapshotCatalog) SyncCompleted() error {
+	c.saveMtx.Lock()
+	defer c.saveMtx.Unlock()
+	c.Lock()
+	c.started = time.Time{}
+	c.dirty = false
+	path := c.path
+	c.Unlock()
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove snapshot catalog %v: %w", path, err)
+	}
+	return nil
+}
+
+// Flush persists the catalog if it changed since it was last persisted, and persisting is
+// enabled. The catalog isn't locked while writing it, such that adding snapshots doesn't block on
+// disk I/O.
+func (c *snapshotCatalog) Flush() error {
+	c.saveMtx.Lock()
+	defer c.saveMtx.Unlock()
+	c.Lock()
+	if !c.dirty {
+		c.Unlock()
+		return nil
+	}
+	path, record := c.path, c.record()
+	c.dirty = false
+	c.Unlock()
+
+	err := saveCatalogRecord(path, record)
+	if err != nil {
+		c.Lock()
+		c.dirty = true // retry on the next flush
+		c.Unlock()
+	}
+	return err
+}
+
+// record returns the persisted form of the catalog. The caller must hold the mutex lock.
+func (c *snapshotCatalog) record() *catalogRecord {
+	record := &catalogRecord{Started: c.started, Entries: make([]catalogRecordEntry, 0, len(c.entries))}
+	for _, entry := range c.entries {
+		record.Entries = append(record.Entries, catalogRecordEntry{
+			PeerID:     entry.peerID,
+			Height:     entry.snapshot.Height,
+			Format:     entry.snapshot.Format,
+			Chunks:     entry.snapshot.Chunks,
+			Hash:       entry.snapshot.Hash,
+			Metadata:   entry.snapshot.Metadata,
+			Preferred:  entry.snapshot.Preferred,
+			BaseHeight: entry.snapshot.BaseHeight,
+			Seen:       entry.seen,
+		})
+	}
+	return record
+}
+
+// saveCatalogRecord persists a catalog record to a file.
+func saveCatalogRecord(path string, record *catalogRecord) error {
+	bz, err := tmjson.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot catalog: %w", err)
+	}
+	if err := tempfile.WriteFileAtomic(path, bz, 0600); err != nil {
+		return fmt.Errorf("failed to write snapshot catalog %v: %w", path, err)
+	}
+	return nil
+}
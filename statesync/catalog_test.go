@@ -0,0 +1,208 @@
+package statesync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	p2pmocks "github.com/tendermint/tendermint/p2p/mocks"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+)
+
+// Sets up a peer mock with an ID, which may or may not be running
+func runningPeer(id string, running bool) *p2pmocks.Peer {
+	peer := simplePeer(id)
+	peer.On("IsRunning").Return(running)
+	return peer
+}
+
+func TestSnapshotCatalog(t *testing.T) {
+	catalog := newSnapshotCatalog(time.Minute)
+	peerA, peerB := simplePeer("a"), simplePeer("b")
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}, trustedAppHash: []byte("app_hash")}
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}
+
+	catalog.Add(peerA, s1)
+	catalog.Add(peerA, s1)
+	catalog.Add(peerA, s2)
+	catalog.Add(peerB, s2)
+	entries := catalog.Entries()
+	require.Len(t, entries, 3)
+	for _, entry := range entries {
+		assert.Nil(t, entry.snapshot.trustedAppHash)
+	}
+
+	// Peers can only have recentSnapshots snapshots in the catalog.
+	for i := uint64(0); i < recentSnapshots; i++ {
+		catalog.Add(peerB, &snapshot{Height: 10 + i, Format: 1, Chunks: 1, Hash: []byte{1}})
+	}
+	assert.Len(t, catalog.Entries(), 2+recentSnapshots)
+
+	// Removing a peer removes its snapshots.
+	catalog.RemovePeer("b")
+	assert.Len(t, catalog.Entries(), 2)
+
+	// Rejected snapshots are removed.
+	pool := newSnapshotPool(nil)
+	pool.Reject(s2, RejectReasonApp)
+	catalog.RemoveBlacklisted(pool)
+	entries = catalog.Entries()
+	require.Len(t, entries, 1)
+	assert.EqualValues(t, 1, entries[0].snapshot.Height)
+
+	// Expired entries are removed.
+	catalog.ttl = 0
+	time.Sleep(time.Millisecond)
+	assert.Empty(t, catalog.Entries())
+}
+
+func TestSnapshotCatalog_Load(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}, Metadata: []byte{9}}
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}, BaseHeight: 1}
+	catalog := newSnapshotCatalog(time.Minute)
+	require.NoError(t, catalog.Load(tempDir))
+	elapsed, err := catalog.StartDiscovery()
+	require.NoError(t, err)
+	assert.Zero(t, elapsed)
+	catalog.Add(simplePeer("a"), s1)
+	catalog.Add(simplePeer("b"), s2)
+
+	// Added snapshots are only persisted once flushed.
+	loaded := newSnapshotCatalog(time.Minute)
+	require.NoError(t, loaded.Load(tempDir))
+	assert.Empty(t, loaded.Entries())
+	require.NoError(t, catalog.Flush())
+
+	// A restarted node loads the entries without their peers, and resumes the discovery once.
+	time.Sleep(10 * time.Millisecond)
+	catalog = newSnapshotCatalog(time.Minute)
+	require.NoError(t, catalog.Load(tempDir))
+	entries := catalog.Entries()
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Nil(t, entry.peer)
+		switch entry.peerID {
+		case "a":
+			assert.Equal(t, s1.Key(), entry.snapshot.Key())
+		case "b":
+			assert.Equal(t, s2.Key(), entry.snapshot.Key())
+		default:
+			t.Errorf("unexpected peer %v", entry.peerID)
+		}
+	}
+	elapsed, err = catalog.StartDiscovery()
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(10*time.Millisecond))
+	elapsed, err = catalog.StartDiscovery()
+	require.NoError(t, err)
+	assert.Zero(t, elapsed)
+
+	// Expired entries and discoveries are discarded.
+	catalog = newSnapshotCatalog(0)
+	require.NoError(t, catalog.Load(tempDir))
+	assert.Empty(t, catalog.Entries())
+	elapsed, err = catalog.StartDiscovery()
+	require.NoError(t, err)
+	assert.Zero(t, elapsed)
+
+	// A completed sync removes the persisted catalog, and undecodable catalogs are reported.
+	require.NoError(t, catalog.SyncCompleted())
+	_, err = os.Stat(filepath.Join(tempDir, catalogFile))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, catalogFile), []byte("{"), 0600))
+	assert.Error(t, newSnapshotCatalog(time.Minute).Load(tempDir))
+}
+
+func TestReactor_reuseCatalog(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.DiscoveryCatalogTTL = time.Minute
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "")
+	require.NotNil(t, r.catalog)
+
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}
+	r.catalog.Add(runningPeer("a", true), s1)
+	r.catalog.Add(runningPeer("b", false), s2)
+
+	// Only snapshots from peers that are still connected are reused.
+	syncer, _ := setupOfferSyncer(t)
+	r.reuseCatalog(syncer)
+	best := syncer.snapshots.Best()
+	require.NotNil(t, best)
+	assert.EqualValues(t, 1, best.Height)
+	assert.Equal(t, []byte("app_hash"), best.trustedAppHash)
+	assert.Len(t, syncer.snapshots.Ranked(), 1)
+
+	// Snapshots rejected by a sync are not reused by later syncs.
+	syncer.snapshots.Reject(best, RejectReasonApp)
+	r.catalog.RemoveBlacklisted(syncer.snapshots)
+	syncer, _ = setupOfferSyncer(t)
+	r.reuseCatalog(syncer)
+	assert.Nil(t, syncer.snapshots.Best())
+}
+
+func TestReactor_reuseCatalog_persisted(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	catalog := newSnapshotCatalog(time.Minute)
+	require.NoError(t, catalog.Load(tempDir))
+	catalog.Add(simplePeer("a"), s1)
+	require.NoError(t, catalog.Flush())
+
+	// The catalog persisted by a previous run is loaded on start, and its snapshots are only
+	// reused once their peer has advertised them again.
+	config := cfg.TestStateSyncConfig()
+	config.DiscoveryCatalogTTL = time.Minute
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, tempDir)
+	require.NoError(t, r.Start())
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	require.Len(t, r.catalog.Entries(), 1)
+	syncer, _ := setupOfferSyncer(t)
+	r.reuseCatalog(syncer)
+	assert.Nil(t, syncer.snapshots.Best())
+
+	r.catalog.Add(runningPeer("a", true), s1)
+	r.reuseCatalog(syncer)
+	best := syncer.snapshots.Best()
+	require.NotNil(t, best)
+	assert.EqualValues(t, 1, best.Height)
+}
+
+func TestReactor_Stop_flushesCatalog(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Snapshots pushed by peers are persisted in the background, and when the reactor stops.
+	config := cfg.TestStateSyncConfig()
+	config.DiscoveryCatalogTTL = time.Minute
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, tempDir)
+	require.NoError(t, r.Start())
+	r.Receive(SnapshotChannel, simplePeer("a"), mustEncodeMsg(&ssproto.SnapshotsResponse{
+		Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}))
+	require.Len(t, r.catalog.Entries(), 1)
+	require.NoError(t, r.Stop())
+
+	catalog := newSnapshotCatalog(time.Minute)
+	require.NoError(t, catalog.Load(tempDir))
+	entries := catalog.Entries()
+	require.Len(t, entries, 1)
+	assert.EqualValues(t, 1, entries[0].snapshot.Height)
+}
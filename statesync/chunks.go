@@ -1,20 +1,55 @@
 package statesync
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
 	tmsync "github.com/tendermint/tendermint/libs/sync"
 	"github.com/tendermint/tendermint/p2p"
 )
 
-// errDone is returned by chunkQueue.Next() when all chunks have been returned.
-var errDone = errors.New("chunk queue has completed")
+var (
+	// errDone is returned by chunkQueue.Next() when all chunks have been returned.
+	errDone = errors.New("chunk queue has completed")
+	// errAbandoned is returned by chunk readers when the chunk queue is closed before all chunks
+	// have been read.
+	errAbandoned = errors.New("snapshot restoration was abandoned")
+)
+
+// ChunkVerifier hashes snapshot chunks and verifies chunks against their expected hash. It is used
+// to check the integrity of chunks buffered in temp_dir when resuming a restore, e.g. after an
+// unclean shutdown. The default uses SHA-256, but deployments can use a different scheme, e.g. the
+// content addressing used by their app. It must be safe for concurrent use.
+type ChunkVerifier interface {
+	// Hash returns the hash of a chunk.
+	Hash(chunk []byte) []byte
+	// Verify checks whether a chunk matches the expected hash.
+	Verify(chunk []byte, hash []byte) bool
+}
+
+// sha256ChunkVerifier is the default ChunkVerifier, using SHA-256 hashes.
+type sha256ChunkVerifier struct{}
+
+// Hash implements ChunkVerifier.
+func (sha256ChunkVerifier) Hash(chunk []byte) []byte {
+	hash := sha256.Sum256(chunk)
+	return hash[:]
+}
+
+// Verify implements ChunkVerifier.
+func (v sha256ChunkVerifier) Verify(chunk []byte, hash []byte) bool {
+	return bytes.Equal(v.Hash(chunk), hash)
+}
 
 // chunk contains data for a chunk.
 type chunk struct {
@@ -23,6 +58,7 @@ type chunk struct {
 	Index  uint32
 	Chunk  []byte
 	Sender p2p.ID
+	Proof  []byte // the chunk's proof, if requested with one
 }
 
 // chunkQueue manages chunks for a state sync process, ordering them if requested. It acts as an
@@ -34,30 +70,120 @@ type chunkQueue struct {
 	dir            string                     // temp dir for on-disk chunk storage
 	chunkFiles     map[uint32]string          // path to temporary chunk file
 	chunkSenders   map[uint32]p2p.ID          // the peer who sent the given chunk
-	chunkAllocated map[uint32]bool            // chunks that have been allocated via Allocate()
+	chunkAllocated map[uint32]bool            // chunks claimed via Allocate(), or received
 	chunkReturned  map[uint32]bool            // chunks returned via Next()
+	chunkAccepted  map[uint32]bool            // chunks accepted by the app via Accept()
 	waiters        map[uint32][]chan<- uint32 // signals WaitFor() waiters about chunk arrival
+	changed        *sync.Cond                 // signals chunk readers about queue changes
+	checksums      ChunkVerifier              // writes chunk checksums for resumption, if not nil
 }
 
 // newChunkQueue creates a new chunk queue for a snapshot, using a temp dir for storage.
 // Callers must call Close() when done.
 func newChunkQueue(snapshot *snapshot, tempDir string) (*chunkQueue, error) {
+	if snapshot.Chunks == 0 {
+		return nil, errors.New("snapshot has no chunks")
+	}
 	dir, err := ioutil.TempDir(tempDir, "tm-statesync")
 	if err != nil {
 		return nil, fmt.Errorf("unable to create temp dir for state sync chunks: %w", err)
 	}
+	return newChunkQueueInDir(snapshot, dir), nil
+}
+
+// resumeChunkQueue creates a chunk queue for a snapshot using the given directory for storage,
+// which is created if necessary. Chunks are stored along with their checksums, as hashed by the
+// verifier, such that a queue for the same snapshot can later be resumed from the directory, e.g.
+// after an unclean shutdown.
+// Any chunks already in the directory are verified against their checksums and added to the
+// queue, while corrupt chunks are removed for refetching and their indexes returned. The caller
+// must make sure the directory only contains chunks for this snapshot. Callers must call Close()
+// when done, which removes the directory.
+func resumeChunkQueue(snapshot *snapshot, dir string, verifier ChunkVerifier) (*chunkQueue, []uint32, error) {
 	if snapshot.Chunks == 0 {
-		return nil, errors.New("snapshot has no chunks")
+		return nil, nil, errors.New("snapshot has no chunks")
 	}
-	return &chunkQueue{
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create dir for state sync chunks: %w", err)
+	}
+	q := newChunkQueueInDir(snapshot, dir)
+	q.checksums = verifier
+
+	corrupt := []uint32{}
+	for index := uint32(0); index < snapshot.Chunks; index++ {
+		path := q.chunkPath(index)
+		ok, err := verifyChunkFile(path, verifier)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			q.chunkFiles[index] = path
+			q.chunkAllocated[index] = true
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			corrupt = append(corrupt, index)
+		}
+		for _, p := range []string{path, path + chunkChecksumSuffix} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return nil, nil, fmt.Errorf("failed to remove corrupt chunk %v: %w", index, err)
+			}
+		}
+	}
+	return q, corrupt, nil
+}
+
+// newChunkQueueInDir creates a new chunk queue for a snapshot, using the given directory.
+func newChunkQueueInDir(snapshot *snapshot, dir string) *chunkQueue {
+	q := &chunkQueue{
 		snapshot:       snapshot,
 		dir:            dir,
 		chunkFiles:     make(map[uint32]string, snapshot.Chunks),
 		chunkSenders:   make(map[uint32]p2p.ID, snapshot.Chunks),
 		chunkAllocated: make(map[uint32]bool, snapshot.Chunks),
 		chunkReturned:  make(map[uint32]bool, snapshot.Chunks),
+		chunkAccepted:  make(map[uint32]bool, snapshot.Chunks),
 		waiters:        make(map[uint32][]chan<- uint32),
-	}, nil
+	}
+	q.changed = sync.NewCond(&q.Mutex)
+	return q
+}
+
+// chunkChecksumSuffix is the file name suffix of chunk checksum files.
+const chunkChecksumSuffix = ".sha256"
+
+// verifyChunkFile checks whether a chunk file exists and matches its checksum file.
+func verifyChunkFile(path string, verifier ChunkVerifier) (bool, error) {
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read chunk file %v: %w", path, err)
+	}
+	checksum, err := ioutil.ReadFile(path + chunkChecksumSuffix)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read chunk checksum file %v: %w", path, err)
+	}
+	expect, err := hex.DecodeString(string(bytes.TrimSpace(checksum)))
+	if err != nil {
+		return false, nil
+	}
+	return verifier.Verify(body, expect), nil
+}
+
+// chunkPath returns the path of a chunk file.
+func (q *chunkQueue) chunkPath(index uint32) string {
+	return filepath.Join(q.dir, strconv.FormatUint(uint64(index), 10))
+}
+
+// Matches checks whether the queue is open and holds chunks for the given snapshot.
+func (q *chunkQueue) Matches(height uint64, format uint32) bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.snapshot != nil && q.snapshot.Height == height && q.snapshot.Format == format
 }
 
 // Add adds a chunk to the queue. It ignores chunks that already exist, returning false.
@@ -83,13 +209,24 @@ func (q *chunkQueue) Add(chunk *chunk) (bool, error) {
 		return false, nil
 	}
 
-	path := filepath.Join(q.dir, strconv.FormatUint(uint64(chunk.Index), 10))
+	path := q.chunkPath(chunk.Index)
 	err := ioutil.WriteFile(path, chunk.Chunk, 0600)
 	if err != nil {
 		return false, fmt.Errorf("failed to save chunk %v to file %v: %w", chunk.Index, path, err)
 	}
+	if q.checksums != nil {
+		// The checksum is written after the chunk, such that a chunk is only resumed if fully
+		// written.
+		checksum := q.checksums.Hash(chunk.Chunk)
+		err = ioutil.WriteFile(path+chunkChecksumSuffix, []byte(hex.EncodeToString(checksum)), 0600)
+		if err != nil {
+			return false, fmt.Errorf("failed to save chunk %v checksum: %w", chunk.Index, err)
+		}
+	}
 	q.chunkFiles[chunk.Index] = path
 	q.chunkSenders[chunk.Index] = chunk.Sender
+	// A chunk which arrives after its claim was released mustn't be claimed and fetched again.
+	q.chunkAllocated[chunk.Index] = true
 
 	// Signal any waiters that the chunk has arrived.
 	for _, waiter := range q.waiters[chunk.Index] {
@@ -97,12 +234,26 @@ func (q *chunkQueue) Add(chunk *chunk) (bool, error) {
 		close(waiter)
 	}
 	delete(q.waiters, chunk.Index)
+	q.changed.Broadcast()
 
 	return true, nil
 }
 
-// Allocate allocates a chunk to the caller, making it responsible for fetching it. Returns
-// errDone once no chunks are left or the queue is closed.
+// Accept marks a chunk as accepted by the app, making it available to chunk readers.
+func (q *chunkQueue) Accept(index uint32) {
+	q.Lock()
+	defer q.Unlock()
+	if q.snapshot == nil {
+		return
+	}
+	q.chunkAccepted[index] = true
+	q.changed.Broadcast()
+}
+
+// Allocate allocates a chunk to the caller, making it responsible for fetching it. Each chunk is
+// claimed by a single caller, lowest index first, until it is released via Release() or discarded
+// for refetching via Discard(), which makes it claimable again. Returns errDone once no chunks
+// are left or the queue is closed, although chunks may become claimable again later.
 func (q *chunkQueue) Allocate() (uint32, error) {
 	q.Lock()
 	defer q.Unlock()
@@ -121,8 +272,30 @@ func (q *chunkQueue) Allocate() (uint32, error) {
 	return 0, errDone
 }
 
+// Release releases a chunk claimed via Allocate() which hasn't been received yet, e.g. because its
+// request timed out, making it claimable again. Chunks which have been received are unaffected.
+func (q *chunkQueue) Release(index uint32) {
+	q.Lock()
+	defer q.Unlock()
+	if q.snapshot == nil || q.chunkFiles[index] != "" {
+		return
+	}
+	delete(q.chunkAllocated, index)
+}
+
 // Close closes the chunk queue, cleaning up all temporary files.
 func (q *chunkQueue) Close() error {
+	return q.close(true)
+}
+
+// Suspend closes the chunk queue like Close(), but keeps the buffered chunks on disk, such that
+// an interrupted restore can resume with them via resumeChunkQueue().
+func (q *chunkQueue) Suspend() error {
+	return q.close(false)
+}
+
+// close closes the chunk queue, cleaning up its temporary files if requested.
+func (q *chunkQueue) close(cleanup bool) error {
 	q.Lock()
 	defer q.Unlock()
 	if q.snapshot == nil {
@@ -135,6 +308,10 @@ func (q *chunkQueue) Close() error {
 	}
 	q.waiters = nil
 	q.snapshot = nil
+	q.changed.Broadcast()
+	if !cleanup {
+		return nil
+	}
 	err := os.RemoveAll(q.dir)
 	if err != nil {
 		return fmt.Errorf("failed to clean up state sync tempdir %v: %w", q.dir, err)
@@ -164,9 +341,16 @@ func (q *chunkQueue) discard(index uint32) error {
 	if err != nil {
 		return fmt.Errorf("failed to remove chunk %v: %w", index, err)
 	}
+	if q.checksums != nil {
+		err = os.Remove(path + chunkChecksumSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove chunk %v checksum: %w", index, err)
+		}
+	}
 	delete(q.chunkFiles, index)
 	delete(q.chunkReturned, index)
 	delete(q.chunkAllocated, index)
+	delete(q.chunkAccepted, index)
 	return nil
 }
 
@@ -222,6 +406,43 @@ func (q *chunkQueue) load(index uint32) (*chunk, error) {
 	}, nil
 }
 
+// Load loads a chunk from disk, or nil if the chunk is not in the queue or the queue is closed.
+func (q *chunkQueue) Load(index uint32) (*chunk, error) {
+	q.Lock()
+	defer q.Unlock()
+	if q.snapshot == nil {
+		return nil, nil
+	}
+	return q.load(index)
+}
+
+// NewReader returns an io.Reader which yields the contents of all chunks in order, as they are
+// accepted via Accept(). It blocks until the next chunk is accepted, and returns errAbandoned if
+// the queue is closed before all chunks have been read.
+func (q *chunkQueue) NewReader() io.Reader {
+	return &chunkReader{queue: q}
+}
+
+// waitAccepted waits for the given chunk to be accepted, and returns its contents. The caller
+// must not hold the mutex lock.
+func (q *chunkQueue) waitAccepted(index uint32) ([]byte, error) {
+	q.Lock()
+	defer q.Unlock()
+	for {
+		if q.snapshot == nil {
+			return nil, errAbandoned
+		}
+		if q.chunkAccepted[index] && q.chunkFiles[index] != "" {
+			chunk, err := q.load(index)
+			if err != nil {
+				return nil, err
+			}
+			return chunk.Chunk, nil
+		}
+		q.changed.Wait()
+	}
+}
+
 // Next returns the next chunk from the queue, or errDone if all chunks have been returned. It
 // blocks until the chunk is available. Concurrent Next() calls may return the same chunk.
 func (q *chunkQueue) Next() (*chunk, error) {
@@ -272,6 +493,38 @@ func (q *chunkQueue) nextUp() (uint32, error) {
 	return 0, errDone
 }
 
+// Outstanding returns the number of chunks that have been allocated for fetching, but which
+// have not yet been received.
+func (q *chunkQueue) Outstanding() uint32 {
+	q.Lock()
+	defer q.Unlock()
+	if q.snapshot == nil {
+		return 0
+	}
+	outstanding := uint32(0)
+	for index := range q.chunkAllocated {
+		if q.chunkFiles[index] == "" {
+			outstanding++
+		}
+	}
+	return outstanding
+}
+
+// Buffered returns the number of chunks buffered in the queue, and their total size in bytes.
+func (q *chunkQueue) Buffered() (uint32, uint64, error) {
+	q.Lock()
+	defer q.Unlock()
+	size := uint64(0)
+	for index, path := range q.chunkFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to stat chunk %v: %w", index, err)
+		}
+		size += uint64(info.Size())
+	}
+	return uint32(len(q.chunkFiles)), size, nil
+}
+
 // Retry schedules a chunk to be retried, without refetching it.
 func (q *chunkQueue) Retry(index uint32) {
 	q.Lock()
@@ -319,3 +572,35 @@ func (q *chunkQueue) WaitFor(index uint32) <-chan uint32 {
 	}
 	return ch
 }
+
+// chunkReader reads the contents of a chunk queue's accepted chunks in order.
+type chunkReader struct {
+	queue  *chunkQueue
+	chunks uint32 // total number of chunks
+	index  uint32 // index of the next chunk to read
+	buf    []byte // unread contents of the current chunk
+}
+
+// Read implements io.Reader.
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.chunks == 0 {
+		r.chunks = r.queue.Size()
+		if r.chunks == 0 {
+			return 0, errAbandoned
+		}
+	}
+	for len(r.buf) == 0 {
+		if r.index >= r.chunks {
+			return 0, io.EOF
+		}
+		body, err := r.queue.waitAccepted(r.index)
+		if err != nil {
+			return 0, err
+		}
+		r.buf = body
+		r.index++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
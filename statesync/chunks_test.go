@@ -1,9 +1,15 @@
 package statesync
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -54,6 +60,85 @@ func TestNewChunkQueue_TempDir(t *testing.T) {
 	assert.Len(t, files, 0)
 }
 
+func TestResumeChunkQueue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	dir := filepath.Join(tempDir, "chunks")
+
+	s := &snapshot{Height: 3, Format: 1, Chunks: 5, Hash: []byte{7}}
+	queue, corrupt, err := resumeChunkQueue(s, dir, sha256ChunkVerifier{})
+	require.NoError(t, err)
+	assert.Empty(t, corrupt)
+	for i := uint32(0); i < 4; i++ {
+		_, err = queue.Add(&chunk{Height: 3, Format: 1, Index: i, Chunk: []byte{3, 1, byte(i)}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, queue.Discard(3))
+
+	// Simulate an unclean shutdown, which corrupts chunk 1 and loses the checksum of chunk 2.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1"), []byte{9}, 0600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "2"+chunkChecksumSuffix)))
+
+	queue, corrupt, err = resumeChunkQueue(s, dir, sha256ChunkVerifier{})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2}, corrupt)
+	assert.True(t, queue.Has(0))
+	for _, index := range []uint32{1, 2, 3, 4} {
+		assert.False(t, queue.Has(index))
+	}
+
+	// The corrupt and missing chunks are refetched, and the valid chunk is returned as before.
+	for _, expect := range []uint32{1, 2, 3, 4} {
+		index, err := queue.Allocate()
+		require.NoError(t, err)
+		assert.Equal(t, expect, index)
+	}
+	c, err := queue.Next()
+	require.NoError(t, err)
+	assert.Equal(t, &chunk{Height: 3, Format: 1, Index: 0, Chunk: []byte{3, 1, 0}}, c)
+
+	require.NoError(t, queue.Close())
+	assert.NoDirExists(t, dir)
+}
+
+// reverseChunkVerifier is a ChunkVerifier which "hashes" chunks by reversing them.
+type reverseChunkVerifier struct{}
+
+func (reverseChunkVerifier) Hash(chunk []byte) []byte {
+	hash := make([]byte, len(chunk))
+	for i, b := range chunk {
+		hash[len(chunk)-1-i] = b
+	}
+	return hash
+}
+
+func (v reverseChunkVerifier) Verify(chunk []byte, hash []byte) bool {
+	return bytes.Equal(v.Hash(chunk), hash)
+}
+
+func TestResumeChunkQueue_verifier(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "chunks")
+	s := &snapshot{Height: 3, Format: 1, Chunks: 2, Hash: []byte{7}}
+	queue, _, err := resumeChunkQueue(s, dir, reverseChunkVerifier{})
+	require.NoError(t, err)
+	for i := uint32(0); i < 2; i++ {
+		_, err = queue.Add(&chunk{Height: 3, Format: 1, Index: i, Chunk: []byte{3, 1, byte(i)}})
+		require.NoError(t, err)
+	}
+	checksum, err := ioutil.ReadFile(filepath.Join(dir, "1"+chunkChecksumSuffix))
+	require.NoError(t, err)
+	assert.Equal(t, "010103", string(checksum))
+
+	// The chunks are resumed with the same verifier, but are corrupt according to another one.
+	_, corrupt, err := resumeChunkQueue(s, dir, reverseChunkVerifier{})
+	require.NoError(t, err)
+	assert.Empty(t, corrupt)
+	_, corrupt, err = resumeChunkQueue(s, dir, sha256ChunkVerifier{})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{0, 1}, corrupt)
+}
+
 func TestChunkQueue(t *testing.T) {
 	queue, teardown := setupChunkQueue(t)
 	defer teardown()
@@ -178,6 +263,97 @@ func TestChunkQueue_Allocate(t *testing.T) {
 	assert.Equal(t, errDone, err)
 }
 
+func TestChunkQueue_Release(t *testing.T) {
+	queue, teardown := setupChunkQueue(t)
+	defer teardown()
+
+	for i := uint32(0); i < queue.Size(); i++ {
+		_, err := queue.Allocate()
+		require.NoError(t, err)
+	}
+
+	// Released chunks are claimed again, lowest index first.
+	queue.Release(3)
+	queue.Release(1)
+	index, err := queue.Allocate()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, index)
+
+	// A released chunk which arrives late isn't claimed again, and releasing a received chunk
+	// has no effect.
+	_, err = queue.Add(&chunk{Height: 3, Format: 1, Index: 3, Chunk: []byte{3}})
+	require.NoError(t, err)
+	_, err = queue.Add(&chunk{Height: 3, Format: 1, Index: 4, Chunk: []byte{4}})
+	require.NoError(t, err)
+	queue.Release(4)
+	_, err = queue.Allocate()
+	assert.Equal(t, errDone, err)
+}
+
+func TestChunkQueue_Allocate_concurrent(t *testing.T) {
+	// Many fetchers claim chunks concurrently, and release some of them as if their requests
+	// timed out. No chunk is claimed by two fetchers at once, and every chunk is received once.
+	snapshot := &snapshot{Height: 3, Format: 1, Chunks: 200, Hash: []byte{7}}
+	queue, err := newChunkQueue(snapshot, "")
+	require.NoError(t, err)
+	defer queue.Close()
+
+	var (
+		mtx      sync.Mutex
+		claimed  = make(map[uint32]bool)
+		released = make(map[uint32]bool)
+		received = make(map[uint32]int)
+		done     int32
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&done) < int32(snapshot.Chunks) {
+				index, err := queue.Allocate()
+				if err == errDone {
+					time.Sleep(time.Millisecond) // claims may still be released
+					continue
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				mtx.Lock()
+				assert.False(t, claimed[index], "chunk %v claimed twice", index)
+				claimed[index] = true
+				release := index%3 == 0 && !released[index]
+				released[index] = released[index] || release
+				mtx.Unlock()
+
+				if release {
+					mtx.Lock()
+					claimed[index] = false
+					mtx.Unlock()
+					queue.Release(index)
+					continue
+				}
+				added, err := queue.Add(&chunk{Height: 3, Format: 1, Index: index, Chunk: []byte{1}})
+				assert.NoError(t, err)
+				assert.True(t, added)
+				mtx.Lock()
+				claimed[index] = false
+				received[index]++
+				mtx.Unlock()
+				atomic.AddInt32(&done, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, received, int(snapshot.Chunks))
+	for index, count := range received {
+		assert.Equal(t, 1, count, "chunk %v", index)
+	}
+	_, err = queue.Allocate()
+	assert.Equal(t, errDone, err)
+}
+
 func TestChunkQueue_Discard(t *testing.T) {
 	queue, teardown := setupChunkQueue(t)
 	defer teardown()
@@ -414,6 +590,94 @@ func TestChunkQueue_Next_Closed(t *testing.T) {
 	assert.Equal(t, errDone, err)
 }
 
+func TestChunkQueue_NewReader(t *testing.T) {
+	queue, teardown := setupChunkQueue(t)
+	defer teardown()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		data, err := ioutil.ReadAll(queue.NewReader())
+		results <- result{data, err}
+	}()
+
+	// Chunks that are added but not accepted should not be yielded, and accepted chunks should be
+	// yielded in order even if accepted out of order.
+	for i := uint32(0); i < 5; i++ {
+		_, err := queue.Add(&chunk{Height: 3, Format: 1, Index: i, Chunk: []byte{3, 1, byte(i)}})
+		require.NoError(t, err)
+	}
+	queue.Accept(1)
+	queue.Accept(0)
+	queue.Accept(3)
+	queue.Accept(2)
+
+	// Discarded chunks must be accepted again after being refetched.
+	err := queue.Discard(4)
+	require.NoError(t, err)
+	queue.Accept(4)
+	select {
+	case <-results:
+		t.Fatal("reader completed before all chunks were accepted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = queue.Add(&chunk{Height: 3, Format: 1, Index: 4, Chunk: []byte{3, 1, 9}})
+	require.NoError(t, err)
+	queue.Accept(4)
+
+	res := <-results
+	require.NoError(t, res.err)
+	assert.Equal(t, []byte{3, 1, 0, 3, 1, 1, 3, 1, 2, 3, 1, 3, 3, 1, 9}, res.data)
+}
+
+func TestChunkQueue_NewReader_Closed(t *testing.T) {
+	queue, teardown := setupChunkQueue(t)
+	defer teardown()
+
+	reader := queue.NewReader()
+	_, err := queue.Add(&chunk{Height: 3, Format: 1, Index: 0, Chunk: []byte{3, 1, 0}})
+	require.NoError(t, err)
+	queue.Accept(0)
+
+	buf := make([]byte, 2)
+	n, err := reader.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{3, 1}, buf[:n])
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, reader)
+		errs <- err
+	}()
+	err = queue.Close()
+	require.NoError(t, err)
+	assert.Equal(t, errAbandoned, <-errs)
+}
+
+func TestChunkQueue_Outstanding(t *testing.T) {
+	queue, teardown := setupChunkQueue(t)
+	defer teardown()
+
+	assert.EqualValues(t, 0, queue.Outstanding())
+
+	for i := 0; i < 3; i++ {
+		_, err := queue.Allocate()
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, 3, queue.Outstanding())
+
+	_, err := queue.Add(&chunk{Height: 3, Format: 1, Index: 1, Chunk: []byte{3, 1, 1}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, queue.Outstanding())
+
+	err = queue.Close()
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, queue.Outstanding())
+}
+
 func TestChunkQueue_Retry(t *testing.T) {
 	queue, teardown := setupChunkQueue(t)
 	defer teardown()
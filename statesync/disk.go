@@ -0,0 +1,113 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+)
+
+// With check_disk_space, the syncer checks that the directory which buffers snapshot chunks has
+// enough free disk space for the whole snapshot, plus disk_space_margin, before restoring it, and
+// refuses to restore it otherwise rather than filling up the disk partway through. The snapshot
+// size is estimated via the app's SnapshotSizeFunc, if provided via WithSnapshotSize(), or else
+// from the chunks already buffered when resuming a restore. Without either, it is estimated from
+// the first chunk received, and the restore is aborted if the disk falls short.
+
+var (
+	// errInsufficientDiskSpace is returned by Sync() when the chunk buffer dir doesn't have enough
+	// free disk space for the snapshot.
+	errInsufficientDiskSpace = errors.New("insufficient disk space for snapshot")
+	// errDiskSpaceUnsupported is returned by freeDiskSpace() on platforms where it isn't supported.
+	errDiskSpaceUnsupported = errors.New("querying free disk space is not supported on this platform")
+)
+
+// SnapshotSizeFunc returns the estimated total size of a snapshot's chunks in bytes, e.g. decoded
+// from the snapshot metadata. It returns 0 if the size is unknown.
+type SnapshotSizeFunc func(snapshot *abci.Snapshot) (uint64, error)
+
+// estimateSnapshotSize estimates the total size of a snapshot's chunks, returning 0 if it can't be
+// estimated yet. The app's estimate is preferred, falling back to extrapolating from the chunks
+// buffered in the queue.
+func (s *syncer) estimateSnapshotSize(snapshot *snapshot, chunks *chunkQueue) (uint64, error) {
+	if s.snapshotSize != nil {
+		size, err := s.snapshotSize(snapshot.abciSnapshot())
+		if err != nil {
+			s.logger.Error("Failed to estimate snapshot size", "height", snapshot.Height,
+				"format", snapshot.Format, "err", err)
+		} else if size > 0 {
+			return size, nil
+		}
+	}
+	count, size, err := chunks.Buffered()
+	if err != nil || count == 0 {
+		return 0, err
+	}
+	return size / uint64(count) * uint64(snapshot.Chunks), nil
+}
+
+// checkDiskSpace checks that the chunk buffer dir has enough free disk space for the rest of the
+// snapshot, including the configured margin. It returns false if the snapshot size can't be
+// estimated yet, in which case the check must be repeated once chunks have been received.
+func (s *syncer) checkDiskSpace(snapshot *snapshot, chunks *chunkQueue) (bool, error) {
+	if !s.config.CheckDiskSpace {
+		return true, nil
+	}
+	estimate, err := s.estimateSnapshotSize(snapshot, chunks)
+	if err != nil {
+		return false, err
+	}
+	if estimate == 0 {
+		return false, nil
+	}
+	_, buffered, err := chunks.Buffered()
+	if err != nil {
+		return false, err
+	}
+	required := uint64(0)
+	if estimate > buffered {
+		required = uint64(float64(estimate-buffered) * (1 + s.config.DiskSpaceMargin))
+	}
+	available, err := s.diskFree(chunks.dir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		s.logger.Info("Unable to check free disk space for snapshot", "err", err)
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to check free disk space in %v: %w", chunks.dir, err)
+	}
+	s.logger.Debug("Checked free disk space for snapshot", "height", snapshot.Height,
+		"format", snapshot.Format, "estimate", estimate, "required", required, "available", available)
+	if available < required {
+		return true, fmt.Errorf("%w: %v needs %v bytes for an estimated snapshot size of %v bytes "+
+			"(see statesync.disk_space_margin), but only %v bytes are available", errInsufficientDiskSpace,
+			chunks.dir, required, estimate, available)
+	}
+	return true, nil
+}
+
+// watchDiskSpace spawns a watchdog which repeats the disk space check once the first chunk has been
+// received, if the snapshot size couldn't be estimated before starting, and sends on the returned
+// channel if the disk space is insufficient. The watchdog terminates when the context is
+// cancelled. If the check has already been done, it returns a nil channel which never receives.
+func (s *syncer) watchDiskSpace(ctx context.Context, snapshot *snapshot, chunks *chunkQueue,
+	checked bool) <-chan error {
+	if checked {
+		return nil
+	}
+	insufficient := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-chunks.WaitFor(0):
+			if !ok {
+				return
+			}
+		}
+		if _, err := s.checkDiskSpace(snapshot, chunks); err != nil {
+			insufficient <- err
+		}
+	}()
+	return insufficient
+}
@@ -0,0 +1,9 @@
+// +build !linux,!darwin,!freebsd
+
+package statesync
+
+// freeDiskSpace returns the disk space available in a directory, which isn't supported on this
+// platform.
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errDiskSpaceUnsupported
+}
@@ -0,0 +1,114 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	"github.com/tendermint/tendermint/statesync/mocks"
+)
+
+// fixedDiskFree returns a diskFree function reporting a fixed amount of free disk space.
+func fixedDiskFree(free uint64) func(string) (uint64, error) {
+	return func(string) (uint64, error) { return free, nil }
+}
+
+func TestSyncer_checkDiskSpace(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 4, Hash: []byte{1}}
+
+	testcases := map[string]struct {
+		disabled    bool
+		appSize     uint64
+		buffered    []int
+		free        uint64
+		expectCheck bool
+		expectErr   bool
+	}{
+		"disabled":                       {true, 1000, nil, 0, true, false},
+		"unknown size":                   {false, 0, nil, 0, false, false},
+		"app size fits":                  {false, 1000, nil, 1100, true, false},
+		"app size exceeds margin":        {false, 1000, nil, 1099, true, true},
+		"buffered chunks are deducted":   {false, 1000, []int{500}, 550, true, false},
+		"extrapolated from buffered":     {false, 0, []int{100, 100}, 220, true, false},
+		"extrapolated size exceeds free": {false, 0, []int{100, 100}, 219, true, true},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			config := cfg.TestStateSyncConfig()
+			config.CheckDiskSpace = !tc.disabled
+			config.DiskSpaceMargin = 0.1
+			syncer := newSyncer(config, log.NewNopLogger(), nil, nil, nil, "",
+				withSnapshotSize(func(*abci.Snapshot) (uint64, error) { return tc.appSize, nil }))
+			syncer.diskFree = fixedDiskFree(tc.free)
+
+			chunks, err := newChunkQueue(s, "")
+			require.NoError(t, err)
+			defer chunks.Close()
+			for i, size := range tc.buffered {
+				_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: uint32(i), Chunk: make([]byte, size)})
+				require.NoError(t, err)
+			}
+
+			checked, err := syncer.checkDiskSpace(s, chunks)
+			assert.Equal(t, tc.expectCheck, checked)
+			if tc.expectErr {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, errInsufficientDiskSpace))
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSyncer_Sync_insufficientDiskSpace(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+
+	// The snapshot must be refused before it is offered to the app.
+	conn := &proxymocks.AppConnSnapshot{}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, uint64(1)).Return([]byte("app_hash"), nil)
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), conn, nil, stateProvider, "",
+		withSnapshotSize(func(*abci.Snapshot) (uint64, error) { return 1 << 30, nil }))
+	syncer.diskFree = fixedDiskFree(1 << 20)
+	_, err := syncer.AddSnapshot(simplePeer("a"), s)
+	require.NoError(t, err)
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+
+	_, _, err = syncer.Sync(s, chunks)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errInsufficientDiskSpace))
+	conn.AssertExpectations(t)
+}
+
+func TestSyncer_watchDiskSpace(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 10, Hash: []byte{1}}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), nil, nil, nil, "")
+	syncer.diskFree = fixedDiskFree(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	assert.Nil(t, syncer.watchDiskSpace(ctx, s, chunks, true))
+
+	// The first chunk extrapolates to 10*200 bytes, which doesn't fit.
+	insufficient := syncer.watchDiskSpace(ctx, s, chunks, false)
+	_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: make([]byte, 200)})
+	require.NoError(t, err)
+	err = <-insufficient
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errInsufficientDiskSpace))
+}
@@ -0,0 +1,14 @@
+// +build linux darwin freebsd
+
+package statesync
+
+import "syscall"
+
+// freeDiskSpace returns the disk space available to unprivileged users in a directory, in bytes.
+func freeDiskSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil // nolint:unconvert // types vary by platform
+}
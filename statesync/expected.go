@@ -0,0 +1,66 @@
+package statesync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	cfg "github.com/tendermint/tendermint/config"
+)
+
+// Operators may obtain the hash of a known good snapshot from a trusted source out-of-band, and
+// configure it via expected_snapshot_hash, optionally along with its height, to bootstrap from
+// that exact snapshot. With expected_snapshot_mode = "require", snapshots which don't match it are
+// ignored during discovery, and the sync fails if no matching snapshot is discovered within the
+// discovery time. With "prefer", matching snapshots rank before any others, but other snapshots
+// are restored as usual if none is discovered.
+
+// errExpectedSnapshotNotFound is returned by SyncAny() when the expected snapshot is required but
+// no peer has it.
+var errExpectedSnapshotNotFound = errors.New("expected snapshot not found")
+
+// expectedSnapshot identifies the snapshot configured via expected_snapshot_hash. A nil
+// *expectedSnapshot matches no snapshots, and isn't required.
+type expectedSnapshot struct {
+	hash    []byte
+	height  uint64 // 0 matches any height
+	require bool   // whether only matching snapshots may be restored
+}
+
+// newExpectedSnapshot creates the expected snapshot for a state sync config. It returns nil if no
+// expected snapshot hash is configured.
+func newExpectedSnapshot(config *cfg.StateSyncConfig) *expectedSnapshot {
+	hash := config.ExpectedSnapshotHashBytes()
+	if len(hash) == 0 {
+		return nil
+	}
+	return &expectedSnapshot{
+		hash:    hash,
+		height:  uint64(config.ExpectedSnapshotHeight),
+		require: config.ExpectedSnapshotMode == "require",
+	}
+}
+
+// Matches checks whether a snapshot is the expected snapshot.
+func (e *expectedSnapshot) Matches(snapshot *snapshot) bool {
+	if e == nil {
+		return false
+	}
+	if e.height > 0 && snapshot.Height != e.height {
+		return false
+	}
+	return bytes.Equal(snapshot.Hash, e.hash)
+}
+
+// Required checks whether only the expected snapshot may be restored.
+func (e *expectedSnapshot) Required() bool {
+	return e != nil && e.require
+}
+
+// String implements fmt.Stringer.
+func (e *expectedSnapshot) String() string {
+	if e.height > 0 {
+		return fmt.Sprintf("hash %X at height %v", e.hash, e.height)
+	}
+	return fmt.Sprintf("hash %X", e.hash)
+}
@@ -0,0 +1,104 @@
+package statesync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	"github.com/tendermint/tendermint/statesync/mocks"
+)
+
+// setupExpectedSyncer sets up a syncer expecting the snapshot with hash 0x09, in the given mode.
+func setupExpectedSyncer(t *testing.T, mode string) (*syncer, *proxymocks.AppConnSnapshot) {
+	config := cfg.TestStateSyncConfig()
+	config.ExpectedSnapshotHash = "09"
+	config.ExpectedSnapshotMode = mode
+	require.NoError(t, config.ValidateBasic())
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	syncer := newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{}, stateProvider, "")
+	return syncer, connSnapshot
+}
+
+func TestExpectedSnapshot_Matches(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	assert.Nil(t, newExpectedSnapshot(config))
+
+	config.ExpectedSnapshotHash = "0102"
+	expected := newExpectedSnapshot(config)
+	require.NotNil(t, expected)
+	assert.True(t, expected.Required())
+	assert.True(t, expected.Matches(&snapshot{Height: 1, Hash: []byte{1, 2}}))
+	assert.True(t, expected.Matches(&snapshot{Height: 2, Hash: []byte{1, 2}}))
+	assert.False(t, expected.Matches(&snapshot{Height: 1, Hash: []byte{1}}))
+
+	config.ExpectedSnapshotHeight = 2
+	config.ExpectedSnapshotMode = "prefer"
+	expected = newExpectedSnapshot(config)
+	assert.False(t, expected.Required())
+	assert.False(t, expected.Matches(&snapshot{Height: 1, Hash: []byte{1, 2}}))
+	assert.True(t, expected.Matches(&snapshot{Height: 2, Hash: []byte{1, 2}}))
+
+	var none *expectedSnapshot
+	assert.False(t, none.Required())
+	assert.False(t, none.Matches(&snapshot{Height: 2, Hash: []byte{1, 2}}))
+}
+
+func TestSyncer_SyncAny_expectedRequired(t *testing.T) {
+	syncer, connSnapshot := setupExpectedSyncer(t, "require")
+
+	// Only the expected snapshot is added, regardless of height.
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{9}}
+	added, err := syncer.AddSnapshot(simplePeer("a"), &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}})
+	require.NoError(t, err)
+	assert.False(t, added)
+	added, err = syncer.AddSnapshot(simplePeer("a"), s)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}, nil)
+
+	// Once the expected snapshot is rejected, no other snapshot is tried.
+	_, err = syncer.SyncAny(0)
+	assert.True(t, errors.Is(err, errExpectedSnapshotNotFound), err)
+	connSnapshot.AssertExpectations(t)
+}
+
+func TestSyncer_SyncAny_expectedPreferred(t *testing.T) {
+	syncer, connSnapshot := setupExpectedSyncer(t, "prefer")
+
+	// The expected snapshot ranks before higher snapshots.
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{9}}
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}
+	for _, s := range []*snapshot{s2, s1} {
+		added, err := syncer.AddSnapshot(simplePeer("a"), s)
+		require.NoError(t, err)
+		assert.True(t, added)
+	}
+	selected, decision := syncer.snapshots.Select()
+	assert.Equal(t, s1, selected)
+	require.NotNil(t, decision)
+	assert.Equal(t, SelectReasonExpected, decision.Reason)
+
+	// Other snapshots are tried once the expected snapshot is rejected.
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s1), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}, nil)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s2), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ABORT}, nil)
+
+	_, err := syncer.SyncAny(0)
+	assert.Equal(t, errAbort, err)
+	connSnapshot.AssertExpectations(t)
+}
@@ -0,0 +1,114 @@
+package statesync
+
+import (
+	"sync"
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// When a restore ends, its chunk fetchers may still be awaiting responses from peers, which would
+// be fed to a later restore of the same snapshot, e.g. when the snapshot is retried or picked again
+// by a subsequent sync, and mistaken for responses to its own requests. The restore is therefore
+// finalized by stopping its fetchers, such that no further requests are sent, and recording the
+// requests still in flight as stale. Responses to stale requests which arrive within
+// straggler_chunk_window are discarded, unless the chunk has been requested from the peer again.
+
+// staleChunkKey identifies a chunk request to a peer.
+type staleChunkKey struct {
+	height uint64
+	format uint32
+	index  uint32
+	peerID p2p.ID
+}
+
+// staleChunks tracks chunk requests left in flight by finished restores, and is shared by the
+// syncers of a reactor such that back-to-back syncs don't pick up each other's chunks. A nil
+// *staleChunks tracks nothing.
+type staleChunks struct {
+	tmsync.Mutex
+	window   time.Duration
+	requests map[staleChunkKey]time.Time // stale requests, by expiry time
+}
+
+// newStaleChunks creates a new stale chunk tracker, which discards responses to stale requests for
+// the given window. It returns nil if the window is 0.
+func newStaleChunks(window time.Duration) *staleChunks {
+	if window <= 0 {
+		return nil
+	}
+	return &staleChunks{
+		window:   window,
+		requests: make(map[staleChunkKey]time.Time),
+	}
+}
+
+// Add records the requests in flight for a snapshot when its restore finished as stale.
+func (c *staleChunks) Add(snapshot *snapshot, requests []ChunkRequestInfo) {
+	if c == nil || len(requests) == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.prune()
+	expires := time.Now().Add(c.window)
+	for _, request := range requests {
+		if request.Peer == "" {
+			continue
+		}
+		c.requests[staleChunkKey{snapshot.Height, snapshot.Format, request.Index, request.Peer}] = expires
+	}
+}
+
+// Requested records that a chunk is requested from a peer, such that its response is no longer
+// considered stale.
+func (c *staleChunks) Requested(snapshot *snapshot, index uint32, peerID p2p.ID) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	delete(c.requests, staleChunkKey{snapshot.Height, snapshot.Format, index, peerID})
+}
+
+// Discard checks whether a chunk is a response to a stale request, which should be discarded. Only
+// the first response to a stale request is discarded.
+func (c *staleChunks) Discard(chunk *chunk) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	key := staleChunkKey{chunk.Height, chunk.Format, chunk.Index, chunk.Sender}
+	expires, ok := c.requests[key]
+	if !ok {
+		return false
+	}
+	delete(c.requests, key)
+	return time.Now().Before(expires)
+}
+
+// prune removes expired stale requests. The caller must hold the mutex.
+func (c *staleChunks) prune() {
+	now := time.Now()
+	for key, expires := range c.requests {
+		if !now.Before(expires) {
+			delete(c.requests, key)
+		}
+	}
+}
+
+// finalizeRestore finalizes a restore: it cancels the chunk fetchers and waits for them to exit,
+// such that no more chunk requests are sent for it, and records the requests left in flight as
+// stale, such that a later restore discards their responses.
+func (s *syncer) finalizeRestore(snapshot *snapshot, cancel func(), fetchers *sync.WaitGroup) {
+	cancel()
+	fetchers.Wait()
+	requests := s.currentRequests().Inspect()
+	s.stale.Add(snapshot, requests)
+	if len(requests) > 0 {
+		s.chunkLogger().Debug("Finalized restore with chunk requests in flight", "height", snapshot.Height,
+			"format", snapshot.Format, "requests", len(requests))
+	}
+}
@@ -0,0 +1,128 @@
+package statesync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync/mocks"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestStaleChunks(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}}
+	stale := newStaleChunks(time.Minute)
+	stale.Add(s, []ChunkRequestInfo{{Index: 0, Peer: "a"}, {Index: 1, Peer: "a"}, {Index: 2}})
+
+	// Only the first response to a stale request is discarded.
+	assert.True(t, stale.Discard(&chunk{Height: 1, Format: 1, Index: 0, Sender: "a"}))
+	assert.False(t, stale.Discard(&chunk{Height: 1, Format: 1, Index: 0, Sender: "a"}))
+	assert.False(t, stale.Discard(&chunk{Height: 1, Format: 1, Index: 1, Sender: "b"}))
+	assert.False(t, stale.Discard(&chunk{Height: 2, Format: 1, Index: 1, Sender: "a"}))
+	assert.False(t, stale.Discard(&chunk{Height: 1, Format: 1, Index: 2}))
+
+	// Requesting the chunk from the peer again makes its response current.
+	stale.Requested(s, 1, "a")
+	assert.False(t, stale.Discard(&chunk{Height: 1, Format: 1, Index: 1, Sender: "a"}))
+
+	// Stale requests expire after the window.
+	stale = newStaleChunks(10 * time.Millisecond)
+	stale.Add(s, []ChunkRequestInfo{{Index: 0, Peer: "a"}})
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, stale.Discard(&chunk{Height: 1, Format: 1, Index: 0, Sender: "a"}))
+
+	// A zero window disables the tracker.
+	stale = newStaleChunks(0)
+	assert.Nil(t, stale)
+	stale.Add(s, []ChunkRequestInfo{{Index: 0, Peer: "a"}})
+	assert.False(t, stale.Discard(&chunk{Height: 1, Format: 1, Index: 0, Sender: "a"}))
+}
+
+func TestSyncer_Sync_backToBack(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.StallTimeout = 200 * time.Millisecond
+	stale := newStaleChunks(config.StragglerChunkWindow)
+
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(sm.State{}, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(&types.Commit{}, nil)
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+
+	// The first sync stalls, since peer a never responds to its chunk requests.
+	requestsMtx := tmsync.Mutex{}
+	requests := 0
+	peerA := simplePeer("a")
+	peerA.On("Send", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
+		requestsMtx.Lock()
+		requests++
+		requestsMtx.Unlock()
+	}).Return(true)
+	first := newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{},
+		stateProvider, "", withStaleChunks(stale))
+	_, err := first.AddSnapshot(peerA, s)
+	require.NoError(t, err)
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	_, _, err = first.Sync(s, chunks)
+	assert.Equal(t, ErrStalled, err)
+	require.NoError(t, chunks.Close())
+
+	// Once finalized, the first sync sends no more requests, and its requests are stale.
+	requestsMtx.Lock()
+	sent := requests
+	requestsMtx.Unlock()
+	assert.EqualValues(t, s.Chunks, sent)
+	time.Sleep(100 * time.Millisecond)
+	requestsMtx.Lock()
+	assert.Equal(t, sent, requests)
+	requestsMtx.Unlock()
+	assert.Len(t, stale.requests, int(s.Chunks))
+
+	// The second sync restores the same snapshot from peer b. Peer a's belated responses to the
+	// first sync arrive just before b's, and must be discarded.
+	second := newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{},
+		stateProvider, "", withStaleChunks(stale))
+	peerB := simplePeer("b")
+	peerB.On("Send", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
+		pb, err := decodeMsg(args[1].([]byte))
+		assert.NoError(t, err)
+		index := pb.(*ssproto.ChunkRequest).Index
+		added, err := second.AddChunk(&chunk{Height: 1, Format: 1, Index: index, Chunk: []byte{'a'}, Sender: "a"})
+		assert.NoError(t, err)
+		assert.False(t, added)
+		added, err = second.AddChunk(&chunk{Height: 1, Format: 1, Index: index, Chunk: []byte{'b'}, Sender: "b"})
+		assert.NoError(t, err)
+		assert.True(t, added)
+	}).Return(true)
+	_, err = second.AddSnapshot(peerB, s)
+	require.NoError(t, err)
+
+	var applied abci.RequestApplySnapshotChunk
+	connSnapshot.On("ApplySnapshotChunkSync", mock.Anything).Run(func(args mock.Arguments) {
+		applied = args[0].(abci.RequestApplySnapshotChunk)
+	}).Once().Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ABORT}, nil)
+
+	chunks, err = newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	_, _, err = second.Sync(s, chunks)
+	assert.Equal(t, errAbort, err)
+	assert.EqualValues(t, 0, applied.Index)
+	assert.Equal(t, []byte{'b'}, applied.Chunk)
+	assert.Equal(t, "b", applied.Sender)
+}
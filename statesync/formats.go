@@ -0,0 +1,160 @@
+package statesync
+
+import (
+	"fmt"
+
+	cfg "github.com/tendermint/tendermint/config"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/proxy"
+)
+
+// AppFormatsFunc returns the snapshot formats the app is able to restore and serve, e.g. by
+// issuing an ABCI query against the given connection. ABCI has no method for declaring snapshot
+// formats, so this must be provided by the app's integration. It is called once when the reactor
+// starts, to validate the configured formats, and to skip snapshots in formats newer than the app
+// with future_formats = "skip".
+type AppFormatsFunc func(conn proxy.AppConnQuery) ([]uint32, error)
+
+// validateAppFormats checks that the configured restore, serving, and priority formats are all
+// supported by the app, such that a misconfigured node fails at startup rather than after a
+// futile snapshot discovery. Nothing is validated without an AppFormatsFunc.
+func (r *Reactor) validateAppFormats() error {
+	if r.appFormats == nil {
+		return nil
+	}
+	formats, err := r.appFormats(r.connQuery)
+	if err != nil {
+		return fmt.Errorf("failed to query app snapshot formats: %w", err)
+	}
+	if err := checkAppFormats(r.config, formats); err != nil {
+		return err
+	}
+	r.syncerOptions = append(r.syncerOptions, withAppFormats(formats))
+	return nil
+}
+
+// checkAppFormats checks that the formats configured in a state sync config are in the set of
+// formats supported by the app.
+func checkAppFormats(config *cfg.StateSyncConfig, formats []uint32) error {
+	supported := make(map[uint32]bool, len(formats))
+	for _, format := range formats {
+		supported[format] = true
+	}
+	for _, option := range []struct {
+		name    string
+		formats []uint32
+	}{
+		{"restore_formats", config.RestoreFormats},
+		{"serving_formats", config.ServingFormats},
+		{"format_priority", config.FormatPriority},
+	} {
+		for _, format := range option.formats {
+			if !supported[format] {
+				return fmt.Errorf("%v contains snapshot format %v, which the app doesn't support "+
+					"(supported formats: %v)", option.name, format, formats)
+			}
+		}
+	}
+	return nil
+}
+
+// Apps are expected to number their snapshot formats incrementally, such that a peer running a
+// newer app version may advertise snapshots in formats higher than any the local app supports.
+// With future_formats = "skip", such snapshots are skipped when discovered rather than offered to
+// the app in vain, logging once per format that a newer format exists. The highest supported
+// format is taken from the AppFormatsFunc, if provided, and is otherwise learned from offers: a
+// rejected format higher than any accepted format is assumed to be newer than the app, as are
+// any formats above it.
+
+// formatHorizon tracks the highest snapshot format supported by the app, beyond which snapshot
+// formats are considered to be from the future. It is safe for concurrent use.
+type formatHorizon struct {
+	tmsync.Mutex
+	known    bool            // whether the highest supported format is known
+	max      uint32          // the highest supported format, if known
+	fromApp  bool            // whether max was provided by the app, rather than learned
+	accepted *uint32         // the highest format accepted in an offer, if any
+	logged   map[uint32]bool // future formats which have been logged
+}
+
+// newFormatHorizon creates a new format horizon, with the formats supported by the app, if known.
+func newFormatHorizon(formats []uint32) *formatHorizon {
+	h := &formatHorizon{logged: make(map[uint32]bool)}
+	for _, format := range formats {
+		if !h.known || format > h.max {
+			h.known, h.max, h.fromApp = true, format, true
+		}
+	}
+	return h
+}
+
+// Future checks whether a format is higher than the highest supported format. It also returns
+// whether this is the first time the format was found to be from the future.
+func (h *formatHorizon) Future(format uint32) (bool, bool) {
+	h.Lock()
+	defer h.Unlock()
+	if !h.known || format <= h.max {
+		return false, false
+	}
+	first := !h.logged[format]
+	h.logged[format] = true
+	return true, first
+}
+
+// Max returns the highest supported format, if known.
+func (h *formatHorizon) Max() (uint32, bool) {
+	h.Lock()
+	defer h.Unlock()
+	return h.max, h.known
+}
+
+// Accepted records that the app accepted an offered snapshot in the given format.
+func (h *formatHorizon) Accepted(format uint32) {
+	h.Lock()
+	defer h.Unlock()
+	if h.accepted == nil || format > *h.accepted {
+		h.accepted = &format
+	}
+}
+
+// Rejected records that the app rejected the given format, and returns true if the highest
+// supported format was lowered as a result, i.e. the format was higher than any accepted one.
+func (h *formatHorizon) Rejected(format uint32) bool {
+	h.Lock()
+	defer h.Unlock()
+	switch {
+	case h.fromApp || format == 0:
+		return false
+	case h.accepted != nil && format <= *h.accepted:
+		return false
+	case h.known && format > h.max:
+		return false
+	}
+	h.known, h.max = true, format-1
+	return true
+}
+
+// skipsFutureFormat checks whether snapshots in the given format are skipped for being newer than
+// the app, logging the first time a format is skipped to hint the operator to upgrade the app.
+func (s *syncer) skipsFutureFormat(format uint32) bool {
+	if s.config.FutureFormats != "skip" {
+		return false
+	}
+	future, first := s.formats.Future(format)
+	if first {
+		max, _ := s.formats.Max()
+		s.logger.Info("Peers have snapshots in a format newer than the app supports, skipping them. "+
+			"Upgrading the app may allow restoring them.", "format", format, "max_format", max)
+	}
+	return future
+}
+
+// rejectFutureFormats learns from the app rejecting a format that formats above it are newer than
+// the app, if it is higher than any accepted format, and rejects any snapshots in such formats.
+func (s *syncer) rejectFutureFormats(format uint32) {
+	if s.config.FutureFormats != "skip" || !s.formats.Rejected(format) {
+		return
+	}
+	s.snapshots.RejectFormatsAbove(format - 1)
+	s.logger.Info("Skipping snapshot formats newer than the rejected format", "format", format)
+}
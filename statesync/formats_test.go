@@ -0,0 +1,203 @@
+package statesync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/proxy"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	"github.com/tendermint/tendermint/statesync/mocks"
+)
+
+func TestReactor_validateAppFormats(t *testing.T) {
+	boom := errors.New("boom")
+
+	testcases := map[string]struct {
+		restore  []uint32
+		serving  []uint32
+		priority []uint32
+		formats  []uint32
+		err      error
+		expectOK bool
+	}{
+		"unconfigured":           {nil, nil, nil, []uint32{1}, nil, true},
+		"supported":              {[]uint32{1, 2}, []uint32{2}, []uint32{2, 1}, []uint32{1, 2, 3}, nil, true},
+		"unsupported restore":    {[]uint32{1, 4}, nil, nil, []uint32{1, 2}, nil, false},
+		"unsupported serving":    {nil, []uint32{4}, nil, []uint32{1, 2}, nil, false},
+		"unsupported priority":   {nil, nil, []uint32{4}, []uint32{1, 2}, nil, false},
+		"no supported formats":   {[]uint32{1}, nil, nil, nil, nil, false},
+		"app formats error":      {nil, nil, nil, nil, boom, false},
+		"max uint32 supported":   {[]uint32{4294967295}, nil, nil, []uint32{4294967295}, nil, true},
+		"max uint32 unsupported": {[]uint32{4294967295}, nil, nil, []uint32{1}, nil, false},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			config := cfg.DefaultStateSyncConfig()
+			config.RestoreFormats = tc.restore
+			config.ServingFormats = tc.serving
+			config.FormatPriority = tc.priority
+			connQuery := &proxymocks.AppConnQuery{}
+			var queried proxy.AppConnQuery
+			r := NewReactor(config, &proxymocks.AppConnSnapshot{}, connQuery, "",
+				WithAppFormats(func(conn proxy.AppConnQuery) ([]uint32, error) {
+					queried = conn
+					return tc.formats, tc.err
+				}))
+
+			err := r.validateAppFormats()
+			if tc.expectOK {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err))
+			}
+			assert.Equal(t, connQuery, queried)
+		})
+	}
+}
+
+func TestReactor_OnStart_appFormats(t *testing.T) {
+	config := cfg.DefaultStateSyncConfig()
+	config.RestoreFormats = []uint32{2}
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, &proxymocks.AppConnQuery{}, "",
+		WithAppFormats(func(conn proxy.AppConnQuery) ([]uint32, error) { return []uint32{1}, nil }))
+	require.Error(t, r.Start())
+
+	// Without an app formats function, the configured formats aren't validated.
+	r = NewReactor(config, &proxymocks.AppConnSnapshot{}, &proxymocks.AppConnQuery{}, "")
+	require.NoError(t, r.Start())
+	require.NoError(t, r.Stop())
+}
+
+func TestFormatHorizon(t *testing.T) {
+	testcases := map[string]struct {
+		formats   []uint32
+		accepted  []uint32
+		rejected  []uint32
+		expectMax uint32
+		expectOK  bool
+	}{
+		"unknown":                 {nil, nil, nil, 0, false},
+		"from app":                {[]uint32{1, 3, 2}, nil, nil, 3, true},
+		"app not lowered":         {[]uint32{1, 3}, []uint32{1}, []uint32{3}, 3, true},
+		"learned":                 {nil, nil, []uint32{3}, 2, true},
+		"learned above accepted":  {nil, []uint32{2}, []uint32{3}, 2, true},
+		"rejected below accepted": {nil, []uint32{2}, []uint32{1, 2}, 0, false},
+		"rejected format 0":       {nil, nil, []uint32{0}, 0, false},
+		"lowered":                 {nil, []uint32{1}, []uint32{5, 3}, 2, true},
+		"not raised":              {nil, nil, []uint32{3, 5}, 2, true},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			h := newFormatHorizon(tc.formats)
+			for _, format := range tc.accepted {
+				h.Accepted(format)
+			}
+			for _, format := range tc.rejected {
+				h.Rejected(format)
+			}
+			max, ok := h.Max()
+			assert.Equal(t, tc.expectOK, ok)
+			if tc.expectOK {
+				assert.Equal(t, tc.expectMax, max)
+			}
+
+			future, _ := h.Future(tc.expectMax + 1)
+			assert.Equal(t, tc.expectOK, future)
+			future, _ = h.Future(tc.expectMax)
+			assert.False(t, future)
+		})
+	}
+}
+
+func TestFormatHorizon_Future_first(t *testing.T) {
+	h := newFormatHorizon([]uint32{1})
+	future, first := h.Future(2)
+	assert.True(t, future)
+	assert.True(t, first)
+	future, first = h.Future(2)
+	assert.True(t, future)
+	assert.False(t, first)
+	future, first = h.Future(3)
+	assert.True(t, future)
+	assert.True(t, first)
+}
+
+func TestSyncer_AddSnapshot_futureFormat(t *testing.T) {
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	s2 := &snapshot{Height: 1, Format: 2, Chunks: 1, Hash: []byte{2}}
+
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	config := cfg.TestStateSyncConfig()
+	syncer := newSyncer(config, log.NewNopLogger(), nil, nil, stateProvider, "", withAppFormats([]uint32{0, 1}))
+	added, err := syncer.AddSnapshot(simplePeer("a"), s1)
+	require.NoError(t, err)
+	assert.True(t, added)
+	added, err = syncer.AddSnapshot(simplePeer("a"), s2)
+	require.NoError(t, err)
+	assert.False(t, added)
+
+	// Without app formats, nothing is skipped until a format has been rejected.
+	syncer = newSyncer(config, log.NewNopLogger(), nil, nil, stateProvider, "")
+	added, err = syncer.AddSnapshot(simplePeer("a"), s2)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	// With future_formats = "offer", future formats are added as usual.
+	config.FutureFormats = "offer"
+	syncer = newSyncer(config, log.NewNopLogger(), nil, nil, stateProvider, "", withAppFormats([]uint32{0, 1}))
+	added, err = syncer.AddSnapshot(simplePeer("a"), s2)
+	require.NoError(t, err)
+	assert.True(t, added)
+}
+
+func TestSyncer_SyncAny_rejectFutureFormat(t *testing.T) {
+	syncer, connSnapshot := setupOfferSyncer(t)
+
+	// s23 is tried first, and its rejected format also rejects s14, then s11 will abort.
+	s23 := &snapshot{Height: 2, Format: 3, Chunks: 3, Hash: []byte{1, 2, 3}}
+	s14 := &snapshot{Height: 1, Format: 4, Chunks: 3, Hash: []byte{1, 2, 3}}
+	s11 := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	for _, s := range []*snapshot{s23, s14, s11} {
+		_, err := syncer.AddSnapshot(simplePeer("id"), s)
+		require.NoError(t, err)
+	}
+
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s23), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT_FORMAT}, nil)
+
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s11), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ABORT}, nil)
+
+	_, err := syncer.SyncAny(0)
+	assert.Equal(t, errAbort, err)
+	connSnapshot.AssertExpectations(t)
+	rejected := map[uint32]string{}
+	for _, info := range syncer.snapshots.Catalog() {
+		rejected[info.Format] = info.Rejected
+	}
+	assert.Equal(t, RejectReasonFutureFormat, rejected[4])
+	assert.NotEqual(t, RejectReasonFutureFormat, rejected[3])
+
+	// Snapshots in formats above the rejected format are now skipped when discovered.
+	added, err := syncer.AddSnapshot(simplePeer("id"), &snapshot{Height: 3, Format: 5, Chunks: 1, Hash: []byte{5}})
+	require.NoError(t, err)
+	assert.False(t, added)
+	added, err = syncer.AddSnapshot(simplePeer("id"), &snapshot{Height: 3, Format: 2, Chunks: 1, Hash: []byte{2}})
+	require.NoError(t, err)
+	assert.True(t, added)
+}
@@ -0,0 +1,86 @@
+package statesync
+
+import (
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// peerGrace defers the removal of peers which disconnected, for the peer_reconnect_grace window,
+// such that peers which briefly flap, i.e. disconnect and quickly reconnect, keep their latency
+// estimates, advertised snapshots, active peer slots, and in-flight chunk requests, rather than
+// causing chunk requests to be rescheduled. Peers which are away aren't sent new chunk requests.
+// A nil *peerGrace removes peers right away.
+type peerGrace struct {
+	tmsync.Mutex
+	window time.Duration
+	away   map[p2p.ID]*time.Timer // removal timers of disconnected peers
+}
+
+// newPeerGrace creates a new peer reconnect grace tracker, or nil if the window is 0.
+func newPeerGrace(window time.Duration) *peerGrace {
+	if window <= 0 {
+		return nil
+	}
+	return &peerGrace{
+		window: window,
+		away:   make(map[p2p.ID]*time.Timer),
+	}
+}
+
+// Leave records a peer as disconnected, calling remove once the window expires unless the peer
+// returns first. It returns false if there is no grace, in which case the caller must remove the
+// peer itself.
+func (g *peerGrace) Leave(peerID p2p.ID, remove func()) bool {
+	if g == nil {
+		return false
+	}
+	g.Lock()
+	defer g.Unlock()
+	if timer, ok := g.away[peerID]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(g.window, func() {
+		g.Lock()
+		expired := g.away[peerID] == timer
+		if expired {
+			delete(g.away, peerID)
+		}
+		g.Unlock()
+		if expired {
+			remove()
+		}
+	})
+	g.away[peerID] = timer
+	return true
+}
+
+// Return records a peer as reconnected, cancelling its removal. It returns true if the peer was
+// away, i.e. returned within the window.
+func (g *peerGrace) Return(peerID p2p.ID) bool {
+	if g == nil {
+		return false
+	}
+	g.Lock()
+	defer g.Unlock()
+	timer, ok := g.away[peerID]
+	if !ok {
+		return false
+	}
+	timer.Stop()
+	delete(g.away, peerID)
+	return true
+}
+
+// Away checks whether a peer is disconnected and within the window.
+func (g *peerGrace) Away(peerID p2p.ID) bool {
+	if g == nil {
+		return false
+	}
+	g.Lock()
+	defer g.Unlock()
+	_, ok := g.away[peerID]
+	return ok
+}
@@ -0,0 +1,134 @@
+package statesync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/p2p"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+)
+
+func TestPeerGrace(t *testing.T) {
+	assert.False(t, newPeerGrace(0).Leave("a", func() { t.Error("removed with no grace") }))
+	assert.False(t, newPeerGrace(0).Return("a"))
+
+	grace := newPeerGrace(50 * time.Millisecond)
+	removed := make(chan p2p.ID, 2)
+	remove := func(peerID p2p.ID) func() { return func() { removed <- peerID } }
+
+	// Peer a returns within the window and is retained, while peer b is removed once it expires.
+	require.True(t, grace.Leave("a", remove("a")))
+	require.True(t, grace.Leave("b", remove("b")))
+	assert.True(t, grace.Away("a"))
+	assert.True(t, grace.Return("a"))
+	assert.False(t, grace.Away("a"))
+	assert.False(t, grace.Return("a"))
+
+	select {
+	case peerID := <-removed:
+		assert.EqualValues(t, "b", peerID)
+	case <-time.After(time.Second):
+		t.Fatal("peer b was not removed")
+	}
+	assert.False(t, grace.Away("b"))
+	assert.False(t, grace.Return("b"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, removed)
+}
+
+func TestReactor_flappingPeer(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.PeerReconnectGrace = time.Hour
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "")
+	syncer, _ := setupOfferSyncer(t)
+	syncer.grace = r.grace
+	syncer.latencies = r.latencies
+	syncer.active = newActivePeerSet(1, r.latencies)
+	r.syncers[syncer] = struct{}{}
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1, 2, 3}}
+	peerA := simplePeer("a")
+	peerA.On("Send", ChunkChannel, mock.Anything).Maybe().Return(true)
+	for _, peer := range []p2p.Peer{peerA, simplePeer("b")} {
+		_, err := syncer.AddSnapshot(peer, s)
+		require.NoError(t, err)
+	}
+	r.latencies.Observe("a", time.Millisecond)
+	r.latencies.Observe("b", time.Second)
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	syncer.chunks = chunks
+	syncer.requests = newChunkRequests()
+	require.EqualValues(t, "a", syncer.selectPeer(s, 0).ID())
+	syncer.requests.Start(0, "a")
+
+	// Peer a disconnects, which the switch reports as a connection error. It keeps its snapshots,
+	// latency estimate and active slot, but isn't sent new chunk requests while away.
+	r.RemovePeer(peerA, io.EOF)
+	assert.Len(t, syncer.snapshots.GetPeers(s), 2)
+	_, ok := r.latencies.Estimate("a")
+	assert.True(t, ok)
+	assert.Nil(t, syncer.selectPeer(s, 1))
+	_, removed := r.PeerRemovals()
+	assert.False(t, removed)
+
+	// Peer a quickly reconnects. Its chunk request in flight is sent again on the new connection,
+	// and it is selected again.
+	reconnected := simplePeer("a")
+	reconnected.On("Send", ChunkChannel, mustEncodeMsg(&ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0})).
+		Once().Return(true)
+	reconnected.On("Send", ChunkChannel, mock.Anything).Maybe().Return(true)
+	reconnected.On("TrySend", SnapshotChannel, mock.Anything).Maybe().Return(true)
+	reconnected.On("IsRunning").Maybe().Return(true)
+	r.AddPeer(reconnected)
+	reconnected.AssertExpectations(t)
+	assert.False(t, r.grace.Away("a"))
+	assert.Same(t, reconnected, syncer.selectPeer(s, 1))
+	assert.Equal(t, []ChunkRequestInfo{{Index: 0, Peer: "a"}}, zeroElapsed(syncer.requests.Inspect()))
+
+	// A peer stopped for violating the protocol is removed right away.
+	r.RemovePeer(reconnected, protocolViolation{errors.New("invalid message")})
+	assert.Len(t, syncer.snapshots.GetPeers(s), 1)
+}
+
+func TestIsProtocolViolation(t *testing.T) {
+	testcases := map[string]struct {
+		reason    interface{}
+		violation bool
+	}{
+		"nil":              {nil, false},
+		"string":           {"stopped", false},
+		"eof":              {io.EOF, false},
+		"connection error": {fmt.Errorf("read: %w", errors.New("connection reset by peer")), false},
+		"violation":        {protocolViolation{errors.New("invalid message")}, true},
+		"wrapped violation": {fmt.Errorf("stopped: %w", protocolViolation{errors.New("invalid message")}),
+			true},
+		"chunk too large":     {fmt.Errorf("bad: %w", errChunkTooLarge), true},
+		"unknown message":     {errUnknownMessage, true},
+		"invalid chunk proof": {errInvalidChunkProof, true},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.violation, isProtocolViolation(tc.reason))
+		})
+	}
+}
+
+// zeroElapsed clears the elapsed time of chunk requests, for comparisons.
+func zeroElapsed(infos []ChunkRequestInfo) []ChunkRequestInfo {
+	for i := range infos {
+		infos[i].Elapsed = 0
+	}
+	return infos
+}
@@ -0,0 +1,94 @@
+package statesync
+
+import (
+	"fmt"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+)
+
+// When a restored snapshot fails the final app hash check, this is usually caused by a single bad
+// chunk, e.g. one corrupted by a faulty peer in a way the app didn't detect while applying it.
+// Rather than discarding the whole snapshot, apps with per-chunk hashes can have the syncer heal
+// it: the buffered chunks are checked against their expected hashes, and only the chunks which
+// don't match are refetched from alternate peers. The snapshot is then re-offered to the app and
+// re-applied from the buffered chunks, and the app hash checked again. Only if no chunks are found
+// responsible, or the healed snapshot still doesn't match, is it rejected as a whole.
+
+const (
+	// chunkHealAttempts is the number of times a snapshot is healed before it is rejected.
+	chunkHealAttempts = 2
+)
+
+// ChunkHashesFunc returns the expected hash of each chunk of a snapshot, in chunk order, for
+// snapshots with per-chunk hashes, e.g. decoded from the snapshot metadata. The hashes are checked
+// via the ChunkVerifier, SHA-256 by default. It returns nil if the snapshot has no chunk hashes.
+type ChunkHashesFunc func(snapshot *abci.Snapshot) ([][]byte, error)
+
+// suspectChunks returns the buffered chunks of a snapshot which don't match their expected hashes,
+// and may thus be responsible for an app hash mismatch.
+func (s *syncer) suspectChunks(snapshot *snapshot, chunks *chunkQueue) ([]uint32, error) {
+	if s.chunkHashes == nil {
+		return nil, nil
+	}
+	hashes, err := s.chunkHashes(snapshot.abciSnapshot())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunk hashes: %w", err)
+	}
+	if hashes == nil {
+		return nil, nil
+	}
+	if uint32(len(hashes)) != snapshot.Chunks {
+		return nil, fmt.Errorf("got %v chunk hashes for %v chunks", len(hashes), snapshot.Chunks)
+	}
+	var suspects []uint32
+	for index := uint32(0); index < snapshot.Chunks; index++ {
+		chunk, err := chunks.Load(index)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil || !s.verifier.Verify(chunk.Chunk, hashes[index]) {
+			suspects = append(suspects, index)
+		}
+	}
+	return suspects, nil
+}
+
+// healChunks heals a snapshot which failed the app hash check, by discarding the chunks which don't
+// match their expected hashes, such that they're refetched from peers other than their senders,
+// and re-offering the snapshot for the buffered chunks to be re-applied. It returns false if no
+// chunks were found responsible, in which case the snapshot can't be healed. Refetches are spent
+// against the snapshot's retry budget.
+func (s *syncer) healChunks(snapshot *snapshot, chunks *chunkQueue) (bool, error) {
+	// A streamed snapshot has already been yielded to the stream, including the bad chunks.
+	if s.streamFunc != nil {
+		return false, nil
+	}
+	suspects, err := s.suspectChunks(snapshot, chunks)
+	if err != nil || len(suspects) == 0 {
+		return false, err
+	}
+	s.logger.Error("Restored app hash does not match, refetching chunks with unexpected hashes",
+		"height", snapshot.Height, "format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash),
+		"chunks", suspects)
+	for _, index := range suspects {
+		sender := chunks.GetSender(index)
+		if err := chunks.Discard(index); err != nil {
+			return false, fmt.Errorf("failed to discard chunk %v: %w", index, err)
+		}
+		if sender != "" {
+			s.reputation.Failed(sender)
+		}
+		if err := s.currentBudget().Refetch(index, sender); err != nil {
+			return false, err
+		}
+		if err := s.spendRetry(retryReasonRefetch); err != nil {
+			return false, err
+		}
+	}
+	chunks.RetryAll()
+	if err := s.offerSnapshot(snapshot); err != nil {
+		return false, fmt.Errorf("failed to re-offer snapshot: %w", err)
+	}
+	s.markApplied()
+	return true, nil
+}
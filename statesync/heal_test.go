@@ -0,0 +1,122 @@
+package statesync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	"github.com/tendermint/tendermint/libs/log"
+	p2pmocks "github.com/tendermint/tendermint/p2p/mocks"
+	"github.com/tendermint/tendermint/proxy"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync/mocks"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestSyncer_Sync_healChunks(t *testing.T) {
+	blockID := types.BlockID{
+		Hash:          tmhash.Sum([]byte("block")),
+		PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte("parts"))},
+	}
+	valSet, commit := makeSignedCommit(t, "chain", 1, blockID)
+	state := sm.State{ChainID: "chain", LastBlockHeight: 1, LastBlockID: blockID, LastValidators: valSet}
+	s := &snapshot{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1, 2, 3}}
+	offer := abci.RequestOfferSnapshot{Snapshot: toABCI(s), AppHash: []byte("app_hash")}
+	accept := &abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}
+	verifier := sha256ChunkVerifier{}
+	hashes := [][]byte{verifier.Hash([]byte{1, 0}), verifier.Hash([]byte{1, 1})}
+
+	testcases := map[string]struct {
+		hashes    [][]byte
+		expectErr error
+	}{
+		"bad chunk is refetched": {hashes, nil},
+		"no chunk hashes":        {nil, errAppHashMismatch},
+		"no chunks responsible":  {[][]byte{hashes[0], verifier.Hash([]byte{9})}, errAppHashMismatch},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			stateProvider := &mocks.StateProvider{}
+			stateProvider.On("AppHash", mock.Anything, uint64(1)).Return([]byte("app_hash"), nil)
+			stateProvider.On("State", mock.Anything, uint64(1)).Return(state, nil)
+			stateProvider.On("Commit", mock.Anything, uint64(1)).Return(commit, nil)
+			connSnapshot := &proxymocks.AppConnSnapshot{}
+			connQuery := &proxymocks.AppConnQuery{}
+			syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery,
+				stateProvider, "", withChunkHashes(func(snapshot *abci.Snapshot) ([][]byte, error) {
+					assert.Equal(t, toABCI(s), snapshot)
+					return tc.hashes, nil
+				}))
+
+			// Peer a sent a bad chunk 1, which makes the app hash mismatch. Once healed, chunk 1
+			// is refetched from peer b, and the snapshot re-applied.
+			peerA := simplePeer("a")
+			peerA.On("Send", ChunkChannel, mock.Anything).Maybe().Return(true)
+			peerB := simplePeer("b")
+			peerB.On("Send", ChunkChannel, mock.Anything).Maybe().Run(func(args mock.Arguments) {
+				go func() {
+					_, err := syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 1, Chunk: []byte{1, 1}, Sender: "b"})
+					assert.NoError(t, err)
+				}()
+			}).Return(true)
+			for _, peer := range []*p2pmocks.Peer{peerA, peerB} {
+				_, err := syncer.AddSnapshot(peer, s)
+				require.NoError(t, err)
+			}
+
+			chunks, err := newChunkQueue(s, "")
+			require.NoError(t, err)
+			defer chunks.Close()
+			_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1, 0}, Sender: "a"})
+			require.NoError(t, err)
+			_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 1, Chunk: []byte{9}, Sender: "a"})
+			require.NoError(t, err)
+
+			healed := tc.expectErr == nil
+			offers := 1
+			if healed {
+				offers = 2
+			}
+			connSnapshot.On("OfferSnapshotSync", offer).Times(offers).Return(
+				&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+			connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+				Index: 0, Chunk: []byte{1, 0}, Sender: "a",
+			}).Times(offers).Return(accept, nil)
+			connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+				Index: 1, Chunk: []byte{9}, Sender: "a",
+			}).Once().Return(accept, nil)
+			connQuery.On("InfoSync", proxy.RequestInfo).Once().Return(&abci.ResponseInfo{
+				LastBlockHeight:  1,
+				LastBlockAppHash: []byte("bad_hash"),
+			}, nil)
+			if healed {
+				connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+					Index: 1, Chunk: []byte{1, 1}, Sender: "b",
+				}).Once().Return(accept, nil)
+				connQuery.On("InfoSync", proxy.RequestInfo).Once().Return(&abci.ResponseInfo{
+					LastBlockHeight:  1,
+					LastBlockAppHash: []byte("app_hash"),
+				}, nil)
+			}
+
+			_, _, err = syncer.Sync(s, chunks)
+			if tc.expectErr != nil {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, tc.expectErr))
+			} else {
+				require.NoError(t, err)
+				assert.True(t, syncer.budget.Refetched(1, "a"))
+			}
+			connSnapshot.AssertExpectations(t)
+			connQuery.AssertExpectations(t)
+		})
+	}
+}
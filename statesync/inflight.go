@@ -0,0 +1,119 @@
+package statesync
+
+import (
+	"sort"
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ChunkRequestInfo describes a chunk request in flight.
+type ChunkRequestInfo struct {
+	Index   uint32
+	Peer    p2p.ID        // the peer the chunk was requested from, or empty if there were no peers
+	Elapsed time.Duration // time since the chunk was requested
+}
+
+// inFlightRequest is a chunk request awaiting a response.
+type inFlightRequest struct {
+	peerID    p2p.ID
+	requested time.Time
+	abort     chan struct{} // closed when the request is aborted
+}
+
+// chunkRequests tracks the chunk requests in flight for a sync, such that operators can see which
+// peer each chunk is waiting on, and abort requests stuck on a flaky peer via AbortChunk(). Chunks
+// whose request was aborted are requested from other peers, if possible. A nil *chunkRequests
+// tracks nothing.
+type chunkRequests struct {
+	tmsync.Mutex
+	requests map[uint32]*inFlightRequest
+	aborted  map[uint32]map[p2p.ID]bool // peers whose requests were aborted, by chunk
+}
+
+// newChunkRequests creates a new chunk request tracker.
+func newChunkRequests() *chunkRequests {
+	return &chunkRequests{
+		requests: make(map[uint32]*inFlightRequest),
+		aborted:  make(map[uint32]map[p2p.ID]bool),
+	}
+}
+
+// Start records a chunk request to a peer, returning a channel which is closed if the request is
+// aborted. The caller must call Done() with the channel once the request completes.
+func (c *chunkRequests) Start(index uint32, peerID p2p.ID) <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	request := &inFlightRequest{peerID: peerID, requested: time.Now(), abort: make(chan struct{})}
+	c.requests[index] = request
+	return request.abort
+}
+
+// Done records the completion of the chunk request started with the given abort channel. It is a
+// noop if the request has since been aborted or superseded.
+func (c *chunkRequests) Done(index uint32, abort <-chan struct{}) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if request, ok := c.requests[index]; ok && (<-chan struct{})(request.abort) == abort {
+		delete(c.requests, index)
+	}
+}
+
+// Abort aborts the request in flight for a chunk, returning the peer it was requested from, or
+// false if the chunk has no request in flight.
+func (c *chunkRequests) Abort(index uint32) (p2p.ID, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.Lock()
+	defer c.Unlock()
+	request, ok := c.requests[index]
+	if !ok {
+		return "", false
+	}
+	delete(c.requests, index)
+	close(request.abort)
+	if request.peerID != "" {
+		if c.aborted[index] == nil {
+			c.aborted[index] = make(map[p2p.ID]bool)
+		}
+		c.aborted[index][request.peerID] = true
+	}
+	return request.peerID, true
+}
+
+// Aborted checks whether a request for a chunk to a peer has been aborted.
+func (c *chunkRequests) Aborted(index uint32, peerID p2p.ID) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.aborted[index][peerID]
+}
+
+// Inspect returns the chunk requests in flight, in index order.
+func (c *chunkRequests) Inspect() []ChunkRequestInfo {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	infos := make([]ChunkRequestInfo, 0, len(c.requests))
+	for index, request := range c.requests {
+		infos = append(infos, ChunkRequestInfo{
+			Index:   index,
+			Peer:    request.peerID,
+			Elapsed: time.Since(request.requested),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Index < infos[j].Index })
+	return infos
+}
@@ -0,0 +1,127 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	"github.com/tendermint/tendermint/statesync/mocks"
+)
+
+func TestChunkRequests(t *testing.T) {
+	var disabled *chunkRequests
+	assert.Nil(t, disabled.Start(0, "a"))
+	disabled.Done(0, nil)
+	_, ok := disabled.Abort(0)
+	assert.False(t, ok)
+	assert.False(t, disabled.Aborted(0, "a"))
+	assert.Empty(t, disabled.Inspect())
+
+	requests := newChunkRequests()
+	abort0 := requests.Start(0, "a")
+	abort2 := requests.Start(2, "b")
+	infos := requests.Inspect()
+	require.Len(t, infos, 2)
+	assert.Equal(t, uint32(0), infos[0].Index)
+	assert.Equal(t, p2p.ID("a"), infos[0].Peer)
+	assert.Equal(t, uint32(2), infos[1].Index)
+	assert.Equal(t, p2p.ID("b"), infos[1].Peer)
+
+	// Aborting a request closes its abort channel and records the peer.
+	peerID, ok := requests.Abort(0)
+	require.True(t, ok)
+	assert.Equal(t, p2p.ID("a"), peerID)
+	select {
+	case <-abort0:
+	default:
+		require.Fail(t, "abort channel not closed")
+	}
+	assert.True(t, requests.Aborted(0, "a"))
+	assert.False(t, requests.Aborted(0, "b"))
+	_, ok = requests.Abort(0)
+	assert.False(t, ok)
+
+	// Completing a superseded request leaves the new one in flight.
+	requests.Start(0, "b")
+	requests.Done(0, abort0)
+	requests.Done(2, abort2)
+	infos = requests.Inspect()
+	require.Len(t, infos, 1)
+	assert.Equal(t, p2p.ID("b"), infos[0].Peer)
+}
+
+func TestSyncer_AbortChunk(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, stateProvider, "")
+	assert.Error(t, syncer.AbortChunk(0))
+
+	var mtx tmsync.Mutex
+	requested := []p2p.ID{}
+	for _, id := range []string{"a", "b"} {
+		peer := simplePeer(id)
+		peerID := p2p.ID(id)
+		peer.On("Send", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
+			msg, err := decodeMsg(args[1].([]byte))
+			require.NoError(t, err)
+			require.IsType(t, &ssproto.ChunkRequest{}, msg)
+			mtx.Lock()
+			requested = append(requested, peerID)
+			mtx.Unlock()
+		}).Return(true)
+		_, err := syncer.AddSnapshot(peer, s)
+		require.NoError(t, err)
+	}
+	requestedFrom := func() []p2p.ID {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]p2p.ID{}, requested...)
+	}
+
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	syncer.chunks = chunks
+	syncer.requests = newChunkRequests()
+	assert.Error(t, syncer.AbortChunk(1))
+	assert.True(t, errors.Is(syncer.AbortChunk(0), errChunkNotInFlight))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go syncer.fetchChunks(ctx, s, chunks)
+	require.Eventually(t, func() bool { return len(syncer.State().ChunkRequests) == 1 }, time.Second,
+		10*time.Millisecond)
+	first := syncer.State().ChunkRequests[0]
+	assert.EqualValues(t, 0, first.Index)
+	assert.Equal(t, requestedFrom(), []p2p.ID{first.Peer})
+
+	// Aborting the request sends it to the other peer right away.
+	require.NoError(t, syncer.AbortChunk(0))
+	require.Eventually(t, func() bool { return len(requestedFrom()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, first.Peer, requestedFrom()[1])
+
+	// Received chunks can't be aborted.
+	_, err = syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}, Sender: requestedFrom()[1]})
+	require.NoError(t, err)
+	assert.True(t, errors.Is(syncer.AbortChunk(0), errChunkNotInFlight))
+	require.Eventually(t, func() bool { return len(syncer.State().ChunkRequests) == 0 }, time.Second,
+		10*time.Millisecond)
+}
+
+func TestReactor_AbortChunk(t *testing.T) {
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, &proxymocks.AppConnQuery{}, "")
+	assert.Error(t, r.AbortChunk(0))
+}
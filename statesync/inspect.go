@@ -0,0 +1,177 @@
+package statesync
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// SyncerState is a point-in-time view of the internal state of a state sync, e.g. for tests to
+// assert on after feeding it snapshots and chunks, or for diagnostics.
+type SyncerState struct {
+	// Snapshots is the catalog of discovered snapshots, as returned by Reactor.Snapshots().
+	Snapshots []SnapshotInfo
+	// Peers are the peers which have advertised usable snapshots, in ID order.
+	Peers []p2p.ID
+	// BannedPeers are the peers rejected by the app, in ID order. They are never used again.
+	BannedPeers []p2p.ID
+	// RejectedFormats are the snapshot formats rejected by the app, in ascending order.
+	RejectedFormats []uint32
+
+	// Restoring is the snapshot currently being restored, if any. The chunk fields below are empty
+	// if none is.
+	Restoring *SnapshotInfo
+	// ChunksPending are the chunks which have neither been allocated for fetching nor received.
+	ChunksPending []uint32
+	// ChunksInFlight are the chunks allocated for fetching which have not yet been received.
+	ChunksInFlight []uint32
+	// ChunkRequests are the chunk requests in flight, i.e. the chunks in ChunksInFlight which have
+	// been requested from a peer, along with the peer. These can be aborted via AbortChunk().
+	ChunkRequests []ChunkRequestInfo
+	// ChunksReceived are the chunks received and stored in the chunk queue.
+	ChunksReceived []uint32
+	// ChunksAccepted are the chunks accepted by the app.
+	ChunksAccepted []uint32
+	// ChunksFailed are the chunks which the app asked to refetch, e.g. because they failed
+	// verification, at least once.
+	ChunksFailed []uint32
+
+	// Progress is the progress made by the sync.
+	Progress SyncProgress
+	// Preview is the snapshot which would be selected for restoration if discovery ended now,
+	// along with the runners-up, while no snapshot is being restored. It is nil while restoring, or
+	// if no snapshots are known.
+	Preview *SelectDecision
+}
+
+// State returns a view of the syncer's internal state.
+func (s *syncer) State() SyncerState {
+	state := SyncerState{
+		Snapshots: s.snapshots.Catalog(),
+		Progress:  s.Progress(),
+	}
+	state.Peers, state.BannedPeers, state.RejectedFormats = s.snapshots.Inspect()
+
+	s.mtx.RLock()
+	chunks := s.chunks
+	budget := s.budget
+	requests := s.requests
+	s.mtx.RUnlock()
+	if chunks != nil {
+		if snapshot := chunks.Snapshot(); snapshot != nil {
+			info := s.snapshots.Info(snapshot)
+			state.Restoring = &info
+			state.ChunksPending, state.ChunksInFlight, state.ChunksReceived, state.ChunksAccepted =
+				chunks.Inspect()
+			state.ChunkRequests = requests.Inspect()
+			if budget != nil && budget.key == snapshot.Key() {
+				state.ChunksFailed = budget.RefetchedChunks()
+			}
+		}
+	}
+	if state.Restoring == nil {
+		state.Preview = s.snapshots.Preview()
+	}
+	return state
+}
+
+// Inspect returns the peers with usable snapshots, the banned peers, and the rejected formats.
+func (p *snapshotPool) Inspect() (peers []p2p.ID, banned []p2p.ID, formats []uint32) {
+	p.Lock()
+	defer p.Unlock()
+	for peerID := range p.peerIndex {
+		peers = append(peers, peerID)
+	}
+	for peerID := range p.peerBlacklist {
+		banned = append(banned, peerID)
+	}
+	for format := range p.formatBlacklist {
+		formats = append(formats, format)
+	}
+	sortPeerIDs(peers)
+	sortPeerIDs(banned)
+	sortUint32s(formats)
+	return peers, banned, formats
+}
+
+// Snapshot returns the queue's snapshot, or nil if the queue is closed.
+func (q *chunkQueue) Snapshot() *snapshot {
+	q.Lock()
+	defer q.Unlock()
+	return q.snapshot
+}
+
+// Inspect returns the chunks which are in flight, i.e. allocated but not received, the chunks
+// which have been received, and the chunks accepted by the app.
+func (q *chunkQueue) Inspect() (pending, inFlight, received, accepted []uint32) {
+	q.Lock()
+	defer q.Unlock()
+	if q.snapshot != nil {
+		for index := uint32(0); index < q.snapshot.Chunks; index++ {
+			if !q.chunkAllocated[index] && q.chunkFiles[index] == "" {
+				pending = append(pending, index)
+			}
+		}
+	}
+	for index := range q.chunkAllocated {
+		if q.chunkFiles[index] == "" {
+			inFlight = append(inFlight, index)
+		}
+	}
+	for index, path := range q.chunkFiles {
+		if path != "" {
+			received = append(received, index)
+		}
+	}
+	for index := range q.chunkAccepted {
+		accepted = append(accepted, index)
+	}
+	sortUint32s(inFlight)
+	sortUint32s(received)
+	sortUint32s(accepted)
+	return pending, inFlight, received, accepted
+}
+
+// RefetchedChunks returns the chunks which have been refetched at least once, in ascending order.
+func (b *retryBudget) RefetchedChunks() []uint32 {
+	b.Lock()
+	defer b.Unlock()
+	var indexes []uint32
+	for index := range b.refetches {
+		indexes = append(indexes, index)
+	}
+	sortUint32s(indexes)
+	return indexes
+}
+
+// verboseLogger is a logger which logs debug messages at info level while verbose logging is
+// enabled, such that per-chunk logging can be enabled at runtime, e.g. to debug a stuck state sync
+// without restarting the node with debug logging. See Reactor.SetChunkLogging().
+type verboseLogger struct {
+	log.Logger
+	verbose *int32 // non-zero while verbose logging is enabled, accessed atomically
+}
+
+// Debug implements log.Logger.
+func (l verboseLogger) Debug(msg string, keyvals ...interface{}) {
+	if l.verbose != nil && atomic.LoadInt32(l.verbose) != 0 {
+		l.Logger.Info(msg, keyvals...)
+		return
+	}
+	l.Logger.Debug(msg, keyvals...)
+}
+
+// With implements log.Logger.
+func (l verboseLogger) With(keyvals ...interface{}) log.Logger {
+	return verboseLogger{Logger: l.Logger.With(keyvals...), verbose: l.verbose}
+}
+
+func sortPeerIDs(ids []p2p.ID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+func sortUint32s(values []uint32) {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+}
@@ -0,0 +1,144 @@
+package statesync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+)
+
+func TestSyncer_State(t *testing.T) {
+	syncer, _ := setupOfferSyncer(t)
+	assert.Equal(t, SyncerState{Snapshots: []SnapshotInfo{}}, syncer.State())
+
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 4, Hash: []byte{1}}
+	s2 := &snapshot{Height: 2, Format: 2, Chunks: 3, Hash: []byte{2}}
+	for _, id := range []string{"c", "a", "b"} {
+		_, err := syncer.AddSnapshot(simplePeer(id), s1)
+		require.NoError(t, err)
+	}
+	_, err := syncer.AddSnapshot(simplePeer("a"), s2)
+	require.NoError(t, err)
+	syncer.snapshots.RejectFormat(2)
+	syncer.snapshots.RejectPeer("b")
+
+	// Restore s1, with chunk 0 accepted, chunk 1 received after a refetch, chunk 2 in flight and
+	// chunk 3 pending.
+	chunks, err := newChunkQueue(s1, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { chunks.Close() })
+	syncer.chunks = chunks
+	for i := 0; i < 3; i++ {
+		_, err := chunks.Allocate()
+		require.NoError(t, err)
+	}
+	for _, index := range []uint32{0, 1} {
+		added, err := syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: index, Chunk: []byte{1}, Sender: "a"})
+		require.NoError(t, err)
+		assert.True(t, added)
+	}
+	chunks.Accept(0)
+	syncer.budget = newRetryBudget(s1, 0, 0)
+	require.NoError(t, syncer.budget.Refetch(1, "a"))
+
+	state := syncer.State()
+	assert.Equal(t, []p2p.ID{"a", "c"}, state.Peers)
+	assert.Equal(t, []p2p.ID{"b"}, state.BannedPeers)
+	assert.Equal(t, []uint32{2}, state.RejectedFormats)
+	require.Len(t, state.Snapshots, 2)
+	assert.Equal(t, RejectReasonFormat, state.Snapshots[1].Rejected)
+	assert.Equal(t, &SnapshotInfo{Height: 1, Format: 1, Chunks: 4, Hash: []byte{1}, Peers: 2}, state.Restoring)
+	assert.Equal(t, []uint32{3}, state.ChunksPending)
+	assert.Equal(t, []uint32{2}, state.ChunksInFlight)
+	assert.Equal(t, []uint32{0, 1}, state.ChunksReceived)
+	assert.Equal(t, []uint32{0}, state.ChunksAccepted)
+	assert.Equal(t, []uint32{1}, state.ChunksFailed)
+
+	// The chunk fields are cleared once the chunk queue is closed.
+	require.NoError(t, chunks.Close())
+	state = syncer.State()
+	assert.Nil(t, state.Restoring)
+	assert.Nil(t, state.ChunksReceived)
+	assert.Nil(t, state.ChunksFailed)
+}
+
+func TestSyncer_State_preview(t *testing.T) {
+	syncer, _ := setupOfferSyncer(t)
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}
+	_, err := syncer.AddSnapshot(simplePeer("a"), s1)
+	require.NoError(t, err)
+
+	// The preview follows the snapshots discovered so far, without selecting any of them.
+	preview := syncer.State().Preview
+	require.NotNil(t, preview)
+	assert.EqualValues(t, 1, preview.Selected.Height)
+	assert.Equal(t, SelectReasonOnly, preview.Reason)
+
+	_, err = syncer.AddSnapshot(simplePeer("b"), s2)
+	require.NoError(t, err)
+	preview = syncer.State().Preview
+	require.NotNil(t, preview)
+	assert.EqualValues(t, 2, preview.Selected.Height)
+	assert.Equal(t, SelectReasonHeight, preview.Reason)
+	require.Len(t, preview.RunnersUp, 1)
+	assert.EqualValues(t, 1, preview.RunnersUp[0].Height)
+	assert.Equal(t, 2, preview.Candidates)
+	assert.Len(t, syncer.snapshots.Ranked(), 2)
+	assert.Nil(t, syncer.Progress().Selection)
+
+	// There's no preview while restoring.
+	chunks, err := newChunkQueue(s2, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { chunks.Close() })
+	syncer.chunks = chunks
+	assert.Nil(t, syncer.State().Preview)
+}
+
+func TestReactor_SetChunkLogging(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, nil, "")
+	r.SetLogger(log.NewFilter(log.NewTMLogger(buf), log.AllowInfo()))
+	syncer := newSyncer(r.config, r.Logger, nil, nil, nil, "", r.syncerOptions...)
+	assert.False(t, r.ChunkLogging())
+
+	// Per-chunk debug messages are only logged at info level while verbose chunk logging is enabled,
+	// including by syncers started before it was enabled.
+	syncer.chunkLogger().Debug("Requesting snapshot chunk")
+	r.chunkLogger().With("module", "statesync").Debug("Sending chunk")
+	assert.Empty(t, buf.String())
+
+	r.SetChunkLogging(true)
+	assert.True(t, r.ChunkLogging())
+	buf.Reset()
+	syncer.chunkLogger().Debug("Requesting snapshot chunk")
+	r.chunkLogger().With("module", "statesync").Debug("Sending chunk")
+	assert.Contains(t, buf.String(), "Requesting snapshot chunk")
+	assert.Contains(t, buf.String(), "Sending chunk")
+	assert.Contains(t, buf.String(), "module=statesync")
+
+	r.SetChunkLogging(false)
+	buf.Reset()
+	syncer.chunkLogger().Debug("Requesting snapshot chunk")
+	assert.Empty(t, buf.String())
+}
+
+func TestReactor_SyncerState(t *testing.T) {
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, nil, "")
+	_, ok := r.SyncerState()
+	assert.False(t, ok)
+
+	syncer, _ := setupOfferSyncer(t)
+	r.syncer = syncer
+	_, err := syncer.AddSnapshot(simplePeer("a"), &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}})
+	require.NoError(t, err)
+	state, ok := r.SyncerState()
+	assert.True(t, ok)
+	assert.Equal(t, []p2p.ID{"a"}, state.Peers)
+}
@@ -0,0 +1,84 @@
+package statesync
+
+import (
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// latencyWeight is the weight given to each new chunk fetch time in a peer's latency estimate.
+const latencyWeight = 0.2
+
+// peerLatencies estimates the latency of peers as an exponentially weighted moving average of the
+// time taken to fetch chunks from them. The estimates are retained across state syncs while peers
+// stay connected. A nil *peerLatencies has no estimates.
+type peerLatencies struct {
+	tmsync.Mutex
+	estimates map[p2p.ID]time.Duration
+}
+
+// newPeerLatencies creates a new peer latency estimator.
+func newPeerLatencies() *peerLatencies {
+	return &peerLatencies{
+		estimates: make(map[p2p.ID]time.Duration),
+	}
+}
+
+// Observe records the time taken to fetch a chunk from a peer.
+func (l *peerLatencies) Observe(peerID p2p.ID, fetchTime time.Duration) {
+	if l == nil || peerID == "" {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	estimate, ok := l.estimates[peerID]
+	if !ok {
+		l.estimates[peerID] = fetchTime
+		return
+	}
+	l.estimates[peerID] = estimate + time.Duration(latencyWeight*float64(fetchTime-estimate))
+}
+
+// Estimate returns the latency estimate of a peer, if any.
+func (l *peerLatencies) Estimate(peerID p2p.ID) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.Lock()
+	defer l.Unlock()
+	estimate, ok := l.estimates[peerID]
+	return estimate, ok
+}
+
+// Mean returns the mean latency estimate of the given peers, ignoring peers without estimates. It
+// returns false if none of the peers have estimates.
+func (l *peerLatencies) Mean(peerIDs []p2p.ID) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.Lock()
+	defer l.Unlock()
+	var sum time.Duration
+	count := 0
+	for _, peerID := range peerIDs {
+		if estimate, ok := l.estimates[peerID]; ok {
+			sum += estimate
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return sum / time.Duration(count), true
+}
+
+// RemovePeer forgets a peer's latency estimate.
+func (l *peerLatencies) RemovePeer(peerID p2p.ID) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	delete(l.estimates, peerID)
+}
@@ -0,0 +1,46 @@
+package statesync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+func TestPeerLatencies(t *testing.T) {
+	l := newPeerLatencies()
+	_, ok := l.Estimate("a")
+	assert.False(t, ok)
+
+	// The first observation is the initial estimate, later ones are weighted in.
+	l.Observe("a", 100*time.Millisecond)
+	l.Observe("a", 600*time.Millisecond)
+	estimate, ok := l.Estimate("a")
+	assert.True(t, ok)
+	assert.Equal(t, 200*time.Millisecond, estimate)
+
+	// Observations without a sender are ignored.
+	l.Observe("", time.Second)
+	_, ok = l.Estimate("")
+	assert.False(t, ok)
+
+	// The mean ignores peers without estimates.
+	l.Observe("b", 400*time.Millisecond)
+	mean, ok := l.Mean([]p2p.ID{"a", "b", "c"})
+	assert.True(t, ok)
+	assert.Equal(t, 300*time.Millisecond, mean)
+	_, ok = l.Mean([]p2p.ID{"c"})
+	assert.False(t, ok)
+
+	l.RemovePeer("a")
+	_, ok = l.Estimate("a")
+	assert.False(t, ok)
+
+	// A nil estimator has no estimates.
+	var nilLatencies *peerLatencies
+	nilLatencies.Observe("a", time.Second)
+	_, ok = nilLatencies.Mean([]p2p.ID{"a"})
+	assert.False(t, ok)
+}
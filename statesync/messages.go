@@ -3,9 +3,12 @@ package statesync
 import (
 	"errors"
 	"fmt"
+	"math"
 
 	"github.com/gogo/protobuf/proto"
 
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto/ed25519"
 	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
 )
 
@@ -14,8 +17,29 @@ const (
 	snapshotMsgSize = int(4e6)
 	// chunkMsgSize is the maximum size of a chunkResponseMessage
 	chunkMsgSize = int(16e6)
+	// maxSnapshotHeight is the maximum snapshot height. Block heights are int64, and restoring a
+	// snapshot requires the light blocks at the two following heights.
+	maxSnapshotHeight = uint64(math.MaxInt64 - 2)
 )
 
+// maxChunkSize returns the maximum size of received chunks, as configured and capped by the chunk
+// channel's maximum message size.
+func maxChunkSize(config *cfg.StateSyncConfig) int {
+	if config != nil && config.MaxChunkBytes > 0 && config.MaxChunkBytes < chunkMsgSize {
+		return config.MaxChunkBytes
+	}
+	return chunkMsgSize
+}
+
+// maxMetadataSize returns the maximum size of snapshot metadata, as configured and capped by the
+// snapshot channel's maximum message size.
+func maxMetadataSize(config *cfg.StateSyncConfig) int {
+	if config != nil && config.MaxMetadataBytes > 0 && config.MaxMetadataBytes < snapshotMsgSize {
+		return config.MaxMetadataBytes
+	}
+	return snapshotMsgSize
+}
+
 // mustEncodeMsg encodes a Protobuf message, panicing on error.
 func mustEncodeMsg(pb proto.Message) []byte {
 	msg := ssproto.Message{}
@@ -28,6 +52,8 @@ func mustEncodeMsg(pb proto.Message) []byte {
 		msg.Sum = &ssproto.Message_SnapshotsRequest{SnapshotsRequest: pb}
 	case *ssproto.SnapshotsResponse:
 		msg.Sum = &ssproto.Message_SnapshotsResponse{SnapshotsResponse: pb}
+	case *ssproto.Hello:
+		msg.Sum = &ssproto.Message_Hello{Hello: pb}
 	default:
 		panic(fmt.Errorf("unknown message type %T", pb))
 	}
@@ -54,35 +80,53 @@ func decodeMsg(bz []byte) (proto.Message, error) {
 		return msg.SnapshotsRequest, nil
 	case *ssproto.Message_SnapshotsResponse:
 		return msg.SnapshotsResponse, nil
+	case *ssproto.Message_Hello:
+		return msg.Hello, nil
 	default:
-		return nil, fmt.Errorf("unknown message type %T", msg)
+		return nil, fmt.Errorf("%w %T", errUnknownMessage, msg)
 	}
 }
 
-// validateMsg validates a message.
-func validateMsg(pb proto.Message) error {
+// validateMsg validates a message, using the size limits of the given config if any.
+func validateMsg(pb proto.Message, config *cfg.StateSyncConfig) error {
 	if pb == nil {
 		return errors.New("message cannot be nil")
 	}
 	switch msg := pb.(type) {
 	case *ssproto.ChunkRequest:
-		if msg.Height == 0 {
-			return errors.New("height cannot be 0")
+		if err := validateHeight(msg.Height); err != nil {
+			return err
 		}
 	case *ssproto.ChunkResponse:
-		if msg.Height == 0 {
-			return errors.New("height cannot be 0")
+		if err := validateHeight(msg.Height); err != nil {
+			return err
 		}
 		if msg.Missing && len(msg.Chunk) > 0 {
 			return errors.New("missing chunk cannot have contents")
 		}
+		if len(msg.Chunk) > chunkMsgSize {
+			return fmt.Errorf("%w: %v bytes exceeds limit %v", errChunkTooLarge, len(msg.Chunk), chunkMsgSize)
+		}
 		if !msg.Missing && msg.Chunk == nil {
 			return errors.New("chunk cannot be nil")
 		}
+		if msg.Missing && len(msg.Proof) > 0 {
+			return errors.New("missing chunk cannot have a proof")
+		}
+		if len(msg.Proof) > maxChunkProofSize {
+			return fmt.Errorf("chunk proof of %v bytes exceeds limit %v", len(msg.Proof), maxChunkProofSize)
+		}
 	case *ssproto.SnapshotsRequest:
+		if msg.Hello != nil {
+			if err := validateHello(msg.Hello); err != nil {
+				return fmt.Errorf("invalid hello: %w", err)
+			}
+		}
+	case *ssproto.Hello:
+		return validateHello(msg)
 	case *ssproto.SnapshotsResponse:
-		if msg.Height == 0 {
-			return errors.New("height cannot be 0")
+		if err := validateHeight(msg.Height); err != nil {
+			return err
 		}
 		if len(msg.Hash) == 0 {
 			return errors.New("snapshot has no hash")
@@ -90,8 +134,49 @@ func validateMsg(pb proto.Message) error {
 		if msg.Chunks == 0 {
 			return errors.New("snapshot has no chunks")
 		}
+		if msg.BaseHeight >= msg.Height {
+			return fmt.Errorf("diff snapshot base height %v must be below height %v", msg.BaseHeight,
+				msg.Height)
+		}
+		if max := maxMetadataSize(config); len(msg.Metadata) > max {
+			return fmt.Errorf("%w: %v bytes exceeds limit %v", errMetadataTooLarge, len(msg.Metadata), max)
+		}
+		if err := validateMetadata(msg.Metadata); err != nil {
+			return fmt.Errorf("invalid snapshot metadata: %w", err)
+		}
+		if (len(msg.Signature) == 0) != (len(msg.PubKey) == 0) {
+			return errors.New("snapshot signature and public key must be given together")
+		}
+		if len(msg.PubKey) > 0 && len(msg.PubKey) != ed25519.PubKeySize {
+			return fmt.Errorf("invalid snapshot public key size %v", len(msg.PubKey))
+		}
+		if len(msg.Signature) > 0 && len(msg.Signature) != ed25519.SignatureSize {
+			return fmt.Errorf("invalid snapshot signature size %v", len(msg.Signature))
+		}
 	default:
 		return fmt.Errorf("unknown message type %T", msg)
 	}
 	return nil
 }
+
+// validateHeight validates a snapshot height.
+func validateHeight(height uint64) error {
+	if height == 0 {
+		return errors.New("height cannot be 0")
+	}
+	if height > maxSnapshotHeight {
+		return fmt.Errorf("height %v exceeds maximum %v", height, maxSnapshotHeight)
+	}
+	return nil
+}
+
+// validateHello validates a Hello message.
+func validateHello(msg *ssproto.Hello) error {
+	if msg.Version == 0 {
+		return errors.New("protocol version cannot be 0")
+	}
+	if len(msg.Features) > maxHelloFeatures {
+		return fmt.Errorf("%v features exceeds limit %v", len(msg.Features), maxHelloFeatures)
+	}
+	return nil
+}
@@ -2,11 +2,13 @@ package statesync
 
 import (
 	"encoding/hex"
+	"math"
 	"testing"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/stretchr/testify/require"
 
+	"github.com/tendermint/tendermint/crypto/ed25519"
 	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
 	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
 )
@@ -23,6 +25,12 @@ func TestValidateMsg(t *testing.T) {
 		"ChunkRequest 0 height": {&ssproto.ChunkRequest{Height: 0, Format: 1, Index: 1}, false},
 		"ChunkRequest 0 format": {&ssproto.ChunkRequest{Height: 1, Format: 0, Index: 1}, true},
 		"ChunkRequest 0 chunk":  {&ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0}, true},
+		"ChunkRequest max height": {
+			&ssproto.ChunkRequest{Height: maxSnapshotHeight, Format: 1, Index: 1},
+			true},
+		"ChunkRequest overflowing height": {
+			&ssproto.ChunkRequest{Height: math.MaxUint64, Format: 1, Index: 1},
+			false},
 
 		"ChunkResponse valid": {
 			&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 1, Chunk: []byte{1}},
@@ -30,6 +38,9 @@ func TestValidateMsg(t *testing.T) {
 		"ChunkResponse 0 height": {
 			&ssproto.ChunkResponse{Height: 0, Format: 1, Index: 1, Chunk: []byte{1}},
 			false},
+		"ChunkResponse overflowing height": {
+			&ssproto.ChunkResponse{Height: math.MaxInt64, Format: 1, Index: 1, Chunk: []byte{1}},
+			false},
 		"ChunkResponse 0 format": {
 			&ssproto.ChunkResponse{Height: 1, Format: 0, Index: 1, Chunk: []byte{1}},
 			true},
@@ -51,8 +62,38 @@ func TestValidateMsg(t *testing.T) {
 		"ChunkResponse missing with body": {
 			&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 1, Missing: true, Chunk: []byte{1}},
 			false},
+		"ChunkResponse with proof": {
+			&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 1, Chunk: []byte{1}, Proof: []byte{1}},
+			true},
+		"ChunkResponse missing with proof": {
+			&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 1, Missing: true, Proof: []byte{1}},
+			false},
+		"ChunkResponse oversized proof": {
+			&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 1, Chunk: []byte{1},
+				Proof: make([]byte, maxChunkProofSize+1)},
+			false},
+		"ChunkResponse max size": {
+			&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 1, Chunk: make([]byte, chunkMsgSize)},
+			true},
+		"ChunkResponse oversized": {
+			&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 1, Chunk: make([]byte, chunkMsgSize+1)},
+			false},
 
 		"SnapshotsRequest valid": {&ssproto.SnapshotsRequest{}, true},
+		"SnapshotsRequest with hello": {
+			&ssproto.SnapshotsRequest{Hello: &ssproto.Hello{Version: 1, Features: []string{"a"}}},
+			true},
+		"SnapshotsRequest with invalid hello": {
+			&ssproto.SnapshotsRequest{Hello: &ssproto.Hello{Version: 0}},
+			false},
+
+		"Hello valid":        {&ssproto.Hello{Version: 1, Features: []string{"a", "b"}}, true},
+		"Hello no features":  {&ssproto.Hello{Version: 2}, true},
+		"Hello 0 version":    {&ssproto.Hello{Version: 0, Features: []string{"a"}}, false},
+		"Hello max features": {&ssproto.Hello{Version: 1, Features: make([]string, maxHelloFeatures)}, true},
+		"Hello too many features": {
+			&ssproto.Hello{Version: 1, Features: make([]string, maxHelloFeatures+1)},
+			false},
 
 		"SnapshotsResponse valid": {
 			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1}},
@@ -60,6 +101,16 @@ func TestValidateMsg(t *testing.T) {
 		"SnapshotsResponse 0 height": {
 			&ssproto.SnapshotsResponse{Height: 0, Format: 1, Chunks: 2, Hash: []byte{1}},
 			false},
+		"SnapshotsResponse max height": {
+			&ssproto.SnapshotsResponse{Height: maxSnapshotHeight, Format: 1, Chunks: 2, Hash: []byte{1}},
+			true},
+		"SnapshotsResponse height with overflowing successors": {
+			&ssproto.SnapshotsResponse{Height: maxSnapshotHeight + 1, Format: 1, Chunks: 2, Hash: []byte{1}},
+			false},
+		"SnapshotsResponse max uint64 height": {
+			&ssproto.SnapshotsResponse{Height: math.MaxUint64, Format: 1, Chunks: 2, Hash: []byte{1},
+				BaseHeight: math.MaxUint64 - 1},
+			false},
 		"SnapshotsResponse 0 format": {
 			&ssproto.SnapshotsResponse{Height: 1, Format: 0, Chunks: 2, Hash: []byte{1}},
 			true},
@@ -69,11 +120,48 @@ func TestValidateMsg(t *testing.T) {
 		"SnapshotsResponse no hash": {
 			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{}},
 			false},
+		"SnapshotsResponse raw metadata": {
+			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1}, Metadata: []byte{1, 2}},
+			true},
+		"SnapshotsResponse versioned metadata": {
+			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1},
+				Metadata: append(append([]byte{}, metadataMagic...), 0, 0, 0, 1, 0, 0, 0, 2, 7, 8)},
+			true},
+		"SnapshotsResponse corrupt versioned metadata": {
+			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1},
+				Metadata: append(append([]byte{}, metadataMagic...), 0, 0, 0, 1, 0, 0, 0, 9, 7, 8)},
+			false},
+		"SnapshotsResponse diff": {
+			&ssproto.SnapshotsResponse{Height: 2, Format: 1, Chunks: 2, Hash: []byte{1}, BaseHeight: 1},
+			true},
+		"SnapshotsResponse diff base height not below height": {
+			&ssproto.SnapshotsResponse{Height: 2, Format: 1, Chunks: 2, Hash: []byte{1}, BaseHeight: 2},
+			false},
+		"SnapshotsResponse signed": {
+			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1},
+				Signature: make([]byte, ed25519.SignatureSize), PubKey: make([]byte, ed25519.PubKeySize)},
+			true},
+		"SnapshotsResponse signature without public key": {
+			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1},
+				Signature: make([]byte, ed25519.SignatureSize)},
+			false},
+		"SnapshotsResponse public key without signature": {
+			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1},
+				PubKey: make([]byte, ed25519.PubKeySize)},
+			false},
+		"SnapshotsResponse invalid public key size": {
+			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1},
+				Signature: make([]byte, ed25519.SignatureSize), PubKey: []byte{1}},
+			false},
+		"SnapshotsResponse invalid signature size": {
+			&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1},
+				Signature: []byte{1}, PubKey: make([]byte, ed25519.PubKeySize)},
+			false},
 	}
 	for name, tc := range testcases {
 		tc := tc
 		t.Run(name, func(t *testing.T) {
-			err := validateMsg(tc.msg)
+			err := validateMsg(tc.msg, nil)
 			if tc.valid {
 				require.NoError(t, err)
 			} else {
@@ -92,9 +180,13 @@ func TestStateSyncVectors(t *testing.T) {
 		expBytes string
 	}{
 		{"SnapshotsRequest", &ssproto.SnapshotsRequest{}, "0a00"},
+		{"SnapshotsRequest with hello", &ssproto.SnapshotsRequest{Hello: &ssproto.Hello{Version: 1, Features: []string{"diff_snapshots"}}}, "0a140a120801120e646966665f736e617073686f7473"},
 		{"SnapshotsResponse", &ssproto.SnapshotsResponse{Height: 1, Format: 2, Chunks: 3, Hash: []byte("chuck hash"), Metadata: []byte("snapshot metadata")}, "1225080110021803220a636875636b20686173682a11736e617073686f74206d65746164617461"},
 		{"ChunkRequest", &ssproto.ChunkRequest{Height: 1, Format: 2, Index: 3}, "1a06080110021803"},
+		{"ChunkRequest with proof", &ssproto.ChunkRequest{Height: 1, Format: 2, Index: 3, Proof: true}, "1a080801100218032001"},
 		{"ChunkResponse", &ssproto.ChunkResponse{Height: 1, Format: 2, Index: 3, Chunk: []byte("it's a chunk")}, "2214080110021803220c697427732061206368756e6b"},
+		{"ChunkResponse with proof", &ssproto.ChunkResponse{Height: 1, Format: 2, Index: 3, Chunk: []byte("it's a chunk"), Proof: []byte("a proof")}, "221d080110021803220c697427732061206368756e6b3207612070726f6f66"},
+		{"Hello", &ssproto.Hello{Version: 1, Features: []string{"diff_snapshots"}}, "2a120801120e646966665f736e617073686f7473"},
 	}
 
 	for _, tc := range testCases {
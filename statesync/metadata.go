@@ -0,0 +1,171 @@
+package statesync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Snapshot metadata is opaque to Tendermint and interpreted by the app. Apps may optionally wrap
+// their metadata in a small versioned header, using EncodeSnapshotMetadata(), which allows the
+// reactor to reject obviously corrupt metadata as soon as a snapshot is advertised. Metadata
+// without the header is passed through unchecked.
+//
+// The header consists of the magic bytes, followed by the app's metadata schema version and the
+// payload length, both as big-endian uint32s.
+
+const (
+	// metadataMagicString is the prefix identifying versioned snapshot metadata. It starts with a
+	// null byte to make collisions with existing textual or protobuf-encoded metadata unlikely.
+	metadataMagicString = "\x00TMSM"
+	// metadataHeaderSize is the size of the versioned metadata header.
+	metadataHeaderSize = len(metadataMagicString) + 4 + 4
+)
+
+// metadataMagic is the metadata magic prefix as a byte slice.
+var metadataMagic = []byte(metadataMagicString)
+
+// EncodeSnapshotMetadata wraps a metadata payload in a versioned header. The version is the app's
+// metadata schema version, and must be non-zero.
+func EncodeSnapshotMetadata(version uint32, payload []byte) ([]byte, error) {
+	if version == 0 {
+		return nil, errors.New("metadata version cannot be 0")
+	}
+	if uint64(len(payload)) > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("metadata payload too large (%v bytes)", len(payload))
+	}
+	bz := make([]byte, metadataHeaderSize+len(payload))
+	n := copy(bz, metadataMagic)
+	binary.BigEndian.PutUint32(bz[n:], version)
+	binary.BigEndian.PutUint32(bz[n+4:], uint32(len(payload)))
+	copy(bz[metadataHeaderSize:], payload)
+	return bz, nil
+}
+
+// DecodeSnapshotMetadata decodes metadata encoded with EncodeSnapshotMetadata, returning the
+// version and payload. It returns an error if the metadata does not have a valid header.
+func DecodeSnapshotMetadata(metadata []byte) (uint32, []byte, error) {
+	if !HasVersionedMetadata(metadata) {
+		return 0, nil, errors.New("metadata does not have a versioned header")
+	}
+	if len(metadata) < metadataHeaderSize {
+		return 0, nil, fmt.Errorf("metadata header truncated, got %v bytes", len(metadata))
+	}
+	version := binary.BigEndian.Uint32(metadata[len(metadataMagic):])
+	if version == 0 {
+		return 0, nil, errors.New("metadata version cannot be 0")
+	}
+	size := binary.BigEndian.Uint32(metadata[len(metadataMagic)+4:])
+	payload := metadata[metadataHeaderSize:]
+	if uint64(len(payload)) != uint64(size) {
+		return 0, nil, fmt.Errorf("metadata payload size mismatch, header says %v bytes but got %v",
+			size, len(payload))
+	}
+	return version, payload, nil
+}
+
+// HasVersionedMetadata checks whether the metadata starts with a versioned header.
+func HasVersionedMetadata(metadata []byte) bool {
+	return bytes.HasPrefix(metadata, metadataMagic)
+}
+
+// Apps may also mark snapshots they recommend serving, e.g. the most recent snapshot that they
+// have verified, by wrapping the listed metadata with PreferSnapshotMetadata(). The reactor strips
+// the marker before advertising the snapshot, flagging the advertisement as preferred instead, such
+// that the metadata seen by syncing apps is unchanged. The hint is advisory: syncing nodes try
+// snapshots preferred by peers first, but fall back to other snapshots as usual.
+
+// preferredMagicString is the prefix marking a snapshot as preferred in listed metadata.
+const preferredMagicString = "\x00TMSP"
+
+// preferredMagic is the preferred marker prefix as a byte slice.
+var preferredMagic = []byte(preferredMagicString)
+
+// PreferSnapshotMetadata marks snapshot metadata, as returned in ListSnapshots, as preferred.
+func PreferSnapshotMetadata(metadata []byte) []byte {
+	if IsPreferredMetadata(metadata) {
+		return metadata
+	}
+	bz := make([]byte, len(preferredMagic)+len(metadata))
+	n := copy(bz, preferredMagic)
+	copy(bz[n:], metadata)
+	return bz
+}
+
+// IsPreferredMetadata checks whether the metadata has been marked as preferred.
+func IsPreferredMetadata(metadata []byte) bool {
+	return bytes.HasPrefix(metadata, preferredMagic)
+}
+
+// splitPreferredMetadata removes any preferred marker from the metadata, returning whether it was
+// present along with the original metadata.
+func splitPreferredMetadata(metadata []byte) (bool, []byte) {
+	if !IsPreferredMetadata(metadata) {
+		return false, metadata
+	}
+	metadata = metadata[len(preferredMagic):]
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	return true, metadata
+}
+
+// Apps that can produce differential snapshots, containing the changes from a base height to the
+// snapshot height, advertise them by wrapping the listed metadata with DiffSnapshotMetadata(). The
+// reactor strips the marker before advertising the snapshot, setting its base height instead.
+// Syncing nodes with diff_snapshots enabled only restore a diff if their app is already at its
+// base height, preferring it over full snapshots. When offered to the app, the diff's metadata is
+// wrapped again, such that the app can tell it apart from a full snapshot via
+// DecodeDiffSnapshotMetadata() and apply it on top of its existing state. Since chunks are
+// requested by snapshot height and format, diffs must use a different format than any full
+// snapshot at the same height.
+
+// diffMagicString is the prefix marking a snapshot as a diff in listed and offered metadata. It is
+// followed by the base height as a big-endian uint64.
+const diffMagicString = "\x00TMSD"
+
+// diffHeaderSize is the size of the diff marker, including the base height.
+const diffHeaderSize = len(diffMagicString) + 8
+
+// diffMagic is the diff marker prefix as a byte slice.
+var diffMagic = []byte(diffMagicString)
+
+// DiffSnapshotMetadata marks snapshot metadata as belonging to a differential snapshot, which
+// restores the snapshot height on top of the app state at the given base height. A base height of
+// 0 denotes a full snapshot, for which the metadata is returned unchanged.
+func DiffSnapshotMetadata(baseHeight uint64, metadata []byte) []byte {
+	if baseHeight == 0 {
+		return metadata
+	}
+	bz := make([]byte, diffHeaderSize+len(metadata))
+	n := copy(bz, diffMagic)
+	binary.BigEndian.PutUint64(bz[n:], baseHeight)
+	copy(bz[diffHeaderSize:], metadata)
+	return bz
+}
+
+// DecodeDiffSnapshotMetadata decodes metadata marked with DiffSnapshotMetadata(), returning the
+// base height and the original metadata. For metadata without a diff marker, it returns a base
+// height of 0 and the metadata unchanged.
+func DecodeDiffSnapshotMetadata(metadata []byte) (uint64, []byte) {
+	if !bytes.HasPrefix(metadata, diffMagic) || len(metadata) < diffHeaderSize {
+		return 0, metadata
+	}
+	baseHeight := binary.BigEndian.Uint64(metadata[len(diffMagic):])
+	metadata = metadata[diffHeaderSize:]
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	return baseHeight, metadata
+}
+
+// validateMetadata sanity-checks snapshot metadata. Metadata without a versioned header is
+// always considered valid.
+func validateMetadata(metadata []byte) error {
+	if !HasVersionedMetadata(metadata) {
+		return nil
+	}
+	_, _, err := DecodeSnapshotMetadata(metadata)
+	return err
+}
@@ -0,0 +1,98 @@
+package statesync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotMetadata(t *testing.T) {
+	bz, err := EncodeSnapshotMetadata(3, []byte("payload"))
+	require.NoError(t, err)
+	assert.True(t, HasVersionedMetadata(bz))
+	assert.Len(t, bz, metadataHeaderSize+7)
+
+	version, payload, err := DecodeSnapshotMetadata(bz)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, version)
+	assert.Equal(t, []byte("payload"), payload)
+
+	_, err = EncodeSnapshotMetadata(0, []byte("payload"))
+	require.Error(t, err)
+}
+
+func TestPreferSnapshotMetadata(t *testing.T) {
+	versioned, err := EncodeSnapshotMetadata(1, []byte{1, 2, 3})
+	require.NoError(t, err)
+
+	for _, metadata := range [][]byte{nil, []byte("raw metadata"), versioned} {
+		preferred := PreferSnapshotMetadata(metadata)
+		assert.True(t, IsPreferredMetadata(preferred))
+		assert.Equal(t, preferred, PreferSnapshotMetadata(preferred))
+
+		ok, stripped := splitPreferredMetadata(preferred)
+		assert.True(t, ok)
+		assert.Equal(t, metadata, stripped)
+
+		ok, stripped = splitPreferredMetadata(metadata)
+		assert.False(t, ok)
+		assert.Equal(t, metadata, stripped)
+	}
+}
+
+func TestDiffSnapshotMetadata(t *testing.T) {
+	for _, metadata := range [][]byte{nil, []byte("raw metadata")} {
+		diff := DiffSnapshotMetadata(7, metadata)
+		baseHeight, stripped := DecodeDiffSnapshotMetadata(diff)
+		assert.EqualValues(t, 7, baseHeight)
+		assert.Equal(t, metadata, stripped)
+
+		// Full snapshots have no diff marker.
+		assert.Equal(t, metadata, DiffSnapshotMetadata(0, metadata))
+		baseHeight, stripped = DecodeDiffSnapshotMetadata(metadata)
+		assert.Zero(t, baseHeight)
+		assert.Equal(t, metadata, stripped)
+	}
+
+	// Markers can be combined with preferred hints.
+	preferred, metadata := splitPreferredMetadata(PreferSnapshotMetadata(DiffSnapshotMetadata(3, []byte{1})))
+	assert.True(t, preferred)
+	baseHeight, metadata := DecodeDiffSnapshotMetadata(metadata)
+	assert.EqualValues(t, 3, baseHeight)
+	assert.Equal(t, []byte{1}, metadata)
+}
+
+func TestValidateMetadata(t *testing.T) {
+	valid, err := EncodeSnapshotMetadata(1, []byte{1, 2, 3})
+	require.NoError(t, err)
+	empty, err := EncodeSnapshotMetadata(1, nil)
+	require.NoError(t, err)
+
+	testcases := map[string]struct {
+		metadata []byte
+		valid    bool
+	}{
+		"nil":               {nil, true},
+		"raw":               {[]byte("raw metadata"), true},
+		"versioned":         {valid, true},
+		"versioned empty":   {empty, true},
+		"magic only":        {metadataMagic, false},
+		"truncated header":  {valid[:metadataHeaderSize-1], false},
+		"truncated payload": {valid[:len(valid)-1], false},
+		"trailing garbage":  {append(append([]byte{}, valid...), 9), false},
+		"zero version": {
+			append(append([]byte{}, metadataMagic...), 0, 0, 0, 0, 0, 0, 0, 0), false},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			err := validateMetadata(tc.metadata)
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
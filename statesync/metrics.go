@@ -0,0 +1,307 @@
+package statesync
+
+import (
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// MetricsSubsystem is a subsystem shared by all metrics exposed by this
+	// package.
+	MetricsSubsystem = "statesync"
+)
+
+// Metrics contains metrics exposed by this package.
+type Metrics struct {
+	// Number of duplicate chunks received, e.g. when several peers answer a retried request.
+	DuplicateChunks metrics.Counter
+	// Total size of duplicate chunks received, in bytes.
+	DuplicateChunkBytes metrics.Counter
+	// Number of chunk retries, by reason.
+	ChunkRetries metrics.Counter
+	// Number of snapshots rejected after exhausting their chunk retry budget.
+	RetryBudgetExhausted metrics.Counter
+	// Number of chunks rejected for failing verification against their proof.
+	InvalidChunkProofs metrics.Counter
+	// Number of served snapshots detected to be incomplete, i.e. missing chunks.
+	IncompleteSnapshots metrics.Counter
+	// Number of chunks discarded because they arrived shortly after a state sync completed.
+	StragglerChunks metrics.Counter
+	// Number of chunk requests awaiting a response.
+	ChunkRequestsInFlight metrics.Gauge
+	// Time from requesting a chunk until it is received, in seconds.
+	ChunkFetchTime metrics.Histogram
+	// Time from receiving a chunk until the app starts applying it, in seconds.
+	ChunkQueueTime metrics.Histogram
+	// Time taken by the app to apply a chunk, in seconds.
+	ChunkApplyTime metrics.Histogram
+	// Number of chunks which took the app much longer to apply than previous chunks.
+	SlowChunkApplies metrics.Counter
+	// Number of snapshot states reused from a previous verification, rather than verified again.
+	VerificationCacheHits metrics.Counter
+	// Number of snapshot states verified via the state provider, with the verification cache enabled.
+	VerificationCacheMisses metrics.Counter
+	// Number of snapshot and chunk requests served, by peer.
+	ServedRequests metrics.Counter
+	// Number of snapshot requests which found no local snapshots to advertise.
+	EmptySnapshotRequests metrics.Counter
+	// Number of snapshot and chunk requests dropped because the peer's serving queue was full.
+	DroppedServingRequests metrics.Counter
+	// Time from queueing a snapshot or chunk request until it is served, in seconds, by peer.
+	ServingQueueTime metrics.Histogram
+	// Number of chunk responses which found the peer's chunk send queue full, by peer.
+	ChunkSendQueueFull metrics.Counter
+	// Number of chunk responses dropped because they couldn't be queued for sending, by peer.
+	DroppedChunkResponses metrics.Counter
+	// Size of chunks served to peers, in bytes.
+	ServedChunkSize metrics.Histogram
+	// Total size of chunks served to peers, in bytes, by snapshot height.
+	ServedChunkBytes metrics.Counter
+	// Number of local snapshots pruned under the retention policy.
+	PrunedSnapshots metrics.Counter
+	// Number of snapshot and chunk requests received from peers, by type.
+	ServeRequests metrics.Counter
+	// Number of chunks served to peers.
+	ServedChunks metrics.Counter
+	// Number of chunks restored, i.e. accepted by the app.
+	RestoredChunks metrics.Counter
+	// Total size of chunks restored, in bytes.
+	RestoredChunkBytes metrics.Counter
+	// Rate chunks have been restored at since the current restore started applying them, in
+	// bytes/second.
+	RestoreThroughput metrics.Gauge
+	// Number of snapshot advertisements skipped as identical to ones recently processed from the
+	// same peer.
+	RedundantSnapshots metrics.Counter
+}
+
+// PrometheusMetrics returns Metrics build using Prometheus client library.
+// Optionally, labels can be provided along with their values ("foo",
+// "fooValue").
+func PrometheusMetrics(namespace string, labelsAndValues ...string) *Metrics {
+	labels := []string{}
+	for i := 0; i < len(labelsAndValues); i += 2 {
+		labels = append(labels, labelsAndValues[i])
+	}
+	return &Metrics{
+		DuplicateChunks: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "duplicate_chunks",
+			Help:      "Number of duplicate snapshot chunks received.",
+		}, labels).With(labelsAndValues...),
+		DuplicateChunkBytes: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "duplicate_chunk_bytes",
+			Help:      "Total size of duplicate snapshot chunks received, in bytes.",
+		}, labels).With(labelsAndValues...),
+		ChunkRetries: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "chunk_retries",
+			Help:      "Number of snapshot chunk retries, by reason.",
+		}, append(labels, "reason")).With(labelsAndValues...),
+		RetryBudgetExhausted: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "retry_budget_exhausted",
+			Help:      "Number of snapshots rejected after exhausting their chunk retry budget.",
+		}, labels).With(labelsAndValues...),
+		InvalidChunkProofs: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "invalid_chunk_proofs",
+			Help:      "Number of chunks rejected for failing verification against their proof.",
+		}, labels).With(labelsAndValues...),
+		IncompleteSnapshots: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "incomplete_snapshots",
+			Help:      "Number of served snapshots detected to be missing chunks.",
+		}, labels).With(labelsAndValues...),
+		StragglerChunks: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "straggler_chunks",
+			Help:      "Number of chunks discarded because they arrived shortly after a state sync completed.",
+		}, labels).With(labelsAndValues...),
+		ChunkRequestsInFlight: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "chunk_requests_in_flight",
+			Help:      "Number of snapshot chunk requests awaiting a response.",
+		}, labels).With(labelsAndValues...),
+		ChunkFetchTime: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "chunk_fetch_time",
+			Help:      "Time from requesting a snapshot chunk until it is received, in seconds.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.01, 2, 12),
+		}, labels).With(labelsAndValues...),
+		ChunkQueueTime: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "chunk_queue_time",
+			Help:      "Time from receiving a snapshot chunk until the app starts applying it, in seconds.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.01, 2, 12),
+		}, labels).With(labelsAndValues...),
+		ChunkApplyTime: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "chunk_apply_time",
+			Help:      "Time taken by the app to apply a snapshot chunk, in seconds.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.01, 2, 12),
+		}, labels).With(labelsAndValues...),
+		SlowChunkApplies: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "slow_chunk_applies",
+			Help:      "Number of snapshot chunks which took the app much longer to apply than previous chunks.",
+		}, labels).With(labelsAndValues...),
+		VerificationCacheHits: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "verification_cache_hits",
+			Help:      "Number of snapshot states reused from a previous verification.",
+		}, labels).With(labelsAndValues...),
+		VerificationCacheMisses: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "verification_cache_misses",
+			Help:      "Number of snapshot states verified via the state provider.",
+		}, labels).With(labelsAndValues...),
+		ServedRequests: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "served_requests",
+			Help:      "Number of snapshot and chunk requests served, by peer.",
+		}, append(labels, "peer_id")).With(labelsAndValues...),
+		EmptySnapshotRequests: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "empty_snapshot_requests",
+			Help:      "Number of snapshot requests which found no local snapshots to advertise.",
+		}, labels).With(labelsAndValues...),
+		DroppedServingRequests: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "dropped_serving_requests",
+			Help:      "Number of snapshot and chunk requests dropped due to a full serving queue, by peer.",
+		}, append(labels, "peer_id")).With(labelsAndValues...),
+		ServingQueueTime: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "serving_queue_time",
+			Help:      "Time from queueing a snapshot or chunk request until it is served, in seconds, by peer.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.01, 2, 12),
+		}, append(labels, "peer_id")).With(labelsAndValues...),
+		ChunkSendQueueFull: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "chunk_send_queue_full",
+			Help:      "Number of chunk responses which found the peer's chunk send queue full, by peer.",
+		}, append(labels, "peer_id")).With(labelsAndValues...),
+		DroppedChunkResponses: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "dropped_chunk_responses",
+			Help:      "Number of chunk responses dropped because they couldn't be queued for sending, by peer.",
+		}, append(labels, "peer_id")).With(labelsAndValues...),
+		ServedChunkSize: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "served_chunk_size",
+			Help:      "Size of snapshot chunks served to peers, in bytes.",
+			Buckets:   stdprometheus.ExponentialBuckets(1024, 4, 8),
+		}, labels).With(labelsAndValues...),
+		ServedChunkBytes: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "served_chunk_bytes",
+			Help:      "Total size of snapshot chunks served to peers, in bytes, by snapshot height.",
+		}, append(labels, "height")).With(labelsAndValues...),
+		PrunedSnapshots: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "pruned_snapshots",
+			Help:      "Number of local snapshots pruned under the retention policy.",
+		}, labels).With(labelsAndValues...),
+		ServeRequests: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "serve_requests",
+			Help:      "Number of snapshot and chunk requests received from peers, by type.",
+		}, append(labels, "type")).With(labelsAndValues...),
+		ServedChunks: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "served_chunks",
+			Help:      "Number of snapshot chunks served to peers.",
+		}, labels).With(labelsAndValues...),
+		RestoredChunks: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "restored_chunks",
+			Help:      "Number of snapshot chunks restored, i.e. accepted by the app.",
+		}, labels).With(labelsAndValues...),
+		RestoredChunkBytes: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "restored_chunk_bytes",
+			Help:      "Total size of snapshot chunks restored, in bytes.",
+		}, labels).With(labelsAndValues...),
+		RestoreThroughput: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "restore_throughput",
+			Help:      "Rate snapshot chunks have been restored at during the current restore, in bytes/second.",
+		}, labels).With(labelsAndValues...),
+		RedundantSnapshots: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "redundant_snapshots",
+			Help:      "Number of snapshot advertisements skipped as identical to ones recently processed from the same peer.",
+		}, labels).With(labelsAndValues...),
+	}
+}
+
+// NopMetrics returns no-op Metrics.
+func NopMetrics() *Metrics {
+	return &Metrics{
+		DuplicateChunks:      discard.NewCounter(),
+		DuplicateChunkBytes:  discard.NewCounter(),
+		ChunkRetries:         discard.NewCounter(),
+		RetryBudgetExhausted: discard.NewCounter(),
+		InvalidChunkProofs:   discard.NewCounter(),
+		IncompleteSnapshots:  discard.NewCounter(),
+		StragglerChunks:      discard.NewCounter(),
+
+		ChunkRequestsInFlight: discard.NewGauge(),
+		ChunkFetchTime:        discard.NewHistogram(),
+		ChunkQueueTime:        discard.NewHistogram(),
+		ChunkApplyTime:        discard.NewHistogram(),
+		SlowChunkApplies:      discard.NewCounter(),
+
+		VerificationCacheHits:   discard.NewCounter(),
+		VerificationCacheMisses: discard.NewCounter(),
+
+		ServedRequests:         discard.NewCounter(),
+		EmptySnapshotRequests:  discard.NewCounter(),
+		DroppedServingRequests: discard.NewCounter(),
+		ServingQueueTime:       discard.NewHistogram(),
+		ChunkSendQueueFull:     discard.NewCounter(),
+		DroppedChunkResponses:  discard.NewCounter(),
+		ServedChunkSize:        discard.NewHistogram(),
+		ServedChunkBytes:       discard.NewCounter(),
+		PrunedSnapshots:        discard.NewCounter(),
+		ServeRequests:          discard.NewCounter(),
+		ServedChunks:           discard.NewCounter(),
+		RestoredChunks:         discard.NewCounter(),
+		RestoredChunkBytes:     discard.NewCounter(),
+		RestoreThroughput:      discard.NewGauge(),
+		RedundantSnapshots:     discard.NewCounter(),
+	}
+}
@@ -0,0 +1,104 @@
+package statesync
+
+import (
+	"fmt"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+)
+
+// chunkCache holds the chunks of pinned snapshots in memory, such that they can be served to
+// peers without loading them from the app. This avoids latency spikes when many nodes state sync
+// the same snapshot at once, e.g. during network-wide restarts. Pinned chunks are kept until the
+// snapshot is explicitly unpinned, so operators should take care to only pin snapshots that fit
+// comfortably in memory.
+type chunkCache struct {
+	tmsync.RWMutex
+	chunks map[servedSnapshot][][]byte
+}
+
+// newChunkCache creates a new, empty chunk cache.
+func newChunkCache() *chunkCache {
+	return &chunkCache{
+		chunks: make(map[servedSnapshot][][]byte),
+	}
+}
+
+// Get fetches a cached chunk, if the snapshot is pinned.
+func (c *chunkCache) Get(height uint64, format uint32, index uint32) ([]byte, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	chunks, ok := c.chunks[servedSnapshot{Height: height, Format: format}]
+	if !ok || index >= uint32(len(chunks)) {
+		return nil, false
+	}
+	return chunks[index], true
+}
+
+// Has checks whether a snapshot is pinned.
+func (c *chunkCache) Has(height uint64, format uint32) bool {
+	c.RLock()
+	defer c.RUnlock()
+	_, ok := c.chunks[servedSnapshot{Height: height, Format: format}]
+	return ok
+}
+
+// Put caches the chunks of a snapshot, replacing any already cached.
+func (c *chunkCache) Put(height uint64, format uint32, chunks [][]byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.chunks[servedSnapshot{Height: height, Format: format}] = chunks
+}
+
+// Remove removes the chunks of a snapshot from the cache, if any.
+func (c *chunkCache) Remove(height uint64, format uint32) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.chunks, servedSnapshot{Height: height, Format: format})
+}
+
+// PinSnapshot loads all chunks of a local snapshot from the app and retains them in memory, such
+// that they are served to peers without further calls to the app until the snapshot is unpinned.
+// Pinning an already pinned snapshot reloads its chunks.
+func (r *Reactor) PinSnapshot(height uint64, format uint32) error {
+	resp, err := r.servingConn.ListSnapshotsSync(abci.RequestListSnapshots{})
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	var snapshot *abci.Snapshot
+	for _, s := range resp.Snapshots {
+		if s.Height == height && s.Format == format {
+			snapshot = s
+			break
+		}
+	}
+	if snapshot == nil {
+		return fmt.Errorf("snapshot at height %v format %v not found", height, format)
+	}
+
+	chunks := make([][]byte, 0, snapshot.Chunks)
+	for index := uint32(0); index < snapshot.Chunks; index++ {
+		resp, err := r.servingConn.LoadSnapshotChunkSync(abci.RequestLoadSnapshotChunk{
+			Height: height,
+			Format: format,
+			Chunk:  index,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load chunk %v: %w", index, err)
+		}
+		if resp.Chunk == nil {
+			return fmt.Errorf("chunk %v not found", index)
+		}
+		chunks = append(chunks, resp.Chunk)
+	}
+	r.pinned.Put(height, format, chunks)
+	r.Logger.Info("Pinned snapshot", "height", height, "format", format, "chunks", len(chunks))
+	return nil
+}
+
+// UnpinSnapshot releases the chunks of a snapshot pinned via PinSnapshot, if any. Its chunks are
+// then loaded from the app on demand, as usual.
+func (r *Reactor) UnpinSnapshot(height uint64, format uint32) {
+	r.pinned.Remove(height, format)
+	r.Logger.Info("Unpinned snapshot", "height", height, "format", format)
+}
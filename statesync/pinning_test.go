@@ -0,0 +1,106 @@
+package statesync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/p2p"
+	p2pmocks "github.com/tendermint/tendermint/p2p/mocks"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+)
+
+func TestChunkCache(t *testing.T) {
+	cache := newChunkCache()
+	_, ok := cache.Get(1, 1, 0)
+	assert.False(t, ok)
+
+	cache.Put(1, 1, [][]byte{{1, 0}, {1, 1}})
+	chunk, ok := cache.Get(1, 1, 1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1, 1}, chunk)
+	_, ok = cache.Get(1, 1, 2)
+	assert.False(t, ok)
+	_, ok = cache.Get(1, 2, 0)
+	assert.False(t, ok)
+
+	cache.Remove(1, 1)
+	_, ok = cache.Get(1, 1, 0)
+	assert.False(t, ok)
+}
+
+func TestReactor_PinSnapshot(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
+		Snapshots: []*abci.Snapshot{
+			{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1}},
+			{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}},
+		},
+	}, nil)
+	for i := uint32(0); i < 2; i++ {
+		conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 1, Format: 1, Chunk: i}).
+			Once().Return(&abci.ResponseLoadSnapshotChunk{Chunk: []byte{1, byte(i)}}, nil)
+	}
+	conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 2, Format: 1, Chunk: 0}).
+		Once().Return(&abci.ResponseLoadSnapshotChunk{}, nil)
+
+	r := NewReactor(cfg.TestStateSyncConfig(), conn, nil, "")
+	require.NoError(t, r.PinSnapshot(1, 1))
+	require.Error(t, r.PinSnapshot(1, 2)) // unknown snapshot
+	require.Error(t, r.PinSnapshot(2, 1)) // missing chunk
+	conn.AssertExpectations(t)
+
+	// Pinned chunks are served from memory, without calling the app.
+	for i := uint32(0); i < 2; i++ {
+		resp, err := r.loadChunk(1, 1, i)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{1, byte(i)}, resp.Chunk)
+	}
+	conn.AssertExpectations(t)
+
+	// Once unpinned, chunks are loaded from the app again.
+	r.UnpinSnapshot(1, 1)
+	conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 1, Format: 1, Chunk: 0}).
+		Once().Return(&abci.ResponseLoadSnapshotChunk{Chunk: []byte{9}}, nil)
+	resp, err := r.loadChunk(1, 1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{9}, resp.Chunk)
+	conn.AssertExpectations(t)
+}
+
+func TestReactor_Receive_ChunkRequest_pinned(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	r := NewReactor(cfg.TestStateSyncConfig(), conn, nil, "")
+	r.pinned.Put(1, 1, [][]byte{{1, 0}, {1, 1}})
+	err := r.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	responses := make(chan *ssproto.ChunkResponse, 1)
+	peer := &p2pmocks.Peer{}
+	peer.On("ID").Return(p2p.ID("id"))
+	peer.On("TrySend", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
+		msg, err := decodeMsg(args[1].([]byte))
+		require.NoError(t, err)
+		responses <- msg.(*ssproto.ChunkResponse)
+	}).Return(true)
+
+	r.Receive(ChunkChannel, peer, mustEncodeMsg(&ssproto.ChunkRequest{Height: 1, Format: 1, Index: 1}))
+	select {
+	case response := <-responses:
+		assert.Equal(t, &ssproto.ChunkResponse{Height: 1, Format: 1, Index: 1, Chunk: []byte{1, 1}}, response)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for chunk response")
+	}
+	conn.AssertExpectations(t)
+}
@@ -0,0 +1,260 @@
+package statesync
+
+import (
+	"time"
+
+	"github.com/tendermint/tendermint/libs/log"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+)
+
+const (
+	// applyBoundUtilization is the fraction of the chunk application phase which the app must
+	// spend applying chunks for a restore to be considered bound by the app rather than the network.
+	applyBoundUtilization = 0.5
+	// applySlowdownFactor is how many times longer than the average of previous chunks a chunk must
+	// take to apply for it to be considered slow, indicating that the app is struggling.
+	applySlowdownFactor = 4
+	// applySlowdownMinChunks is the number of chunks which must have been applied before slow
+	// chunks are detected, such that the average is meaningful.
+	applySlowdownMinChunks = 3
+	// applySlowdownMinTime is the minimum apply time of a slow chunk, to not report slowdowns of
+	// chunks which are quick to apply anyway.
+	applySlowdownMinTime = time.Second
+	// etaMinChunks is the number of chunks which must have been applied before the time remaining
+	// is estimated.
+	etaMinChunks = 2
+	// etaConfidentChunks and etaConfidentFraction are the number and fraction of the snapshot's
+	// chunks which must have been applied for the time remaining estimate to be high confidence.
+	etaConfidentChunks   = 10
+	etaConfidentFraction = 0.1
+)
+
+// durationStat accumulates durations, to compute their average.
+type durationStat struct {
+	total time.Duration
+	count int
+}
+
+// Add adds a duration.
+func (d *durationStat) Add(duration time.Duration) {
+	d.total += duration
+	d.count++
+}
+
+// Average returns the average duration, or 0 if none have been added.
+func (d *durationStat) Average() time.Duration {
+	if d.count == 0 {
+		return 0
+	}
+	return d.total / time.Duration(d.count)
+}
+
+// pipelineStats tracks the time snapshot chunks spend in flight (from request to response),
+// queued (from response until the app starts applying them) and being applied by the app, during
+// the restore of a single snapshot. This is reported via metrics and used to diagnose whether the
+// restore is bound by the network or by the app, to guide tuning of the concurrency options.
+//
+// The methods are safe to call on a nil pipelineStats, in which case nothing is tracked.
+type pipelineStats struct {
+	tmsync.Mutex
+	metrics   *Metrics
+	requested map[uint32]time.Time // chunks in flight, by request time
+	received  map[uint32]time.Time // chunks queued for application, by receive time
+	bytes     int64                // total size of chunks received
+	restored  int64                // total size of chunks accepted by the app
+	fetch     durationStat
+	queue     durationStat
+	apply     durationStat
+	slowest   time.Duration // longest chunk apply time
+	slowIndex uint32        // index of the chunk with the longest apply time
+	started   time.Time     // start of chunk application
+}
+
+// newPipelineStats creates new pipeline stats.
+func newPipelineStats(metrics *Metrics) *pipelineStats {
+	return &pipelineStats{
+		metrics:   metrics,
+		requested: make(map[uint32]time.Time),
+		received:  make(map[uint32]time.Time),
+		started:   time.Now(),
+	}
+}
+
+// Start records the start of chunk application.
+func (p *pipelineStats) Start() {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.started = time.Now()
+}
+
+// Requested records that a chunk was requested from a peer. Rerequests restart the in-flight time.
+func (p *pipelineStats) Requested(index uint32) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.requested[index] = time.Now()
+	p.metrics.ChunkRequestsInFlight.Set(float64(len(p.requested)))
+}
+
+// Received records that a requested chunk was received and queued for application. It returns the
+// chunk's fetch time, or false if the chunk was not requested.
+func (p *pipelineStats) Received(index uint32) (time.Duration, bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	p.received[index] = now
+	requested, ok := p.requested[index]
+	if !ok {
+		return 0, false
+	}
+	fetchTime := now.Sub(requested)
+	p.fetch.Add(fetchTime)
+	p.metrics.ChunkFetchTime.Observe(fetchTime.Seconds())
+	delete(p.requested, index)
+	p.metrics.ChunkRequestsInFlight.Set(float64(len(p.requested)))
+	return fetchTime, true
+}
+
+// Downloaded records the size of a received chunk.
+func (p *pipelineStats) Downloaded(size int) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.bytes += int64(size)
+}
+
+// DownloadedBytes returns the total size of the chunks received.
+func (p *pipelineStats) DownloadedBytes() int64 {
+	if p == nil {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.bytes
+}
+
+// Applying records that the app is starting to apply a chunk.
+func (p *pipelineStats) Applying(index uint32) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if received, ok := p.received[index]; ok {
+		p.queue.Add(time.Since(received))
+		p.metrics.ChunkQueueTime.Observe(time.Since(received).Seconds())
+		delete(p.received, index)
+	}
+}
+
+// Applied records that the app has applied a chunk, taking the given duration. It returns true
+// if the chunk took much longer to apply than previous chunks, along with their average apply
+// time.
+func (p *pipelineStats) Applied(index uint32, duration time.Duration) (bool, time.Duration) {
+	if p == nil {
+		return false, 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	average := p.apply.Average()
+	slow := p.apply.count >= applySlowdownMinChunks && duration >= applySlowdownMinTime &&
+		duration > applySlowdownFactor*average
+	p.apply.Add(duration)
+	if duration > p.slowest {
+		p.slowest, p.slowIndex = duration, index
+	}
+	p.metrics.ChunkApplyTime.Observe(duration.Seconds())
+	if slow {
+		p.metrics.SlowChunkApplies.Add(1)
+	}
+	return slow, average
+}
+
+// Accepted records that the app has accepted a chunk of the given size, and updates the restore
+// throughput, i.e. the rate chunks have been accepted at since the start of chunk application.
+func (p *pipelineStats) Accepted(size int) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.restored += int64(size)
+	p.metrics.RestoredChunks.Add(1)
+	p.metrics.RestoredChunkBytes.Add(float64(size))
+	if elapsed := time.Since(p.started).Seconds(); elapsed > 0 {
+		p.metrics.RestoreThroughput.Set(float64(p.restored) / elapsed)
+	}
+}
+
+// Bottleneck diagnoses whether the restore is "apply-bound", i.e. the app spends most of the chunk
+// application phase applying chunks, or "network-bound", i.e. the app is mostly waiting for chunks.
+func (p *pipelineStats) Bottleneck() string {
+	if p == nil {
+		return ""
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.bottleneck()
+}
+
+// bottleneck implements Bottleneck. The caller must hold the mutex lock.
+func (p *pipelineStats) bottleneck() string {
+	if p.utilization() >= applyBoundUtilization {
+		return "apply-bound"
+	}
+	return "network-bound"
+}
+
+// utilization returns the fraction of the chunk application phase spent applying chunks. The
+// caller must hold the mutex lock.
+func (p *pipelineStats) utilization() float64 {
+	elapsed := time.Since(p.started)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.apply.total) / float64(elapsed)
+}
+
+// Estimate estimates the time remaining until the remaining chunks of a snapshot with the given
+// number of chunks are applied, from the rate chunks have been applied at since the start of chunk
+// application. It returns ETAUnknown if too few chunks have been applied.
+func (p *pipelineStats) Estimate(remaining, total uint32) (time.Duration, ETAConfidence) {
+	if p == nil || total == 0 {
+		return 0, ETAUnknown
+	}
+	p.Lock()
+	defer p.Unlock()
+	applied := p.apply.count
+	if applied < etaMinChunks {
+		return 0, ETAUnknown
+	}
+	perChunk := time.Since(p.started) / time.Duration(applied)
+	confidence := ETALow
+	if applied >= etaConfidentChunks && float64(total-remaining) >= etaConfidentFraction*float64(total) {
+		confidence = ETAHigh
+	}
+	return perChunk * time.Duration(remaining), confidence
+}
+
+// Log logs a one-line summary of the pipeline stats, with a diagnosis of the bottleneck.
+func (p *pipelineStats) Log(logger log.Logger, snapshot *snapshot) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	logger.Info("Snapshot chunk pipeline stats", "height", snapshot.Height, "format", snapshot.Format,
+		"bottleneck", p.bottleneck(), "avg_fetch", p.fetch.Average(), "avg_queue", p.queue.Average(),
+		"avg_apply", p.apply.Average(), "max_apply", p.slowest, "max_apply_chunk", p.slowIndex,
+		"apply_utilization", p.utilization())
+}
@@ -0,0 +1,153 @@
+package statesync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tendermint/tendermint/libs/log"
+)
+
+func TestPipelineStats(t *testing.T) {
+	inFlight := generic.NewGauge("chunk_requests_in_flight")
+	fetchTime := generic.NewHistogram("chunk_fetch_time", 10)
+	queueTime := generic.NewHistogram("chunk_queue_time", 10)
+	applyTime := generic.NewHistogram("chunk_apply_time", 10)
+	slowApplies := generic.NewCounter("slow_chunk_applies")
+	p := newPipelineStats(&Metrics{
+		ChunkRequestsInFlight: inFlight,
+		ChunkFetchTime:        fetchTime,
+		ChunkQueueTime:        queueTime,
+		ChunkApplyTime:        applyTime,
+		SlowChunkApplies:      slowApplies,
+	})
+
+	p.Requested(0)
+	p.Requested(1)
+	p.Requested(1)
+	assert.EqualValues(t, 2, inFlight.Value())
+	_, ok := p.Received(0)
+	assert.True(t, ok)
+	_, ok = p.Received(2) // not requested, so not counted as fetched
+	assert.False(t, ok)
+	assert.EqualValues(t, 1, inFlight.Value())
+	assert.Equal(t, 1, p.fetch.count)
+	p.Downloaded(100)
+	p.Downloaded(50)
+	assert.EqualValues(t, 150, p.DownloadedBytes())
+
+	p.Applying(0)
+	p.Applying(0) // already applied, so not counted as queued again
+	slow, _ := p.Applied(0, 10*time.Millisecond)
+	assert.False(t, slow)
+	assert.Equal(t, 1, p.queue.count)
+	assert.Equal(t, 10*time.Millisecond, p.apply.Average())
+	assert.Equal(t, time.Duration(0), (&durationStat{}).Average())
+
+	// The bottleneck depends on the fraction of time the app spent applying chunks.
+	p.started = time.Now().Add(-time.Second)
+	assert.Equal(t, "network-bound", p.Bottleneck())
+	p.Applied(1, 900*time.Millisecond)
+	assert.Equal(t, "apply-bound", p.Bottleneck())
+	p.Log(log.NewNopLogger(), &snapshot{Height: 1, Format: 1})
+	assert.Equal(t, 900*time.Millisecond, p.slowest)
+	assert.EqualValues(t, 1, p.slowIndex)
+}
+
+func TestPipelineStats_Accepted(t *testing.T) {
+	chunks := generic.NewCounter("restored_chunks")
+	bytes := generic.NewCounter("restored_chunk_bytes")
+	throughput := generic.NewGauge("restore_throughput")
+	p := newPipelineStats(&Metrics{
+		RestoredChunks:     chunks,
+		RestoredChunkBytes: bytes,
+		RestoreThroughput:  throughput,
+	})
+	p.started = time.Now().Add(-2 * time.Second)
+
+	p.Accepted(1000)
+	p.Accepted(3000)
+	assert.EqualValues(t, 2, chunks.Value())
+	assert.EqualValues(t, 4000, bytes.Value())
+	assert.InDelta(t, 2000, throughput.Value(), 100)
+}
+
+func TestPipelineStats_Applied_slow(t *testing.T) {
+	slowApplies := generic.NewCounter("slow_chunk_applies")
+	p := newPipelineStats(&Metrics{ChunkApplyTime: generic.NewHistogram("chunk_apply_time", 10),
+		SlowChunkApplies: slowApplies})
+
+	// Slow chunks aren't detected until a few chunks have been applied.
+	for i := uint32(0); i < applySlowdownMinChunks-1; i++ {
+		slow, _ := p.Applied(i, time.Second)
+		assert.False(t, slow)
+	}
+	slow, _ := p.Applied(2, 10*time.Second)
+	assert.False(t, slow)
+
+	// Chunks much slower than the average of previous chunks are reported...
+	slow, average := p.Applied(3, 30*time.Second)
+	assert.True(t, slow)
+	assert.Equal(t, 4*time.Second, average)
+	assert.EqualValues(t, 1, slowApplies.Value())
+	assert.Equal(t, 30*time.Second, p.slowest)
+	assert.EqualValues(t, 3, p.slowIndex)
+
+	// ...but not ones that are merely slower, or quick to apply regardless.
+	slow, _ = p.Applied(4, 20*time.Second)
+	assert.False(t, slow)
+	p = newPipelineStats(&Metrics{ChunkApplyTime: generic.NewHistogram("chunk_apply_time", 10),
+		SlowChunkApplies: slowApplies})
+	for i := uint32(0); i < applySlowdownMinChunks; i++ {
+		p.Applied(i, time.Millisecond)
+	}
+	slow, _ = p.Applied(3, 500*time.Millisecond)
+	assert.False(t, slow)
+	assert.EqualValues(t, 1, slowApplies.Value())
+}
+
+func TestPipelineStats_Estimate(t *testing.T) {
+	p := newPipelineStats(NopMetrics())
+
+	// No estimate is made until a couple of chunks have been applied.
+	p.Applied(0, time.Millisecond)
+	_, confidence := p.Estimate(99, 100)
+	assert.Equal(t, ETAUnknown, confidence)
+
+	// The estimate extrapolates the rate since the start of chunk application, and is low
+	// confidence until enough of the snapshot has been applied.
+	p.started = time.Now().Add(-2 * time.Second)
+	p.Applied(1, time.Millisecond)
+	eta, confidence := p.Estimate(98, 100)
+	assert.Equal(t, ETALow, confidence)
+	assert.InDelta(t, 98*time.Second, eta, float64(time.Second))
+
+	p.started = time.Now().Add(-20 * time.Second)
+	for i := uint32(2); i < 20; i++ {
+		p.Applied(i, time.Millisecond)
+	}
+	eta, confidence = p.Estimate(80, 100)
+	assert.Equal(t, ETAHigh, confidence)
+	assert.InDelta(t, 80*time.Second, eta, float64(time.Second))
+	_, confidence = p.Estimate(980, 1000)
+	assert.Equal(t, ETALow, confidence)
+	assert.Equal(t, "low", confidence.String())
+}
+
+func TestPipelineStats_nil(t *testing.T) {
+	var p *pipelineStats
+	p.Start()
+	p.Requested(0)
+	p.Received(0)
+	p.Downloaded(100)
+	p.Applying(0)
+	p.Applied(0, time.Second)
+	p.Accepted(100)
+	_, confidence := p.Estimate(1, 2)
+	assert.Equal(t, ETAUnknown, confidence)
+	p.Log(log.NewNopLogger(), &snapshot{Height: 1, Format: 1})
+	assert.Equal(t, "", p.Bottleneck())
+	assert.Zero(t, p.DownloadedBytes())
+}
@@ -0,0 +1,96 @@
+package statesync
+
+import (
+	"errors"
+	"fmt"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/merkle"
+	tmcrypto "github.com/tendermint/tendermint/proto/tendermint/crypto"
+)
+
+// Apps which structure snapshots as a Merkle tree can have each chunk verified as soon as it is
+// received, rather than only once the app applies it, by committing to a root in the snapshot hash
+// or metadata and serving a proof alongside each chunk. Syncing nodes with a ChunkProofVerifier ask
+// peers advertising the chunk_proofs feature to include proofs, reject chunks with invalid or
+// missing proofs, and reject their senders. Peers without the feature are sent plain chunk
+// requests, and their chunks are only verified by the app as before.
+
+const (
+	// maxChunkProofSize is the maximum size of a chunk proof. A Merkle proof over any number of
+	// chunks at most takes 32 aunts of 32 bytes each, plus its encoding overhead.
+	maxChunkProofSize = 4096
+)
+
+var (
+	// errInvalidChunkProof is returned when a chunk fails verification against its proof.
+	errInvalidChunkProof = errors.New("invalid chunk proof")
+)
+
+// ChunkProveFunc returns the proof for a snapshot chunk served to a peer which asked for one, for
+// verification by the peer's ChunkProofVerifier. ABCI has no method for loading chunk proofs, so
+// this must be provided by the app's integration, e.g. by calling into the app's snapshot store.
+// If it returns nil or an error, the chunk is reported missing, since the peer would reject it.
+type ChunkProveFunc func(height uint64, format uint32, index uint32, chunk []byte) ([]byte, error)
+
+// ChunkProofVerifier verifies snapshot chunks against the proofs served alongside them. It must be
+// safe for concurrent use.
+type ChunkProofVerifier interface {
+	// Proves checks whether the chunks of a snapshot can be verified against proofs, e.g. based on
+	// its format. Proofs are only requested for such snapshots.
+	Proves(snapshot *abci.Snapshot) bool
+	// VerifyChunkProof verifies a chunk of a snapshot against its proof.
+	VerifyChunkProof(snapshot *abci.Snapshot, index uint32, chunk []byte, proof []byte) error
+}
+
+// MerkleChunkVerifier is a ChunkProofVerifier for snapshots whose hash is the root of a
+// tendermint Merkle tree over their chunks, with proofs encoded as tendermint.crypto.Proof, as
+// generated by MerkleChunkProofs(). It proves snapshots in the given formats.
+type MerkleChunkVerifier struct {
+	Formats []uint32
+}
+
+var _ ChunkProofVerifier = MerkleChunkVerifier{}
+
+// Proves implements ChunkProofVerifier.
+func (v MerkleChunkVerifier) Proves(snapshot *abci.Snapshot) bool {
+	for _, format := range v.Formats {
+		if format == snapshot.Format {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyChunkProof implements ChunkProofVerifier.
+func (v MerkleChunkVerifier) VerifyChunkProof(snapshot *abci.Snapshot, index uint32, chunk []byte,
+	proof []byte) error {
+	pb := &tmcrypto.Proof{}
+	if err := pb.Unmarshal(proof); err != nil {
+		return fmt.Errorf("failed to decode proof: %w", err)
+	}
+	mp, err := merkle.ProofFromProto(pb)
+	if err != nil {
+		return err
+	}
+	if mp.Total != int64(snapshot.Chunks) || mp.Index != int64(index) {
+		return fmt.Errorf("proof is for chunk %v of %v, expected chunk %v of %v", mp.Index, mp.Total,
+			index, snapshot.Chunks)
+	}
+	return mp.Verify(snapshot.Hash, chunk)
+}
+
+// MerkleChunkProofs computes the Merkle root of a snapshot's chunks, for use as the snapshot hash,
+// along with the encoded proof of each chunk, as verified by MerkleChunkVerifier.
+func MerkleChunkProofs(chunks [][]byte) ([]byte, [][]byte, error) {
+	root, proofs := merkle.ProofsFromByteSlices(chunks)
+	encoded := make([][]byte, 0, len(proofs))
+	for _, proof := range proofs {
+		bz, err := proof.ToProto().Marshal()
+		if err != nil {
+			return nil, nil, err
+		}
+		encoded = append(encoded, bz)
+	}
+	return root, encoded, nil
+}
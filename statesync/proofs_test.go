@@ -0,0 +1,35 @@
+package statesync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+)
+
+func TestMerkleChunkVerifier(t *testing.T) {
+	chunks := [][]byte{{1}, {2, 2}, {3, 3, 3}}
+	root, proofs, err := MerkleChunkProofs(chunks)
+	require.NoError(t, err)
+	require.Len(t, proofs, 3)
+	snapshot := &abci.Snapshot{Height: 1, Format: 2, Chunks: 3, Hash: root}
+
+	v := MerkleChunkVerifier{Formats: []uint32{2}}
+	assert.True(t, v.Proves(snapshot))
+	assert.False(t, v.Proves(&abci.Snapshot{Height: 1, Format: 1, Chunks: 3, Hash: root}))
+	for i, chunk := range chunks {
+		assert.NoError(t, v.VerifyChunkProof(snapshot, uint32(i), chunk, proofs[i]))
+	}
+
+	// Tampered chunks, proofs for other chunks or snapshots, and garbage proofs fail.
+	assert.Error(t, v.VerifyChunkProof(snapshot, 0, []byte{9}, proofs[0]))
+	assert.Error(t, v.VerifyChunkProof(snapshot, 1, chunks[0], proofs[0]))
+	assert.Error(t, v.VerifyChunkProof(&abci.Snapshot{Height: 1, Format: 2, Chunks: 3, Hash: []byte{1}},
+		0, chunks[0], proofs[0]))
+	assert.Error(t, v.VerifyChunkProof(&abci.Snapshot{Height: 1, Format: 2, Chunks: 4, Hash: root},
+		0, chunks[0], proofs[0]))
+	assert.Error(t, v.VerifyChunkProof(snapshot, 0, chunks[0], []byte{0xff, 0xff}))
+	assert.Error(t, v.VerifyChunkProof(snapshot, 0, chunks[0], nil))
+}
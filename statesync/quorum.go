@@ -0,0 +1,110 @@
+package statesync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quorumPrimary is the name under which the syncer's own state provider is reported when
+// verifying app hashes against a quorum of state providers.
+const quorumPrimary = "primary"
+
+// errQuorum is returned by SyncAny() when too few state providers agree on a snapshot's app hash.
+var errQuorum = errors.New("state providers disagree on app hash")
+
+// WithVerifiers sets additional, independent state providers which the app hash of a snapshot
+// must be verified against before it is restored, keyed by a name used when reporting
+// disagreements. At least quorum providers, counting the state provider given to Sync(), must
+// return the same app hash, otherwise the sync fails. This defends against a single compromised
+// state provider, e.g. a light client with compromised RPC servers.
+func WithVerifiers(quorum int, verifiers map[string]StateProvider) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withVerifiers(quorum, verifiers)) }
+}
+
+// withVerifiers sets additional state providers to verify snapshot app hashes against.
+func withVerifiers(quorum int, verifiers map[string]StateProvider) syncerOption {
+	return func(s *syncer) {
+		s.quorum = quorum
+		s.verifiers = verifiers
+	}
+}
+
+// checkQuorum checks that the configured quorum can be reached at all.
+func (s *syncer) checkQuorum() error {
+	if len(s.verifiers) == 0 {
+		return nil
+	}
+	if _, ok := s.verifiers[quorumPrimary]; ok {
+		return fmt.Errorf("state provider name %q is reserved", quorumPrimary)
+	}
+	if s.quorum < 1 || s.quorum > len(s.verifiers)+1 {
+		return fmt.Errorf("invalid state provider quorum %v, must be between 1 and %v", s.quorum,
+			len(s.verifiers)+1)
+	}
+	return nil
+}
+
+// verifyQuorum verifies the trusted app hash of a snapshot against the additional state providers,
+// if any. It returns an error reporting the app hash returned by each provider if fewer than the
+// quorum agree with the primary state provider. The providers are queried concurrently, and the
+// queries are cancelled if the sync is interrupted.
+func (s *syncer) verifyQuorum(snapshot *snapshot) error {
+	if len(s.verifiers) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(s.verifiers))
+	for name := range s.verifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+	appHashes := make([][]byte, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, verifier StateProvider) {
+			defer wg.Done()
+			appHashes[i], errs[i] = verifier.AppHash(ctx, snapshot.Height)
+		}(i, s.verifiers[name])
+	}
+	wg.Wait()
+	if err := s.ctx.Err(); err != nil {
+		return fmt.Errorf("%v: %w", errInterrupted, err)
+	}
+
+	agree := 1
+	results := []string{fmt.Sprintf("%v=%X", quorumPrimary, snapshot.trustedAppHash)}
+	for i, name := range names {
+		appHash, err := appHashes[i], errs[i]
+		switch {
+		case err != nil:
+			s.logger.Error("Failed to fetch app hash from state provider", "provider", name,
+				"height", snapshot.Height, "err", err)
+			results = append(results, fmt.Sprintf("%v=error: %v", name, err))
+		case !bytes.Equal(appHash, snapshot.trustedAppHash):
+			s.logger.Error("State provider disagrees on app hash", "provider", name,
+				"height", snapshot.Height, "expected", fmt.Sprintf("%X", snapshot.trustedAppHash),
+				"actual", fmt.Sprintf("%X", appHash))
+			results = append(results, fmt.Sprintf("%v=%X", name, appHash))
+		default:
+			agree++
+			results = append(results, fmt.Sprintf("%v=%X", name, appHash))
+		}
+	}
+	if agree < s.quorum {
+		return fmt.Errorf("%w at height %v: %v of %v state providers agree, %v required (%v)",
+			errQuorum, snapshot.Height, agree, len(s.verifiers)+1, s.quorum, strings.Join(results, ", "))
+	}
+	s.logger.Info("Verified app hash against state providers", "height", snapshot.Height,
+		"agree", agree, "providers", len(s.verifiers)+1, "quorum", s.quorum)
+	return nil
+}
@@ -0,0 +1,140 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	"github.com/tendermint/tendermint/statesync/mocks"
+)
+
+// Sets up a state provider mock returning the given app hash, or error if non-nil
+func appHashProvider(appHash []byte, err error) *mocks.StateProvider {
+	provider := &mocks.StateProvider{}
+	provider.On("AppHash", mock.Anything, uint64(1)).Return(appHash, err)
+	return provider
+}
+
+func TestSyncer_verifyQuorum(t *testing.T) {
+	boom := errors.New("boom")
+	testcases := map[string]struct {
+		quorum    int
+		verifiers map[string]StateProvider
+		expectErr string
+	}{
+		"no verifiers": {0, nil, ""},
+		"all agree": {3, map[string]StateProvider{
+			"a": appHashProvider([]byte{1}, nil),
+			"b": appHashProvider([]byte{1}, nil),
+		}, ""},
+		"quorum despite disagreement": {2, map[string]StateProvider{
+			"a": appHashProvider([]byte{1}, nil),
+			"b": appHashProvider([]byte{2}, nil),
+		}, ""},
+		"quorum despite error": {2, map[string]StateProvider{
+			"a": appHashProvider(nil, boom),
+			"b": appHashProvider([]byte{1}, nil),
+		}, ""},
+		"no quorum": {3, map[string]StateProvider{
+			"a": appHashProvider(nil, boom),
+			"b": appHashProvider([]byte{2}, nil),
+			"c": appHashProvider([]byte{1}, nil),
+		}, "2 of 4 state providers agree, 3 required (primary=01, a=error: boom, b=02, c=01)"},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+				&proxymocks.AppConnQuery{}, &mocks.StateProvider{}, "", withVerifiers(tc.quorum, tc.verifiers))
+			require.NoError(t, syncer.checkQuorum())
+			err := syncer.verifyQuorum(&snapshot{Height: 1, Format: 1, Chunks: 1, trustedAppHash: []byte{1}})
+			if tc.expectErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, errQuorum))
+				assert.Contains(t, err.Error(), tc.expectErr)
+			}
+		})
+	}
+}
+
+func TestSyncer_checkQuorum(t *testing.T) {
+	verifiers := map[string]StateProvider{"a": &mocks.StateProvider{}, "b": &mocks.StateProvider{}}
+	for quorum, valid := range map[int]bool{-1: false, 0: false, 1: true, 3: true, 4: false} {
+		syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+			&proxymocks.AppConnQuery{}, &mocks.StateProvider{}, "", withVerifiers(quorum, verifiers))
+		if valid {
+			assert.NoError(t, syncer.checkQuorum(), "quorum %v", quorum)
+		} else {
+			assert.Error(t, syncer.checkQuorum(), "quorum %v", quorum)
+		}
+	}
+
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, &mocks.StateProvider{}, "",
+		withVerifiers(1, map[string]StateProvider{quorumPrimary: &mocks.StateProvider{}}))
+	assert.Error(t, syncer.checkQuorum())
+}
+
+func TestSyncer_verifyQuorum_interrupted(t *testing.T) {
+	// The verifiers are queried concurrently, until the sync is interrupted.
+	queried := make(chan struct{}, 3)
+	verifiers := make(map[string]StateProvider)
+	for _, name := range []string{"a", "b", "c"} {
+		provider := &mocks.StateProvider{}
+		provider.On("AppHash", mock.Anything, uint64(1)).Run(func(args mock.Arguments) {
+			queried <- struct{}{}
+			<-args[0].(context.Context).Done()
+		}).Return(nil, context.Canceled)
+		verifiers[name] = provider
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, &mocks.StateProvider{}, "", withVerifiers(2, verifiers), withContext(ctx))
+
+	verified := make(chan error, 1)
+	go func() {
+		verified <- syncer.verifyQuorum(&snapshot{Height: 1, Format: 1, Chunks: 1, trustedAppHash: []byte{1}})
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-queried:
+		case <-time.After(time.Second):
+			require.Fail(t, "verifiers not queried concurrently")
+		}
+	}
+	cancel()
+	select {
+	case err := <-verified:
+		assert.True(t, errors.Is(err, context.Canceled), err)
+	case <-time.After(time.Second):
+		require.Fail(t, "verification not interrupted")
+	}
+}
+
+func TestSyncer_SyncAny_quorum(t *testing.T) {
+	stateProvider := appHashProvider([]byte("app_hash"), nil)
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot,
+		&proxymocks.AppConnQuery{}, stateProvider, "", withVerifiers(2, map[string]StateProvider{
+			"a": appHashProvider([]byte("other"), nil),
+		}))
+	_, err := syncer.AddSnapshot(simplePeer("id"), &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}})
+	require.NoError(t, err)
+
+	// The snapshot is never offered to the app, since the state providers disagree.
+	_, err = syncer.SyncAny(0)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errQuorum))
+	connSnapshot.AssertExpectations(t)
+}
@@ -0,0 +1,86 @@
+package statesync
+
+import (
+	"context"
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+)
+
+// downloadLimiter caps the rate chunks are downloaded at, as a token bucket of bytes refilled at
+// the configured rate and holding at most a second's worth. Received chunks consume their size in
+// tokens, possibly running the bucket into debt since chunk sizes aren't known up front, and
+// chunk requests are only issued once the bucket is no longer in debt. A nil *downloadLimiter
+// doesn't limit downloads.
+type downloadLimiter struct {
+	tmsync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time // time tokens were last refilled
+}
+
+// newDownloadLimiter creates a new download limiter for the given rate in bytes per second, or
+// nil if rate is 0.
+func newDownloadLimiter(rate int64) *downloadLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &downloadLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Consume records the download of n bytes.
+func (l *downloadLimiter) Consume(n int) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.refill()
+	l.tokens -= float64(n)
+}
+
+// Delay returns the time until the bucket is no longer in debt, or 0 if it isn't.
+func (l *downloadLimiter) Delay() time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.refill()
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait blocks until the bucket is no longer in debt, or the context is cancelled.
+func (l *downloadLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := l.Delay()
+		if delay <= 0 {
+			return ctx.Err()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// refill adds the tokens accrued since the last refill, up to a second's worth. The caller must
+// hold the mutex.
+func (l *downloadLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
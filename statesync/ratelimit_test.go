@@ -0,0 +1,50 @@
+package statesync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadLimiter(t *testing.T) {
+	var disabled *downloadLimiter
+	assert.Nil(t, newDownloadLimiter(0))
+	disabled.Consume(1 << 20)
+	assert.Zero(t, disabled.Delay())
+	require.NoError(t, disabled.Wait(context.Background()))
+
+	limiter := newDownloadLimiter(1000)
+	limiter.Consume(1000)
+	assert.Zero(t, limiter.Delay())
+	limiter.Consume(500)
+	delay := limiter.Delay()
+	assert.Greater(t, int64(delay), int64(400*time.Millisecond))
+	assert.LessOrEqual(t, int64(delay), int64(500*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, limiter.Wait(ctx))
+}
+
+func TestDownloadLimiter_rate(t *testing.T) {
+	// Downloading chunks as fast as the limiter allows should stay under the cap, apart from the
+	// initial burst of a second's worth of bytes.
+	const (
+		rate      = 100000
+		chunkSize = 10000
+		total     = 250000
+	)
+	limiter := newDownloadLimiter(rate)
+	start := time.Now()
+	for downloaded := 0; downloaded < total; downloaded += chunkSize {
+		require.NoError(t, limiter.Wait(context.Background()))
+		limiter.Consume(chunkSize)
+	}
+	elapsed := time.Since(start)
+	effective := float64(total-rate-chunkSize) / elapsed.Seconds()
+	assert.LessOrEqual(t, effective, float64(rate))
+	assert.Greater(t, int64(elapsed), int64(1400*time.Millisecond))
+}
@@ -1,11 +1,18 @@
 package statesync
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sort"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto"
+	"github.com/tendermint/tendermint/libs/log"
 	tmsync "github.com/tendermint/tendermint/libs/sync"
 	"github.com/tendermint/tendermint/p2p"
 	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
@@ -21,33 +28,320 @@ const (
 	ChunkChannel = byte(0x61)
 	// recentSnapshots is the number of recent snapshots to send and receive per peer.
 	recentSnapshots = 10
+	// snapshotRequestRetryInterval is the interval between attempts to queue a snapshot request
+	// with a peer whose send queue is full.
+	snapshotRequestRetryInterval = 100 * time.Millisecond
+	// snapshotRequestTimeout is the time after which we give up on queueing a snapshot request
+	// with a peer whose send queue is full.
+	snapshotRequestTimeout = 10 * time.Second
+	// snapshotAdvertiseInterval is the minimum interval between pushes of our snapshots to peers
+	// via AdvertiseSnapshots().
+	snapshotAdvertiseInterval = 10 * time.Second
 )
 
 // Reactor handles state sync, both restoring snapshots for the local node and serving snapshots
-// for other nodes.
+// for other nodes. It can do both at once, e.g. for snapshot relays, restoring a snapshot from
+// some peers while serving its complete local snapshots to others. Snapshots at heights being
+// restored are not served until the restore completes, and serving can use a separate app
+// connection via WithServingConn() to avoid contending with the restore.
 type Reactor struct {
 	p2p.BaseReactor
 
-	conn      proxy.AppConnSnapshot
-	connQuery proxy.AppConnQuery
-	tempDir   string
+	config      *cfg.StateSyncConfig
+	conn        proxy.AppConnSnapshot // used to restore snapshots
+	connQuery   proxy.AppConnQuery
+	servingConn proxy.AppConnSnapshot // used to serve snapshots, defaults to conn
+	tempDir     string
+	nodeKey     crypto.PrivKey // used to sign snapshot advertisements, if enabled
+	pruner      SnapshotPruneFunc
+	prover      ChunkProveFunc
+	appFormats  AppFormatsFunc // validates the configured formats on start, if set
+	staging     StagingApp     // restores snapshots into a staging app, if staging_restore is set
 
-	// This will only be set when a state sync is in progress. It is used to feed received
-	// snapshots and chunks into the sync.
-	mtx    tmsync.RWMutex
-	syncer *syncer
+	// serving tracks snapshots that are actively being served to peers.
+	serving *servingTracker
+	// advertised tracks recent snapshot advertisements to peers, or nil if disabled.
+	advertised *advertisementTracker
+	// pinned caches the chunks of snapshots pinned via PinSnapshot().
+	pinned *chunkCache
+	// retention is the retention policy for local snapshots.
+	retention *snapshotRetention
+	// catalog retains discovered snapshots across state syncs, or nil if disabled.
+	catalog *snapshotCatalog
+	// verified retains states verified by the state provider across state syncs, or nil if disabled.
+	verified *verificationCache
+	// servers serves snapshot and chunk requests, or nil to serve them inline in Receive().
+	servers *servingPool
+	// peerCaps tracks the protocol capabilities advertised by peers.
+	peerCaps *capabilityTracker
+	// latencies estimates peer latencies across state syncs.
+	latencies *peerLatencies
+	metrics   *Metrics
+
+	// reputation records peer quality across state syncs and restarts, or nil if disabled.
+	reputation *peerReputation
+	// grace defers the removal of disconnected peers which may reconnect, or nil if disabled.
+	grace *peerGrace
+	// stale tracks chunk requests left in flight by finished restores, or nil if disabled.
+	stale *staleChunks
+	// verification is the snapshot verification in progress, or the last one, if any.
+	verification *snapshotVerification
+	// ctx is cancelled when the reactor stops, interrupting any state syncs in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// syncers contains the state syncs in progress, which are fed received snapshots and chunks.
+	// syncer is the node's own state sync, via Sync(), if in progress. syncEnded is the time the
+	// last state sync completed, used to discard straggler chunks.
+	mtx       tmsync.RWMutex
+	syncers   map[*syncer]struct{}
+	syncer    *syncer
+	syncEnded time.Time
+
+	// lastAdvertise is the time of the last push via AdvertiseSnapshots(), for rate limiting.
+	lastAdvertise time.Time
+
+	// servingDisabled disables serving snapshots and chunks to peers, via SetServingEnabled().
+	servingDisabled bool
+
+	// verboseChunks enables verbose per-chunk logging while non-zero, via SetChunkLogging(). It is
+	// accessed atomically.
+	verboseChunks int32
+
+	// syncerOptions are passed on to the syncer when a state sync is started.
+	syncerOptions []syncerOption
+}
+
+// ReactorOption sets an optional parameter on the Reactor.
+type ReactorOption func(*Reactor)
+
+// WithPeerSelector sets a PeerSelector which is consulted when choosing the peer to request each
+// snapshot chunk from. By default, a random peer that has the snapshot is chosen.
+func WithPeerSelector(selector PeerSelector) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withPeerSelector(selector)) }
+}
+
+// WithPeerFilter sets a PeerFilter which is consulted when peers advertise snapshots and when
+// scheduling chunk requests, to exclude or prefer peers based on their attributes. By default, all
+// peers are accepted.
+func WithPeerFilter(filter PeerFilter) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withPeerFilter(filter)) }
+}
+
+// WithChunkVerifier sets a ChunkVerifier which hashes and verifies the snapshot chunks buffered in
+// temp_dir, for apps using a content addressing scheme other than SHA-256. By default, SHA-256 is
+// used.
+func WithChunkVerifier(verifier ChunkVerifier) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withChunkVerifier(verifier)) }
+}
+
+// WithChunkProofVerifier sets a ChunkProofVerifier which verifies the chunks of snapshots it
+// proves as soon as they are received, against proofs requested from peers which can serve them.
+// Chunks with invalid proofs are discarded and their senders rejected. By default, chunks are only
+// verified by the app.
+func WithChunkProofVerifier(verifier ChunkProofVerifier) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withChunkProofVerifier(verifier)) }
+}
+
+// WithChunkHashes sets a function which returns the expected hash of each chunk of a snapshot, for
+// apps with per-chunk hashes. If a restored snapshot fails the app hash check, only the chunks
+// which don't match their hashes are refetched from alternate peers, and the snapshot re-applied,
+// before rejecting it as a whole. By default, such snapshots are rejected right away.
+func WithChunkHashes(fn ChunkHashesFunc) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withChunkHashes(fn)) }
+}
+
+// WithSnapshotSize sets a function which estimates the total size of a snapshot's chunks, e.g. from
+// the snapshot metadata, such that check_disk_space can refuse to restore snapshots which won't
+// fit on disk before fetching any chunks. By default, the size is estimated from the first chunk.
+func WithSnapshotSize(fn SnapshotSizeFunc) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withSnapshotSize(fn)) }
+}
+
+// WithChunkProver sets a function which provides the proofs of served snapshot chunks, for peers
+// verifying chunks via a ChunkProofVerifier. The node then advertises that it serves chunk proofs.
+func WithChunkProver(fn ChunkProveFunc) ReactorOption {
+	return func(r *Reactor) { r.prover = fn }
+}
+
+// WithSnapshotStream sets a function which is given an io.Reader over the contents of each
+// snapshot being restored, yielding chunks in order as they are accepted by the app. See
+// SnapshotStreamFunc for details.
+func WithSnapshotStream(fn SnapshotStreamFunc) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withSnapshotStream(fn)) }
+}
+
+// WithServingConn sets a separate app connection used to serve snapshots to peers, such that
+// serving doesn't contend with restoring snapshots on the same connection. By default, the
+// reactor's snapshot connection is used for both.
+func WithServingConn(conn proxy.AppConnSnapshot) ReactorOption {
+	return func(r *Reactor) { r.servingConn = conn }
+}
+
+// WithMetrics sets the metrics.
+func WithMetrics(metrics *Metrics) ReactorOption {
+	return func(r *Reactor) {
+		r.metrics = metrics
+		r.syncerOptions = append(r.syncerOptions, withMetrics(metrics))
+	}
+}
+
+// WithAppReconnect sets a function which re-establishes the app connections if they are lost while
+// restoring a snapshot via Sync(), e.g. because the app restarted, such that the snapshot can be
+// re-offered and the restore resumed. See the app_reconnect_attempts option.
+func WithAppReconnect(fn AppReconnectFunc) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withAppReconnect(fn)) }
+}
+
+// WithSnapshotAvailable sets a function which is notified as soon as the first usable snapshot is
+// discovered by each state sync, e.g. to decide between state sync and block sync before the
+// discovery time has elapsed. See SnapshotAvailableFunc for details.
+func WithSnapshotAvailable(fn SnapshotAvailableFunc) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withSnapshotAvailable(fn)) }
+}
+
+// WithSnapshotConfirm sets a function which must confirm the snapshot selected by each state
+// sync before it is restored, e.g. for an operator to approve it during supervised bootstraps.
+// Declined snapshots are rejected and the next candidate is selected. By default, snapshots are
+// restored without confirmation. See SnapshotConfirmFunc for details.
+func WithSnapshotConfirm(fn SnapshotConfirmFunc) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withSnapshotConfirm(fn)) }
+}
+
+// WithSyncLifecycle sets a SyncLifecycle which is notified when each state sync completes or is
+// about to fail, e.g. for the app to clean up scratch state from partial restore attempts. See
+// SyncLifecycle for details.
+func WithSyncLifecycle(lifecycle SyncLifecycle) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withSyncLifecycle(lifecycle)) }
+}
+
+// WithTracer sets a Tracer which traces the phases of each state sync, e.g. to export them to an
+// OpenTelemetry tracer. By default, syncs are not traced.
+func WithTracer(tracer Tracer) ReactorOption {
+	return func(r *Reactor) { r.syncerOptions = append(r.syncerOptions, withTracer(tracer)) }
+}
+
+// WithNodeKey sets the node key, which is used to sign snapshot advertisements if enabled via
+// the sign_snapshots option.
+func WithNodeKey(key crypto.PrivKey) ReactorOption {
+	return func(r *Reactor) { r.nodeKey = key }
+}
+
+// WithSnapshotPruner sets a function which deletes local snapshots from the app once they expire
+// under the retention policy set via snapshot_keep_recent and snapshot_keep_age. Snapshots being
+// served to peers or pinned are only pruned once no longer in use. Without a pruner, expired
+// snapshots are merely no longer advertised to peers.
+func WithSnapshotPruner(fn SnapshotPruneFunc) ReactorOption {
+	return func(r *Reactor) { r.pruner = fn }
+}
+
+// WithAppFormats sets a function which returns the snapshot formats supported by the app. When
+// the reactor starts, it fails if restore_formats, serving_formats, or format_priority contain
+// other formats. By default, the configured formats aren't validated.
+func WithAppFormats(fn AppFormatsFunc) ReactorOption {
+	return func(r *Reactor) { r.appFormats = fn }
+}
+
+// WithStagingApp sets a staging app instance, which snapshots are restored into if staging_restore
+// is enabled, such that the live app state is only replaced once the restored snapshot has been
+// verified. It is required by staging_restore. See StagingApp for details.
+func WithStagingApp(app StagingApp) ReactorOption {
+	return func(r *Reactor) {
+		r.staging = app
+		if r.config.StagingRestore {
+			r.syncerOptions = append(r.syncerOptions, withStagingApp(app))
+		}
+	}
 }
 
 // NewReactor creates a new state sync reactor.
-func NewReactor(conn proxy.AppConnSnapshot, connQuery proxy.AppConnQuery, tempDir string) *Reactor {
+func NewReactor(config *cfg.StateSyncConfig, conn proxy.AppConnSnapshot, connQuery proxy.AppConnQuery,
+	tempDir string, options ...ReactorOption) *Reactor {
 	r := &Reactor{
-		conn:      conn,
-		connQuery: connQuery,
+		config:      config,
+		conn:        conn,
+		connQuery:   connQuery,
+		servingConn: conn,
+		tempDir:     tempDir,
+		serving:     newServingTracker(servingIdleTimeout),
+		retention:   newSnapshotRetention(config.SnapshotKeepRecent, config.SnapshotKeepAge),
+		pinned:      newChunkCache(),
+		peerCaps:    newCapabilityTracker(),
+		latencies:   newPeerLatencies(),
+		syncers:     make(map[*syncer]struct{}),
+		metrics:     NopMetrics(),
 	}
+	if config.DiscoveryCatalogTTL > 0 {
+		r.catalog = newSnapshotCatalog(config.DiscoveryCatalogTTL)
+	}
+	if config.VerificationCacheTTL > 0 {
+		r.verified = newVerificationCache(config.VerificationCacheTTL)
+	}
+	if config.SnapshotAdvertiseWindow > 0 {
+		r.advertised = newAdvertisementTracker(config.SnapshotAdvertiseWindow)
+	}
+	if config.PeerReputationTTL > 0 {
+		r.reputation = newPeerReputation(config.PeerReputationTTL)
+	}
+	r.grace = newPeerGrace(config.PeerReconnectGrace)
+	r.stale = newStaleChunks(config.StragglerChunkWindow)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
 	r.BaseReactor = *p2p.NewBaseReactor("StateSync", r)
+	r.syncerOptions = append(r.syncerOptions, withPeerCount(r.peerCount), withPeerLatencies(r.latencies),
+		withRediscovery(r.rediscover), withVerificationCache(r.verified), withChunkLogging(&r.verboseChunks),
+		withPeerFeatures(r.peerCaps.Supports), withHello(r.hello), withPeerReputation(r.reputation),
+		withPeerGrace(r.grace), withStaleChunks(r.stale), withContext(r.ctx))
+	for _, option := range options {
+		option(r)
+	}
+	if config.ServingWorkers > 0 {
+		r.servers = newServingPool(config.ServingWorkers, r.metrics)
+	}
 	return r
 }
 
+// peerCount returns the number of connected peers.
+func (r *Reactor) peerCount() int {
+	if r.Switch == nil {
+		return 0
+	}
+	return r.Switch.Peers().Size()
+}
+
+// rediscover requests snapshots from all connected peers again.
+func (r *Reactor) rediscover() {
+	if r.Switch == nil {
+		return
+	}
+	r.requestSnapshots(r.Switch.Peers().List()...)
+}
+
+// dialSnapshotPeers asynchronously dials the configured snapshot peers which aren't connected yet.
+// They're dialed directly rather than via Switch.DialPeersAsync, such that they aren't added to
+// the address book. Dial failures are logged, and don't fail the sync, since snapshots may still
+// be discovered from other peers.
+func (r *Reactor) dialSnapshotPeers() {
+	if r.Switch == nil {
+		return
+	}
+	for _, addr := range r.config.SnapshotPeers {
+		netAddr, err := p2p.NewNetAddressString(addr)
+		if err != nil {
+			r.Logger.Error("Invalid snapshot peer address", "addr", addr, "err", err)
+			continue
+		}
+		if r.Switch.Peers().Has(netAddr.ID) {
+			continue
+		}
+		r.Logger.Info("Dialing snapshot peer", "addr", netAddr)
+		go func() {
+			if err := r.Switch.DialPeerWithAddress(netAddr); err != nil {
+				r.Logger.Error("Failed to dial snapshot peer", "addr", netAddr, "err", err)
+			}
+		}()
+	}
+}
+
 // GetChannels implements p2p.Reactor.
 func (r *Reactor) GetChannels() []*p2p.ChannelDescriptor {
 	return []*p2p.ChannelDescriptor{
@@ -68,25 +362,209 @@ func (r *Reactor) GetChannels() []*p2p.ChannelDescriptor {
 
 // OnStart implements p2p.Reactor.
 func (r *Reactor) OnStart() error {
+	if err := r.validateAppFormats(); err != nil {
+		return err
+	}
+	if r.config.StagingRestore && r.staging == nil {
+		return errNoStagingApp
+	}
+	if r.servers != nil {
+		r.servers.Start(r.Quit())
+	}
+	if r.tempDir != "" {
+		// Clean up garbage left behind by unclean shutdowns, such that syncs start afresh
+		// rather than failing on it.
+		removed, err := recoverTempDir(r.tempDir)
+		for _, path := range removed {
+			r.Logger.Error("Removed invalid state sync data from temp dir", "path", path)
+		}
+		if err != nil {
+			r.Logger.Error("Failed to validate state sync temp dir", "dir", r.tempDir, "err", err)
+		}
+		if r.catalog != nil {
+			if err := r.catalog.Load(r.tempDir); err != nil {
+				r.Logger.Error("Failed to load snapshot catalog", "err", err)
+			}
+			go r.flushCatalogRoutine()
+		}
+		if r.reputation != nil {
+			if err := r.reputation.Load(r.tempDir); err != nil {
+				r.Logger.Error("Failed to load peer reputation", "err", err)
+			}
+		}
+	}
+	if r.pruner != nil && r.retention.Enabled() {
+		go r.pruneRoutine()
+	}
 	return nil
 }
 
+// OnStop implements p2p.Reactor. It interrupts any state syncs in progress, see shutdown.go, and
+// persists any snapshots added to the catalog since it was last flushed.
+func (r *Reactor) OnStop() {
+	r.cancel()
+	if r.catalog != nil {
+		if err := r.catalog.Flush(); err != nil {
+			r.Logger.Error("Failed to persist snapshot catalog", "err", err)
+		}
+	}
+}
+
+// flushCatalogRoutine periodically persists the snapshots added to the catalog, until the reactor
+// is stopped.
+func (r *Reactor) flushCatalogRoutine() {
+	ticker := time.NewTicker(catalogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.catalog.Flush(); err != nil {
+				r.Logger.Error("Failed to persist snapshot catalog", "err", err)
+			}
+		case <-r.Quit():
+			return
+		}
+	}
+}
+
+// pruneRoutine periodically prunes expired local snapshots, until the reactor is stopped.
+func (r *Reactor) pruneRoutine() {
+	ticker := time.NewTicker(snapshotPruneInterval)
+	defer ticker.Stop()
+	for {
+		r.pruneSnapshots()
+		select {
+		case <-ticker.C:
+		case <-r.Quit():
+			return
+		}
+	}
+}
+
+// pruneSnapshots prunes the local snapshots expired under the retention policy via the pruner,
+// except for snapshots which are being served to peers, pinned, or restored.
+func (r *Reactor) pruneSnapshots() {
+	local, err := r.listSnapshots(recentSnapshots, log.NewNopLogger())
+	if err != nil {
+		r.Logger.Error("Failed to list snapshots for pruning", "err", err)
+		return
+	}
+	for _, s := range local {
+		switch {
+		case !s.expired:
+		case r.serving.Refs(s.Height, s.Format) > 0, r.pinned.Has(s.Height, s.Format), r.isRestoring(s.Height):
+			r.Logger.Debug("Deferring pruning of snapshot in use", "height", s.Height, "format", s.Format)
+		default:
+			if err := r.pruner(s.Height, s.Format); err != nil {
+				r.Logger.Error("Failed to prune snapshot", "height", s.Height, "format", s.Format, "err", err)
+				continue
+			}
+			r.metrics.PrunedSnapshots.Add(1)
+			r.Logger.Info("Pruned snapshot expired by retention policy", "height", s.Height,
+				"format", s.Format)
+		}
+	}
+}
+
 // AddPeer implements p2p.Reactor.
 func (r *Reactor) AddPeer(peer p2p.Peer) {
+	// Seed the latency estimate of known peers from their reputation, such that they're ranked
+	// without having to fetch chunks from them first.
+	if latency, ok := r.reputation.Latency(peer.ID()); ok {
+		if _, ok := r.latencies.Estimate(peer.ID()); !ok {
+			r.latencies.Observe(peer.ID(), latency)
+		}
+	}
+	returned := r.grace.Return(peer.ID())
 	r.mtx.RLock()
-	defer r.mtx.RUnlock()
-	if r.syncer != nil {
-		r.syncer.AddPeer(peer)
+	syncing := len(r.syncers) > 0
+	if returned {
+		r.Logger.Debug("Peer reconnected within grace", "peer", peer.ID())
+		for syncer := range r.syncers {
+			syncer.ReturnPeer(peer)
+		}
+	}
+	r.mtx.RUnlock()
+	if syncing {
+		r.requestSnapshots(peer)
 	}
 }
 
-// RemovePeer implements p2p.Reactor.
+// RemovePeer implements p2p.Reactor. Peers which disconnected, including due to connection errors
+// such as io.EOF which the switch reports remote disconnects with, are only removed once
+// peer_reconnect_grace expires without them reconnecting, if set. Peers stopped for violating the
+// state sync protocol are removed right away.
 func (r *Reactor) RemovePeer(peer p2p.Peer, reason interface{}) {
+	if !isProtocolViolation(reason) && r.grace.Leave(peer.ID(), func() { r.removePeer(peer, reason) }) {
+		r.Logger.Debug("Peer disconnected, deferring removal for reconnect grace", "peer", peer.ID(),
+			"grace", r.config.PeerReconnectGrace)
+		return
+	}
+	r.removePeer(peer, reason)
+}
+
+// removePeer removes a peer from the reactor and any state syncs in progress.
+func (r *Reactor) removePeer(peer p2p.Peer, reason interface{}) {
+	r.serving.RemovePeer(peer.ID())
+	r.peerCaps.RemovePeer(peer.ID())
+	r.latencies.RemovePeer(peer.ID())
+	if r.servers != nil {
+		r.servers.RemovePeer(peer.ID())
+	}
+	if r.catalog != nil {
+		r.catalog.RemovePeer(peer.ID())
+	}
+	if r.advertised != nil {
+		r.advertised.RemovePeer(peer.ID())
+	}
+	removal := peerRemoval(reason)
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
-	if r.syncer != nil {
-		r.syncer.RemovePeer(peer)
+	for syncer := range r.syncers {
+		syncer.RemovePeer(peer, removal)
+	}
+}
+
+// protocolViolation wraps the reason a peer is stopped for violating the state sync protocol, to
+// tell it apart from the connection errors the switch stops peers for.
+type protocolViolation struct {
+	error
+}
+
+// Unwrap returns the wrapped error.
+func (v protocolViolation) Unwrap() error {
+	return v.error
+}
+
+// isProtocolViolation checks whether a peer was removed for violating the state sync protocol,
+// rather than e.g. due to a connection error or by another reactor.
+func isProtocolViolation(reason interface{}) bool {
+	err, ok := reason.(error)
+	if !ok {
+		return false
+	}
+	var violation protocolViolation
+	return errors.As(err, &violation) || errors.Is(err, errChunkTooLarge) ||
+		errors.Is(err, errUnknownMessage) || errors.Is(err, errInvalidChunkProof)
+}
+
+// peerRemoval returns the reason to record for a peer removed from the reactor. Peers are only
+// considered to have failed if they violated the state sync protocol, since the switch also
+// reports remote disconnects as errors, e.g. io.EOF.
+func peerRemoval(reason interface{}) string {
+	if !isProtocolViolation(reason) {
+		return PeerRemovalDisconnected
+	}
+	err := reason.(error)
+	if errors.Is(err, errChunkTooLarge) || errors.Is(err, errInvalidChunkProof) {
+		return PeerRemovalBadChunk
 	}
+	return PeerRemovalError
+}
+
+// stopPeerForViolation disconnects a peer which violated the state sync protocol.
+func (r *Reactor) stopPeerForViolation(peer p2p.Peer, err error) {
+	r.Switch.StopPeerForError(peer, protocolViolation{err})
 }
 
 // Receive implements p2p.Reactor.
@@ -97,16 +575,29 @@ func (r *Reactor) Receive(chID byte, src p2p.Peer, msgBytes []byte) {
 		return
 	}
 
+	// Reject oversized chunk messages before decoding them, to avoid allocating another copy.
+	if chID == ChunkChannel && len(msgBytes) > chunkMsgSize {
+		err := fmt.Errorf("%w: message of %v bytes exceeds limit %v", errChunkTooLarge, len(msgBytes),
+			chunkMsgSize)
+		r.Logger.Error("Invalid message", "peer", src, "err", err)
+		r.stopPeerForViolation(src, err)
+		return
+	}
+
 	msg, err := decodeMsg(msgBytes)
+	if errors.Is(err, errUnknownMessage) {
+		r.unknownMessage(src, err)
+		return
+	}
 	if err != nil {
 		r.Logger.Error("Error decoding message", "src", src, "chId", chID, "msg", msg, "err", err, "bytes", msgBytes)
-		r.Switch.StopPeerForError(src, err)
+		r.stopPeerForViolation(src, err)
 		return
 	}
-	err = validateMsg(msg)
+	err = validateMsg(msg, r.config)
 	if err != nil {
 		r.Logger.Error("Invalid message", "peer", src, "msg", msg, "err", err)
-		r.Switch.StopPeerForError(src, err)
+		r.stopPeerForViolation(src, err)
 		return
 	}
 
@@ -114,114 +605,661 @@ func (r *Reactor) Receive(chID byte, src p2p.Peer, msgBytes []byte) {
 	case SnapshotChannel:
 		switch msg := msg.(type) {
 		case *ssproto.SnapshotsRequest:
-			snapshots, err := r.recentSnapshots(recentSnapshots)
-			if err != nil {
-				r.Logger.Error("Failed to fetch snapshots", "err", err)
-				return
-			}
-			for _, snapshot := range snapshots {
-				r.Logger.Debug("Advertising snapshot", "height", snapshot.Height,
-					"format", snapshot.Format, "peer", src.ID())
-				src.Send(chID, mustEncodeMsg(&ssproto.SnapshotsResponse{
-					Height:   snapshot.Height,
-					Format:   snapshot.Format,
-					Chunks:   snapshot.Chunks,
-					Hash:     snapshot.Hash,
-					Metadata: snapshot.Metadata,
-				}))
+			r.metrics.ServeRequests.With("type", "snapshots").Add(1)
+			// Peers embedding a Hello in their request can decode a standalone Hello, so we reply
+			// with our own the first time.
+			if msg.Hello != nil && r.peerCaps.Set(src.ID(), msg.Hello) {
+				r.Logger.Debug("Received hello", "version", msg.Hello.Version, "features",
+					msg.Hello.Features, "peer", src.ID())
+				src.TrySend(SnapshotChannel, mustEncodeMsg(r.hello()))
 			}
+			r.serve(src, true, func() { r.serveSnapshots(src) })
+
+		case *ssproto.Hello:
+			r.Logger.Debug("Received hello", "version", msg.Version, "features", msg.Features,
+				"peer", src.ID())
+			r.peerCaps.Set(src.ID(), msg)
 
 		case *ssproto.SnapshotsResponse:
+			// Snapshots pushed by peers while no state sync is in progress are still recorded in
+			// the discovery catalog, if enabled, for the next state sync.
 			r.mtx.RLock()
 			defer r.mtx.RUnlock()
-			if r.syncer == nil {
+			if len(r.syncers) == 0 && r.catalog == nil {
 				r.Logger.Debug("Received unexpected snapshot, no state sync in progress")
 				return
 			}
-			r.Logger.Debug("Received snapshot", "height", msg.Height, "format", msg.Format, "peer", src.ID())
-			_, err := r.syncer.AddSnapshot(src, &snapshot{
-				Height:   msg.Height,
-				Format:   msg.Format,
-				Chunks:   msg.Chunks,
-				Hash:     msg.Hash,
-				Metadata: msg.Metadata,
-			})
-			if err != nil {
-				r.Logger.Error("Failed to add snapshot", "height", msg.Height, "format", msg.Format,
+			if err := verifySnapshotsResponse(msg, src.ID()); err != nil {
+				r.Logger.Error("Invalid snapshot signature", "height", msg.Height, "format", msg.Format,
 					"peer", src.ID(), "err", err)
+				r.stopPeerForViolation(src, err)
 				return
 			}
+			r.Logger.Debug("Received snapshot", "height", msg.Height, "format", msg.Format, "peer", src.ID())
+			rediscover := false
+			for syncer := range r.syncers {
+				added, err := syncer.AddSnapshot(src, &snapshot{
+					Height:     msg.Height,
+					Format:     msg.Format,
+					Chunks:     msg.Chunks,
+					Hash:       msg.Hash,
+					Metadata:   msg.Metadata,
+					Preferred:  msg.Preferred,
+					BaseHeight: msg.BaseHeight,
+				})
+				if err != nil {
+					r.Logger.Error("Failed to add snapshot", "height", msg.Height, "format", msg.Format,
+						"peer", src.ID(), "err", err)
+					continue
+				}
+				if added && syncer.Rediscover(msg.Height) {
+					rediscover = true
+				}
+			}
+			if r.catalog != nil {
+				r.catalog.Add(src, &snapshot{
+					Height:     msg.Height,
+					Format:     msg.Format,
+					Chunks:     msg.Chunks,
+					Hash:       msg.Hash,
+					Metadata:   msg.Metadata,
+					Preferred:  msg.Preferred,
+					BaseHeight: msg.BaseHeight,
+				})
+			}
+			if rediscover {
+				r.Logger.Info("Discovered higher snapshot, requesting snapshots from peers again",
+					"height", msg.Height, "peer", src.ID())
+				r.requestSnapshots(r.Switch.Peers().List()...)
+			}
 
 		default:
-			r.Logger.Error("Received unknown message %T", msg)
+			r.unknownMessage(src, fmt.Errorf("%w %T on snapshot channel", errUnknownMessage, msg))
 		}
 
 	case ChunkChannel:
 		switch msg := msg.(type) {
 		case *ssproto.ChunkRequest:
-			r.Logger.Debug("Received chunk request", "height", msg.Height, "format", msg.Format,
+			r.metrics.ServeRequests.With("type", "chunk").Add(1)
+			r.chunkLogger().Debug("Received chunk request", "height", msg.Height, "format", msg.Format,
 				"chunk", msg.Index, "peer", src.ID())
-			resp, err := r.conn.LoadSnapshotChunkSync(abci.RequestLoadSnapshotChunk{
-				Height: msg.Height,
-				Format: msg.Format,
-				Chunk:  msg.Index,
-			})
-			if err != nil {
-				r.Logger.Error("Failed to load chunk", "height", msg.Height, "format", msg.Format,
-					"chunk", msg.Index, "err", err)
-				return
+			if r.ServingEnabled() {
+				r.serving.Touch(msg.Height, msg.Format, src.ID())
 			}
-			r.Logger.Debug("Sending chunk", "height", msg.Height, "format", msg.Format,
-				"chunk", msg.Index, "peer", src.ID())
-			src.Send(ChunkChannel, mustEncodeMsg(&ssproto.ChunkResponse{
-				Height:  msg.Height,
-				Format:  msg.Format,
-				Index:   msg.Index,
-				Chunk:   resp.Chunk,
-				Missing: resp.Chunk == nil,
-			}))
+			r.serve(src, false, func() { r.serveChunk(src, msg) })
 
 		case *ssproto.ChunkResponse:
 			r.mtx.RLock()
 			defer r.mtx.RUnlock()
-			if r.syncer == nil {
-				r.Logger.Debug("Received unexpected chunk, no state sync in progress", "peer", src.ID())
+			if len(r.syncers) == 0 {
+				if r.isStraggler() {
+					r.metrics.StragglerChunks.Add(1)
+					return
+				}
+				r.chunkLogger().Debug("Received unexpected chunk, no state sync in progress", "peer", src.ID())
 				return
 			}
-			r.Logger.Debug("Received chunk, adding to sync", "height", msg.Height, "format", msg.Format,
+			r.chunkLogger().Debug("Received chunk, adding to sync", "height", msg.Height, "format", msg.Format,
 				"chunk", msg.Index, "peer", src.ID())
-			_, err := r.syncer.AddChunk(&chunk{
-				Height: msg.Height,
-				Format: msg.Format,
-				Index:  msg.Index,
-				Chunk:  msg.Chunk,
-				Sender: src.ID(),
-			})
-			if err != nil {
+			// Chunks are only added to syncs restoring the chunk's snapshot. If several syncs are
+			// in progress, some of them will usually be restoring other snapshots.
+			var err error
+			added, matched := false, false
+			for syncer := range r.syncers {
+				if !syncer.HasChunks(msg.Height, msg.Format) {
+					continue
+				}
+				matched = true
+				ok, addErr := syncer.AddChunk(&chunk{
+					Height: msg.Height,
+					Format: msg.Format,
+					Index:  msg.Index,
+					Chunk:  msg.Chunk,
+					Sender: src.ID(),
+					Proof:  msg.Proof,
+				})
+				if addErr != nil {
+					err = addErr
+				}
+				added = added || ok
+			}
+			if errors.Is(err, errChunkTooLarge) {
+				r.Logger.Error("Received oversized chunk", "height", msg.Height, "format", msg.Format,
+					"chunk", msg.Index, "peer", src.ID(), "err", err)
+				r.stopPeerForViolation(src, err)
+				return
+			} else if errors.Is(err, errInvalidChunkProof) {
+				r.Logger.Error("Rejected chunk failing proof verification, rejecting peer", "height", msg.Height,
+					"format", msg.Format, "chunk", msg.Index, "peer", src.ID(), "err", err)
+				return
+			} else if err != nil {
 				r.Logger.Error("Failed to add chunk", "height", msg.Height, "format", msg.Format,
 					"chunk", msg.Index, "err", err)
 				return
 			}
+			if !matched && r.isStraggler() {
+				r.metrics.StragglerChunks.Add(1)
+				return
+			}
+			if !added {
+				r.chunkLogger().Debug("Ignoring chunk not needed by any state sync", "height", msg.Height,
+					"format", msg.Format, "chunk", msg.Index, "peer", src.ID())
+			}
 
 		default:
-			r.Logger.Error("Received unknown message %T", msg)
+			r.unknownMessage(src, fmt.Errorf("%w %T on chunk channel", errUnknownMessage, msg))
 		}
 
 	default:
-		r.Logger.Error("Received message on invalid channel %x", chID)
+		r.Logger.Error("Received message on invalid channel", "peer", src.ID(), "chID", fmt.Sprintf("%#x", chID))
 	}
 }
 
-// recentSnapshots fetches the n most recent snapshots from the app
-func (r *Reactor) recentSnapshots(n uint32) ([]*snapshot, error) {
-	resp, err := r.conn.ListSnapshotsSync(abci.RequestListSnapshots{})
+// unknownMessage handles a message of an unknown type, or of a type unexpected on its channel. By
+// default it is logged and ignored, while with unknown_messages = "disconnect" it is treated as a
+// protocol violation and the peer is disconnected, to detect incompatible peers early.
+func (r *Reactor) unknownMessage(src p2p.Peer, err error) {
+	if r.config.UnknownMessages == "disconnect" {
+		r.Logger.Error("Received unknown message, disconnecting peer", "peer", src.ID(), "err", err)
+		r.stopPeerForViolation(src, err)
+		return
+	}
+	r.Logger.Error("Received unknown message, ignoring it", "peer", src.ID(), "err", err)
+}
+
+// SetServingEnabled enables or disables serving snapshots and chunks to peers, e.g. to temporarily
+// shed load, without affecting the node's own state syncs. While disabled, snapshot requests are
+// ignored and chunk requests are answered as missing, such that peers fetch them elsewhere.
+// Serving is enabled by default.
+func (r *Reactor) SetServingEnabled(enabled bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.servingDisabled == !enabled {
+		return
+	}
+	r.servingDisabled = !enabled
+	if enabled {
+		r.Logger.Info("Enabled serving snapshots to peers")
+	} else {
+		r.Logger.Info("Disabled serving snapshots to peers")
+	}
+}
+
+// ServingEnabled checks whether snapshots and chunks are served to peers.
+func (r *Reactor) ServingEnabled() bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return !r.servingDisabled
+}
+
+// SetChunkLogging enables or disables verbose per-chunk logging at runtime. While enabled, events
+// for individual chunks of state syncs and served snapshots, which are otherwise logged at debug
+// level, are logged at info level, such that e.g. a stuck state sync can be debugged without
+// restarting the node. Combine with SyncerState() to inspect the chunks of the restore.
+func (r *Reactor) SetChunkLogging(verbose bool) {
+	var value int32
+	if verbose {
+		value = 1
+	}
+	if atomic.SwapInt32(&r.verboseChunks, value) != value {
+		r.Logger.Info("Set verbose chunk logging", "verbose", verbose)
+	}
+}
+
+// ChunkLogging checks whether verbose per-chunk logging is enabled.
+func (r *Reactor) ChunkLogging() bool {
+	return atomic.LoadInt32(&r.verboseChunks) != 0
+}
+
+// chunkLogger returns the logger for per-chunk events, which logs them at info level while
+// verbose chunk logging is enabled.
+func (r *Reactor) chunkLogger() log.Logger {
+	return verboseLogger{Logger: r.Logger, verbose: &r.verboseChunks}
+}
+
+// ServingHeights returns the heights of snapshots that are actively being served to peers, in
+// ascending order. A snapshot is considered actively served from a peer's first chunk request
+// until the peer disconnects or stops requesting chunks. Snapshot pruning should avoid removing
+// these, since the syncing peers would otherwise be unable to complete their restores.
+func (r *Reactor) ServingHeights() []uint64 {
+	return r.serving.Heights()
+}
+
+// Snapshots returns the catalog of snapshots discovered by the node's own state sync, ranked in
+// order of preference, followed by any rejected snapshots. It returns false if no state sync is
+// in progress.
+func (r *Reactor) Snapshots() ([]SnapshotInfo, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if r.syncer == nil {
+		return nil, false
+	}
+	return r.syncer.snapshots.Catalog(), true
+}
+
+// SyncerState returns a view of the internal state of the node's own state sync, e.g. for tests.
+// It returns false if no state sync is in progress.
+func (r *Reactor) SyncerState() (SyncerState, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if r.syncer == nil {
+		return SyncerState{}, false
+	}
+	return r.syncer.State(), true
+}
+
+// AbortChunk aborts the request in flight for a chunk of the snapshot being restored by the node's
+// own state sync, e.g. when the sync is stuck waiting on the chunk from a flaky peer, such that the
+// chunk is requested again from another peer if possible. The chunk requests in flight, and the
+// peers they were sent to, are listed by SyncerState(). Chunks which have already been received or
+// applied, or which haven't been requested yet, can't be aborted.
+func (r *Reactor) AbortChunk(index uint32) error {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if r.syncer == nil {
+		return errors.New("no state sync in progress")
+	}
+	return r.syncer.AbortChunk(index)
+}
+
+// EstimatedTimeRemaining estimates the time remaining until the snapshot being restored by the
+// node's own state sync is restored, from the rate its chunks have been applied at so far. Time
+// spent verifying the restored state is not included. It returns ETAUnknown if no snapshot is
+// being restored or too few chunks have been applied to estimate, and is safe to call at any time.
+func (r *Reactor) EstimatedTimeRemaining() (time.Duration, ETAConfidence) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if r.syncer == nil {
+		return 0, ETAUnknown
+	}
+	return r.syncer.EstimatedTimeRemaining()
+}
+
+// LocalSnapshotInfo describes a snapshot produced by the local app.
+type LocalSnapshotInfo struct {
+	Height     uint64
+	Format     uint32
+	Chunks     uint32
+	Hash       []byte
+	Metadata   []byte // app metadata, without any preference or diff snapshot markers
+	Preferred  bool   // whether the app prefers the snapshot
+	BaseHeight uint64 // base height of a diff snapshot, or 0 for full snapshots
+	Withheld   string // the reason the snapshot is not advertised to peers, if any
+	Peers      int    // number of peers the snapshot is actively being served to
+	Pinned     bool   // whether the snapshot's chunks are pinned in memory via PinSnapshot()
+}
+
+// PeerRemovals returns the reason each peer was removed from the node's own state sync, for peers
+// which had advertised snapshots or were rejected by the app. It returns false if no state sync is in
+// progress.
+func (r *Reactor) PeerRemovals() (map[p2p.ID]string, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if r.syncer == nil {
+		return nil, false
+	}
+	return r.syncer.snapshots.RemovedPeers(), true
+}
+
+// isStraggler checks whether a chunk which no state sync is restoring arrived within the
+// straggler_chunk_window of a state sync completing, in which case it is most likely a late
+// response to a chunk request made by that sync. The caller must hold r.mtx.
+func (r *Reactor) isStraggler() bool {
+	return !r.syncEnded.IsZero() && time.Since(r.syncEnded) < r.config.StragglerChunkWindow
+}
+
+// serve runs a task serving a peer's snapshot or chunk request, either on the serving pool or
+// inline if no pool is configured. Snapshot requests are given priority over chunk requests on
+// the pool, such that chunk traffic doesn't hold up snapshot discovery; their responses are
+// likewise prioritized by the snapshot channel's higher send priority. Requests are dropped if the
+// peer's serving queue is full.
+func (r *Reactor) serve(src p2p.Peer, priority bool, task func()) {
+	if r.servers == nil {
+		task()
+		return
+	}
+	submit := r.servers.Submit
+	if priority {
+		submit = r.servers.SubmitPriority
+	}
+	if !submit(src.ID(), task) {
+		r.Logger.Info("Serving queue full, dropping request", "peer", src.ID())
+	}
+}
+
+// AdvertiseSnapshots pushes our recent snapshots to all connected peers, e.g. after the app took a
+// new snapshot, rather than waiting for peers to request them. They are sent as regular snapshot
+// advertisements, which peers add to their state syncs in progress and discovery catalogs, and
+// which other peers, including legacy ones, ignore. Pushes are best-effort, skipping peers whose
+// send queue is full, and are limited to one per snapshotAdvertiseInterval, returning
+// ErrAdvertiseRateLimited otherwise. It returns the number of peers the snapshots were pushed to.
+func (r *Reactor) AdvertiseSnapshots() (int, error) {
+	if !r.ServingEnabled() {
+		return 0, errors.New("serving snapshots is disabled")
+	}
+	r.mtx.Lock()
+	if wait := time.Until(r.lastAdvertise.Add(snapshotAdvertiseInterval)); wait > 0 {
+		r.mtx.Unlock()
+		return 0, fmt.Errorf("%w: retry in %v", ErrAdvertiseRateLimited, wait.Round(time.Millisecond))
+	}
+	r.lastAdvertise = time.Now()
+	r.mtx.Unlock()
+
+	snapshots, err := r.recentSnapshots(recentSnapshots)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch snapshots: %w", err)
+	}
+	if len(snapshots) == 0 || r.Switch == nil {
+		return 0, nil
+	}
+	peers := r.Switch.Peers().List()
+	for _, peer := range peers {
+		r.advertiseSnapshots(peer, snapshots, true)
+	}
+	r.Logger.Info("Pushed snapshots to peers", "snapshots", len(snapshots), "peers", len(peers))
+	return len(peers), nil
+}
+
+// serveSnapshots advertises our recent snapshots to a peer, skipping snapshots already advertised
+// to it within snapshot_advertise_window.
+func (r *Reactor) serveSnapshots(src p2p.Peer) {
+	if !r.ServingEnabled() {
+		r.Logger.Debug("Serving disabled, ignoring snapshot request", "peer", src.ID())
+		return
+	}
+	snapshots, err := r.recentSnapshots(recentSnapshots)
+	if err != nil {
+		r.Logger.Error("Failed to fetch snapshots", "err", err)
+		return
+	}
+	if len(snapshots) == 0 {
+		// Commonly the app isn't configured to take snapshots, which is otherwise easy to miss.
+		r.Logger.Debug("No local snapshots to advertise", "peer", src.ID())
+		r.metrics.EmptySnapshotRequests.Add(1)
+		return
+	}
+	r.advertiseSnapshots(src, snapshots, false)
+}
+
+// advertiseSnapshots sends snapshot advertisements to a peer. Pushed advertisements are sent
+// regardless of the advertisement window, and are dropped if the peer's send queue is full.
+func (r *Reactor) advertiseSnapshots(src p2p.Peer, snapshots []*snapshot, push bool) {
+	send := src.Send
+	if push {
+		send = src.TrySend
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.BaseHeight > 0 && !r.peerCaps.Supports(src.ID(), featureDiffSnapshots) {
+			r.Logger.Debug("Not advertising diff snapshot to peer without diff snapshot support",
+				"height", snapshot.Height, "format", snapshot.Format, "peer", src.ID())
+			continue
+		}
+		switch {
+		case r.advertised == nil:
+		case push:
+			r.advertised.Record(src.ID(), snapshot.Height, snapshot.Format)
+		case !r.advertised.Advertise(src.ID(), snapshot.Height, snapshot.Format):
+			r.Logger.Debug("Not advertising snapshot recently advertised to peer", "height", snapshot.Height,
+				"format", snapshot.Format, "peer", src.ID())
+			continue
+		}
+		r.Logger.Debug("Advertising snapshot", "height", snapshot.Height,
+			"format", snapshot.Format, "peer", src.ID())
+		resp := &ssproto.SnapshotsResponse{
+			Height:     snapshot.Height,
+			Format:     snapshot.Format,
+			Chunks:     snapshot.Chunks,
+			Hash:       snapshot.Hash,
+			Metadata:   snapshot.Metadata,
+			Preferred:  snapshot.Preferred,
+			BaseHeight: snapshot.BaseHeight,
+		}
+		if r.config.SignSnapshots && r.nodeKey != nil {
+			if err := signSnapshotsResponse(resp, r.nodeKey); err != nil {
+				r.Logger.Error("Failed to sign snapshot, sending unsigned", "height", snapshot.Height,
+					"format", snapshot.Format, "err", err)
+			}
+		}
+		send(SnapshotChannel, mustEncodeMsg(resp))
+	}
+}
+
+// serveChunk sends a requested snapshot chunk to a peer. Chunks at heights being restored are
+// reported as missing, since the app may not have them yet.
+func (r *Reactor) serveChunk(src p2p.Peer, msg *ssproto.ChunkRequest) {
+	serving := r.ServingEnabled()
+	if !serving || r.isRestoring(msg.Height) {
+		reason := "height being restored"
+		if !serving {
+			reason = "serving disabled"
+		}
+		r.chunkLogger().Debug("Not serving chunk", "reason", reason, "height", msg.Height,
+			"format", msg.Format, "chunk", msg.Index, "peer", src.ID())
+		r.sendChunk(src, msg, mustEncodeMsg(&ssproto.ChunkResponse{
+			Height:  msg.Height,
+			Format:  msg.Format,
+			Index:   msg.Index,
+			Missing: true,
+		}))
+		return
+	}
+	resp, err := r.loadChunk(msg.Height, msg.Format, msg.Index)
+	if err != nil {
+		r.Logger.Error("Failed to load chunk", "height", msg.Height, "format", msg.Format,
+			"chunk", msg.Index, "err", err)
+		return
+	}
+	chunk, proof := resp.Chunk, []byte(nil)
+	switch {
+	case chunk == nil:
+		r.checkIncomplete(msg.Height, msg.Format, msg.Index, src)
+	case msg.Proof && r.prover != nil:
+		// The peer would reject the chunk without a valid proof, so it is reported missing instead.
+		if proof = r.proveChunk(msg, chunk); proof == nil {
+			chunk = nil
+		}
+	}
+	if chunk != nil {
+		r.metrics.ServedChunks.Add(1)
+		r.metrics.ServedChunkSize.Observe(float64(len(chunk)))
+		r.metrics.ServedChunkBytes.With("height", strconv.FormatUint(msg.Height, 10)).Add(float64(len(chunk)))
+	}
+	r.chunkLogger().Debug("Sending chunk", "height", msg.Height, "format", msg.Format,
+		"chunk", msg.Index, "peer", src.ID())
+	r.sendChunk(src, msg, mustEncodeMsg(&ssproto.ChunkResponse{
+		Height:  msg.Height,
+		Format:  msg.Format,
+		Index:   msg.Index,
+		Chunk:   chunk,
+		Missing: chunk == nil,
+		Proof:   proof,
+	}))
+}
+
+// proveChunk fetches the proof of a served chunk from the chunk prover, or nil if it can't be
+// proven.
+func (r *Reactor) proveChunk(msg *ssproto.ChunkRequest, chunk []byte) []byte {
+	proof, err := r.prover(msg.Height, msg.Format, msg.Index, chunk)
+	switch {
+	case err != nil:
+		r.Logger.Error("Failed to prove chunk", "height", msg.Height, "format", msg.Format,
+			"chunk", msg.Index, "err", err)
+		return nil
+	case len(proof) > maxChunkProofSize:
+		r.Logger.Error("Not serving chunk with oversized proof", "height", msg.Height, "format", msg.Format,
+			"chunk", msg.Index, "size", len(proof), "limit", maxChunkProofSize)
+		return nil
+	case len(proof) == 0:
+		r.chunkLogger().Debug("Chunk has no proof", "height", msg.Height, "format", msg.Format,
+			"chunk", msg.Index)
+		return nil
+	}
+	return proof
+}
+
+// hello builds the Hello message advertising our protocol version and features, including chunk
+// proofs if a chunk prover is set.
+func (r *Reactor) hello() *ssproto.Hello {
+	hello := makeHello(r.config)
+	if r.prover != nil {
+		hello.Features = append(hello.Features, featureChunkProofs)
+	}
+	return hello
+}
+
+// sendChunk queues a chunk response for sending to a peer. If the peer's chunk send queue is full,
+// the chunk_send_policy decides whether to wait for it to drain, holding back the peer's further
+// requests, or to drop the response.
+func (r *Reactor) sendChunk(src p2p.Peer, msg *ssproto.ChunkRequest, resp []byte) {
+	if src.TrySend(ChunkChannel, resp) {
+		return
+	}
+	r.metrics.ChunkSendQueueFull.With("peer_id", string(src.ID())).Add(1)
+	if r.config.ChunkSendPolicy == "backpressure" {
+		r.chunkLogger().Debug("Chunk send queue full, waiting for it to drain", "height", msg.Height,
+			"format", msg.Format, "chunk", msg.Index, "peer", src.ID())
+		if src.Send(ChunkChannel, resp) {
+			return
+		}
+	}
+	r.metrics.DroppedChunkResponses.With("peer_id", string(src.ID())).Add(1)
+	r.Logger.Info("Chunk send queue full, dropping chunk response", "height", msg.Height,
+		"format", msg.Format, "chunk", msg.Index, "peer", src.ID())
+}
+
+// checkIncomplete is called when the app is missing a requested chunk. If the snapshot is still
+// listed by the app, it is incomplete and is no longer advertised to peers, since they would never
+// be able to finish syncing it. Otherwise, it has most likely been pruned.
+func (r *Reactor) checkIncomplete(height uint64, format uint32, index uint32, src p2p.Peer) {
+	resp, err := r.servingConn.ListSnapshotsSync(abci.RequestListSnapshots{})
+	if err != nil {
+		r.Logger.Error("Failed to list snapshots", "err", err)
+		return
+	}
+	for _, s := range resp.Snapshots {
+		if s.Height != height || s.Format != format || index >= s.Chunks {
+			continue
+		}
+		if r.serving.MarkIncomplete(height, format) {
+			r.Logger.Error("Snapshot is missing chunk, no longer advertising it", "height", height,
+				"format", format, "chunk", index, "peer", src.ID())
+			r.metrics.IncompleteSnapshots.Add(1)
+		}
+		return
+	}
+	r.Logger.Info("Snapshot chunk not found, it may have been pruned", "height", height,
+		"format", format, "chunk", index, "peer", src.ID())
+}
+
+// requestSnapshots requests snapshots from the given peers, for snapshot discovery. It never
+// blocks: if a peer's send queue is full, the request is queued and retried in the background
+// until it is sent, the peer or reactor stops, or snapshotRequestTimeout passes.
+func (r *Reactor) requestSnapshots(peers ...p2p.Peer) {
+	msg := mustEncodeMsg(&ssproto.SnapshotsRequest{Hello: r.hello()})
+	for _, peer := range peers {
+		r.Logger.Debug("Requesting snapshots from peer", "peer", peer.ID())
+		if peer.TrySend(SnapshotChannel, msg) {
+			continue
+		}
+		go func(peer p2p.Peer) {
+			ticker := time.NewTicker(snapshotRequestRetryInterval)
+			defer ticker.Stop()
+			timeout := time.NewTimer(snapshotRequestTimeout)
+			defer timeout.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if !peer.IsRunning() || peer.TrySend(SnapshotChannel, msg) {
+						return
+					}
+				case <-timeout.C:
+					r.Logger.Info("Failed to request snapshots from peer, send queue full", "peer", peer.ID())
+					return
+				case <-r.Quit():
+					return
+				}
+			}
+		}(peer)
+	}
+}
+
+// loadChunk loads a snapshot chunk, from the pinned snapshot cache if possible.
+func (r *Reactor) loadChunk(height uint64, format uint32, index uint32) (*abci.ResponseLoadSnapshotChunk, error) {
+	if chunk, ok := r.pinned.Get(height, format, index); ok {
+		return &abci.ResponseLoadSnapshotChunk{Chunk: chunk}, nil
+	}
+	return r.servingConn.LoadSnapshotChunkSync(abci.RequestLoadSnapshotChunk{
+		Height: height,
+		Format: format,
+		Chunk:  index,
+	})
+}
+
+// localSnapshot is a snapshot listed by the local app, along with the reason it is withheld from
+// peers, if any, and whether it has expired under the retention policy.
+type localSnapshot struct {
+	*snapshot
+	withheld string
+	expired  bool
+}
+
+// listSnapshots lists the snapshots of the local app, in the order they are advertised to peers:
+// snapshots the app prefers first, then by descending height and format. Only the n most recent
+// snapshots are advertised, skipping snapshots found to be missing chunks while serving them,
+// snapshots at heights being restored, snapshots expired under the retention policy, snapshots in
+// formats not enabled for serving via
+// serving_formats, and snapshots with invalid base heights or metadata exceeding
+// max_metadata_bytes. The latter are logged to the given logger.
+func (r *Reactor) listSnapshots(n uint32, logger log.Logger) ([]localSnapshot, error) {
+	resp, err := r.servingConn.ListSnapshotsSync(abci.RequestListSnapshots{})
 	if err != nil {
 		return nil, err
 	}
-	sort.Slice(resp.Snapshots, func(i, j int) bool {
-		a := resp.Snapshots[i]
-		b := resp.Snapshots[j]
+	expired := r.retention.Expired(resp.Snapshots)
+	snapshots := make([]localSnapshot, 0, len(resp.Snapshots))
+	for _, s := range resp.Snapshots {
+		preferred, metadata := splitPreferredMetadata(s.Metadata)
+		baseHeight, metadata := DecodeDiffSnapshotMetadata(metadata)
+		local := localSnapshot{snapshot: &snapshot{
+			Height:     s.Height,
+			Format:     s.Format,
+			Chunks:     s.Chunks,
+			Hash:       s.Hash,
+			Metadata:   metadata,
+			Preferred:  preferred,
+			BaseHeight: baseHeight,
+		}, expired: expired[servedSnapshot{Height: s.Height, Format: s.Format}]}
+		heightErr := validateHeight(s.Height)
+		switch max := maxMetadataSize(r.config); {
+		case r.serving.Incomplete(s.Height, s.Format):
+			local.withheld = "missing chunks"
+		case r.isRestoring(s.Height):
+			local.withheld = "being restored"
+		case local.expired:
+			local.withheld = "expired by retention policy"
+		case !r.config.ServesFormat(s.Format):
+			local.withheld = "format not served"
+		case heightErr != nil:
+			logger.Error("Not advertising snapshot with invalid height", "height", s.Height,
+				"format", s.Format, "err", heightErr)
+			local.withheld = "invalid height"
+		case baseHeight >= s.Height:
+			logger.Error("Not advertising diff snapshot with invalid base height", "height", s.Height,
+				"format", s.Format, "base", baseHeight)
+			local.withheld = "invalid base height"
+		case len(metadata) > max:
+			logger.Error("Not advertising snapshot with oversized metadata", "height", s.Height,
+				"format", s.Format, "size", len(metadata), "limit", max)
+			local.withheld = "oversized metadata"
+		}
+		snapshots = append(snapshots, local)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		a := snapshots[i]
+		b := snapshots[j]
 		switch {
+		case a.Preferred != b.Preferred:
+			return a.Preferred
 		case a.Height > b.Height:
 			return true
 		case a.Height == b.Height && a.Format > b.Format:
@@ -230,40 +1268,363 @@ func (r *Reactor) recentSnapshots(n uint32) ([]*snapshot, error) {
 			return false
 		}
 	})
-	snapshots := make([]*snapshot, 0, n)
-	for i, s := range resp.Snapshots {
-		if i >= recentSnapshots {
-			break
-		}
-		snapshots = append(snapshots, &snapshot{
-			Height:   s.Height,
-			Format:   s.Format,
-			Chunks:   s.Chunks,
-			Hash:     s.Hash,
-			Metadata: s.Metadata,
-		})
+	advertised := uint32(0)
+	for i := range snapshots {
+		switch {
+		case snapshots[i].withheld != "":
+		case advertised >= n:
+			snapshots[i].withheld = "not among recent snapshots"
+		default:
+			advertised++
+		}
+	}
+	return snapshots, nil
+}
+
+// isRestoring checks whether a snapshot at the given height is being restored by any state sync,
+// in which case the app may only have some of the height's data.
+func (r *Reactor) isRestoring(height uint64) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for syncer := range r.syncers {
+		if syncer.IsRestoring(height) {
+			return true
+		}
+	}
+	return false
+}
+
+// recentSnapshots fetches the n most recent snapshots from the app that are advertised to peers,
+// as ordered by listSnapshots.
+func (r *Reactor) recentSnapshots(n uint32) ([]*snapshot, error) {
+	local, err := r.listSnapshots(n, r.Logger)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*snapshot, 0, len(local))
+	for _, s := range local {
+		if s.withheld == "" {
+			snapshots = append(snapshots, s.snapshot)
+		}
 	}
 	return snapshots, nil
 }
 
+// LocalSnapshots lists the snapshots produced by the local app, in the order they are advertised
+// to peers, along with their serving state. Snapshots which are not advertised to peers are
+// listed with the reason they are withheld. This is read-only, and does not advertise snapshots.
+func (r *Reactor) LocalSnapshots() ([]LocalSnapshotInfo, error) {
+	local, err := r.listSnapshots(recentSnapshots, log.NewNopLogger())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	infos := make([]LocalSnapshotInfo, 0, len(local))
+	for _, s := range local {
+		infos = append(infos, LocalSnapshotInfo{
+			Height:     s.Height,
+			Format:     s.Format,
+			Chunks:     s.Chunks,
+			Hash:       s.Hash,
+			Metadata:   s.Metadata,
+			Preferred:  s.Preferred,
+			BaseHeight: s.BaseHeight,
+			Withheld:   s.withheld,
+			Peers:      r.serving.Refs(s.Height, s.Format),
+			Pinned:     r.pinned.Has(s.Height, s.Format),
+		})
+	}
+	return infos, nil
+}
+
+// SyncTarget is an independent state sync restore target, for use with SyncTo().
+type SyncTarget struct {
+	// Conn and ConnQuery are the snapshot and query connections of the app to restore into.
+	Conn      proxy.AppConnSnapshot
+	ConnQuery proxy.AppConnQuery
+	// StateProvider verifies snapshots and provides the state and commit at the snapshot height.
+	StateProvider StateProvider
+	// TempDir is the directory to store chunks and restore records in, which must not be
+	// shared with other syncs. Defaults to the OS temp dir, in which case restores are not
+	// recorded.
+	TempDir string
+	// Reconnect optionally re-establishes Conn and ConnQuery if they are lost mid-restore.
+	Reconnect AppReconnectFunc
+}
+
+// SyncResult is the result of a successful state sync.
+type SyncResult struct {
+	// State and Commit are the new state and the last commit at the snapshot height, which the
+	// caller must store in the state database and block store.
+	State  sm.State
+	Commit *types.Commit
+
+	// Height, Format, Chunks, and Hash describe the restored snapshot.
+	Height uint64
+	Format uint32
+	Chunks uint32
+	Hash   []byte
+	// AppHash is the app hash at the snapshot height, as verified by the state provider.
+	AppHash []byte
+	// Peers is the number of peers that had the snapshot when the restore completed.
+	Peers int
+	// Time is the block time at the snapshot height.
+	Time time.Time
+	// Offers is the number of snapshot offers made to the app, including re-offers.
+	Offers int
+	// Selection records why the restored snapshot was selected over the other candidates.
+	Selection *SelectDecision
+	// NetworkHeight is the best-known height of the network when the restore completed, as
+	// reported by the state provider, or 0 if unknown. See Gap().
+	NetworkHeight uint64
+}
+
+// SyncProgress describes how far a state sync got, e.g. to diagnose a failed sync and decide
+// whether retrying it is worthwhile.
+type SyncProgress struct {
+	// Height, Format, Chunks, and Hash describe the last snapshot selected for restoration, if
+	// any. Height is 0 if no snapshot was selected, e.g. because none were discovered.
+	Height uint64
+	Format uint32
+	Chunks uint32
+	Hash   []byte
+	// ChunksApplied is the number of chunks of the snapshot accepted by the app. It is reset if
+	// the app asks to retry the restoration from the start.
+	ChunksApplied uint32
+	// SnapshotsTried is the number of snapshots selected for restoration, including the last one.
+	SnapshotsTried int
+	// Offers is the number of snapshot offers made to the app, including re-offers.
+	Offers int
+	// Deadline is the time by which the last snapshot selected for restoration is expected to be
+	// restored, derived from its chunk count and chunk_time_budget. It is zero if no deadline
+	// applies, or until chunks are being fetched.
+	Deadline time.Time
+	// Selection records why the last snapshot selected for restoration was selected over the
+	// other candidates, if any.
+	Selection *SelectDecision
+}
+
+// ETAConfidence indicates how reliable an estimate of the time remaining for a state sync is.
+type ETAConfidence int
+
+const (
+	// ETAUnknown means that no estimate is available, because no snapshot is being restored or too
+	// few of its chunks have been applied yet.
+	ETAUnknown ETAConfidence = iota
+	// ETALow means that the estimate is based on few chunks, early in the restore, and may be far
+	// off.
+	ETALow
+	// ETAHigh means that the estimate is based on a substantial part of the snapshot.
+	ETAHigh
+)
+
+// String implements fmt.Stringer.
+func (c ETAConfidence) String() string {
+	switch c {
+	case ETALow:
+		return "low"
+	case ETAHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// Age returns the age of the restored snapshot, i.e. the time since its block time.
+func (r *SyncResult) Age() time.Duration {
+	return time.Since(r.Time)
+}
+
+// Gap returns the number of blocks between the restored snapshot and the best-known network
+// height, which block sync has to fill. It is 0 if the network height is unknown.
+func (r *SyncResult) Gap() uint64 {
+	if r.NetworkHeight <= r.Height {
+		return 0
+	}
+	return r.NetworkHeight - r.Height
+}
+
 // Sync runs a state sync, returning the new state and last commit at the snapshot height.
-// The caller must store the state and commit in the state database and block store.
+// The caller must store the state and commit in the state database and block store. See
+// SyncSnapshot() for details about the restored snapshot.
 func (r *Reactor) Sync(stateProvider StateProvider, discoveryTime time.Duration) (sm.State, *types.Commit, error) {
+	return syncResultTuple(r.SyncSnapshot(stateProvider, discoveryTime))
+}
+
+// SyncSnapshot runs a state sync, returning the new state and last commit at the snapshot height
+// along with details about the restored snapshot. The caller must store the state and commit in
+// the state database and block store. It only returns once the app reports the restored height
+// and app hash, waiting up to app_flush_timeout for the app to finish applying the snapshot.
+func (r *Reactor) SyncSnapshot(stateProvider StateProvider, discoveryTime time.Duration) (*SyncResult, error) {
+	result, _, err := r.SyncWithProgress(stateProvider, discoveryTime)
+	return result, err
+}
+
+// SyncWithProgress is like SyncSnapshot(), but also returns the progress made by the sync, notably
+// when it fails: a sync which failed after applying most chunks of a snapshot may be worth
+// retrying, unlike one which found no usable snapshots.
+func (r *Reactor) SyncWithProgress(
+	stateProvider StateProvider,
+	discoveryTime time.Duration,
+) (*SyncResult, SyncProgress, error) {
+	if stateProvider == nil {
+		return nil, SyncProgress{}, errNoStateProvider
+	}
+	if err := r.checkExistingState(); err != nil {
+		return nil, SyncProgress{}, err
+	}
+	syncer := newSyncer(r.config, r.Logger, r.conn, r.connQuery, stateProvider, r.tempDir, r.syncerOptions...)
 	r.mtx.Lock()
 	if r.syncer != nil {
 		r.mtx.Unlock()
-		return sm.State{}, nil, errors.New("a state sync is already in progress")
+		return nil, SyncProgress{}, errors.New("a state sync is already in progress")
 	}
-	r.syncer = newSyncer(r.Logger, r.conn, r.connQuery, stateProvider, r.tempDir)
+	r.syncer = syncer
 	r.mtx.Unlock()
+	defer func() {
+		r.mtx.Lock()
+		r.syncer = nil
+		r.mtx.Unlock()
+	}()
 
-	// Request snapshots from all currently connected peers
-	r.Logger.Debug("Requesting snapshots from known peers")
-	r.Switch.Broadcast(SnapshotChannel, mustEncodeMsg(&ssproto.SnapshotsRequest{}))
+	// Resume a discovery interrupted by a restart, if the catalog was persisted.
+	if r.catalog != nil {
+		elapsed, err := r.catalog.StartDiscovery()
+		if err != nil {
+			r.Logger.Error("Failed to persist snapshot catalog", "err", err)
+		}
+		if elapsed > 0 {
+			r.Logger.Info("Resuming snapshot discovery interrupted by restart", "elapsed", elapsed)
+		}
+		syncer.resumedDiscovery = elapsed
+	}
+
+	result, err := r.runSync(syncer, discoveryTime)
+	if err == nil && r.catalog != nil {
+		if err := r.catalog.SyncCompleted(); err != nil {
+			r.Logger.Error("Failed to remove snapshot catalog", "err", err)
+		}
+	}
+	return result, syncer.Progress(), err
+}
+
+// checkExistingState refuses to state sync if the app already has state, i.e. reports a height
+// above 0, since restoring a snapshot over it could corrupt it, e.g. when state sync is mistakenly
+// enabled on a node whose Tendermint data was wiped but whose app data wasn't. This is overridden
+// by unsafe_force_sync, and doesn't apply with diff_snapshots, which are restored on top of the
+// app's state.
+func (r *Reactor) checkExistingState() error {
+	if r.connQuery == nil || r.config.DiffSnapshots {
+		return nil
+	}
+	resp, err := r.connQuery.InfoSync(proxy.RequestInfo)
+	if err != nil {
+		return fmt.Errorf("failed to query ABCI app for height: %w", err)
+	}
+	if resp.LastBlockHeight <= 0 {
+		return nil
+	}
+	if r.config.UnsafeForceSync {
+		r.Logger.Error("ABCI app already has state, state syncing over it as forced by unsafe_force_sync",
+			"height", resp.LastBlockHeight)
+		return nil
+	}
+	return fmt.Errorf("%w: ABCI app is at height %v (set unsafe_force_sync to override)", errExistingState,
+		resp.LastBlockHeight)
+}
 
-	state, commit, err := r.syncer.SyncAny(discoveryTime)
+// SyncTo runs a state sync into the given target, returning the new state and last commit at the
+// snapshot height. Unlike Sync(), several syncs into separate targets may run concurrently, each
+// using the snapshots and chunks received by the reactor. This is mostly useful for test harnesses
+// that drive many independent syncs from a single process. See SyncSnapshotTo() for details about
+// the restored snapshot.
+func (r *Reactor) SyncTo(target SyncTarget, discoveryTime time.Duration) (sm.State, *types.Commit, error) {
+	return syncResultTuple(r.SyncSnapshotTo(target, discoveryTime))
+}
+
+// SyncSnapshotTo is like SyncTo(), but also returns details about the restored snapshot.
+func (r *Reactor) SyncSnapshotTo(target SyncTarget, discoveryTime time.Duration) (*SyncResult, error) {
+	if target.StateProvider == nil {
+		return nil, errNoStateProvider
+	}
+	options := append(append([]syncerOption{}, r.syncerOptions...), withAppReconnect(target.Reconnect))
+	return r.runSync(newSyncer(r.config, r.Logger, target.Conn, target.ConnQuery, target.StateProvider,
+		target.TempDir, options...), discoveryTime)
+}
+
+// reuseCatalog adds the snapshots retained in the catalog to a syncer. Only snapshots from peers
+// that are still connected are reused, and they are verified by the syncer's state provider.
+// Snapshots loaded from disk are reused once their peer has reconnected.
+func (r *Reactor) reuseCatalog(syncer *syncer) {
+	reused := 0
+	for _, entry := range r.catalog.Entries() {
+		peer := entry.peer
+		if peer == nil && r.Switch != nil {
+			peer = r.Switch.Peers().Get(entry.peerID)
+		}
+		if peer == nil || !peer.IsRunning() {
+			continue
+		}
+		s := entry.snapshot
+		added, err := syncer.AddSnapshot(peer, &s)
+		if err != nil {
+			r.Logger.Debug("Failed to reuse snapshot", "height", s.Height, "format", s.Format,
+				"peer", entry.peerID, "err", err)
+			continue
+		}
+		if added {
+			reused++
+		}
+	}
+	if reused > 0 {
+		r.Logger.Info("Reusing snapshots discovered by previous state sync", "snapshots", reused)
+	}
+}
+
+// syncResultTuple converts a sync result to the state and commit returned by Sync() and SyncTo().
+func syncResultTuple(result *SyncResult, err error) (sm.State, *types.Commit, error) {
+	if err != nil {
+		return sm.State{}, nil, err
+	}
+	return result.State, result.Commit, nil
+}
+
+// runSync runs a syncer, feeding it snapshots and chunks received from peers while it runs.
+func (r *Reactor) runSync(syncer *syncer, discoveryTime time.Duration) (*SyncResult, error) {
+	// The app height is needed to add diff snapshots, which are received as soon as the syncer is
+	// registered, and mustn't be queried by the message handlers.
+	if err := syncer.loadAppHeight(); err != nil {
+		return nil, err
+	}
 	r.mtx.Lock()
-	r.syncer = nil
+	r.syncers[syncer] = struct{}{}
 	r.mtx.Unlock()
-	return state, commit, err
+	// A state sync takes precedence over any snapshot verification in progress.
+	r.cancelVerification()
+	defer func() {
+		// Message handlers only use the syncer while holding r.mtx, so once it is unregistered
+		// none of them can still be feeding it, and it can be closed.
+		r.mtx.Lock()
+		delete(r.syncers, syncer)
+		r.syncEnded = time.Now()
+		r.mtx.Unlock()
+		syncer.Close()
+		if err := r.reputation.Save(); err != nil {
+			r.Logger.Error("Failed to persist peer reputation", "err", err)
+		}
+	}()
+
+	// Reuse snapshots discovered by previous syncs, if enabled. Snapshots and peers rejected by a
+	// failed sync are removed from the catalog, such that retries don't reuse them.
+	if r.catalog != nil {
+		r.reuseCatalog(syncer)
+		defer r.catalog.RemoveBlacklisted(syncer.snapshots)
+	}
+
+	// Request snapshots from all currently connected peers, and dial the configured snapshot peers,
+	// which are asked for snapshots by AddPeer once connected.
+	r.Logger.Debug("Requesting snapshots from known peers")
+	r.rediscover()
+	r.dialSnapshotPeers()
+
+	return syncer.SyncAny(discoveryTime)
 }
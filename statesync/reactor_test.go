@@ -1,18 +1,35 @@
 package statesync
 
 import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/gogo/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
 	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
 	"github.com/tendermint/tendermint/p2p"
 	p2pmocks "github.com/tendermint/tendermint/p2p/mocks"
 	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	"github.com/tendermint/tendermint/proxy"
 	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	"github.com/tendermint/tendermint/statesync/mocks"
 )
 
 func TestReactor_Receive_ChunkRequest(t *testing.T) {
@@ -46,21 +63,31 @@ func TestReactor_Receive_ChunkRequest(t *testing.T) {
 				Format: tc.request.Format,
 				Chunk:  tc.request.Index,
 			}).Return(&abci.ResponseLoadSnapshotChunk{Chunk: tc.chunk}, nil)
+			conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Maybe().
+				Return(&abci.ResponseListSnapshots{}, nil)
 
 			// Mock peer to store response, if found
 			peer := &p2pmocks.Peer{}
 			peer.On("ID").Return(p2p.ID("id"))
-			var response *ssproto.ChunkResponse
+			var (
+				response    *ssproto.ChunkResponse
+				responseMtx tmsync.Mutex
+			)
 			if tc.expectResponse != nil {
-				peer.On("Send", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
+				peer.On("TrySend", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
 					msg, err := decodeMsg(args[1].([]byte))
 					require.NoError(t, err)
+					responseMtx.Lock()
 					response = msg.(*ssproto.ChunkResponse)
+					responseMtx.Unlock()
 				}).Return(true)
 			}
 
 			// Start a reactor and send a ssproto.ChunkRequest, then wait for and check response
-			r := NewReactor(conn, nil, "")
+			metrics := NopMetrics()
+			requests := newLabeledCounter()
+			metrics.ServeRequests = requests
+			r := NewReactor(cfg.TestStateSyncConfig(), conn, nil, "", WithMetrics(metrics))
 			err := r.Start()
 			require.NoError(t, err)
 			t.Cleanup(func() {
@@ -71,7 +98,11 @@ func TestReactor_Receive_ChunkRequest(t *testing.T) {
 
 			r.Receive(ChunkChannel, peer, mustEncodeMsg(tc.request))
 			time.Sleep(100 * time.Millisecond)
+			responseMtx.Lock()
 			assert.Equal(t, tc.expectResponse, response)
+			responseMtx.Unlock()
+			assert.Equal(t, []uint64{tc.request.Height}, r.ServingHeights())
+			assert.Equal(t, map[string]float64{"type=chunk": 1}, requests.values)
 
 			conn.AssertExpectations(t)
 			peer.AssertExpectations(t)
@@ -79,12 +110,150 @@ func TestReactor_Receive_ChunkRequest(t *testing.T) {
 	}
 }
 
+// labeledCounter is a counter recording its values by label values, since generic counters
+// don't aggregate the values of counters derived via With().
+type labeledCounter struct {
+	lvs    string
+	values map[string]float64
+}
+
+func newLabeledCounter() *labeledCounter {
+	return &labeledCounter{values: make(map[string]float64)}
+}
+
+func (c *labeledCounter) With(labelValues ...string) metrics.Counter {
+	return &labeledCounter{lvs: c.lvs + strings.Join(labelValues, "="), values: c.values}
+}
+
+func (c *labeledCounter) Add(delta float64) {
+	c.values[c.lvs] += delta
+}
+
+func TestReactor_serveChunk_metrics(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 1, Format: 1, Chunk: 0}).
+		Return(&abci.ResponseLoadSnapshotChunk{Chunk: make([]byte, 100)}, nil)
+	conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 1, Format: 1, Chunk: 1}).
+		Return(&abci.ResponseLoadSnapshotChunk{Chunk: make([]byte, 300)}, nil)
+	conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 1, Format: 1, Chunk: 2}).
+		Return(&abci.ResponseLoadSnapshotChunk{}, nil)
+	conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 2, Format: 1, Chunk: 0}).
+		Return(&abci.ResponseLoadSnapshotChunk{Chunk: make([]byte, 50)}, nil)
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{}, nil)
+	peer := simplePeer("id")
+	peer.On("TrySend", ChunkChannel, mock.Anything).Return(true)
+
+	metrics := NopMetrics()
+	sizes := generic.NewHistogram("served_chunk_size", 10)
+	bytes := newLabeledCounter()
+	served := generic.NewCounter("served_chunks")
+	metrics.ServedChunkSize = sizes
+	metrics.ServedChunkBytes = bytes
+	metrics.ServedChunks = served
+	r := NewReactor(cfg.TestStateSyncConfig(), conn, nil, "", WithMetrics(metrics))
+
+	// Missing chunks aren't recorded.
+	for i := uint32(0); i < 3; i++ {
+		r.serveChunk(peer, &ssproto.ChunkRequest{Height: 1, Format: 1, Index: i})
+	}
+	r.serveChunk(peer, &ssproto.ChunkRequest{Height: 2, Format: 1, Index: 0})
+	assert.Equal(t, map[string]float64{"height=1": 400, "height=2": 50}, bytes.values)
+	assert.EqualValues(t, 50, sizes.Quantile(0))
+	assert.EqualValues(t, 300, sizes.Quantile(1))
+	assert.EqualValues(t, 3, served.Value())
+}
+
+func TestReactor_serveChunk_proofs(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	for i := uint32(0); i < 2; i++ {
+		conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 1, Format: 1, Chunk: i}).
+			Return(&abci.ResponseLoadSnapshotChunk{Chunk: []byte{byte(i)}}, nil)
+	}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{}, nil)
+	var responses []*ssproto.ChunkResponse
+	peer := simplePeer("id")
+	peer.On("TrySend", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
+		msg, err := decodeMsg(args[1].([]byte))
+		require.NoError(t, err)
+		responses = append(responses, msg.(*ssproto.ChunkResponse))
+	}).Return(true)
+
+	// Without a prover, chunk proofs aren't advertised or served.
+	r := NewReactor(cfg.TestStateSyncConfig(), conn, nil, "")
+	assert.NotContains(t, r.hello().Features, featureChunkProofs)
+	r.serveChunk(peer, &ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0, Proof: true})
+	assert.Equal(t, []*ssproto.ChunkResponse{{Height: 1, Format: 1, Index: 0, Chunk: []byte{0}}}, responses)
+
+	// With a prover, proofs are served when requested, and chunks which can't be proven are
+	// reported missing without marking the snapshot incomplete.
+	prover := func(height uint64, format uint32, index uint32, chunk []byte) ([]byte, error) {
+		if index == 1 {
+			return nil, nil
+		}
+		return []byte{7}, nil
+	}
+	r = NewReactor(cfg.TestStateSyncConfig(), conn, nil, "", WithChunkProver(prover))
+	assert.Contains(t, r.hello().Features, featureChunkProofs)
+	responses = nil
+	r.serveChunk(peer, &ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0})
+	r.serveChunk(peer, &ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0, Proof: true})
+	r.serveChunk(peer, &ssproto.ChunkRequest{Height: 1, Format: 1, Index: 1, Proof: true})
+	assert.Equal(t, []*ssproto.ChunkResponse{
+		{Height: 1, Format: 1, Index: 0, Chunk: []byte{0}},
+		{Height: 1, Format: 1, Index: 0, Chunk: []byte{0}, Proof: []byte{7}},
+		{Height: 1, Format: 1, Index: 1, Missing: true},
+	}, responses)
+	assert.False(t, r.serving.Incomplete(1, 1))
+}
+
+func TestReactor_serveChunk_sendQueueFull(t *testing.T) {
+	testcases := map[string]struct {
+		policy      string
+		sendOK      bool
+		expectSend  bool
+		expectDrops float64
+	}{
+		"backpressure waits for the queue":       {"backpressure", true, true, 0},
+		"backpressure drops when the send fails": {"backpressure", false, true, 1},
+		"drop drops the response":                {"drop", true, false, 1},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			conn := &proxymocks.AppConnSnapshot{}
+			conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 1, Format: 1, Chunk: 0}).
+				Return(&abci.ResponseLoadSnapshotChunk{Chunk: []byte{1}}, nil)
+			peer := simplePeer("id")
+			peer.On("TrySend", ChunkChannel, mock.Anything).Return(false)
+			if tc.expectSend {
+				peer.On("Send", ChunkChannel, mock.Anything).Return(tc.sendOK)
+			}
+
+			config := cfg.TestStateSyncConfig()
+			config.ChunkSendPolicy = tc.policy
+			metrics := NopMetrics()
+			full := newLabeledCounter()
+			dropped := newLabeledCounter()
+			metrics.ChunkSendQueueFull = full
+			metrics.DroppedChunkResponses = dropped
+			r := NewReactor(config, conn, nil, "", WithMetrics(metrics))
+
+			r.serveChunk(peer, &ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0})
+			assert.Equal(t, map[string]float64{"peer_id=id": 1}, full.values)
+			assert.Equal(t, tc.expectDrops, dropped.values["peer_id=id"])
+			peer.AssertExpectations(t)
+		})
+	}
+}
+
 func TestReactor_Receive_SnapshotsRequest(t *testing.T) {
 	testcases := map[string]struct {
 		snapshots       []*abci.Snapshot
+		servingFormats  []uint32
+		hello           *ssproto.Hello
 		expectResponses []*ssproto.SnapshotsResponse
 	}{
-		"no snapshots": {nil, []*ssproto.SnapshotsResponse{}},
+		"no snapshots": {nil, nil, nil, []*ssproto.SnapshotsResponse{}},
 		">10 unordered snapshots": {
 			[]*abci.Snapshot{
 				{Height: 1, Format: 2, Chunks: 7, Hash: []byte{1, 2}, Metadata: []byte{1}},
@@ -100,6 +269,8 @@ func TestReactor_Receive_SnapshotsRequest(t *testing.T) {
 				{Height: 2, Format: 3, Chunks: 7, Hash: []byte{2, 3}, Metadata: []byte{11}},
 				{Height: 3, Format: 3, Chunks: 7, Hash: []byte{3, 3}, Metadata: []byte{12}},
 			},
+			nil,
+			nil,
 			[]*ssproto.SnapshotsResponse{
 				{Height: 3, Format: 4, Chunks: 7, Hash: []byte{3, 4}, Metadata: []byte{9}},
 				{Height: 3, Format: 3, Chunks: 7, Hash: []byte{3, 3}, Metadata: []byte{12}},
@@ -113,11 +284,98 @@ func TestReactor_Receive_SnapshotsRequest(t *testing.T) {
 				{Height: 1, Format: 3, Chunks: 7, Hash: []byte{1, 3}, Metadata: []byte{10}},
 			},
 		},
+		"preferred snapshots first": {
+			[]*abci.Snapshot{
+				{Height: 1, Format: 1, Chunks: 7, Hash: []byte{1, 1}, Metadata: PreferSnapshotMetadata([]byte{1})},
+				{Height: 2, Format: 1, Chunks: 7, Hash: []byte{2, 1}, Metadata: []byte{2}},
+				{Height: 3, Format: 1, Chunks: 7, Hash: []byte{3, 1}, Metadata: PreferSnapshotMetadata(nil)},
+			},
+			nil,
+			nil,
+			[]*ssproto.SnapshotsResponse{
+				{Height: 3, Format: 1, Chunks: 7, Hash: []byte{3, 1}, Preferred: true},
+				{Height: 1, Format: 1, Chunks: 7, Hash: []byte{1, 1}, Metadata: []byte{1}, Preferred: true},
+				{Height: 2, Format: 1, Chunks: 7, Hash: []byte{2, 1}, Metadata: []byte{2}},
+			},
+		},
+		"oversized metadata": {
+			[]*abci.Snapshot{
+				{Height: 1, Format: 1, Chunks: 7, Hash: []byte{1, 1}, Metadata: []byte{1}},
+				{Height: 2, Format: 1, Chunks: 7, Hash: []byte{2, 1}, Metadata: make([]byte, 1<<20+1)},
+			},
+			nil,
+			nil,
+			[]*ssproto.SnapshotsResponse{
+				{Height: 1, Format: 1, Chunks: 7, Hash: []byte{1, 1}, Metadata: []byte{1}},
+			},
+		},
+		"diff snapshots": {
+			[]*abci.Snapshot{
+				{Height: 2, Format: 2, Chunks: 7, Hash: []byte{2, 2}, Metadata: DiffSnapshotMetadata(1, []byte{1})},
+				{Height: 2, Format: 3, Chunks: 7, Hash: []byte{2, 3}, Metadata: DiffSnapshotMetadata(2, nil)},
+			},
+			nil,
+			&ssproto.Hello{Version: protocolVersion, Features: []string{featureDiffSnapshots}},
+			[]*ssproto.SnapshotsResponse{
+				{Height: 2, Format: 2, Chunks: 7, Hash: []byte{2, 2}, Metadata: []byte{1}, BaseHeight: 1},
+			},
+		},
+		"diff snapshots withheld from peers without support": {
+			[]*abci.Snapshot{
+				{Height: 3, Format: 1, Chunks: 7, Hash: []byte{3, 1}, Metadata: DiffSnapshotMetadata(1, nil)},
+				{Height: 2, Format: 1, Chunks: 7, Hash: []byte{2, 1}},
+			},
+			nil,
+			&ssproto.Hello{Version: protocolVersion},
+			[]*ssproto.SnapshotsResponse{
+				{Height: 2, Format: 1, Chunks: 7, Hash: []byte{2, 1}},
+			},
+		},
+		"overflowing heights": {
+			[]*abci.Snapshot{
+				{Height: math.MaxUint64, Format: 1, Chunks: 7, Hash: []byte{3, 1}},
+				{Height: maxSnapshotHeight + 1, Format: 1, Chunks: 7, Hash: []byte{2, 1}},
+				{Height: maxSnapshotHeight, Format: 1, Chunks: 7, Hash: []byte{1, 1}},
+			},
+			nil,
+			nil,
+			[]*ssproto.SnapshotsResponse{
+				{Height: maxSnapshotHeight, Format: 1, Chunks: 7, Hash: []byte{1, 1}},
+			},
+		},
+		"diff snapshots withheld from legacy peers": {
+			[]*abci.Snapshot{
+				{Height: 3, Format: 1, Chunks: 7, Hash: []byte{3, 1}, Metadata: DiffSnapshotMetadata(1, nil)},
+				{Height: 2, Format: 1, Chunks: 7, Hash: []byte{2, 1}},
+			},
+			nil,
+			nil,
+			[]*ssproto.SnapshotsResponse{
+				{Height: 2, Format: 1, Chunks: 7, Hash: []byte{2, 1}},
+			},
+		},
+		"disabled formats": {
+			[]*abci.Snapshot{
+				{Height: 1, Format: 0, Chunks: 7, Hash: []byte{1, 0}},
+				{Height: 1, Format: 1, Chunks: 7, Hash: []byte{1, 1}},
+				{Height: 2, Format: 0, Chunks: 7, Hash: []byte{2, 0}},
+				{Height: 2, Format: 2, Chunks: 7, Hash: []byte{2, 2}},
+			},
+			[]uint32{1, 2},
+			nil,
+			[]*ssproto.SnapshotsResponse{
+				{Height: 2, Format: 2, Chunks: 7, Hash: []byte{2, 2}},
+				{Height: 1, Format: 1, Chunks: 7, Hash: []byte{1, 1}},
+			},
+		},
 	}
 
 	for name, tc := range testcases {
 		tc := tc
 		t.Run(name, func(t *testing.T) {
+			config := cfg.TestStateSyncConfig()
+			config.ServingFormats = tc.servingFormats
+
 			// Mock ABCI connection to return local snapshots
 			conn := &proxymocks.AppConnSnapshot{}
 			conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
@@ -126,18 +384,24 @@ func TestReactor_Receive_SnapshotsRequest(t *testing.T) {
 
 			// Mock peer to catch responses and store them in a slice
 			responses := []*ssproto.SnapshotsResponse{}
+			responsesMtx := tmsync.Mutex{}
 			peer := &p2pmocks.Peer{}
+			peer.On("ID").Return(p2p.ID("id"))
 			if len(tc.expectResponses) > 0 {
-				peer.On("ID").Return(p2p.ID("id"))
 				peer.On("Send", SnapshotChannel, mock.Anything).Run(func(args mock.Arguments) {
 					msg, err := decodeMsg(args[1].([]byte))
 					require.NoError(t, err)
+					responsesMtx.Lock()
 					responses = append(responses, msg.(*ssproto.SnapshotsResponse))
+					responsesMtx.Unlock()
 				}).Return(true)
 			}
+			if tc.hello != nil {
+				peer.On("TrySend", SnapshotChannel, mustEncodeMsg(makeHello(config))).Once().Return(true)
+			}
 
 			// Start a reactor and send a SnapshotsRequestMessage, then wait for and check responses
-			r := NewReactor(conn, nil, "")
+			r := NewReactor(config, conn, nil, "")
 			err := r.Start()
 			require.NoError(t, err)
 			t.Cleanup(func() {
@@ -146,12 +410,765 @@ func TestReactor_Receive_SnapshotsRequest(t *testing.T) {
 				}
 			})
 
-			r.Receive(SnapshotChannel, peer, mustEncodeMsg(&ssproto.SnapshotsRequest{}))
+			r.Receive(SnapshotChannel, peer, mustEncodeMsg(&ssproto.SnapshotsRequest{Hello: tc.hello}))
 			time.Sleep(100 * time.Millisecond)
+			responsesMtx.Lock()
 			assert.Equal(t, tc.expectResponses, responses)
+			responsesMtx.Unlock()
 
 			conn.AssertExpectations(t)
 			peer.AssertExpectations(t)
 		})
 	}
 }
+
+func TestReactor_Receive_ChunkRequest_incomplete(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
+		Snapshots: []*abci.Snapshot{
+			{Height: 2, Format: 1, Chunks: 3, Hash: []byte{2}},
+			{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}},
+		},
+	}, nil)
+	conn.On("LoadSnapshotChunkSync", mock.Anything).Return(&abci.ResponseLoadSnapshotChunk{}, nil)
+
+	var (
+		snapshots  []*ssproto.SnapshotsResponse
+		missing    int
+		incomplete = generic.NewCounter("incomplete_snapshots")
+		config     = cfg.TestStateSyncConfig()
+		peer       = &p2pmocks.Peer{}
+	)
+	peer.On("ID").Return(p2p.ID("id"))
+	peer.On("TrySend", ChunkChannel, mock.Anything).Return(true).Run(func(args mock.Arguments) {
+		msg, err := decodeMsg(args[1].([]byte))
+		require.NoError(t, err)
+		if msg.(*ssproto.ChunkResponse).Missing {
+			missing++
+		}
+	})
+	peer.On("Send", SnapshotChannel, mock.Anything).Return(true).Run(func(args mock.Arguments) {
+		msg, err := decodeMsg(args[1].([]byte))
+		require.NoError(t, err)
+		snapshots = append(snapshots, msg.(*ssproto.SnapshotsResponse))
+	})
+
+	// Serve requests inline, so responses are sent before Receive() returns.
+	config.ServingWorkers = 0
+	metrics := NopMetrics()
+	metrics.IncompleteSnapshots = incomplete
+	r := NewReactor(config, conn, nil, "", WithMetrics(metrics))
+	err := r.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// A missing chunk of a listed snapshot marks it as incomplete, once. Missing chunks of
+	// snapshots that are no longer listed were most likely pruned, and are ignored.
+	r.Receive(ChunkChannel, peer, mustEncodeMsg(&ssproto.ChunkRequest{Height: 2, Format: 1, Index: 1}))
+	r.Receive(ChunkChannel, peer, mustEncodeMsg(&ssproto.ChunkRequest{Height: 2, Format: 1, Index: 2}))
+	r.Receive(ChunkChannel, peer, mustEncodeMsg(&ssproto.ChunkRequest{Height: 3, Format: 1, Index: 0}))
+	assert.Equal(t, 3, missing)
+	assert.EqualValues(t, 1, incomplete.Value())
+
+	// The incomplete snapshot is no longer advertised.
+	r.Receive(SnapshotChannel, peer, mustEncodeMsg(&ssproto.SnapshotsRequest{}))
+	assert.Equal(t, []*ssproto.SnapshotsResponse{
+		{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}},
+	}, snapshots)
+}
+
+func TestReactor_LocalSnapshots(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
+		Snapshots: []*abci.Snapshot{
+			{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1}, Metadata: PreferSnapshotMetadata([]byte{9})},
+			{Height: 3, Format: 1, Chunks: 1, Hash: []byte{3}, Metadata: DiffSnapshotMetadata(1, nil)},
+			{Height: 3, Format: 2, Chunks: 1, Hash: []byte{3}},
+			{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}, Metadata: DiffSnapshotMetadata(2, nil)},
+		},
+	}, nil)
+	config := cfg.TestStateSyncConfig()
+	config.ServingFormats = []uint32{1}
+	r := NewReactor(config, conn, nil, "")
+	r.pinned.Put(1, 1, [][]byte{{1}, {2}})
+	r.serving.Touch(3, 1, "a")
+
+	snapshots, err := r.LocalSnapshots()
+	require.NoError(t, err)
+	assert.Equal(t, []LocalSnapshotInfo{
+		{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1}, Metadata: []byte{9}, Preferred: true, Pinned: true},
+		{Height: 3, Format: 2, Chunks: 1, Hash: []byte{3}, Withheld: "format not served"},
+		{Height: 3, Format: 1, Chunks: 1, Hash: []byte{3}, BaseHeight: 1, Peers: 1},
+		{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}, BaseHeight: 2, Withheld: "invalid base height"},
+	}, snapshots)
+
+	// Errors from the app are returned.
+	conn = &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(nil, errors.New("boom"))
+	_, err = NewReactor(config, conn, nil, "").LocalSnapshots()
+	require.Error(t, err)
+}
+
+func TestReactor_ServeWhileRestoring(t *testing.T) {
+	// Snapshots are served via the serving connection, never touching the restore connection.
+	conn := &proxymocks.AppConnSnapshot{}
+	servingConn := &proxymocks.AppConnSnapshot{}
+	servingConn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
+		Snapshots: []*abci.Snapshot{
+			{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}},
+			{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}},
+		},
+	}, nil)
+	servingConn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 1, Format: 1, Chunk: 0}).
+		Return(&abci.ResponseLoadSnapshotChunk{Chunk: []byte{1}}, nil)
+	r := NewReactor(cfg.TestStateSyncConfig(), conn, nil, "", WithServingConn(servingConn))
+
+	// Restore the snapshot at height 2.
+	syncer, _ := setupOfferSyncer(t)
+	chunks, err := newChunkQueue(&snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { chunks.Close() })
+	syncer.chunks = chunks
+	r.syncers[syncer] = struct{}{}
+
+	snapshots, err := r.LocalSnapshots()
+	require.NoError(t, err)
+	assert.Equal(t, []LocalSnapshotInfo{
+		{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}, Withheld: "being restored"},
+		{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}},
+	}, snapshots)
+
+	var responses []*ssproto.ChunkResponse
+	peer := simplePeer("id")
+	peer.On("TrySend", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
+		msg, err := decodeMsg(args[1].([]byte))
+		require.NoError(t, err)
+		responses = append(responses, msg.(*ssproto.ChunkResponse))
+	}).Return(true)
+	r.serveChunk(peer, &ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0})
+	r.serveChunk(peer, &ssproto.ChunkRequest{Height: 2, Format: 1, Index: 0})
+	assert.Equal(t, []*ssproto.ChunkResponse{
+		{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}},
+		{Height: 2, Format: 1, Index: 0, Missing: true},
+	}, responses)
+	assert.False(t, r.serving.Incomplete(2, 1))
+
+	// Once the restore completes, the snapshot is served.
+	delete(r.syncers, syncer)
+	snapshots, err = r.LocalSnapshots()
+	require.NoError(t, err)
+	assert.Empty(t, snapshots[0].Withheld)
+	conn.AssertExpectations(t)
+	servingConn.AssertExpectations(t)
+}
+
+func TestReactor_SetServingEnabled(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
+		Snapshots: []*abci.Snapshot{{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}},
+	}, nil).Once()
+	conn.On("LoadSnapshotChunkSync", abci.RequestLoadSnapshotChunk{Height: 1, Format: 1, Chunk: 0}).
+		Return(&abci.ResponseLoadSnapshotChunk{Chunk: []byte{1}}, nil).Once()
+	r := NewReactor(cfg.TestStateSyncConfig(), conn, nil, "")
+	assert.True(t, r.ServingEnabled())
+
+	var responses []proto.Message
+	peer := simplePeer("id")
+	record := func(args mock.Arguments) {
+		msg, err := decodeMsg(args[1].([]byte))
+		require.NoError(t, err)
+		responses = append(responses, msg)
+	}
+	peer.On("Send", SnapshotChannel, mock.Anything).Run(record).Return(true)
+	peer.On("TrySend", ChunkChannel, mock.Anything).Run(record).Return(true)
+
+	// While disabled, snapshot requests are ignored and chunks are reported missing, without
+	// querying the app.
+	r.SetServingEnabled(false)
+	assert.False(t, r.ServingEnabled())
+	r.serveSnapshots(peer)
+	r.serveChunk(peer, &ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0})
+	assert.Equal(t, []proto.Message{
+		&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 0, Missing: true},
+	}, responses)
+
+	responses = nil
+	r.SetServingEnabled(true)
+	r.serveSnapshots(peer)
+	r.serveChunk(peer, &ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0})
+	assert.Equal(t, []proto.Message{
+		&ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}},
+		&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}},
+	}, responses)
+	conn.AssertExpectations(t)
+}
+
+func TestReactor_serveSnapshots_empty(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{}, nil)
+	emptyRequests := generic.NewCounter("empty_snapshot_requests")
+	metrics := NopMetrics()
+	metrics.EmptySnapshotRequests = emptyRequests
+	r := NewReactor(cfg.TestStateSyncConfig(), conn, nil, "", WithMetrics(metrics))
+
+	// The peer mock fails the test if any response is sent.
+	peer := simplePeer("id")
+	r.serveSnapshots(peer)
+	r.serveSnapshots(peer)
+	assert.EqualValues(t, 2, emptyRequests.Value())
+	conn.AssertExpectations(t)
+	peer.AssertExpectations(t)
+}
+
+func TestReactor_serveSnapshots_advertiseWindow(t *testing.T) {
+	s1 := &abci.Snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	s2 := &abci.Snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
+		Snapshots: []*abci.Snapshot{s1},
+	}, nil).Twice()
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
+		Snapshots: []*abci.Snapshot{s1, s2},
+	}, nil)
+	config := cfg.TestStateSyncConfig()
+	config.SnapshotAdvertiseWindow = time.Hour
+	r := NewReactor(config, conn, nil, "")
+
+	advertised := map[p2p.ID][]uint64{}
+	newPeer := func(id p2p.ID) *p2pmocks.Peer {
+		peer := simplePeer(string(id))
+		peer.On("Send", SnapshotChannel, mock.Anything).Run(func(args mock.Arguments) {
+			msg, err := decodeMsg(args[1].([]byte))
+			require.NoError(t, err)
+			advertised[id] = append(advertised[id], msg.(*ssproto.SnapshotsResponse).Height)
+		}).Return(true)
+		return peer
+	}
+	a, b := newPeer("a"), newPeer("b")
+
+	// Repeated requests within the window don't advertise the same snapshot again, but new
+	// snapshots are advertised, and each peer is tracked separately.
+	r.serveSnapshots(a)
+	r.serveSnapshots(a)
+	assert.Equal(t, []uint64{1}, advertised["a"])
+	r.serveSnapshots(a)
+	r.serveSnapshots(b)
+	assert.Equal(t, []uint64{1, 2}, advertised["a"])
+	assert.Equal(t, []uint64{2, 1}, advertised["b"])
+
+	// Advertisements are sent again once the window has passed, or after the peer reconnects.
+	r.advertised.peers["a"][servedSnapshot{Height: 1, Format: 1}] = time.Now().Add(-2 * time.Hour)
+	r.serveSnapshots(a)
+	assert.Equal(t, []uint64{1, 2, 1}, advertised["a"])
+	r.RemovePeer(b, "disconnected")
+	r.serveSnapshots(b)
+	assert.Equal(t, []uint64{2, 1, 2, 1}, advertised["b"])
+}
+
+func TestReactor_Receive_SnapshotsResponse_oversizedMetadata(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.MaxMetadataBytes = 16
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "")
+	sw := p2p.MakeSwitch(cfg.DefaultP2PConfig(), 1, "testing", "123.123.123",
+		func(i int, sw *p2p.Switch) *p2p.Switch { return sw })
+	r.SetSwitch(sw)
+	err := r.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	syncer, _ := setupOfferSyncer(t)
+	r.syncers[syncer] = struct{}{}
+
+	// The peer is stopped for sending the oversized metadata.
+	peer := simplePeer("a")
+	peer.On("IsRunning").Return(true)
+	peer.On("IsPersistent").Return(false)
+	peer.On("RemoteAddr").Return(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 26656})
+	peer.On("CloseConn").Return(nil)
+	peer.On("String").Maybe().Return("a")
+	peer.On("Stop").Once().Return(nil)
+
+	msg := &ssproto.SnapshotsResponse{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1},
+		Metadata: make([]byte, 17)}
+	err = validateMsg(msg, config)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errMetadataTooLarge))
+	require.NoError(t, validateMsg(msg, nil))
+
+	r.Receive(SnapshotChannel, peer, mustEncodeMsg(msg))
+	peer.AssertExpectations(t)
+	assert.Empty(t, syncer.snapshots.Ranked())
+
+	// Metadata within the limit is accepted.
+	msg.Metadata = make([]byte, 16)
+	r.Receive(SnapshotChannel, simplePeer("b"), mustEncodeMsg(msg))
+	assert.Len(t, syncer.snapshots.Ranked(), 1)
+}
+
+func TestReactor_Receive_unknownMessages(t *testing.T) {
+	unknown, err := (&ssproto.Message{}).Marshal()
+	require.NoError(t, err)
+	_, err = decodeMsg(unknown)
+	require.True(t, errors.Is(err, errUnknownMessage))
+	misrouted := mustEncodeMsg(&ssproto.ChunkRequest{Height: 1, Format: 1, Index: 0})
+
+	testcases := map[string]struct {
+		policy     string
+		disconnect bool
+	}{
+		"ignore":     {"ignore", false},
+		"disconnect": {"disconnect", true},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			config := cfg.TestStateSyncConfig()
+			config.UnknownMessages = tc.policy
+			r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "")
+			sw := p2p.MakeSwitch(cfg.DefaultP2PConfig(), 1, "testing", "123.123.123",
+				func(i int, sw *p2p.Switch) *p2p.Switch { return sw })
+			r.SetSwitch(sw)
+			require.NoError(t, r.Start())
+			t.Cleanup(func() {
+				if err := r.Stop(); err != nil {
+					t.Error(err)
+				}
+			})
+
+			// Both a message of an unknown type, and a known message on the wrong channel, are
+			// handled according to the policy.
+			for _, bz := range [][]byte{unknown, misrouted} {
+				peer := simplePeer("a")
+				if tc.disconnect {
+					peer.On("IsRunning").Return(true)
+					peer.On("IsPersistent").Return(false)
+					peer.On("RemoteAddr").Return(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 26656})
+					peer.On("CloseConn").Return(nil)
+					peer.On("String").Maybe().Return("a")
+					peer.On("Stop").Once().Return(nil)
+				}
+				r.Receive(SnapshotChannel, peer, bz)
+				peer.AssertExpectations(t)
+				if !tc.disconnect {
+					peer.AssertNotCalled(t, "Stop")
+				}
+			}
+		})
+	}
+}
+
+// TestReactor_structuredLogs checks that the package's log calls pass a constant message followed
+// by key/value pairs, rather than a printf-style format string and its arguments, which the
+// structured logger renders as a message with a dangling key.
+func TestReactor_structuredLogs(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	require.NoError(t, err)
+	require.Contains(t, pkgs, "statesync")
+
+	checked := 0
+	ast.Inspect(pkgs["statesync"], func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || (sel.Sel.Name != "Debug" && sel.Sel.Name != "Info" && sel.Sel.Name != "Error") {
+			return true
+		}
+		var logger string
+		switch x := sel.X.(type) {
+		case *ast.Ident:
+			logger = x.Name
+		case *ast.SelectorExpr:
+			logger = x.Sel.Name
+		}
+		if !strings.EqualFold(logger, "logger") || len(call.Args) == 0 {
+			return true
+		}
+		checked++
+		pos := fset.Position(call.Pos())
+		if msg, ok := call.Args[0].(*ast.BasicLit); ok && msg.Kind == token.STRING {
+			assert.NotContains(t, msg.Value, "%", "printf-style log message at %v", pos)
+		}
+		if call.Ellipsis == token.NoPos {
+			assert.True(t, len(call.Args)%2 == 1, "log call with unpaired key/value at %v", pos)
+		}
+		return true
+	})
+	assert.NotZero(t, checked)
+}
+
+func TestReactor_dialSnapshotPeers(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "")
+	switches := make([]*p2p.Switch, 2)
+	for i := range switches {
+		switches[i] = p2p.MakeSwitch(cfg.DefaultP2PConfig(), i, "testing", "123.123.123",
+			func(i int, sw *p2p.Switch) *p2p.Switch {
+				if i == 0 {
+					sw.AddReactor("STATESYNC", r)
+				}
+				return sw
+			})
+	}
+	require.NoError(t, p2p.StartSwitches(switches))
+	t.Cleanup(func() {
+		for _, sw := range switches {
+			if err := sw.Stop(); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	// Invalid addresses are skipped, and the others are dialed asynchronously.
+	server := switches[1].NetAddress()
+	config.SnapshotPeers = []string{"invalid", server.String()}
+	r.dialSnapshotPeers()
+	require.Eventually(t, func() bool { return switches[0].Peers().Has(server.ID) }, 5*time.Second,
+		10*time.Millisecond)
+	assert.Equal(t, 1, switches[0].Peers().Size())
+}
+
+func TestReactor_AdvertiseSnapshots(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
+		Snapshots: []*abci.Snapshot{{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}},
+	}, nil)
+	server := NewReactor(cfg.TestStateSyncConfig(), conn, nil, "")
+	clientConfig := cfg.TestStateSyncConfig()
+	clientConfig.DiscoveryCatalogTTL = time.Hour
+	client := NewReactor(clientConfig, &proxymocks.AppConnSnapshot{}, nil, "")
+	reactors := []*Reactor{server, client}
+	switches := p2p.MakeConnectedSwitches(cfg.DefaultP2PConfig(), 2, func(i int, sw *p2p.Switch) *p2p.Switch {
+		sw.AddReactor("STATESYNC", reactors[i])
+		return sw
+	}, p2p.Connect2Switches)
+	t.Cleanup(func() {
+		for _, sw := range switches {
+			if err := sw.Stop(); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	// Pushed snapshots are recorded in the catalog of peers not syncing, and pushes are rate
+	// limited.
+	n, err := server.AdvertiseSnapshots()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Eventually(t, func() bool { return len(client.catalog.Entries()) == 1 }, 5*time.Second,
+		10*time.Millisecond)
+	assert.EqualValues(t, 1, client.catalog.Entries()[0].snapshot.Height)
+	_, err = server.AdvertiseSnapshots()
+	assert.True(t, errors.Is(err, ErrAdvertiseRateLimited), "unexpected error %v", err)
+
+	server.lastAdvertise = time.Time{}
+	server.SetServingEnabled(false)
+	_, err = server.AdvertiseSnapshots()
+	assert.Error(t, err)
+}
+
+func TestReactor_Sync_existingState(t *testing.T) {
+	connQuery := &proxymocks.AppConnQuery{}
+	connQuery.On("InfoSync", proxy.RequestInfo).Return(&abci.ResponseInfo{LastBlockHeight: 5}, nil)
+	config := cfg.TestStateSyncConfig()
+
+	// The sync is refused if the app already has state.
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, connQuery, "")
+	_, err := r.SyncSnapshot(&mocks.StateProvider{}, 0)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errExistingState), err)
+
+	// When forced, the sync proceeds, and fails for lack of snapshots.
+	config.UnsafeForceSync = true
+	_, err = r.SyncSnapshot(&mocks.StateProvider{}, 0)
+	assert.Equal(t, errNoSnapshots, err)
+	connQuery.AssertNumberOfCalls(t, "InfoSync", 2)
+
+	// Diff snapshots are restored on top of the app's state, so the check doesn't apply. The app
+	// is only queried once, for the height diffs must be based on.
+	config.UnsafeForceSync = false
+	config.DiffSnapshots = true
+	_, err = r.SyncSnapshot(&mocks.StateProvider{}, 0)
+	assert.Equal(t, errNoSnapshots, err)
+	connQuery.AssertNumberOfCalls(t, "InfoSync", 3)
+}
+
+func TestReactor_Receive_ChunkResponse_multipleSyncs(t *testing.T) {
+	peer := &p2pmocks.Peer{}
+	peer.On("ID").Return(p2p.ID("id"))
+
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, nil, "")
+	err := r.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// Set up two independent syncs restoring different snapshots, and one that isn't restoring.
+	snapshots := []*snapshot{
+		{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1}},
+		{Height: 2, Format: 1, Chunks: 2, Hash: []byte{2}},
+	}
+	queues := make([]*chunkQueue, 0, len(snapshots))
+	for _, s := range snapshots {
+		syncer, _ := setupOfferSyncer(t)
+		queue, err := newChunkQueue(s, "")
+		require.NoError(t, err)
+		defer queue.Close()
+		syncer.chunks = queue
+		queues = append(queues, queue)
+		r.syncers[syncer] = struct{}{}
+	}
+	idle, _ := setupOfferSyncer(t)
+	r.syncers[idle] = struct{}{}
+
+	r.Receive(ChunkChannel, peer, mustEncodeMsg(&ssproto.ChunkResponse{
+		Height: 2, Format: 1, Index: 1, Chunk: []byte{2, 1}}))
+	r.Receive(ChunkChannel, peer, mustEncodeMsg(&ssproto.ChunkResponse{
+		Height: 3, Format: 1, Index: 0, Chunk: []byte{3, 0}}))
+
+	assert.False(t, queues[0].Has(1))
+	assert.True(t, queues[1].Has(1))
+	chunk, err := queues[1].load(1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{2, 1}, chunk.Chunk)
+}
+
+func TestReactor_Receive_SnapshotsResponse_multipleSyncs(t *testing.T) {
+	peer := &p2pmocks.Peer{}
+	peer.On("ID").Return(p2p.ID("id"))
+
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, nil, "")
+	err := r.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// A sync failing to add snapshots, here since it has ended, doesn't keep them from other syncs.
+	syncer, _ := setupOfferSyncer(t)
+	r.syncers[syncer] = struct{}{}
+	ended, _ := setupOfferSyncer(t)
+	ended.Close()
+	r.syncers[ended] = struct{}{}
+
+	for height := uint64(10); height > 0; height-- {
+		r.Receive(SnapshotChannel, peer, mustEncodeMsg(&ssproto.SnapshotsResponse{
+			Height: height, Format: 1, Chunks: 1, Hash: []byte{byte(height)}}))
+	}
+	assert.Len(t, syncer.snapshots.Ranked(), 10)
+	assert.Empty(t, ended.snapshots.Ranked())
+}
+
+func TestReactor_Receive_ChunkResponse_stragglers(t *testing.T) {
+	peer := &p2pmocks.Peer{}
+	peer.On("ID").Return(p2p.ID("id"))
+	metrics := NopMetrics()
+	stragglers := generic.NewCounter("straggler_chunks")
+	metrics.StragglerChunks = stragglers
+	config := cfg.TestStateSyncConfig()
+	config.StragglerChunkWindow = time.Minute
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "", WithMetrics(metrics))
+	err := r.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	msg := mustEncodeMsg(&ssproto.ChunkResponse{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}})
+
+	// Chunks received before any state sync has run aren't stragglers.
+	r.Receive(ChunkChannel, peer, msg)
+	assert.EqualValues(t, 0, stragglers.Value())
+
+	// Chunks received shortly after a sync completes are, as are chunks not needed by the
+	// syncs still in progress.
+	r.syncEnded = time.Now()
+	r.Receive(ChunkChannel, peer, msg)
+	assert.EqualValues(t, 1, stragglers.Value())
+
+	syncer, _ := setupOfferSyncer(t)
+	queue, err := newChunkQueue(&snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}, "")
+	require.NoError(t, err)
+	defer queue.Close()
+	syncer.chunks = queue
+	r.syncers[syncer] = struct{}{}
+	r.Receive(ChunkChannel, peer, msg)
+	assert.EqualValues(t, 2, stragglers.Value())
+
+	// Once the window has passed, chunks are no longer considered stragglers.
+	r.syncEnded = time.Now().Add(-time.Minute)
+	r.Receive(ChunkChannel, peer, msg)
+	delete(r.syncers, syncer)
+	r.Receive(ChunkChannel, peer, msg)
+	assert.EqualValues(t, 2, stragglers.Value())
+}
+
+func TestReactor_RemovePeer_reasons(t *testing.T) {
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, nil, "")
+	_, ok := r.PeerRemovals()
+	assert.False(t, ok)
+
+	syncer, _ := setupOfferSyncer(t)
+	r.syncer = syncer
+	r.syncers[syncer] = struct{}{}
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	for _, id := range []string{"a", "b", "c", "d", "f"} {
+		_, err := syncer.AddSnapshot(simplePeer(id), s)
+		require.NoError(t, err)
+	}
+
+	// Remote disconnects are reported by the switch as connection errors, unlike peers stopped by
+	// the reactor for violating the protocol.
+	r.RemovePeer(simplePeer("a"), io.EOF)
+	r.RemovePeer(simplePeer("b"), protocolViolation{errors.New("invalid message")})
+	r.RemovePeer(simplePeer("c"), protocolViolation{fmt.Errorf("bad: %w", errChunkTooLarge)})
+	syncer.snapshots.RejectPeer("d")
+	r.RemovePeer(simplePeer("d"), io.EOF)
+	r.RemovePeer(simplePeer("e"), io.EOF)
+	r.RemovePeer(simplePeer("f"), fmt.Errorf("write: %w", errors.New("connection reset by peer")))
+
+	removals, ok := r.PeerRemovals()
+	assert.True(t, ok)
+	assert.Equal(t, map[p2p.ID]string{
+		"a": PeerRemovalDisconnected,
+		"b": PeerRemovalError,
+		"c": PeerRemovalBadChunk,
+		"d": PeerRemovalRejected,
+		"f": PeerRemovalDisconnected,
+	}, removals)
+}
+
+func TestReactor_requestSnapshots(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "")
+	request := mustEncodeMsg(&ssproto.SnapshotsRequest{Hello: makeHello(config)})
+
+	// Peer a accepts the request immediately, peer b once its send queue has room, and peer c
+	// stops while its send queue is full.
+	sentB := make(chan struct{})
+	stoppedC := make(chan struct{})
+	peerA := simplePeer("a")
+	peerA.On("TrySend", SnapshotChannel, request).Once().Return(true)
+	peerB := simplePeer("b")
+	peerB.On("TrySend", SnapshotChannel, request).Twice().Return(false)
+	peerB.On("TrySend", SnapshotChannel, request).Once().Run(func(args mock.Arguments) {
+		close(sentB)
+	}).Return(true)
+	peerB.On("IsRunning").Return(true)
+	peerC := simplePeer("c")
+	peerC.On("TrySend", SnapshotChannel, request).Once().Return(false)
+	peerC.On("IsRunning").Once().Run(func(args mock.Arguments) {
+		close(stoppedC)
+	}).Return(false)
+
+	r.requestSnapshots(peerA, peerB, peerC)
+	peerA.AssertExpectations(t)
+	for _, ch := range []chan struct{}{sentB, stoppedC} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for snapshot request")
+		}
+	}
+}
+
+func TestReactor_Receive_Hello(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.DiffSnapshots = true
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{}, nil)
+	r := NewReactor(config, conn, nil, "")
+	require.NoError(t, r.Start())
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// Peers are baseline peers until they send a hello.
+	peer := simplePeer("a")
+	assert.EqualValues(t, 0, r.peerCaps.Version("a"))
+	assert.False(t, r.peerCaps.Supports("a", featureDiffSnapshots))
+
+	// A hello embedded in a snapshot request is answered with our own hello, once.
+	hello := mustEncodeMsg(&ssproto.Hello{Version: protocolVersion, Features: []string{featureDiffSnapshots}})
+	peer.On("TrySend", SnapshotChannel, hello).Once().Return(true)
+	request := &ssproto.SnapshotsRequest{Hello: &ssproto.Hello{Version: 1, Features: []string{featureDiffSnapshots}}}
+	r.Receive(SnapshotChannel, peer, mustEncodeMsg(request))
+	r.Receive(SnapshotChannel, peer, mustEncodeMsg(request))
+	peer.AssertExpectations(t)
+	assert.EqualValues(t, 1, r.peerCaps.Version("a"))
+	assert.True(t, r.peerCaps.Supports("a", featureDiffSnapshots))
+
+	// A standalone hello updates the peer's capabilities without a reply, ignoring unknown
+	// features and versions.
+	r.Receive(SnapshotChannel, peer, mustEncodeMsg(&ssproto.Hello{Version: 7, Features: []string{"unknown"}}))
+	assert.EqualValues(t, 7, r.peerCaps.Version("a"))
+	assert.False(t, r.peerCaps.Supports("a", featureDiffSnapshots))
+	assert.True(t, r.peerCaps.Supports("a", "unknown"))
+
+	// The capabilities are forgotten when the peer disconnects.
+	r.RemovePeer(peer, nil)
+	assert.EqualValues(t, 0, r.peerCaps.Version("a"))
+}
+
+func TestReactor_Receive_syncEnding(t *testing.T) {
+	peer := &p2pmocks.Peer{}
+	peer.On("ID").Return(p2p.ID("id"))
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return(nil, errors.New("unavailable"))
+
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, nil, "")
+	err := r.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// Feed messages while syncs repeatedly start and end, for the race detector to catch message
+	// handlers using a syncer which is being torn down.
+	done := make(chan struct{})
+	fed := make(chan struct{})
+	go func() {
+		defer close(fed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			r.Receive(SnapshotChannel, peer, mustEncodeMsg(&ssproto.SnapshotsResponse{
+				Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}))
+			r.Receive(ChunkChannel, peer, mustEncodeMsg(&ssproto.ChunkResponse{
+				Height: 1, Format: 1, Index: 0, Chunk: []byte{1}}))
+			_ = r.AbortChunk(0)
+			r.EstimatedTimeRemaining()
+			r.RemovePeer(peer, errors.New("removed"))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		_, err := r.SyncSnapshot(stateProvider, 0)
+		assert.Equal(t, errNoSnapshots, err)
+	}
+	close(done)
+	<-fed
+}
@@ -0,0 +1,125 @@
+package statesync
+
+import (
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+const (
+	// readvertiseBackoffMin is the initial window after processing a snapshot advertisement within
+	// which identical advertisements from the same peer are skipped.
+	readvertiseBackoffMin = 10 * time.Second
+	// readvertiseBackoffMax is the maximum window, which repeated advertisements back off to.
+	readvertiseBackoffMax = 5 * time.Minute
+	// readvertisePeerCap is the maximum number of advertisements tracked per peer. Peers
+	// advertising more snapshots than this have their least recently processed ones forgotten.
+	readvertisePeerCap = 64
+)
+
+// advertisementKey identifies the contents of a snapshot advertisement.
+type advertisementKey struct {
+	height     uint64
+	format     uint32
+	chunks     uint32
+	hash       string
+	metadata   string
+	preferred  bool
+	baseHeight uint64
+}
+
+// processedAdvertisement is an advertisement processed from a peer.
+type processedAdvertisement struct {
+	processed time.Time
+	window    time.Duration
+}
+
+// readvertisementFilter skips snapshot advertisements which a peer has re-sent unchanged since
+// they were last processed, e.g. by buggy or malicious peers continuously re-advertising, to avoid
+// verifying the same snapshots repeatedly. Each identical advertisement processed again once its
+// window expires doubles the window, up to readvertiseBackoffMax. Advertisements are tracked until
+// the peer is removed.
+type readvertisementFilter struct {
+	tmsync.Mutex
+	peers map[p2p.ID]map[advertisementKey]*processedAdvertisement
+}
+
+// newReadvertisementFilter creates a new readvertisement filter.
+func newReadvertisementFilter() *readvertisementFilter {
+	return &readvertisementFilter{
+		peers: make(map[p2p.ID]map[advertisementKey]*processedAdvertisement),
+	}
+}
+
+// Redundant checks whether a snapshot advertisement from a peer is identical to one processed
+// within its window, and should thus be skipped.
+func (f *readvertisementFilter) Redundant(peerID p2p.ID, snapshot *snapshot) bool {
+	f.Lock()
+	defer f.Unlock()
+	ad, ok := f.peers[peerID][newAdvertisementKey(snapshot)]
+	return ok && time.Since(ad.processed) < ad.window
+}
+
+// Processed records a snapshot advertisement from a peer as processed now, backing off its window
+// if it had been processed before.
+func (f *readvertisementFilter) Processed(peerID p2p.ID, snapshot *snapshot) {
+	f.Lock()
+	defer f.Unlock()
+	ads := f.peers[peerID]
+	if ads == nil {
+		ads = make(map[advertisementKey]*processedAdvertisement)
+		f.peers[peerID] = ads
+	}
+	key := newAdvertisementKey(snapshot)
+	ad, ok := ads[key]
+	switch {
+	case !ok:
+		if len(ads) >= readvertisePeerCap {
+			f.evictOldest(ads)
+		}
+		ad = &processedAdvertisement{window: readvertiseBackoffMin}
+		ads[key] = ad
+	case ad.window < readvertiseBackoffMax:
+		ad.window *= 2
+		if ad.window > readvertiseBackoffMax {
+			ad.window = readvertiseBackoffMax
+		}
+	}
+	ad.processed = time.Now()
+}
+
+// RemovePeer forgets the advertisements processed from a peer.
+func (f *readvertisementFilter) RemovePeer(peerID p2p.ID) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.peers, peerID)
+}
+
+// evictOldest forgets a peer's least recently processed advertisement. The caller must hold the
+// mutex.
+func (f *readvertisementFilter) evictOldest(ads map[advertisementKey]*processedAdvertisement) {
+	var (
+		oldest     advertisementKey
+		oldestTime time.Time
+	)
+	for key, ad := range ads {
+		if oldestTime.IsZero() || ad.processed.Before(oldestTime) {
+			oldest, oldestTime = key, ad.processed
+		}
+	}
+	delete(ads, oldest)
+}
+
+// newAdvertisementKey returns the key identifying a snapshot advertisement.
+func newAdvertisementKey(snapshot *snapshot) advertisementKey {
+	return advertisementKey{
+		height:     snapshot.Height,
+		format:     snapshot.Format,
+		chunks:     snapshot.Chunks,
+		hash:       string(snapshot.Hash),
+		metadata:   string(snapshot.Metadata),
+		preferred:  snapshot.Preferred,
+		baseHeight: snapshot.BaseHeight,
+	}
+}
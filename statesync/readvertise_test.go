@@ -0,0 +1,91 @@
+package statesync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	"github.com/tendermint/tendermint/statesync/mocks"
+)
+
+func TestReadvertisementFilter(t *testing.T) {
+	filter := newReadvertisementFilter()
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	assert.False(t, filter.Redundant("a", s))
+	filter.Processed("a", s)
+	assert.True(t, filter.Redundant("a", s))
+
+	// Only identical advertisements from the same peer are redundant.
+	assert.False(t, filter.Redundant("b", s))
+	assert.False(t, filter.Redundant("a", &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{2}}))
+	assert.False(t, filter.Redundant("a", &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1},
+		Metadata: []byte{1}}))
+
+	// Advertisements processed again back off, up to the maximum window.
+	key := newAdvertisementKey(s)
+	assert.Equal(t, readvertiseBackoffMin, filter.peers["a"][key].window)
+	filter.Processed("a", s)
+	assert.Equal(t, 2*readvertiseBackoffMin, filter.peers["a"][key].window)
+	for i := 0; i < 10; i++ {
+		filter.Processed("a", s)
+	}
+	assert.Equal(t, readvertiseBackoffMax, filter.peers["a"][key].window)
+	filter.peers["a"][key].processed = time.Now().Add(-readvertiseBackoffMax)
+	assert.False(t, filter.Redundant("a", s))
+
+	// The advertisements tracked per peer are capped, forgetting the least recently processed.
+	for i := 0; i < readvertisePeerCap; i++ {
+		filter.Processed("a", &snapshot{Height: uint64(i + 2), Format: 1, Chunks: 1, Hash: []byte{1}})
+	}
+	assert.Len(t, filter.peers["a"], readvertisePeerCap)
+	assert.False(t, filter.Redundant("a", s))
+	assert.True(t, filter.Redundant("a", &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{1}}))
+
+	filter.RemovePeer("a")
+	assert.False(t, filter.Redundant("a", &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{1}}))
+}
+
+func TestSyncer_AddSnapshot_spammingPeer(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	redundant := generic.NewCounter("redundant")
+	metrics := NopMetrics()
+	metrics.RedundantSnapshots = redundant
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, stateProvider, "", withMetrics(metrics))
+
+	// A peer continuously re-advertising the same snapshots only has them verified once.
+	spammer := simplePeer("a")
+	snapshots := []*snapshot{
+		{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}},
+		{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}},
+	}
+	for i := 0; i < 100; i++ {
+		for _, s := range snapshots {
+			added, err := syncer.AddSnapshot(spammer, s)
+			require.NoError(t, err)
+			assert.Equal(t, i == 0, added)
+		}
+	}
+	stateProvider.AssertNumberOfCalls(t, "AppHash", 2)
+	assert.EqualValues(t, 198, redundant.Value())
+	assert.Len(t, syncer.snapshots.Ranked(), 2)
+
+	// Other peers advertising the same snapshots are still processed, as is the spamming peer once
+	// it reconnects.
+	_, err := syncer.AddSnapshot(simplePeer("b"), snapshots[0])
+	require.NoError(t, err)
+	assert.Len(t, syncer.snapshots.GetPeers(snapshots[0]), 2)
+	syncer.RemovePeer(spammer, PeerRemovalDisconnected)
+	added, err := syncer.AddSnapshot(spammer, snapshots[1])
+	require.NoError(t, err)
+	assert.True(t, added)
+	stateProvider.AssertNumberOfCalls(t, "AppHash", 4)
+}
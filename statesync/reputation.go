@@ -0,0 +1,219 @@
+package statesync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	tmjson "github.com/tendermint/tendermint/libs/json"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/libs/tempfile"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+const (
+	// reputationFile is the name of the file in the state sync temp dir which persists the peer
+	// reputation store, such that it survives restarts.
+	reputationFile = "statesync-peers.json"
+	// reputationMaxPeers is the maximum number of peers in the reputation store. Beyond it, the
+	// least recently updated peers are evicted.
+	reputationMaxPeers = 1000
+	// reputationMinRequests is the number of chunk requests a peer must have served or failed
+	// before its reliability is judged.
+	reputationMinRequests = 4
+	// reputationMaxFailureRate is the fraction of failed chunk requests beyond which a peer is
+	// considered unreliable.
+	reputationMaxFailureRate = 0.5
+)
+
+// peerRecord is the reputation of a peer, which is also its persisted form.
+type peerRecord struct {
+	PeerID   p2p.ID        `json:"peer_id"`
+	Chunks   uint64        `json:"chunks"`   // number of chunks fetched from the peer
+	Failures uint64        `json:"failures"` // number of timed out chunk requests and rejections
+	Latency  time.Duration `json:"latency"`  // chunk fetch latency estimate, if any chunks
+	Updated  time.Time     `json:"updated"`
+}
+
+// reputationRecord is the persisted form of the peer reputation store.
+type reputationRecord struct {
+	Peers []peerRecord `json:"peers"`
+}
+
+// peerReputation records the historical chunk reliability and latency of peers across state
+// syncs, whether or not they are still connected, such that later syncs can prefer known-good
+// peers and avoid unreliable ones without re-learning their quality. Peers which fail most of
+// their chunk requests are avoided while other peers are available, and the latency estimates of
+// reconnecting peers are seeded from their reputation. Records expire after the TTL since they
+// were last updated, so peers that no longer exist are eventually forgotten.
+//
+// If loaded from a temp dir, the store is also persisted there whenever a state sync ends. A nil
+// *peerReputation records nothing.
+type peerReputation struct {
+	tmsync.Mutex
+	ttl   time.Duration
+	peers map[p2p.ID]*peerRecord
+	path  string // file to persist the store to, if any
+}
+
+// newPeerReputation creates a new peer reputation store.
+func newPeerReputation(ttl time.Duration) *peerReputation {
+	return &peerReputation{
+		ttl:   ttl,
+		peers: make(map[p2p.ID]*peerRecord),
+	}
+}
+
+// Succeeded records a chunk fetched from a peer, along with its fetch time.
+func (p *peerReputation) Succeeded(peerID p2p.ID, fetchTime time.Duration) {
+	if p == nil || peerID == "" {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	record := p.record(peerID)
+	if record.Chunks == 0 {
+		record.Latency = fetchTime
+	} else {
+		record.Latency += time.Duration(latencyWeight * float64(fetchTime-record.Latency))
+	}
+	record.Chunks++
+}
+
+// Failed records a failure by a peer, i.e. a timed out chunk request or a rejection.
+func (p *peerReputation) Failed(peerID p2p.ID) {
+	if p == nil || peerID == "" {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.record(peerID).Failures++
+}
+
+// Latency returns the recorded chunk fetch latency estimate of a peer, if any.
+func (p *peerReputation) Latency(peerID p2p.ID) (time.Duration, bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.Lock()
+	defer p.Unlock()
+	record, ok := p.peers[peerID]
+	if !ok || p.expired(record) || record.Chunks == 0 {
+		return 0, false
+	}
+	return record.Latency, true
+}
+
+// Unreliable checks whether a peer has failed too many of its chunk requests.
+func (p *peerReputation) Unreliable(peerID p2p.ID) bool {
+	if p == nil {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	record, ok := p.peers[peerID]
+	if !ok || p.expired(record) {
+		return false
+	}
+	requests := record.Chunks + record.Failures
+	return requests >= reputationMinRequests &&
+		float64(record.Failures)/float64(requests) > reputationMaxFailureRate
+}
+
+// Load loads the store persisted in a temp dir, if any, and persists the store there from now on.
+// Expired records are discarded.
+func (p *peerReputation) Load(tempDir string) error {
+	p.Lock()
+	defer p.Unlock()
+	p.path = filepath.Join(tempDir, reputationFile)
+	bz, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read peer reputation %v: %w", p.path, err)
+	}
+	record := &reputationRecord{}
+	if err := tmjson.Unmarshal(bz, record); err != nil {
+		return fmt.Errorf("failed to decode peer reputation %v: %w", p.path, err)
+	}
+	for i := range record.Peers {
+		peer := record.Peers[i]
+		if peer.PeerID == "" || p.expired(&peer) || peer.Updated.After(time.Now()) {
+			continue
+		}
+		p.peers[peer.PeerID] = &peer
+	}
+	return nil
+}
+
+// Save persists the store, if loaded from a temp dir, after removing expired records.
+func (p *peerReputation) Save() error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.path == "" {
+		return nil
+	}
+	p.prune()
+	record := &reputationRecord{Peers: make([]peerRecord, 0, len(p.peers))}
+	for _, peer := range p.peers {
+		record.Peers = append(record.Peers, *peer)
+	}
+	bz, err := tmjson.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode peer reputation: %w", err)
+	}
+	if err := tempfile.WriteFileAtomic(p.path, bz, 0600); err != nil {
+		return fmt.Errorf("failed to write peer reputation %v: %w", p.path, err)
+	}
+	return nil
+}
+
+// record returns the unexpired record of a peer, creating a new one if necessary, and marks it
+// as updated. The caller must hold the mutex.
+func (p *peerReputation) record(peerID p2p.ID) *peerRecord {
+	record, ok := p.peers[peerID]
+	if !ok || p.expired(record) {
+		if len(p.peers) >= reputationMaxPeers {
+			p.prune()
+			p.evictOldest()
+		}
+		record = &peerRecord{PeerID: peerID}
+		p.peers[peerID] = record
+	}
+	record.Updated = time.Now()
+	return record
+}
+
+// expired checks whether a record has expired. The caller must hold the mutex.
+func (p *peerReputation) expired(record *peerRecord) bool {
+	return time.Since(record.Updated) > p.ttl
+}
+
+// prune removes expired records. The caller must hold the mutex.
+func (p *peerReputation) prune() {
+	for peerID, record := range p.peers {
+		if p.expired(record) {
+			delete(p.peers, peerID)
+		}
+	}
+}
+
+// evictOldest removes the least recently updated record if the store is full. The caller must
+// hold the mutex.
+func (p *peerReputation) evictOldest() {
+	if len(p.peers) < reputationMaxPeers {
+		return
+	}
+	var oldest *peerRecord
+	for _, record := range p.peers {
+		if oldest == nil || record.Updated.Before(oldest.Updated) {
+			oldest = record
+		}
+	}
+	delete(p.peers, oldest.PeerID)
+}
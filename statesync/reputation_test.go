@@ -0,0 +1,164 @@
+package statesync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+)
+
+func TestPeerReputation(t *testing.T) {
+	var disabled *peerReputation
+	disabled.Succeeded("a", time.Second)
+	disabled.Failed("a")
+	_, ok := disabled.Latency("a")
+	assert.False(t, ok)
+	assert.False(t, disabled.Unreliable("a"))
+	require.NoError(t, disabled.Save())
+
+	reputation := newPeerReputation(time.Minute)
+	_, ok = reputation.Latency("a")
+	assert.False(t, ok)
+
+	// Latencies are estimated from chunk fetch times.
+	reputation.Succeeded("a", 100*time.Millisecond)
+	reputation.Succeeded("a", 200*time.Millisecond)
+	latency, ok := reputation.Latency("a")
+	require.True(t, ok)
+	assert.Equal(t, 120*time.Millisecond, latency)
+
+	// Peers without successful chunks have no latency estimate.
+	reputation.Failed("b")
+	_, ok = reputation.Latency("b")
+	assert.False(t, ok)
+
+	// Peers are only judged unreliable after enough requests, once most of them failed.
+	assert.False(t, reputation.Unreliable("b"))
+	for i := 0; i < reputationMinRequests; i++ {
+		reputation.Failed("b")
+	}
+	assert.True(t, reputation.Unreliable("b"))
+	reputation.Failed("a")
+	reputation.Failed("a")
+	assert.False(t, reputation.Unreliable("a"))
+	reputation.Failed("a")
+	assert.True(t, reputation.Unreliable("a"))
+	assert.False(t, reputation.Unreliable("c"))
+
+	// Expired records are ignored, and restart afresh.
+	reputation.ttl = 0
+	assert.False(t, reputation.Unreliable("a"))
+	_, ok = reputation.Latency("a")
+	assert.False(t, ok)
+	reputation.ttl = time.Minute
+	reputation.peers["a"].Updated = time.Now().Add(-time.Hour)
+	reputation.Failed("a")
+	assert.EqualValues(t, 1, reputation.peers["a"].Failures)
+	assert.Zero(t, reputation.peers["a"].Chunks)
+}
+
+func TestPeerReputation_maxPeers(t *testing.T) {
+	reputation := newPeerReputation(time.Minute)
+	for i := 0; i < reputationMaxPeers; i++ {
+		reputation.Failed(p2p.ID(rune(i)))
+	}
+	reputation.peers[p2p.ID(rune(7))].Updated = time.Now().Add(-time.Second)
+	reputation.Failed("new")
+	assert.Len(t, reputation.peers, reputationMaxPeers)
+	assert.NotContains(t, reputation.peers, p2p.ID(rune(7)))
+	assert.Contains(t, reputation.peers, p2p.ID("new"))
+}
+
+func TestPeerReputation_persistence(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "reputation")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Stores are only persisted once loaded from a temp dir, and loading a missing file is fine.
+	reputation := newPeerReputation(time.Minute)
+	reputation.Succeeded("a", time.Second)
+	require.NoError(t, reputation.Save())
+	require.NoFileExists(t, filepath.Join(tempDir, reputationFile))
+	require.NoError(t, reputation.Load(tempDir))
+
+	reputation.Succeeded("a", time.Second)
+	reputation.Failed("b")
+	reputation.Failed("expired")
+	reputation.peers["expired"].Updated = time.Now().Add(-time.Hour)
+	require.NoError(t, reputation.Save())
+	require.FileExists(t, filepath.Join(tempDir, reputationFile))
+
+	// Expired records are discarded when saving and loading.
+	loaded := newPeerReputation(time.Minute)
+	require.NoError(t, loaded.Load(tempDir))
+	assert.Len(t, loaded.peers, 2)
+	latency, ok := loaded.Latency("a")
+	require.True(t, ok)
+	assert.Equal(t, time.Second, latency)
+	assert.EqualValues(t, 2, loaded.peers["a"].Chunks)
+	assert.EqualValues(t, 1, loaded.peers["b"].Failures)
+
+	loaded = newPeerReputation(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	require.NoError(t, loaded.Load(tempDir))
+	assert.Empty(t, loaded.peers)
+
+	// Corrupt files are reported.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, reputationFile), []byte("foo"), 0600))
+	assert.Error(t, newPeerReputation(time.Minute).Load(tempDir))
+}
+
+func TestSyncer_reliablePeers(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	syncer := newSyncer(config, log.NewNopLogger(), &proxymocks.AppConnSnapshot{}, &proxymocks.AppConnQuery{},
+		nil, "")
+	peerA, peerB := simplePeer("a"), simplePeer("b")
+	peers := []p2p.Peer{peerA, peerB}
+	assert.Equal(t, peers, syncer.reliablePeers(peers))
+
+	syncer.reputation = newPeerReputation(time.Minute)
+	assert.Equal(t, peers, syncer.reliablePeers(peers))
+	for i := 0; i < reputationMinRequests; i++ {
+		syncer.reputation.Failed("a")
+	}
+	assert.Equal(t, []p2p.Peer{peerB}, syncer.reliablePeers(peers))
+
+	// If all peers are unreliable, they're all used.
+	for i := 0; i < reputationMinRequests; i++ {
+		syncer.reputation.Failed("b")
+	}
+	assert.Equal(t, peers, syncer.reliablePeers(peers))
+}
+
+func TestReactor_AddPeer_reputation(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.PeerReputationTTL = time.Minute
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, &proxymocks.AppConnQuery{}, "")
+	r.reputation.Succeeded("a", time.Second)
+
+	// Known peers have their latency estimate seeded from their reputation.
+	r.AddPeer(simplePeer("a"))
+	latency, ok := r.latencies.Estimate("a")
+	require.True(t, ok)
+	assert.Equal(t, time.Second, latency)
+
+	r.AddPeer(simplePeer("b"))
+	_, ok = r.latencies.Estimate("b")
+	assert.False(t, ok)
+
+	// The reputation outlives the peer's connection.
+	r.RemovePeer(simplePeer("a"), nil)
+	_, ok = r.latencies.Estimate("a")
+	assert.False(t, ok)
+	_, ok = r.reputation.Latency("a")
+	assert.True(t, ok)
+}
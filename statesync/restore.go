@@ -0,0 +1,212 @@
+package statesync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	tmjson "github.com/tendermint/tendermint/libs/json"
+	"github.com/tendermint/tendermint/libs/tempfile"
+)
+
+const (
+	// restoreRecordFile is the name of the file in the state sync temp dir which records the
+	// snapshot currently being restored into the app.
+	restoreRecordFile = "statesync-restore.json"
+	// restoreChunksDir is the name of the directory in the state sync temp dir which buffers the
+	// chunks of the snapshot being restored, such that they can be reused when resuming.
+	restoreChunksDir = "statesync-chunks"
+)
+
+// errRestoreMismatch is returned when a snapshot that the app previously accepted is re-offered,
+// but the trusted app hash or the app's response no longer match the original restore.
+var errRestoreMismatch = errors.New("snapshot does not match previously accepted restore")
+
+// restoreRecord records a snapshot that the app has accepted for restoration, along with the
+// app hash verified by the state provider. It is persisted when the app accepts a snapshot and
+// removed once the restore completes or is abandoned, such that snapshot re-offers (e.g. when
+// retrying or resuming) can be checked against the original restore.
+type restoreRecord struct {
+	Height  uint64 `json:"height"`
+	Format  uint32 `json:"format"`
+	Chunks  uint32 `json:"chunks"`
+	Hash    []byte `json:"hash"`
+	AppHash []byte `json:"app_hash"`
+}
+
+// newRestoreRecord creates a restore record for a snapshot.
+func newRestoreRecord(snapshot *snapshot) *restoreRecord {
+	return &restoreRecord{
+		Height:  snapshot.Height,
+		Format:  snapshot.Format,
+		Chunks:  snapshot.Chunks,
+		Hash:    snapshot.Hash,
+		AppHash: snapshot.trustedAppHash,
+	}
+}
+
+// Matches checks whether the record refers to the given snapshot, ignoring the app hash.
+func (r *restoreRecord) Matches(snapshot *snapshot) bool {
+	return r.Height == snapshot.Height && r.Format == snapshot.Format &&
+		r.Chunks == snapshot.Chunks && bytes.Equal(r.Hash, snapshot.Hash)
+}
+
+// ValidateBasic checks that the record describes a valid snapshot.
+func (r *restoreRecord) ValidateBasic() error {
+	if r.Height == 0 || r.Height > maxSnapshotHeight {
+		return fmt.Errorf("invalid height %v", r.Height)
+	}
+	if r.Chunks == 0 {
+		return errors.New("no chunks")
+	}
+	if len(r.Hash) == 0 {
+		return errors.New("no snapshot hash")
+	}
+	return nil
+}
+
+// Verify checks that a re-offered snapshot matches the record, including the trusted app hash.
+func (r *restoreRecord) Verify(snapshot *snapshot) error {
+	if !r.Matches(snapshot) {
+		return fmt.Errorf("%w: expected snapshot at height %v format %v hash %X", errRestoreMismatch,
+			r.Height, r.Format, r.Hash)
+	}
+	if !bytes.Equal(r.AppHash, snapshot.trustedAppHash) {
+		return fmt.Errorf("%w: trusted app hash changed from %X to %X", errRestoreMismatch,
+			r.AppHash, snapshot.trustedAppHash)
+	}
+	return nil
+}
+
+// restoreRecordPath returns the path of the restore record file in a temp dir, or an empty string
+// if no temp dir is configured, in which case records are not persisted. We don't persist records
+// to the shared OS temp dir, since several nodes may be running on the same machine.
+func restoreRecordPath(tempDir string) string {
+	if tempDir == "" {
+		return ""
+	}
+	return filepath.Join(tempDir, restoreRecordFile)
+}
+
+// loadRestoreRecord loads a restore record from a temp dir, or nil if none exists.
+func loadRestoreRecord(tempDir string) (*restoreRecord, error) {
+	path := restoreRecordPath(tempDir)
+	if path == "" {
+		return nil, nil
+	}
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read restore record %v: %w", path, err)
+	}
+	record := &restoreRecord{}
+	err = tmjson.Unmarshal(bz, record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode restore record %v: %w", path, err)
+	}
+	return record, nil
+}
+
+// saveRestoreRecord persists a restore record to a temp dir, if configured.
+func saveRestoreRecord(tempDir string, record *restoreRecord) error {
+	path := restoreRecordPath(tempDir)
+	if path == "" {
+		return nil
+	}
+	bz, err := tmjson.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode restore record: %w", err)
+	}
+	err = tempfile.WriteFileAtomic(path, bz, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write restore record %v: %w", path, err)
+	}
+	return nil
+}
+
+// recoverTempDir validates the state sync data in a temp dir, e.g. after an unclean shutdown, and
+// removes any which doesn't form a valid resumable restore: an undecodable or invalid restore
+// record, buffered chunks without a restore record, and stray entries among the buffered chunks.
+// Other entries in the temp dir are left alone, since it may be shared. It returns the paths of
+// the removed entries.
+func recoverTempDir(tempDir string) ([]string, error) {
+	info, err := os.Stat(tempDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", tempDir)
+	}
+
+	removed := []string{}
+	remove := func(path string) error {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %v: %w", path, err)
+		}
+		removed = append(removed, path)
+		return nil
+	}
+
+	record, err := loadRestoreRecord(tempDir)
+	if err == nil && record != nil {
+		err = record.ValidateBasic()
+	}
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return removed, err // the record couldn't be read, so it's not necessarily garbage
+		}
+		if err := remove(restoreRecordPath(tempDir)); err != nil {
+			return removed, err
+		}
+		record = nil
+	}
+
+	dir := filepath.Join(tempDir, restoreChunksDir)
+	info, err = os.Stat(dir)
+	if os.IsNotExist(err) {
+		return removed, nil
+	} else if err != nil {
+		return removed, err
+	}
+	if record == nil || !info.IsDir() {
+		return removed, remove(dir)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return removed, err
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), chunkChecksumSuffix)
+		index, err := strconv.ParseUint(name, 10, 32)
+		if err == nil && entry.Mode().IsRegular() && uint32(index) < record.Chunks &&
+			name == strconv.FormatUint(index, 10) {
+			continue
+		}
+		if err := remove(filepath.Join(dir, entry.Name())); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// removeRestoreRecord removes a persisted restore record from a temp dir, if any.
+func removeRestoreRecord(tempDir string) error {
+	path := restoreRecordPath(tempDir)
+	if path == "" {
+		return nil
+	}
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove restore record %v: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package statesync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync/mocks"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestRestoreRecord_SaveLoad(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	record, err := loadRestoreRecord(tempDir)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}, trustedAppHash: []byte("app_hash")}
+	err = saveRestoreRecord(tempDir, newRestoreRecord(s))
+	require.NoError(t, err)
+
+	record, err = loadRestoreRecord(tempDir)
+	require.NoError(t, err)
+	assert.Equal(t, newRestoreRecord(s), record)
+	assert.True(t, record.Matches(s))
+	assert.NoError(t, record.Verify(s))
+
+	err = removeRestoreRecord(tempDir)
+	require.NoError(t, err)
+	err = removeRestoreRecord(tempDir)
+	require.NoError(t, err)
+	record, err = loadRestoreRecord(tempDir)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+
+	// Records are not persisted without a temp dir.
+	require.NoError(t, saveRestoreRecord("", newRestoreRecord(s)))
+	record, err = loadRestoreRecord("")
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestRestoreRecord_Verify(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}, trustedAppHash: []byte("app_hash")}
+	record := newRestoreRecord(s)
+
+	testcases := map[string]struct {
+		snapshot    *snapshot
+		expectMatch bool
+	}{
+		"same": {s, true},
+		"app hash": {&snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3},
+			trustedAppHash: []byte("other")}, true},
+		"height": {&snapshot{Height: 2, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3},
+			trustedAppHash: []byte("app_hash")}, false},
+		"format": {&snapshot{Height: 1, Format: 2, Chunks: 3, Hash: []byte{1, 2, 3},
+			trustedAppHash: []byte("app_hash")}, false},
+		"chunks": {&snapshot{Height: 1, Format: 1, Chunks: 4, Hash: []byte{1, 2, 3},
+			trustedAppHash: []byte("app_hash")}, false},
+		"hash": {&snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 4},
+			trustedAppHash: []byte("app_hash")}, false},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expectMatch, record.Matches(tc.snapshot))
+			err := record.Verify(tc.snapshot)
+			if name == "same" {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, errRestoreMismatch))
+			}
+		})
+	}
+}
+
+func TestSyncer_offerSnapshot_Restart(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}, trustedAppHash: []byte("app_hash")}
+
+	testcases := map[string]struct {
+		appHash   []byte
+		result    abci.ResponseOfferSnapshot_Result
+		expectErr error
+	}{
+		"accept":        {[]byte("app_hash"), abci.ResponseOfferSnapshot_ACCEPT, nil},
+		"app hash":      {[]byte("other"), abci.ResponseOfferSnapshot_ACCEPT, errRestoreMismatch},
+		"reject":        {[]byte("app_hash"), abci.ResponseOfferSnapshot_REJECT, errRestoreMismatch},
+		"abort":         {[]byte("app_hash"), abci.ResponseOfferSnapshot_ABORT, errRestoreMismatch},
+		"reject sender": {[]byte("app_hash"), abci.ResponseOfferSnapshot_REJECT_SENDER, errRestoreMismatch},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("", "restore")
+			require.NoError(t, err)
+			defer os.RemoveAll(tempDir)
+
+			// The first syncer offers the snapshot, which is accepted and recorded.
+			first, connSnapshot := setupRestoreSyncer(tempDir)
+			connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+				Snapshot: toABCI(s),
+				AppHash:  []byte("app_hash"),
+			}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+			require.NoError(t, first.offerSnapshot(s))
+			connSnapshot.AssertExpectations(t)
+			assert.FileExists(t, filepath.Join(tempDir, restoreRecordFile))
+
+			// A restarted syncer re-offers the same snapshot.
+			second, connSnapshot := setupRestoreSyncer(tempDir)
+			reoffered := &snapshot{Height: s.Height, Format: s.Format, Chunks: s.Chunks, Hash: s.Hash,
+				trustedAppHash: tc.appHash}
+			if bytes.Equal(tc.appHash, s.trustedAppHash) {
+				connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+					Snapshot: toABCI(reoffered),
+					AppHash:  tc.appHash,
+				}).Once().Return(&abci.ResponseOfferSnapshot{Result: tc.result}, nil)
+			}
+			err = second.offerSnapshot(reoffered)
+			if tc.expectErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, tc.expectErr), "unexpected error %v", err)
+			}
+			connSnapshot.AssertExpectations(t)
+
+			// The record is kept in any case, to guard later offers.
+			record, err := loadRestoreRecord(tempDir)
+			require.NoError(t, err)
+			assert.Equal(t, newRestoreRecord(s), record)
+		})
+	}
+}
+
+func TestSyncer_SyncAny_RetryThenReject(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1, 2, 3}}
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, uint64(1)).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(sm.State{}, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(&types.Commit{}, nil)
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{},
+		stateProvider, tempDir)
+	peer := simplePeer("a")
+	peer.On("Send", ChunkChannel, mock.Anything).Maybe().Run(func(args mock.Arguments) {
+		_, err := syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}, Sender: "a"})
+		assert.NoError(t, err)
+	}).Return(true)
+	_, err = syncer.AddSnapshot(peer, s)
+	require.NoError(t, err)
+
+	// The app asks to retry the snapshot, and then rejects it when it is re-offered. This is an
+	// ordinary rejection rather than a mismatch with a restore accepted before a restart.
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+	connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+		Index: 0, Chunk: []byte{1}, Sender: "a",
+	}).Once().Return(&abci.ResponseApplySnapshotChunk{
+		Result: abci.ResponseApplySnapshotChunk_RETRY_SNAPSHOT}, nil)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}, nil)
+
+	_, err = syncer.SyncAny(0)
+	assert.Equal(t, errNoSnapshots, err)
+	connSnapshot.AssertExpectations(t)
+
+	// The rejected snapshot's restore record is removed.
+	record, err := loadRestoreRecord(tempDir)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestSyncer_offerSnapshot_OtherSnapshot(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}, trustedAppHash: []byte("app_hash")}
+	require.NoError(t, saveRestoreRecord(tempDir, newRestoreRecord(s)))
+
+	// Offers of a different snapshot are not re-offers, and are passed to the app as usual.
+	other := &snapshot{Height: 2, Format: 1, Chunks: 3, Hash: []byte{1, 2, 4}, trustedAppHash: []byte("app_hash")}
+	syncer, connSnapshot := setupRestoreSyncer(tempDir)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(other),
+		AppHash:  []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}, nil)
+	err = syncer.offerSnapshot(other)
+	assert.True(t, errors.Is(err, errRejectSnapshot))
+	connSnapshot.AssertExpectations(t)
+}
+
+func TestSyncer_newChunkQueue_Resume(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}, trustedAppHash: []byte("app_hash")}
+	require.NoError(t, saveRestoreRecord(tempDir, newRestoreRecord(s)))
+
+	syncer, _ := setupRestoreSyncer(tempDir)
+	chunks, err := syncer.newChunkQueue(s)
+	require.NoError(t, err)
+	for i := uint32(0); i < s.Chunks; i++ {
+		_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: i, Chunk: []byte{1, byte(i)}})
+		require.NoError(t, err)
+	}
+
+	// A restarted syncer resumes the restore, refetching chunks corrupted by an unclean shutdown.
+	bz, err := ioutil.ReadFile(filepath.Join(tempDir, restoreChunksDir, "1"))
+	require.NoError(t, err)
+	bz[0] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, restoreChunksDir, "1"), bz, 0600))
+
+	syncer, _ = setupRestoreSyncer(tempDir)
+	chunks, err = syncer.newChunkQueue(s)
+	require.NoError(t, err)
+	assert.True(t, chunks.Has(0))
+	assert.False(t, chunks.Has(1))
+	assert.True(t, chunks.Has(2))
+	index, err := chunks.Allocate()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, index)
+
+	// Restoring another snapshot discards the buffered chunks.
+	other := &snapshot{Height: 2, Format: 1, Chunks: 3, Hash: []byte{1, 2, 4}, trustedAppHash: []byte("app_hash")}
+	syncer, _ = setupRestoreSyncer(tempDir)
+	chunks, err = syncer.newChunkQueue(other)
+	require.NoError(t, err)
+	defer chunks.Close()
+	for i := uint32(0); i < other.Chunks; i++ {
+		assert.False(t, chunks.Has(i))
+	}
+}
+
+func TestRecoverTempDir(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}, trustedAppHash: []byte("app_hash")}
+	valid := func(t *testing.T, dir string) {
+		require.NoError(t, saveRestoreRecord(dir, newRestoreRecord(s)))
+		chunks, _, err := resumeChunkQueue(s, filepath.Join(dir, restoreChunksDir), sha256ChunkVerifier{})
+		require.NoError(t, err)
+		_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 1, Chunk: []byte{1}})
+		require.NoError(t, err)
+	}
+	write := func(t *testing.T, path string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, []byte("garbage"), 0600))
+	}
+
+	testcases := map[string]struct {
+		setup         func(t *testing.T, dir string)
+		expectRemoved []string
+	}{
+		"empty":         {func(t *testing.T, dir string) {}, []string{}},
+		"valid restore": {valid, []string{}},
+		"unrelated files are kept": {func(t *testing.T, dir string) {
+			write(t, filepath.Join(dir, "other"))
+		}, []string{}},
+		"undecodable record": {func(t *testing.T, dir string) {
+			valid(t, dir)
+			write(t, filepath.Join(dir, restoreRecordFile))
+		}, []string{restoreRecordFile, restoreChunksDir}},
+		"invalid record": {func(t *testing.T, dir string) {
+			valid(t, dir)
+			require.NoError(t, saveRestoreRecord(dir, &restoreRecord{Height: 1, Format: 1, Hash: []byte{1}}))
+		}, []string{restoreRecordFile, restoreChunksDir}},
+		"chunks without record": {func(t *testing.T, dir string) {
+			valid(t, dir)
+			require.NoError(t, removeRestoreRecord(dir))
+		}, []string{restoreChunksDir}},
+		"chunks dir is a file": {func(t *testing.T, dir string) {
+			require.NoError(t, saveRestoreRecord(dir, newRestoreRecord(s)))
+			write(t, filepath.Join(dir, restoreChunksDir))
+		}, []string{restoreChunksDir}},
+		"stray chunk entries": {func(t *testing.T, dir string) {
+			valid(t, dir)
+			write(t, filepath.Join(dir, restoreChunksDir, "3"))
+			write(t, filepath.Join(dir, restoreChunksDir, "01"))
+			write(t, filepath.Join(dir, restoreChunksDir, "x.sha256"))
+			require.NoError(t, os.Mkdir(filepath.Join(dir, restoreChunksDir, "2"), 0700))
+		}, []string{
+			filepath.Join(restoreChunksDir, "01"),
+			filepath.Join(restoreChunksDir, "2"),
+			filepath.Join(restoreChunksDir, "3"),
+			filepath.Join(restoreChunksDir, "x.sha256"),
+		}},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			tc.setup(t, dir)
+			removed, err := recoverTempDir(dir)
+			require.NoError(t, err)
+			expect := []string{}
+			for _, path := range tc.expectRemoved {
+				expect = append(expect, filepath.Join(dir, path))
+				_, err := os.Stat(filepath.Join(dir, path))
+				assert.True(t, os.IsNotExist(err))
+			}
+			assert.Equal(t, expect, removed)
+
+			// Whatever remains is a valid, resumable restore.
+			record, err := loadRestoreRecord(dir)
+			require.NoError(t, err)
+			if record != nil {
+				require.NoError(t, record.ValidateBasic())
+				chunks, corrupt, err := resumeChunkQueue(s, filepath.Join(dir, restoreChunksDir), sha256ChunkVerifier{})
+				require.NoError(t, err)
+				assert.Empty(t, corrupt)
+				require.NoError(t, chunks.Close())
+			}
+		})
+	}
+
+	// Missing temp dirs are fine, but a temp dir which is a file is not.
+	removed, err := recoverTempDir(filepath.Join(t.TempDir(), "missing"))
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+	file := filepath.Join(t.TempDir(), "file")
+	write(t, file)
+	_, err = recoverTempDir(file)
+	assert.Error(t, err)
+}
+
+func TestReactor_OnStart_RecoverTempDir(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, restoreRecordFile)
+	require.NoError(t, ioutil.WriteFile(path, []byte("garbage"), 0600))
+
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, nil, tempDir)
+	require.NoError(t, r.Start())
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// setupRestoreSyncer sets up a syncer using the given temp dir, for testing restore records.
+func setupRestoreSyncer(tempDir string) (*syncer, *proxymocks.AppConnSnapshot) {
+	connQuery := &proxymocks.AppConnQuery{}
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	stateProvider := &mocks.StateProvider{}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery, stateProvider,
+		tempDir)
+	return syncer, connSnapshot
+}
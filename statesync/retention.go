@@ -0,0 +1,90 @@
+package statesync
+
+import (
+	"sort"
+	"time"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+)
+
+const (
+	// snapshotPruneInterval is the interval between enforcements of the snapshot retention policy.
+	snapshotPruneInterval = time.Minute
+)
+
+// SnapshotPruneFunc deletes a local snapshot from the app, on behalf of the snapshot retention
+// policy. ABCI has no method for deleting snapshots, so this must be provided by the app's
+// integration, e.g. by calling into the app's snapshot store. If it returns an error, the snapshot
+// is pruned again on the next enforcement.
+type SnapshotPruneFunc func(height uint64, format uint32) error
+
+// snapshotRetention implements the snapshot retention policy, which retains local snapshots at
+// the snapshot_keep_recent most recent heights and snapshots first listed by the app within
+// snapshot_keep_age. Snapshots outside of either limit are expired. Snapshot ages are tracked in
+// memory, from the time the reactor first lists a snapshot, and thus restart with the node.
+type snapshotRetention struct {
+	tmsync.Mutex
+	keepRecent int
+	keepAge    time.Duration
+	firstSeen  map[servedSnapshot]time.Time
+}
+
+// newSnapshotRetention creates a new snapshot retention policy. Zero limits are disabled.
+func newSnapshotRetention(keepRecent int, keepAge time.Duration) *snapshotRetention {
+	return &snapshotRetention{
+		keepRecent: keepRecent,
+		keepAge:    keepAge,
+		firstSeen:  make(map[servedSnapshot]time.Time),
+	}
+}
+
+// Enabled checks whether any retention limit is enabled.
+func (p *snapshotRetention) Enabled() bool {
+	return p.keepRecent > 0 || p.keepAge > 0
+}
+
+// Expired returns the snapshots among all the app's current snapshots which are no longer
+// retained by the policy. Snapshots not seen before are recorded as first seen now, and snapshots
+// which are no longer listed are forgotten. It returns nil if the policy is disabled.
+func (p *snapshotRetention) Expired(snapshots []*abci.Snapshot) map[servedSnapshot]bool {
+	if !p.Enabled() {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	listed := make(map[servedSnapshot]bool, len(snapshots))
+	seenHeights := make(map[uint64]bool, len(snapshots))
+	heights := make([]uint64, 0, len(snapshots))
+	for _, s := range snapshots {
+		key := servedSnapshot{Height: s.Height, Format: s.Format}
+		if _, ok := p.firstSeen[key]; !ok {
+			p.firstSeen[key] = now
+		}
+		listed[key] = true
+		if !seenHeights[s.Height] {
+			seenHeights[s.Height] = true
+			heights = append(heights, s.Height)
+		}
+	}
+	for key := range p.firstSeen {
+		if !listed[key] {
+			delete(p.firstSeen, key)
+		}
+	}
+
+	var minHeight uint64
+	if p.keepRecent > 0 && len(heights) > p.keepRecent {
+		sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+		minHeight = heights[p.keepRecent-1]
+	}
+	expired := make(map[servedSnapshot]bool)
+	for _, s := range snapshots {
+		key := servedSnapshot{Height: s.Height, Format: s.Format}
+		if s.Height < minHeight || (p.keepAge > 0 && now.Sub(p.firstSeen[key]) > p.keepAge) {
+			expired[key] = true
+		}
+	}
+	return expired
+}
@@ -0,0 +1,97 @@
+package statesync
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+)
+
+func TestSnapshotRetention_Expired(t *testing.T) {
+	snapshots := []*abci.Snapshot{
+		{Height: 1, Format: 1},
+		{Height: 3, Format: 1},
+		{Height: 3, Format: 2},
+		{Height: 2, Format: 1},
+	}
+	assert.Nil(t, newSnapshotRetention(0, 0).Expired(snapshots))
+
+	// The most recent heights are retained, with all of their formats.
+	p := newSnapshotRetention(2, 0)
+	assert.Equal(t, map[servedSnapshot]bool{{Height: 1, Format: 1}: true}, p.Expired(snapshots))
+	assert.Empty(t, newSnapshotRetention(3, 0).Expired(snapshots))
+
+	// Snapshots expire once they were first seen longer ago than the age limit, and forgotten
+	// snapshots start afresh.
+	p = newSnapshotRetention(0, time.Hour)
+	assert.Empty(t, p.Expired(snapshots))
+	p.firstSeen[servedSnapshot{Height: 2, Format: 1}] = time.Now().Add(-2 * time.Hour)
+	p.firstSeen[servedSnapshot{Height: 9, Format: 1}] = time.Now().Add(-2 * time.Hour)
+	assert.Equal(t, map[servedSnapshot]bool{{Height: 2, Format: 1}: true}, p.Expired(snapshots))
+	assert.NotContains(t, p.firstSeen, servedSnapshot{Height: 9, Format: 1})
+	assert.Len(t, p.firstSeen, 4)
+}
+
+func TestReactor_pruneSnapshots(t *testing.T) {
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("ListSnapshotsSync", abci.RequestListSnapshots{}).Return(&abci.ResponseListSnapshots{
+		Snapshots: []*abci.Snapshot{
+			{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}},
+			{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}},
+			{Height: 3, Format: 1, Chunks: 1, Hash: []byte{3}},
+			{Height: 4, Format: 1, Chunks: 1, Hash: []byte{4}},
+			{Height: 5, Format: 1, Chunks: 1, Hash: []byte{5}},
+		},
+	}, nil)
+	config := cfg.TestStateSyncConfig()
+	config.SnapshotKeepRecent = 2
+
+	// Without a pruner, expired snapshots are withheld from peers.
+	r := NewReactor(config, conn, nil, "")
+	snapshots, err := r.recentSnapshots(recentSnapshots)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.EqualValues(t, 5, snapshots[0].Height)
+	assert.EqualValues(t, 4, snapshots[1].Height)
+	local, err := r.LocalSnapshots()
+	require.NoError(t, err)
+	assert.Equal(t, "expired by retention policy", local[4].Withheld)
+
+	// With a pruner, expired snapshots are pruned unless they're in use, and failures are retried
+	// on the next enforcement.
+	pruned := []uint64{}
+	fail := true
+	pruner := func(height uint64, format uint32) error {
+		if height == 3 && fail {
+			fail = false
+			return errors.New("boom")
+		}
+		pruned = append(pruned, height)
+		return nil
+	}
+	prunedSnapshots := generic.NewCounter("pruned_snapshots")
+	metrics := NopMetrics()
+	metrics.PrunedSnapshots = prunedSnapshots
+	r = NewReactor(config, conn, nil, "", WithSnapshotPruner(pruner), WithMetrics(metrics))
+	r.serving.Touch(2, 1, "a")
+	r.pinned.Put(1, 1, [][]byte{{1}})
+
+	r.pruneSnapshots()
+	assert.Empty(t, pruned)
+	r.pruneSnapshots()
+	assert.Equal(t, []uint64{3}, pruned)
+	assert.EqualValues(t, 1, prunedSnapshots.Value())
+
+	r.pinned.Remove(1, 1)
+	r.serving.RemovePeer("a")
+	pruned = pruned[:0]
+	r.pruneSnapshots()
+	assert.Equal(t, []uint64{3, 2, 1}, pruned)
+}
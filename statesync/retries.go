@@ -0,0 +1,166 @@
+package statesync
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// Reasons for retrying a chunk, as counted against the retry budget and reported in metrics.
+const (
+	retryReasonTimeout = "timeout" // the chunk request timed out, and was sent again
+	retryReasonRefetch = "refetch" // the app asked for the chunk to be refetched
+	retryReasonApply   = "retry"   // the app asked to retry applying the chunk
+)
+
+var (
+	// errRetryBudget is returned by Sync() when the snapshot's chunk retry budget is exhausted.
+	errRetryBudget = errors.New("chunk retry budget exhausted")
+	// errRefetchLimit is returned by Sync() when a chunk has been refetched too many times.
+	errRefetchLimit = errors.New("chunk refetch limit exceeded")
+)
+
+// retryBudget limits the total number of chunk retries for a snapshot, across all of its chunks
+// and restoration attempts, such that a bad snapshot can't consume unbounded bandwidth before we
+// give up on it. It also limits the number of app-requested refetches of each individual chunk,
+// since repeated verification failures for a chunk likely mean that the snapshot itself is bad
+// rather than its senders. A nil budget is unlimited.
+type retryBudget struct {
+	tmsync.Mutex
+	key          snapshotKey
+	limit        int            // maximum number of retries, or 0 for unlimited
+	retries      map[string]int // number of retries by reason
+	total        int
+	exhausted    chan struct{}
+	refetchLimit int                       // maximum refetches per chunk, or 0 for unlimited
+	refetches    map[uint32]map[p2p.ID]int // refetches by chunk and sender of the refetched chunk
+}
+
+// newRetryBudget creates a retry budget for a snapshot, allowing factor retries per chunk in
+// total, and refetchLimit refetches of any single chunk. A factor or limit of 0 disables the
+// respective limit.
+func newRetryBudget(snapshot *snapshot, factor float64, refetchLimit int) *retryBudget {
+	limit := 0
+	if factor > 0 {
+		limit = int(math.Ceil(factor * float64(snapshot.Chunks)))
+	}
+	return &retryBudget{
+		key:          snapshot.Key(),
+		limit:        limit,
+		retries:      make(map[string]int),
+		exhausted:    make(chan struct{}),
+		refetchLimit: refetchLimit,
+		refetches:    make(map[uint32]map[p2p.ID]int),
+	}
+}
+
+// Refetch records an app-requested refetch of a chunk sent by the given peer, which may be empty
+// if unknown. It returns an error once the chunk has been refetched more than the refetch limit.
+// The refetch should also be spent against the budget via Spend().
+func (b *retryBudget) Refetch(index uint32, sender p2p.ID) error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.refetches[index] == nil {
+		b.refetches[index] = make(map[p2p.ID]int)
+	}
+	b.refetches[index][sender]++
+	total := 0
+	senders := make([]string, 0, len(b.refetches[index]))
+	for peerID, count := range b.refetches[index] {
+		total += count
+		if peerID == "" {
+			peerID = "unknown"
+		}
+		senders = append(senders, fmt.Sprintf("%v=%v", peerID, count))
+	}
+	if b.refetchLimit == 0 || total <= b.refetchLimit {
+		return nil
+	}
+	sort.Strings(senders)
+	return fmt.Errorf("%w: chunk %v refetched %v times, exceeding limit %v (senders %v)",
+		errRefetchLimit, index, total, b.refetchLimit, strings.Join(senders, ", "))
+}
+
+// Refetched checks whether a chunk has previously been refetched after being sent by the given
+// peer.
+func (b *retryBudget) Refetched(index uint32, peerID p2p.ID) bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.refetches[index][peerID] > 0
+}
+
+// Refetches returns the number of times a chunk has been refetched, from any sender.
+func (b *retryBudget) Refetches(index uint32) int {
+	if b == nil {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	total := 0
+	for _, count := range b.refetches[index] {
+		total += count
+	}
+	return total
+}
+
+// Spend records a chunk retry for the given reason. It returns an error once the budget has been
+// exceeded.
+func (b *retryBudget) Spend(reason string) error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.retries[reason]++
+	b.total++
+	if b.limit == 0 || b.total <= b.limit {
+		return nil
+	}
+	if b.total == b.limit+1 {
+		close(b.exhausted)
+	}
+	return b.err()
+}
+
+// Exhausted returns a channel which is closed when the budget is exhausted.
+func (b *retryBudget) Exhausted() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.exhausted
+}
+
+// Err returns an error describing how the budget was exhausted, or nil if it hasn't been.
+func (b *retryBudget) Err() error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.limit == 0 || b.total <= b.limit {
+		return nil
+	}
+	return b.err()
+}
+
+// err returns an exhaustion error. The caller must hold the mutex lock.
+func (b *retryBudget) err() error {
+	reasons := make([]string, 0, len(b.retries))
+	for reason, count := range b.retries {
+		reasons = append(reasons, fmt.Sprintf("%v=%v", reason, count))
+	}
+	sort.Strings(reasons)
+	return fmt.Errorf("%w: %v retries exceeds limit %v (%v)", errRetryBudget, b.total, b.limit,
+		strings.Join(reasons, ", "))
+}
@@ -0,0 +1,172 @@
+package statesync
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	"github.com/tendermint/tendermint/statesync/mocks"
+)
+
+func TestRetryBudget(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}}
+	budget := newRetryBudget(s, 1.5, 0)
+	assert.Equal(t, 5, budget.limit)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, budget.Spend(retryReasonTimeout))
+	}
+	require.NoError(t, budget.Spend(retryReasonRefetch))
+	require.NoError(t, budget.Spend(retryReasonApply))
+	require.NoError(t, budget.Err())
+	select {
+	case <-budget.Exhausted():
+		t.Fatal("budget exhausted early")
+	default:
+	}
+
+	err := budget.Spend(retryReasonRefetch)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errRetryBudget))
+	assert.Contains(t, err.Error(), "refetch=2, retry=1, timeout=3")
+	assert.Equal(t, err, budget.Err())
+	<-budget.Exhausted()
+
+	// Further spending keeps failing, without closing the channel again.
+	assert.Error(t, budget.Spend(retryReasonTimeout))
+}
+
+func TestRetryBudget_unlimited(t *testing.T) {
+	budget := newRetryBudget(&snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}}, 0, 0)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, budget.Spend(retryReasonTimeout))
+	}
+	require.NoError(t, budget.Err())
+
+	var nilBudget *retryBudget
+	require.NoError(t, nilBudget.Spend(retryReasonTimeout))
+	require.NoError(t, nilBudget.Err())
+	assert.Nil(t, nilBudget.Exhausted())
+}
+
+func TestRetryBudget_Refetch(t *testing.T) {
+	budget := newRetryBudget(&snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}}, 0, 3)
+
+	require.NoError(t, budget.Refetch(0, "a"))
+	require.NoError(t, budget.Refetch(0, "b"))
+	require.NoError(t, budget.Refetch(1, "a"))
+	require.NoError(t, budget.Refetch(0, ""))
+	assert.True(t, budget.Refetched(0, "a"))
+	assert.True(t, budget.Refetched(0, "b"))
+	assert.False(t, budget.Refetched(1, "b"))
+	assert.False(t, budget.Refetched(2, "a"))
+
+	err := budget.Refetch(0, "b")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errRefetchLimit))
+	assert.Contains(t, err.Error(), "chunk 0 refetched 4 times, exceeding limit 3 (senders a=1, b=2, unknown=1)")
+
+	unlimited := newRetryBudget(&snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}}, 0, 0)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, unlimited.Refetch(0, "a"))
+	}
+
+	var nilBudget *retryBudget
+	require.NoError(t, nilBudget.Refetch(0, "a"))
+	assert.False(t, nilBudget.Refetched(0, "a"))
+}
+
+func TestSyncer_selectPeer_AvoidsRefetchedSenders(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, stateProvider, "")
+	syncer.budget = newRetryBudget(s, 0, 0)
+	for _, id := range []string{"a", "b"} {
+		_, err := syncer.AddSnapshot(simplePeer(id), s)
+		require.NoError(t, err)
+	}
+
+	// Peers which sent a bad copy of the chunk are avoided, unless there are no other peers.
+	require.NoError(t, syncer.budget.Refetch(2, "a"))
+	for i := 0; i < 10; i++ {
+		assert.EqualValues(t, "b", syncer.selectPeer(s, 2).ID())
+	}
+	require.NoError(t, syncer.budget.Refetch(2, "b"))
+	assert.NotNil(t, syncer.selectPeer(s, 2))
+}
+
+func TestSyncer_applyChunks_RetryBudget(t *testing.T) {
+	connQuery := &proxymocks.AppConnQuery{}
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	stateProvider := &mocks.StateProvider{}
+	config := cfg.TestStateSyncConfig()
+	config.ChunkRetryBudget = 2
+	syncer := newSyncer(config, log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	syncer.budget = newRetryBudget(s, config.ChunkRetryBudget, config.ChunkRefetchLimit)
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	body := []byte{1, 2, 3}
+	_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: body})
+	require.NoError(t, err)
+
+	// The app keeps asking to retry the chunk, until the budget is exhausted.
+	connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+		Index: 0, Chunk: body,
+	}).Times(3).Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_RETRY}, nil)
+
+	err = syncer.applyChunks(chunks)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errRetryBudget))
+	connSnapshot.AssertExpectations(t)
+}
+
+func TestSyncer_applyChunks_RefetchLimit(t *testing.T) {
+	connQuery := &proxymocks.AppConnQuery{}
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	stateProvider := &mocks.StateProvider{}
+	config := cfg.TestStateSyncConfig()
+	config.ChunkRefetchLimit = 1
+	syncer := newSyncer(config, log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	syncer.budget = newRetryBudget(s, config.ChunkRetryBudget, config.ChunkRefetchLimit)
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	body := []byte{1, 2, 3}
+	_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: body, Sender: "a"})
+	require.NoError(t, err)
+
+	// The app keeps asking to refetch the chunk, which is resent by another peer once.
+	connSnapshot.On("ApplySnapshotChunkSync", mock.Anything).Times(2).Return(&abci.ResponseApplySnapshotChunk{
+		Result:        abci.ResponseApplySnapshotChunk_RETRY,
+		RefetchChunks: []uint32{0},
+	}, nil)
+	go func() {
+		for chunks.Has(0) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, err := chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: body, Sender: p2p.ID("b")})
+		assert.NoError(t, err)
+	}()
+
+	err = syncer.applyChunks(chunks)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errRefetchLimit))
+	assert.Contains(t, err.Error(), "senders a=1, b=1")
+	connSnapshot.AssertExpectations(t)
+}
@@ -0,0 +1,325 @@
+package statesync
+
+import (
+	"sort"
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+const (
+	// servingIdleTimeout is the time after a peer's last chunk request for a snapshot at which
+	// we no longer consider the snapshot to be actively served to that peer.
+	servingIdleTimeout = time.Minute
+	// servingQueueSize is the number of serving requests that can be queued per peer, beyond
+	// which further requests from the peer are dropped.
+	servingQueueSize = 32
+	// servingPriorityQueueSize is the number of priority requests that can be queued per peer, in
+	// addition to servingQueueSize regular requests.
+	servingPriorityQueueSize = 4
+)
+
+// servedSnapshot identifies a snapshot being served to peers.
+type servedSnapshot struct {
+	Height uint64
+	Format uint32
+}
+
+// servingTracker reference counts the snapshots that are actively being served to peers, such
+// that the node can avoid pruning snapshots out from under syncing peers. A snapshot is
+// referenced by a peer from its first chunk request until the peer disconnects or has been idle
+// for the idle timeout.
+//
+// It also records snapshots which turned out to be missing chunks while serving them, such that
+// they are no longer advertised to peers, who would never be able to finish syncing them.
+type servingTracker struct {
+	tmsync.Mutex
+	idleTimeout time.Duration
+	peers       map[servedSnapshot]map[p2p.ID]time.Time // last request time, by snapshot and peer
+	incomplete  map[servedSnapshot]bool
+}
+
+// newServingTracker creates a new serving tracker.
+func newServingTracker(idleTimeout time.Duration) *servingTracker {
+	return &servingTracker{
+		idleTimeout: idleTimeout,
+		peers:       make(map[servedSnapshot]map[p2p.ID]time.Time),
+		incomplete:  make(map[servedSnapshot]bool),
+	}
+}
+
+// Touch records that a peer requested a chunk of the given snapshot.
+func (t *servingTracker) Touch(height uint64, format uint32, peerID p2p.ID) {
+	t.Lock()
+	defer t.Unlock()
+	key := servedSnapshot{Height: height, Format: format}
+	if t.peers[key] == nil {
+		t.peers[key] = make(map[p2p.ID]time.Time)
+	}
+	t.peers[key][peerID] = time.Now()
+}
+
+// RemovePeer releases all snapshot references held by a peer.
+func (t *servingTracker) RemovePeer(peerID p2p.ID) {
+	t.Lock()
+	defer t.Unlock()
+	for key, peers := range t.peers {
+		delete(peers, peerID)
+		if len(peers) == 0 {
+			delete(t.peers, key)
+		}
+	}
+}
+
+// Refs returns the number of peers actively being served the given snapshot.
+func (t *servingTracker) Refs(height uint64, format uint32) int {
+	t.Lock()
+	defer t.Unlock()
+	t.expire()
+	return len(t.peers[servedSnapshot{Height: height, Format: format}])
+}
+
+// Heights returns the heights of all snapshots that are actively being served, in ascending order.
+func (t *servingTracker) Heights() []uint64 {
+	t.Lock()
+	defer t.Unlock()
+	t.expire()
+
+	seen := make(map[uint64]bool, len(t.peers))
+	heights := make([]uint64, 0, len(t.peers))
+	for key := range t.peers {
+		if !seen[key.Height] {
+			seen[key.Height] = true
+			heights = append(heights, key.Height)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights
+}
+
+// MarkIncomplete records that a snapshot is missing chunks. It returns false if the snapshot
+// was already marked as incomplete.
+func (t *servingTracker) MarkIncomplete(height uint64, format uint32) bool {
+	t.Lock()
+	defer t.Unlock()
+	key := servedSnapshot{Height: height, Format: format}
+	if t.incomplete[key] {
+		return false
+	}
+	t.incomplete[key] = true
+	return true
+}
+
+// Incomplete checks whether a snapshot has been marked as missing chunks.
+func (t *servingTracker) Incomplete(height uint64, format uint32) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.incomplete[servedSnapshot{Height: height, Format: format}]
+}
+
+// expire releases references from peers that have been idle for longer than the idle timeout.
+// The caller must hold the mutex lock.
+func (t *servingTracker) expire() {
+	cutoff := time.Now().Add(-t.idleTimeout)
+	for key, peers := range t.peers {
+		for peerID, last := range peers {
+			if last.Before(cutoff) {
+				delete(peers, peerID)
+			}
+		}
+		if len(peers) == 0 {
+			delete(t.peers, key)
+		}
+	}
+}
+
+// servingPool is a bounded pool of workers which serve snapshot and chunk requests from peers,
+// such that slow app responses don't block the reactor from processing restore messages.
+//
+// Requests are queued per peer, and the workers serve peers in turn, taking one request from each
+// peer with pending requests, such that a peer sending many requests can't starve other peers of
+// the app's serving throughput. A peer's requests are never served concurrently, and are thus
+// answered in order. Each peer can queue up to servingQueueSize requests, beyond which further
+// requests are dropped.
+//
+// Priority requests, i.e. snapshot requests, are served ahead of regular chunk requests, both
+// within a peer's queue and across peers, such that snapshot discovery isn't starved by chunk
+// traffic. They are queued separately, up to servingPriorityQueueSize per peer, such that a full
+// queue of chunk requests doesn't cause them to be dropped either.
+type servingPool struct {
+	workers int
+	metrics *Metrics
+	wake    chan struct{} // signals workers that requests have been queued
+
+	mtx    tmsync.Mutex
+	queues map[p2p.ID][]servingTask // pending requests by peer
+	order  []p2p.ID                 // peers with pending requests, in serving order
+	busy   map[p2p.ID]bool          // peers whose requests are currently being served
+}
+
+// servingTask is a queued serving request.
+type servingTask struct {
+	run      func()
+	queued   time.Time
+	priority bool
+}
+
+// newServingPool creates a new serving pool with the given number of workers.
+func newServingPool(workers int, metrics *Metrics) *servingPool {
+	return &servingPool{
+		workers: workers,
+		metrics: metrics,
+		wake:    make(chan struct{}, workers),
+		queues:  make(map[p2p.ID][]servingTask),
+		busy:    make(map[p2p.ID]bool),
+	}
+}
+
+// Start starts the pool workers, which run until the quit channel is closed.
+func (p *servingPool) Start(quit <-chan struct{}) {
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			for {
+				// Stop promptly once quit is closed, even with further requests queued.
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				peerID, task, ok := p.next()
+				if !ok {
+					select {
+					case <-p.wake:
+						continue
+					case <-quit:
+						return
+					}
+				}
+				p.metrics.ServingQueueTime.With("peer_id", string(peerID)).Observe(
+					time.Since(task.queued).Seconds())
+				task.run()
+				p.metrics.ServedRequests.With("peer_id", string(peerID)).Add(1)
+				p.done(peerID)
+			}
+		}()
+	}
+}
+
+// Submit queues a serving task for a peer. It never blocks, and returns false if the peer's
+// queue is full, in which case the task is dropped.
+func (p *servingPool) Submit(peerID p2p.ID, task func()) bool {
+	return p.submit(peerID, servingTask{run: task, queued: time.Now()})
+}
+
+// SubmitPriority is like Submit, but queues a priority task, which is served ahead of the peer's
+// and other peers' regular tasks.
+func (p *servingPool) SubmitPriority(peerID p2p.ID, task func()) bool {
+	return p.submit(peerID, servingTask{run: task, queued: time.Now(), priority: true})
+}
+
+// submit implements Submit and SubmitPriority.
+func (p *servingPool) submit(peerID p2p.ID, task servingTask) bool {
+	p.mtx.Lock()
+	queue := p.queues[peerID]
+	priority := 0
+	for priority < len(queue) && queue[priority].priority {
+		priority++
+	}
+	if (task.priority && priority >= servingPriorityQueueSize) ||
+		(!task.priority && len(queue)-priority >= servingQueueSize) {
+		p.mtx.Unlock()
+		p.metrics.DroppedServingRequests.With("peer_id", string(peerID)).Add(1)
+		return false
+	}
+	if len(queue) == 0 {
+		p.order = append(p.order, peerID)
+	}
+	if task.priority {
+		// Queue the task behind the peer's other priority tasks, but ahead of its regular ones.
+		queue = append(queue, servingTask{})
+		copy(queue[priority+1:], queue[priority:])
+		queue[priority] = task
+	} else {
+		queue = append(queue, task)
+	}
+	p.queues[peerID] = queue
+	p.mtx.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default: // all workers already have a pending wakeup
+	}
+	return true
+}
+
+// RemovePeer drops all queued requests from a peer, e.g. when it disconnects.
+func (p *servingPool) RemovePeer(peerID p2p.ID) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if _, ok := p.queues[peerID]; !ok {
+		return
+	}
+	delete(p.queues, peerID)
+	p.removeOrder(peerID)
+}
+
+// next takes the next request to serve, from the first peer in the serving order which isn't
+// already being served, and moves that peer to the back of the order. Peers with priority
+// requests are served first. It returns false if there are no requests to serve.
+func (p *servingPool) next() (p2p.ID, servingTask, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	peerID, ok := p.nextPeer(true)
+	if !ok {
+		peerID, ok = p.nextPeer(false)
+	}
+	if !ok {
+		return "", servingTask{}, false
+	}
+	return peerID, p.take(peerID), true
+}
+
+// nextPeer returns the first peer in the serving order which isn't already being served and, if
+// priority is true, whose next request is a priority request. The caller must hold the mutex lock.
+func (p *servingPool) nextPeer(priority bool) (p2p.ID, bool) {
+	for _, peerID := range p.order {
+		if !p.busy[peerID] && (!priority || p.queues[peerID][0].priority) {
+			return peerID, true
+		}
+	}
+	return "", false
+}
+
+// take takes the next request of a peer with pending requests, moving the peer to the back of the
+// serving order and marking it as busy. The caller must hold the mutex lock.
+func (p *servingPool) take(peerID p2p.ID) servingTask {
+	queue := p.queues[peerID]
+	task := queue[0]
+	p.removeOrder(peerID)
+	if len(queue) > 1 {
+		p.queues[peerID] = queue[1:]
+		p.order = append(p.order, peerID)
+	} else {
+		delete(p.queues, peerID)
+	}
+	p.busy[peerID] = true
+	return task
+}
+
+// done marks a peer's request as served, such that its next request can be served.
+func (p *servingPool) done(peerID p2p.ID) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.busy, peerID)
+}
+
+// removeOrder removes a peer from the serving order. The caller must hold the mutex lock.
+func (p *servingPool) removeOrder(peerID p2p.ID) {
+	for i, id := range p.order {
+		if id == peerID {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package statesync
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+func TestServingTracker(t *testing.T) {
+	tracker := newServingTracker(time.Minute)
+	assert.Empty(t, tracker.Heights())
+
+	tracker.Touch(3, 1, "a")
+	tracker.Touch(3, 1, "b")
+	tracker.Touch(3, 2, "a")
+	tracker.Touch(1, 1, "b")
+	assert.Equal(t, []uint64{1, 3}, tracker.Heights())
+	assert.Equal(t, 2, tracker.Refs(3, 1))
+	assert.Equal(t, 1, tracker.Refs(3, 2))
+	assert.Equal(t, 0, tracker.Refs(2, 1))
+
+	// Touching again should not add further references.
+	tracker.Touch(3, 1, "a")
+	assert.Equal(t, 2, tracker.Refs(3, 1))
+
+	// Removing peers should release their references.
+	tracker.RemovePeer("b")
+	assert.Equal(t, []uint64{3}, tracker.Heights())
+	assert.Equal(t, 1, tracker.Refs(3, 1))
+
+	tracker.RemovePeer("a")
+	assert.Empty(t, tracker.Heights())
+}
+
+func TestServingTracker_idle(t *testing.T) {
+	tracker := newServingTracker(50 * time.Millisecond)
+	tracker.Touch(3, 1, "a")
+	assert.Equal(t, []uint64{3}, tracker.Heights())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, tracker.Heights())
+	assert.Equal(t, 0, tracker.Refs(3, 1))
+}
+
+func TestServingPool(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	pool := newServingPool(2, NopMetrics())
+	pool.Start(quit)
+
+	// Block the peer's worker, then fill its queue. Further requests are dropped.
+	block, blocked := make(chan struct{}), make(chan struct{})
+	require.True(t, pool.Submit("a", func() {
+		close(blocked)
+		<-block
+	}))
+	<-blocked
+	done := make(chan int, servingQueueSize)
+	for i := 0; i < servingQueueSize; i++ {
+		i := i
+		require.True(t, pool.Submit("a", func() { done <- i }))
+	}
+	assert.False(t, pool.Submit("a", func() { done <- -1 }))
+
+	// Once unblocked, the peer's requests are handled in order.
+	close(block)
+	for i := 0; i < servingQueueSize; i++ {
+		select {
+		case n := <-done:
+			assert.Equal(t, i, n)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for serving task")
+		}
+	}
+}
+
+func TestServingPool_fairness(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	pool := newServingPool(1, NopMetrics())
+	pool.Start(quit)
+
+	// Block the only worker, then queue several requests from a and one each from b and c.
+	block, blocked := make(chan struct{}), make(chan struct{})
+	require.True(t, pool.Submit("a", func() {
+		close(blocked)
+		<-block
+	}))
+	<-blocked
+	done := make(chan string, 8)
+	for _, name := range []string{"a1", "a2", "a3", "b1", "c1", "b2"} {
+		name := name
+		require.True(t, pool.Submit(p2p.ID(name[:1]), func() { done <- name }))
+	}
+	require.True(t, pool.Submit("d", func() { done <- "d1" }))
+	pool.RemovePeer("d")
+
+	// Peers are served in turn, rather than in the order the requests arrived.
+	close(block)
+	for _, expect := range []string{"a1", "b1", "c1", "a2", "b2", "a3"} {
+		select {
+		case name := <-done:
+			assert.Equal(t, expect, name)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for serving task")
+		}
+	}
+	select {
+	case name := <-done:
+		t.Fatalf("unexpected serving task %v", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServingPool_priority(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	pool := newServingPool(1, NopMetrics())
+	pool.Start(quit)
+
+	// Block the only worker, then fill a's queue with chunk requests and queue snapshot requests
+	// from a and b behind them.
+	block, blocked := make(chan struct{}), make(chan struct{})
+	require.True(t, pool.Submit("a", func() {
+		close(blocked)
+		<-block
+	}))
+	<-blocked
+	done := make(chan string, servingQueueSize+servingPriorityQueueSize+2)
+	for i := 0; i < servingQueueSize; i++ {
+		require.True(t, pool.Submit("a", func() { done <- "chunk" }))
+	}
+	require.True(t, pool.Submit("b", func() { done <- "b chunk" }))
+	assert.False(t, pool.Submit("a", func() { done <- "dropped" }))
+	for i := 0; i < servingPriorityQueueSize; i++ {
+		i := i
+		require.True(t, pool.SubmitPriority("a", func() { done <- fmt.Sprintf("a%v", i) }))
+	}
+	assert.False(t, pool.SubmitPriority("a", func() { done <- "dropped" }))
+	require.True(t, pool.SubmitPriority("b", func() { done <- "b0" }))
+
+	// The snapshot requests are served first, in turn and in order, despite the full chunk queue.
+	close(block)
+	for _, expect := range []string{"a0", "b0", "a1", "a2", "a3", "b chunk", "chunk"} {
+		select {
+		case name := <-done:
+			assert.Equal(t, expect, name)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for serving task")
+		}
+	}
+}
+
+func TestServingPool_quit(t *testing.T) {
+	quit := make(chan struct{})
+	pool := newServingPool(1, NopMetrics())
+	pool.Start(quit)
+
+	// Queued requests are no longer served once the pool is stopped.
+	block, blocked := make(chan struct{}), make(chan struct{})
+	require.True(t, pool.Submit("a", func() {
+		close(blocked)
+		<-block
+	}))
+	<-blocked
+	served := make(chan struct{}, 1)
+	require.True(t, pool.Submit("b", func() { served <- struct{}{} }))
+	close(quit)
+	close(block)
+	select {
+	case <-served:
+		t.Fatal("request served after quit")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
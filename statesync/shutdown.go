@@ -0,0 +1,52 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// When the reactor is stopped, e.g. because the node is shutting down, any state syncs in progress
+// are interrupted rather than left running against a node being torn down. The chunk being applied
+// by the app, if any, is allowed to finish such that the app isn't interrupted mid-chunk, and no
+// further chunks are requested or applied. With an explicit temp dir, the restore record and the
+// buffered chunks are kept, such that the restore resumes with them when the node restarts. The
+// sync then returns an error wrapping context.Canceled.
+
+// errInterrupted is returned by SyncAny() when the sync is interrupted by its context being
+// cancelled, wrapping the context error.
+var errInterrupted = errors.New("state sync interrupted")
+
+// withContext sets the context of the syncer's state syncs, which interrupts them when cancelled.
+func withContext(ctx context.Context) syncerOption {
+	return func(s *syncer) { s.ctx = ctx }
+}
+
+// suspendChunks closes a chunk queue for an interrupted restore. With an explicit temp dir, the
+// buffered chunks are kept for the restore to be resumed, otherwise they're removed.
+func (s *syncer) suspendChunks(chunks *chunkQueue) {
+	if chunks == nil {
+		return
+	}
+	var err error
+	if s.tempDir != "" {
+		err = chunks.Suspend()
+	} else {
+		err = chunks.Close()
+	}
+	if err != nil {
+		s.logger.Error("Failed to suspend chunk queue", "err", err)
+	}
+}
+
+// interruptRestore interrupts a restore once its context is cancelled: it closes the chunk queue,
+// which stops the chunk applier, and waits for the applier to return, such that the chunk being
+// applied by the app, if any, is applied in full before the restore returns.
+func (s *syncer) interruptRestore(ctx context.Context, snapshot *snapshot, chunks *chunkQueue,
+	applied <-chan error) error {
+	s.suspendChunks(chunks)
+	<-applied
+	s.logger.Info("Snapshot restore interrupted", "height", snapshot.Height, "format", snapshot.Format,
+		"hash", fmt.Sprintf("%X", snapshot.Hash), "resumable", s.tempDir != "")
+	return ctx.Err()
+}
@@ -0,0 +1,147 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/p2p"
+	p2pmocks "github.com/tendermint/tendermint/p2p/mocks"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync/mocks"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestChunkQueue_Suspend(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "suspend")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	dir := filepath.Join(tempDir, "chunks")
+
+	s := &snapshot{Height: 3, Format: 1, Chunks: 2, Hash: []byte{7}}
+	queue, _, err := resumeChunkQueue(s, dir, sha256ChunkVerifier{})
+	require.NoError(t, err)
+	_, err = queue.Add(&chunk{Height: 3, Format: 1, Index: 0, Chunk: []byte{3, 1, 0}})
+	require.NoError(t, err)
+
+	// Suspending closes the queue, but keeps the buffered chunks for resuming.
+	require.NoError(t, queue.Suspend())
+	_, err = queue.Next()
+	assert.Equal(t, errDone, err)
+	require.NoError(t, queue.Close())
+	queue, corrupt, err := resumeChunkQueue(s, dir, sha256ChunkVerifier{})
+	require.NoError(t, err)
+	assert.Empty(t, corrupt)
+	assert.True(t, queue.Has(0))
+	assert.False(t, queue.Has(1))
+
+	// Closing it removes them.
+	require.NoError(t, queue.Close())
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReactor_Stop_interruptsSync(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shutdown")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1, 2, 3}}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, uint64(1)).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(sm.State{}, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(&types.Commit{}, nil)
+
+	// The app is still applying chunk 0 when the reactor stops, while chunk 1 never arrives.
+	applying, release := make(chan struct{}), make(chan struct{})
+	applied := make(chan struct{})
+	conn := &proxymocks.AppConnSnapshot{}
+	conn.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+	conn.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+		Index: 0, Chunk: []byte{1}, Sender: "a",
+	}).Once().Run(func(args mock.Arguments) {
+		close(applying)
+		<-release
+		close(applied)
+	}).Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}, nil)
+
+	config := cfg.TestStateSyncConfig()
+	config.DiscoveryTime = 100 * time.Millisecond
+	r := NewReactor(config, conn, nil, tempDir)
+	require.NoError(t, r.Start())
+
+	peer := &p2pmocks.Peer{}
+	peer.On("ID").Return(p2p.ID("a"))
+	peer.On("Send", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
+		pb, err := decodeMsg(args[1].([]byte))
+		assert.NoError(t, err)
+		if index := pb.(*ssproto.ChunkRequest).Index; index == 0 {
+			r.Receive(ChunkChannel, peer, mustEncodeMsg(&ssproto.ChunkResponse{
+				Height: 1, Format: 1, Index: 0, Chunk: []byte{1}}))
+		}
+	}).Return(true)
+
+	synced := make(chan error, 1)
+	go func() {
+		_, err := r.SyncSnapshot(stateProvider, config.DiscoveryTime)
+		synced <- err
+	}()
+	require.Eventually(t, func() bool {
+		r.mtx.RLock()
+		defer r.mtx.RUnlock()
+		return len(r.syncers) > 0
+	}, time.Second, 10*time.Millisecond)
+	r.Receive(SnapshotChannel, peer, mustEncodeMsg(&ssproto.SnapshotsResponse{
+		Height: 1, Format: 1, Chunks: 2, Hash: []byte{1, 2, 3}}))
+
+	// Stopping the reactor interrupts the sync, which waits for the chunk being applied.
+	select {
+	case <-applying:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "chunk not applied")
+	}
+	require.NoError(t, r.Stop())
+	select {
+	case err := <-synced:
+		require.Fail(t, "sync returned while applying chunk", "err", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	select {
+	case err = <-synced:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "sync not interrupted")
+	}
+	<-applied
+	assert.True(t, errors.Is(err, context.Canceled), err)
+	conn.AssertExpectations(t)
+	r.mtx.RLock()
+	assert.Empty(t, r.syncers)
+	r.mtx.RUnlock()
+
+	// The restore record and buffered chunks are kept, for the restore to be resumed.
+	record, err := loadRestoreRecord(tempDir)
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	assert.True(t, record.Matches(s))
+	queue, corrupt, err := resumeChunkQueue(s, filepath.Join(tempDir, restoreChunksDir), sha256ChunkVerifier{})
+	require.NoError(t, err)
+	defer queue.Close()
+	assert.Empty(t, corrupt)
+	assert.True(t, queue.Has(0))
+}
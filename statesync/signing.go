@@ -0,0 +1,78 @@
+package statesync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tendermint/tendermint/crypto"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/p2p"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+)
+
+// Snapshot advertisements may optionally be signed with the advertising node's ed25519 node key,
+// allowing receivers to detect advertisements that have been tampered with before attempting to
+// restore them. This does not replace verification of the restored app hash against the trusted
+// chain. Unsigned advertisements are accepted as before.
+
+// snapshotSignPrefix is prepended to the signed bytes of a snapshot advertisement, such that node
+// key signatures can't be replayed in other contexts.
+const snapshotSignPrefix = "tendermint/statesync/SnapshotsResponse:"
+
+// snapshotSignBytes returns the bytes to sign for a snapshot advertisement, i.e. the encoded
+// response without its signature and public key.
+func snapshotSignBytes(msg *ssproto.SnapshotsResponse) ([]byte, error) {
+	unsigned := &ssproto.SnapshotsResponse{
+		Height:     msg.Height,
+		Format:     msg.Format,
+		Chunks:     msg.Chunks,
+		Hash:       msg.Hash,
+		Metadata:   msg.Metadata,
+		Preferred:  msg.Preferred,
+		BaseHeight: msg.BaseHeight,
+	}
+	bz, err := unsigned.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(snapshotSignPrefix), bz...), nil
+}
+
+// signSnapshotsResponse signs a snapshot advertisement with the given node key, which must be an
+// ed25519 key.
+func signSnapshotsResponse(msg *ssproto.SnapshotsResponse, key crypto.PrivKey) error {
+	if key.Type() != ed25519.KeyType {
+		return fmt.Errorf("snapshot signing requires an %v node key, got %v", ed25519.KeyType, key.Type())
+	}
+	bz, err := snapshotSignBytes(msg)
+	if err != nil {
+		return err
+	}
+	sig, err := key.Sign(bz)
+	if err != nil {
+		return err
+	}
+	msg.Signature = sig
+	msg.PubKey = key.PubKey().Bytes()
+	return nil
+}
+
+// verifySnapshotsResponse verifies the signature of a snapshot advertisement, if any, and checks
+// that it was signed by the given peer's node key.
+func verifySnapshotsResponse(msg *ssproto.SnapshotsResponse, peerID p2p.ID) error {
+	if len(msg.Signature) == 0 && len(msg.PubKey) == 0 {
+		return nil
+	}
+	pubKey := ed25519.PubKey(msg.PubKey)
+	if id := p2p.PubKeyToID(pubKey); id != peerID {
+		return fmt.Errorf("snapshot signed by node %v, expected %v", id, peerID)
+	}
+	bz, err := snapshotSignBytes(msg)
+	if err != nil {
+		return err
+	}
+	if !pubKey.VerifySignature(bz, msg.Signature) {
+		return errors.New("invalid snapshot signature")
+	}
+	return nil
+}
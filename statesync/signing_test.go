@@ -0,0 +1,63 @@
+package statesync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/crypto/secp256k1"
+	"github.com/tendermint/tendermint/p2p"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+)
+
+func TestSignSnapshotsResponse(t *testing.T) {
+	key := ed25519.GenPrivKey()
+	peerID := p2p.PubKeyToID(key.PubKey())
+
+	newMsg := func() *ssproto.SnapshotsResponse {
+		return &ssproto.SnapshotsResponse{Height: 1, Format: 2, Chunks: 3, Hash: []byte{4}, Metadata: []byte{5}}
+	}
+
+	// Unsigned responses are accepted.
+	require.NoError(t, verifySnapshotsResponse(newMsg(), peerID))
+
+	msg := newMsg()
+	require.NoError(t, signSnapshotsResponse(msg, key))
+	require.NoError(t, validateMsg(msg, nil))
+	require.NoError(t, verifySnapshotsResponse(msg, peerID))
+
+	// The signature must survive an encoding roundtrip.
+	decoded, err := decodeMsg(mustEncodeMsg(msg))
+	require.NoError(t, err)
+	require.NoError(t, verifySnapshotsResponse(decoded.(*ssproto.SnapshotsResponse), peerID))
+
+	// Responses signed by a different node are rejected.
+	assert.Error(t, verifySnapshotsResponse(msg, p2p.PubKeyToID(ed25519.GenPrivKey().PubKey())))
+
+	// Tampered responses are rejected.
+	testcases := map[string]func(*ssproto.SnapshotsResponse){
+		"height":    func(m *ssproto.SnapshotsResponse) { m.Height++ },
+		"format":    func(m *ssproto.SnapshotsResponse) { m.Format++ },
+		"chunks":    func(m *ssproto.SnapshotsResponse) { m.Chunks++ },
+		"hash":      func(m *ssproto.SnapshotsResponse) { m.Hash = []byte{9} },
+		"metadata":  func(m *ssproto.SnapshotsResponse) { m.Metadata = nil },
+		"signature": func(m *ssproto.SnapshotsResponse) { m.Signature[0]++ },
+	}
+	for name, tamper := range testcases {
+		tamper := tamper
+		t.Run(name, func(t *testing.T) {
+			msg := newMsg()
+			require.NoError(t, signSnapshotsResponse(msg, key))
+			tamper(msg)
+			assert.Error(t, verifySnapshotsResponse(msg, peerID))
+		})
+	}
+
+	// Only ed25519 node keys are supported.
+	msg = newMsg()
+	assert.Error(t, signSnapshotsResponse(msg, secp256k1.GenPrivKey()))
+	assert.Empty(t, msg.Signature)
+	assert.Empty(t, msg.PubKey)
+}
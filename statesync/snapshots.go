@@ -1,6 +1,7 @@
 package statesync
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"sort"
 	"time"
 
+	abci "github.com/tendermint/tendermint/abci/types"
 	tmsync "github.com/tendermint/tendermint/libs/sync"
 	"github.com/tendermint/tendermint/p2p"
 )
@@ -23,59 +25,176 @@ type snapshot struct {
 	Hash     []byte
 	Metadata []byte
 
+	// Preferred is an advisory hint that the snapshot is recommended by the app serving it. It is
+	// not part of the snapshot key.
+	Preferred bool
+
+	// BaseHeight is the height of the app state that a differential snapshot is restored on top
+	// of, or 0 for a full snapshot.
+	BaseHeight uint64
+
 	trustedAppHash []byte // populated by light client
 }
 
 // Key generates a snapshot key, used for lookups. It takes into account not only the height and
-// format, but also the chunks, hash, and metadata in case peers have generated snapshots in a
-// non-deterministic manner. All fields must be equal for the snapshot to be considered the same.
+// format, but also the chunks, hash, metadata, and base height in case peers have generated
+// snapshots in a non-deterministic manner. All fields must be equal for the snapshot to be
+// considered the same.
 func (s *snapshot) Key() snapshotKey {
 	// Hash.Write() never returns an error.
 	hasher := sha256.New()
 	hasher.Write([]byte(fmt.Sprintf("%v:%v:%v", s.Height, s.Format, s.Chunks))) //nolint:errcheck // ignore error
 	hasher.Write(s.Hash)                                                        //nolint:errcheck // ignore error
 	hasher.Write(s.Metadata)                                                    //nolint:errcheck // ignore error
+	if s.BaseHeight > 0 {
+		hasher.Write([]byte(fmt.Sprintf("base:%v", s.BaseHeight))) //nolint:errcheck // ignore error
+	}
 	var key snapshotKey
 	copy(key[:], hasher.Sum(nil))
 	return key
 }
 
+// abciSnapshot returns the snapshot as offered to the app via ABCI.
+func (s *snapshot) abciSnapshot() *abci.Snapshot {
+	return &abci.Snapshot{
+		Height:   s.Height,
+		Format:   s.Format,
+		Chunks:   s.Chunks,
+		Hash:     s.Hash,
+		Metadata: DiffSnapshotMetadata(s.BaseHeight, s.Metadata),
+	}
+}
+
+// Reasons for rejecting a snapshot, as reported in SnapshotInfo.
+const (
+	RejectReasonApp     = "rejected by app"
+	RejectReasonFormat  = "format rejected by app"
+	RejectReasonSenders = "all senders rejected"
+	RejectReasonTimeout = "timed out fetching chunks"
+
+	RejectReasonRetryBudget  = "chunk retry budget exhausted"
+	RejectReasonRefetchLimit = "chunk refetch limit exceeded"
+	RejectReasonDeclined     = "declined by confirmation hook"
+	RejectReasonDeadline     = "restore deadline exceeded"
+	RejectReasonThroughput   = "download throughput too low"
+	RejectReasonBelowTrust   = "below trusted height"
+	RejectReasonAppHash      = "restored app hash mismatch"
+	RejectReasonFutureFormat = "format newer than app"
+)
+
+// Ranking criteria which decide the selection of a snapshot over the runner-up, as reported in
+// SelectDecision.
+const (
+	SelectReasonOnly      = "only candidate"
+	SelectReasonExpected  = "expected snapshot"
+	SelectReasonDiff      = "diff snapshot"
+	SelectReasonPreferred = "preferred by peer"
+	SelectReasonHeight    = "greater height"
+	SelectReasonFormat    = "greater format"
+	SelectReasonPeers     = "more peers"
+	SelectReasonLatency   = "lower peer latency"
+	SelectReasonHash      = "hash tie-break"
+)
+
+// selectRunnersUp is the maximum number of runners-up recorded in a SelectDecision.
+const selectRunnersUp = 3
+
+// Reasons for removing a peer from a state sync, as reported by PeerRemovals().
+const (
+	PeerRemovalDisconnected = "disconnected"
+	PeerRemovalError        = "violated protocol"
+	PeerRemovalBadChunk     = "sent invalid chunk"
+	PeerRemovalRejected     = "rejected by app"
+)
+
+// SnapshotInfo describes a snapshot discovered from peers during a state sync.
+type SnapshotInfo struct {
+	Height    uint64
+	Format    uint32
+	Chunks    uint32
+	Hash      []byte
+	Peers     int    // number of peers known to have the snapshot, at the time of any rejection
+	Preferred bool   // whether any peer advertised the snapshot as preferred
+	Rejected  string // the reason the snapshot was rejected, if any
+}
+
+// SelectCandidate describes a snapshot considered for restoration.
+type SelectCandidate struct {
+	SnapshotInfo
+	// Latency is the mean latency of the snapshot's peers, or 0 if unknown or latency ranking is
+	// disabled.
+	Latency time.Duration
+}
+
+// SelectDecision records why a snapshot was selected for restoration over the other discovered
+// snapshots, to make the snapshot ranking auditable, e.g. when the restore fails.
+type SelectDecision struct {
+	// Selected is the selected snapshot.
+	Selected SelectCandidate
+	// Reason is the ranking criterion by which the selected snapshot beat the first runner-up, as
+	// one of the SelectReason constants.
+	Reason string
+	// RunnersUp are the next best snapshots, in ranking order, up to 3 of them.
+	RunnersUp []SelectCandidate
+	// Candidates is the number of snapshots considered, including the selected one.
+	Candidates int
+	// Time is the time of the selection.
+	Time time.Time
+}
+
 // snapshotPool discovers and aggregates snapshots across peers.
 type snapshotPool struct {
 	stateProvider StateProvider
+	latencies     *peerLatencies    // breaks ranking ties by peer latency, if set
+	maxPerPeer    int               // maximum number of snapshots attributed to a peer
+	formatRank    map[uint32]int    // format preference order, if set, see formatPrecedes()
+	expected      *expectedSnapshot // ranked before any other snapshots, if set
 
 	tmsync.Mutex
 	snapshots     map[snapshotKey]*snapshot
 	snapshotPeers map[snapshotKey]map[p2p.ID]p2p.Peer
+	preferred     map[snapshotKey]bool
 
-	// indexes for fast searches
+	// indexes for fast searches. The peer index maps snapshots to the sequence number of the
+	// peer's last advertisement of them, to evict the least recently advertised ones.
 	formatIndex map[uint32]map[snapshotKey]bool
 	heightIndex map[uint64]map[snapshotKey]bool
-	peerIndex   map[p2p.ID]map[snapshotKey]bool
+	peerIndex   map[p2p.ID]map[snapshotKey]uint64
+	peerSeq     uint64
 
 	// blacklists for rejected items
 	formatBlacklist   map[uint32]bool
 	peerBlacklist     map[p2p.ID]bool
 	snapshotBlacklist map[snapshotKey]bool
+
+	// rejected contains information about rejected snapshots, for reporting
+	rejected map[snapshotKey]SnapshotInfo
+	// removedPeers contains the reason each removed peer was removed, for reporting
+	removedPeers map[p2p.ID]string
 }
 
 // newSnapshotPool creates a new snapshot pool. The state source is used for
 func newSnapshotPool(stateProvider StateProvider) *snapshotPool {
 	return &snapshotPool{
 		stateProvider:     stateProvider,
+		maxPerPeer:        recentSnapshots,
 		snapshots:         make(map[snapshotKey]*snapshot),
 		snapshotPeers:     make(map[snapshotKey]map[p2p.ID]p2p.Peer),
+		preferred:         make(map[snapshotKey]bool),
 		formatIndex:       make(map[uint32]map[snapshotKey]bool),
 		heightIndex:       make(map[uint64]map[snapshotKey]bool),
-		peerIndex:         make(map[p2p.ID]map[snapshotKey]bool),
+		peerIndex:         make(map[p2p.ID]map[snapshotKey]uint64),
 		formatBlacklist:   make(map[uint32]bool),
 		peerBlacklist:     make(map[p2p.ID]bool),
 		snapshotBlacklist: make(map[snapshotKey]bool),
+		rejected:          make(map[snapshotKey]SnapshotInfo),
+		removedPeers:      make(map[p2p.ID]string),
 	}
 }
 
-// Add adds a snapshot to the pool, unless the peer has already sent recentSnapshots snapshots. It
-// returns true if this was a new, non-blacklisted snapshot. The snapshot height is verified using
+// Add adds a snapshot to the pool. If the peer already has maxPerPeer other snapshots attributed
+// to it, the one it least recently advertised is evicted, such that a single peer can't flood the
+// pool. It returns true if this was a new, non-blacklisted snapshot. The snapshot height is verified using
 // the light client, and the expected app hash is set for the snapshot.
 func (p *snapshotPool) Add(peer p2p.Peer, snapshot *snapshot) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -98,19 +217,26 @@ func (p *snapshotPool) Add(peer p2p.Peer, snapshot *snapshot) (bool, error) {
 		return false, nil
 	case p.snapshotBlacklist[key]:
 		return false, nil
-	case len(p.peerIndex[peer.ID()]) >= recentSnapshots:
-		return false, nil
+	}
+	if _, ok := p.peerIndex[peer.ID()][key]; !ok && len(p.peerIndex[peer.ID()]) >= p.maxPerPeer {
+		p.evictOldest(peer.ID())
 	}
 
+	delete(p.removedPeers, peer.ID())
 	if p.snapshotPeers[key] == nil {
 		p.snapshotPeers[key] = make(map[p2p.ID]p2p.Peer)
 	}
 	p.snapshotPeers[key][peer.ID()] = peer
 
 	if p.peerIndex[peer.ID()] == nil {
-		p.peerIndex[peer.ID()] = make(map[snapshotKey]bool)
+		p.peerIndex[peer.ID()] = make(map[snapshotKey]uint64)
+	}
+	p.peerSeq++
+	p.peerIndex[peer.ID()][key] = p.peerSeq
+
+	if snapshot.Preferred {
+		p.preferred[key] = true
 	}
-	p.peerIndex[peer.ID()][key] = true
 
 	if p.snapshots[key] != nil {
 		return false, nil
@@ -166,48 +292,186 @@ func (p *snapshotPool) GetPeers(snapshot *snapshot) []p2p.Peer {
 }
 
 // Ranked returns a list of snapshots ranked by preference. The current heuristic is very naïve,
-// preferring the snapshot with the greatest height, then greatest format, then greatest number of
-// peers. This can be improved quite a lot.
+// preferring the expected snapshot, if set, then diff snapshots, then snapshots advertised as
+// preferred by any peer, then the snapshot with the greatest height, then the preferred format (by
+// format_priority, else the greatest), then greatest number of peers, then, if enabled, the lowest
+// mean peer latency. This can be improved quite a lot.
 func (p *snapshotPool) Ranked() []*snapshot {
 	p.Lock()
 	defer p.Unlock()
+	return p.ranked()
+}
 
+// ranked returns a list of snapshots ranked by preference. The caller must hold the mutex lock.
+func (p *snapshotPool) ranked() []*snapshot {
+	candidates, _ := p.rankedLatency()
+	return candidates
+}
+
+// rankedLatency returns a list of snapshots ranked by preference, along with the mean peer
+// latency of the snapshots with latency estimates, if enabled. The caller must hold the mutex lock.
+func (p *snapshotPool) rankedLatency() ([]*snapshot, map[snapshotKey]time.Duration) {
 	candidates := make([]*snapshot, 0, len(p.snapshots))
 	for _, snapshot := range p.snapshots {
 		candidates = append(candidates, snapshot)
 	}
+	var latency map[snapshotKey]time.Duration
+	if p.latencies != nil {
+		latency = make(map[snapshotKey]time.Duration, len(candidates))
+		for _, snapshot := range candidates {
+			peerIDs := make([]p2p.ID, 0, len(p.snapshotPeers[snapshot.Key()]))
+			for peerID := range p.snapshotPeers[snapshot.Key()] {
+				peerIDs = append(peerIDs, peerID)
+			}
+			if mean, ok := p.latencies.Mean(peerIDs); ok {
+				latency[snapshot.Key()] = mean
+			}
+		}
+	}
 
 	sort.Slice(candidates, func(i, j int) bool {
-		a := candidates[i]
-		b := candidates[j]
-
-		switch {
-		case a.Height > b.Height:
-			return true
-		case a.Height < b.Height:
-			return false
-		case a.Format > b.Format:
-			return true
-		case a.Format < b.Format:
-			return false
-		case len(p.snapshotPeers[a.Key()]) > len(p.snapshotPeers[b.Key()]):
-			return true
-		default:
-			return false
-		}
+		before, _ := p.precedes(latency, candidates[i], candidates[j])
+		return before
 	})
 
-	return candidates
+	return candidates, latency
+}
+
+// precedes checks whether snapshot a ranks before snapshot b, and returns the ranking criterion
+// which decided it, as one of the SelectReason constants. The caller must hold the mutex lock.
+func (p *snapshotPool) precedes(latency map[snapshotKey]time.Duration, a, b *snapshot) (bool, string) {
+	switch {
+	case p.expected.Matches(a) && !p.expected.Matches(b):
+		return true, SelectReasonExpected
+	case !p.expected.Matches(a) && p.expected.Matches(b):
+		return false, SelectReasonExpected
+	// diffs are only added if they apply to the app's current state, and are much smaller
+	case a.BaseHeight > 0 && b.BaseHeight == 0:
+		return true, SelectReasonDiff
+	case a.BaseHeight == 0 && b.BaseHeight > 0:
+		return false, SelectReasonDiff
+	case p.preferred[a.Key()] && !p.preferred[b.Key()]:
+		return true, SelectReasonPreferred
+	case !p.preferred[a.Key()] && p.preferred[b.Key()]:
+		return false, SelectReasonPreferred
+	case a.Height > b.Height:
+		return true, SelectReasonHeight
+	case a.Height < b.Height:
+		return false, SelectReasonHeight
+	case p.formatPrecedes(a.Format, b.Format):
+		return true, SelectReasonFormat
+	case p.formatPrecedes(b.Format, a.Format):
+		return false, SelectReasonFormat
+	case len(p.snapshotPeers[a.Key()]) > len(p.snapshotPeers[b.Key()]):
+		return true, SelectReasonPeers
+	case len(p.snapshotPeers[a.Key()]) < len(p.snapshotPeers[b.Key()]):
+		return false, SelectReasonPeers
+	case lowerLatency(latency, a.Key(), b.Key()):
+		return true, SelectReasonLatency
+	case lowerLatency(latency, b.Key(), a.Key()):
+		return false, SelectReasonLatency
+	default:
+		// break ties deterministically, such that the catalog can be paginated
+		return bytes.Compare(a.Hash, b.Hash) < 0, SelectReasonHash
+	}
+}
+
+// Select returns the best currently known snapshot, if any, like Best(), along with the decision
+// to select it over the other candidates.
+func (p *snapshotPool) Select() (*snapshot, *SelectDecision) {
+	p.Lock()
+	defer p.Unlock()
+	ranked, latency := p.rankedLatency()
+	if len(ranked) == 0 {
+		return nil, nil
+	}
+	candidate := func(s *snapshot) SelectCandidate {
+		return SelectCandidate{SnapshotInfo: p.info(s.Key(), ""), Latency: latency[s.Key()]}
+	}
+	decision := &SelectDecision{
+		Selected:   candidate(ranked[0]),
+		Reason:     SelectReasonOnly,
+		Candidates: len(ranked),
+		Time:       time.Now(),
+	}
+	if len(ranked) > 1 {
+		_, decision.Reason = p.precedes(latency, ranked[0], ranked[1])
+	}
+	for _, s := range ranked[1:] {
+		if len(decision.RunnersUp) >= selectRunnersUp {
+			break
+		}
+		decision.RunnersUp = append(decision.RunnersUp, candidate(s))
+	}
+	return ranked[0], decision
+}
+
+// Preview returns the decision Select() would make if discovery ended now, if any snapshots are
+// known, e.g. to watch the selection converge during discovery. It doesn't modify the pool.
+func (p *snapshotPool) Preview() *SelectDecision {
+	_, decision := p.Select()
+	return decision
+}
+
+// formatPrecedes checks whether snapshot format a is preferred over format b. Formats in the
+// format preference order are preferred in that order over other formats, and are otherwise
+// preferred by greatest format.
+func (p *snapshotPool) formatPrecedes(a, b uint32) bool {
+	rankA, okA := p.formatRank[a]
+	rankB, okB := p.formatRank[b]
+	switch {
+	case okA && okB:
+		return rankA < rankB
+	case okA != okB:
+		return okA
+	default:
+		return a > b
+	}
+}
+
+// lowerLatency checks whether snapshot a has a lower mean peer latency than snapshot b. Snapshots
+// with latency estimates for any of their peers rank before those without.
+func lowerLatency(latency map[snapshotKey]time.Duration, a, b snapshotKey) bool {
+	la, okA := latency[a]
+	lb, okB := latency[b]
+	return okA && (!okB || la < lb)
+}
+
+// Catalog returns information about all known snapshots, ranked by preference, followed by any
+// rejected snapshots ordered by descending height and format.
+func (p *snapshotPool) Catalog() []SnapshotInfo {
+	p.Lock()
+	defer p.Unlock()
+
+	catalog := make([]SnapshotInfo, 0, len(p.snapshots)+len(p.rejected))
+	for _, snapshot := range p.ranked() {
+		catalog = append(catalog, p.info(snapshot.Key(), ""))
+	}
+	rejected := make([]SnapshotInfo, 0, len(p.rejected))
+	for _, info := range p.rejected {
+		rejected = append(rejected, info)
+	}
+	sort.Slice(rejected, func(i, j int) bool {
+		a, b := rejected[i], rejected[j]
+		if a.Height != b.Height {
+			return a.Height > b.Height
+		}
+		if a.Format != b.Format {
+			return a.Format > b.Format
+		}
+		return bytes.Compare(a.Hash, b.Hash) < 0
+	})
+	return append(catalog, rejected...)
 }
 
-// Reject rejects a snapshot. Rejected snapshots will never be used again.
-func (p *snapshotPool) Reject(snapshot *snapshot) {
+// Reject rejects a snapshot for the given reason. Rejected snapshots will never be used again.
+func (p *snapshotPool) Reject(snapshot *snapshot, reason string) {
 	key := snapshot.Key()
 	p.Lock()
 	defer p.Unlock()
 
 	p.snapshotBlacklist[key] = true
-	p.removeSnapshot(key)
+	p.reject(key, reason)
 }
 
 // RejectFormat rejects a snapshot format. It will never be used again.
@@ -217,7 +481,22 @@ func (p *snapshotPool) RejectFormat(format uint32) {
 
 	p.formatBlacklist[format] = true
 	for key := range p.formatIndex[format] {
-		p.removeSnapshot(key)
+		p.reject(key, RejectReasonFormat)
+	}
+}
+
+// RejectFormatsAbove rejects any snapshots in formats above the given format, e.g. once these are
+// found to be newer than the app. Unlike RejectFormat(), the formats aren't blacklisted.
+func (p *snapshotPool) RejectFormatsAbove(max uint32) {
+	p.Lock()
+	defer p.Unlock()
+	for format, keys := range p.formatIndex {
+		if format <= max {
+			continue
+		}
+		for key := range keys {
+			p.reject(key, RejectReasonFutureFormat)
+		}
 	}
 }
 
@@ -229,19 +508,81 @@ func (p *snapshotPool) RejectPeer(peerID p2p.ID) {
 	p.Lock()
 	defer p.Unlock()
 
-	p.removePeer(peerID)
+	for key := range p.peerIndex[peerID] {
+		if len(p.snapshotPeers[key]) == 1 {
+			p.reject(key, RejectReasonSenders)
+		}
+	}
+	p.removePeer(peerID, PeerRemovalRejected)
 	p.peerBlacklist[peerID] = true
 }
 
-// RemovePeer removes a peer from the pool, and any snapshots that no longer have peers.
-func (p *snapshotPool) RemovePeer(peerID p2p.ID) {
+// IsBlacklisted checks whether a snapshot advertised by a peer has been blacklisted, because the
+// snapshot, its format, or the peer has been rejected.
+func (p *snapshotPool) IsBlacklisted(peerID p2p.ID, snapshot *snapshot) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.peerBlacklist[peerID] || p.formatBlacklist[snapshot.Format] ||
+		p.snapshotBlacklist[snapshot.Key()]
+}
+
+// RemovePeer removes a peer from the pool for the given reason, and any snapshots that no longer
+// have peers.
+func (p *snapshotPool) RemovePeer(peerID p2p.ID, reason string) {
 	p.Lock()
 	defer p.Unlock()
-	p.removePeer(peerID)
+	p.removePeer(peerID, reason)
+}
+
+// ReplacePeer replaces a peer in the pool with a reconnected instance of it, keeping its snapshots.
+func (p *snapshotPool) ReplacePeer(peer p2p.Peer) {
+	p.Lock()
+	defer p.Unlock()
+	for key := range p.peerIndex[peer.ID()] {
+		p.snapshotPeers[key][peer.ID()] = peer
+	}
+}
+
+// RemovedPeers returns the reason each removed peer was removed from the pool, for peers that had
+// advertised snapshots or were rejected. Peers that have since advertised snapshots again are
+// omitted.
+func (p *snapshotPool) RemovedPeers() map[p2p.ID]string {
+	p.Lock()
+	defer p.Unlock()
+	removed := make(map[p2p.ID]string, len(p.removedPeers))
+	for peerID, reason := range p.removedPeers {
+		removed[peerID] = reason
+	}
+	return removed
+}
+
+// evictOldest detaches the snapshot least recently advertised by a peer from the peer, removing
+// the snapshot if no other peers have it. The caller must hold the mutex lock.
+func (p *snapshotPool) evictOldest(peerID p2p.ID) {
+	var (
+		oldest    snapshotKey
+		oldestSeq uint64
+	)
+	for key, seq := range p.peerIndex[peerID] {
+		if oldestSeq == 0 || seq < oldestSeq {
+			oldest, oldestSeq = key, seq
+		}
+	}
+	if oldestSeq == 0 {
+		return
+	}
+	delete(p.peerIndex[peerID], oldest)
+	delete(p.snapshotPeers[oldest], peerID)
+	if len(p.snapshotPeers[oldest]) == 0 {
+		p.removeSnapshot(oldest)
+	}
 }
 
 // removePeer removes a peer. The caller must hold the mutex lock.
-func (p *snapshotPool) removePeer(peerID p2p.ID) {
+func (p *snapshotPool) removePeer(peerID p2p.ID, reason string) {
+	if _, ok := p.peerIndex[peerID]; ok || reason == PeerRemovalRejected {
+		p.removedPeers[peerID] = reason
+	}
 	for key := range p.peerIndex[peerID] {
 		delete(p.snapshotPeers[key], peerID)
 		if len(p.snapshotPeers[key]) == 0 {
@@ -251,6 +592,46 @@ func (p *snapshotPool) removePeer(peerID p2p.ID) {
 	delete(p.peerIndex, peerID)
 }
 
+// Info returns information about a snapshot, which need not be in the pool.
+func (p *snapshotPool) Info(snapshot *snapshot) SnapshotInfo {
+	p.Lock()
+	defer p.Unlock()
+	key := snapshot.Key()
+	if _, ok := p.snapshots[key]; !ok {
+		return SnapshotInfo{
+			Height:    snapshot.Height,
+			Format:    snapshot.Format,
+			Chunks:    snapshot.Chunks,
+			Hash:      snapshot.Hash,
+			Preferred: snapshot.Preferred,
+		}
+	}
+	return p.info(key, "")
+}
+
+// info returns information about a known snapshot. The caller must hold the mutex lock.
+func (p *snapshotPool) info(key snapshotKey, rejected string) SnapshotInfo {
+	snapshot := p.snapshots[key]
+	return SnapshotInfo{
+		Height:    snapshot.Height,
+		Format:    snapshot.Format,
+		Chunks:    snapshot.Chunks,
+		Hash:      snapshot.Hash,
+		Peers:     len(p.snapshotPeers[key]),
+		Preferred: p.preferred[key],
+		Rejected:  rejected,
+	}
+}
+
+// reject records a known snapshot as rejected and removes it. The caller must hold the mutex lock.
+func (p *snapshotPool) reject(key snapshotKey, reason string) {
+	if p.snapshots[key] == nil {
+		return
+	}
+	p.rejected[key] = p.info(key, reason)
+	p.removeSnapshot(key)
+}
+
 // removeSnapshot removes a snapshot. The caller must hold the mutex lock.
 func (p *snapshotPool) removeSnapshot(key snapshotKey) {
 	snapshot := p.snapshots[key]
@@ -265,4 +646,5 @@ func (p *snapshotPool) removeSnapshot(key snapshotKey) {
 		delete(p.peerIndex[peerID], key)
 	}
 	delete(p.snapshotPeers, key)
+	delete(p.preferred, key)
 }
@@ -2,6 +2,7 @@ package statesync
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -78,6 +79,47 @@ func TestSnapshotPool_Add(t *testing.T) {
 	stateProvider.AssertExpectations(t)
 }
 
+func TestSnapshotPool_Add_peerLimit(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+
+	peerA := &p2pmocks.Peer{}
+	peerA.On("ID").Return(p2p.ID("a"))
+	peerB := &p2pmocks.Peer{}
+	peerB.On("ID").Return(p2p.ID("b"))
+
+	pool := newSnapshotPool(stateProvider)
+	pool.maxPerPeer = 2
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}
+	s3 := &snapshot{Height: 3, Format: 1, Chunks: 1, Hash: []byte{3}}
+	s4 := &snapshot{Height: 4, Format: 1, Chunks: 1, Hash: []byte{4}}
+	for _, s := range []*snapshot{s1, s2} {
+		_, err := pool.Add(peerA, s)
+		require.NoError(t, err)
+	}
+	_, err := pool.Add(peerB, s1)
+	require.NoError(t, err)
+
+	// Re-advertising a snapshot refreshes it, so a new snapshot beyond the limit evicts s2 rather
+	// than s1. s2 has no other peers, and is removed from the pool.
+	_, err = pool.Add(peerA, s1)
+	require.NoError(t, err)
+	added, err := pool.Add(peerA, s3)
+	require.NoError(t, err)
+	assert.True(t, added)
+	assert.ElementsMatch(t, []*snapshot{s1, s3}, pool.Ranked())
+	assert.Len(t, pool.peerIndex["a"], 2)
+
+	// Evicting s1 from peer a keeps it in the pool, since peer b still has it.
+	_, err = pool.Add(peerA, s3)
+	require.NoError(t, err)
+	_, err = pool.Add(peerA, s4)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*snapshot{s1, s3, s4}, pool.Ranked())
+	assert.Equal(t, []p2p.Peer{peerB}, pool.GetPeers(s1))
+}
+
 func TestSnapshotPool_GetPeer(t *testing.T) {
 	stateProvider := &mocks.StateProvider{}
 	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
@@ -178,11 +220,177 @@ func TestSnapshotPool_Ranked_Best(t *testing.T) {
 	for i := range expectSnapshots {
 		snapshot := expectSnapshots[i].snapshot
 		require.Equal(t, snapshot, pool.Best())
-		pool.Reject(snapshot)
+		pool.Reject(snapshot, RejectReasonApp)
 	}
 	assert.Nil(t, pool.Best())
 }
 
+func TestSnapshotPool_Ranked_FormatPriority(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	pool := newSnapshotPool(stateProvider)
+	pool.formatRank = map[uint32]int{2: 0, 4: 1, 1: 2}
+
+	// Listed formats rank in the given order, then unlisted ones by greatest format, but only
+	// after height.
+	snapshots := []*snapshot{
+		{Height: 2, Format: 1, Chunks: 1, Hash: []byte{1}},
+		{Height: 1, Format: 2, Chunks: 1, Hash: []byte{1}},
+		{Height: 1, Format: 4, Chunks: 1, Hash: []byte{1}},
+		{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}},
+		{Height: 1, Format: 5, Chunks: 1, Hash: []byte{1}},
+		{Height: 1, Format: 3, Chunks: 1, Hash: []byte{1}},
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		_, err := pool.Add(simplePeer("a"), snapshots[i])
+		require.NoError(t, err)
+	}
+	assert.Equal(t, snapshots, pool.Ranked())
+
+	pool.Reject(snapshots[0], RejectReasonApp)
+	_, decision := pool.Select()
+	require.NotNil(t, decision)
+	assert.EqualValues(t, 2, decision.Selected.Format)
+	assert.Equal(t, SelectReasonFormat, decision.Reason)
+}
+
+func TestSnapshotPool_Ranked_Diff(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	pool := newSnapshotPool(stateProvider)
+
+	// Diffs are ranked first, and are distinct from otherwise identical full snapshots.
+	full := &snapshot{Height: 3, Format: 1, Chunks: 1, Hash: []byte{1}}
+	diff := &snapshot{Height: 2, Format: 2, Chunks: 1, Hash: []byte{1}, BaseHeight: 1}
+	same := &snapshot{Height: 3, Format: 1, Chunks: 1, Hash: []byte{1}, BaseHeight: 1}
+	assert.NotEqual(t, full.Key(), same.Key())
+	for _, s := range []*snapshot{full, diff, same} {
+		added, err := pool.Add(simplePeer("a"), s)
+		require.NoError(t, err)
+		assert.True(t, added)
+	}
+	assert.Equal(t, []*snapshot{same, diff, full}, pool.Ranked())
+}
+
+func TestSnapshotPool_Ranked_Latency(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	pool := newSnapshotPool(stateProvider)
+	pool.latencies = newPeerLatencies()
+
+	// Without latency estimates, ties are broken by hash.
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	s2 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{2}}
+	s3 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{3}}
+	for _, add := range []struct {
+		snapshot *snapshot
+		peers    []string
+	}{{s1, []string{"a", "b"}}, {s2, []string{"c", "d"}}, {s3, []string{"e", "f"}}} {
+		for _, peerID := range add.peers {
+			_, err := pool.Add(simplePeer(peerID), add.snapshot)
+			require.NoError(t, err)
+		}
+	}
+	assert.Equal(t, []*snapshot{s1, s2, s3}, pool.Ranked())
+
+	// Snapshots whose peers have lower mean latencies are preferred, ignoring peers without
+	// estimates, and snapshots without estimates come last.
+	pool.latencies.Observe("c", 300*time.Millisecond)
+	pool.latencies.Observe("e", 100*time.Millisecond)
+	pool.latencies.Observe("f", 300*time.Millisecond)
+	assert.Equal(t, []*snapshot{s3, s2, s1}, pool.Ranked())
+
+	// Latency doesn't override the peer count.
+	_, err := pool.Add(simplePeer("g"), s1)
+	require.NoError(t, err)
+	assert.Equal(t, []*snapshot{s1, s3, s2}, pool.Ranked())
+}
+
+func TestSnapshotPool_Select(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	pool := newSnapshotPool(stateProvider)
+	pool.latencies = newPeerLatencies()
+	best, decision := pool.Select()
+	assert.Nil(t, best)
+	assert.Nil(t, decision)
+
+	// The decision records the criterion separating the selected snapshot from the runner-up,
+	// and a bounded number of runners-up in ranking order.
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}
+	s3 := &snapshot{Height: 3, Format: 1, Chunks: 1, Hash: []byte{3}}
+	s4 := &snapshot{Height: 4, Format: 1, Chunks: 1, Hash: []byte{4}}
+	s5 := &snapshot{Height: 5, Format: 1, Chunks: 1, Hash: []byte{5}}
+	for _, s := range []*snapshot{s1, s2, s3, s4, s5} {
+		_, err := pool.Add(simplePeer("a"), s)
+		require.NoError(t, err)
+	}
+	pool.latencies.Observe("a", 100*time.Millisecond)
+	best, decision = pool.Select()
+	assert.Equal(t, s5, best)
+	require.NotNil(t, decision)
+	assert.EqualValues(t, 5, decision.Selected.Height)
+	assert.Equal(t, 1, decision.Selected.Peers)
+	assert.Equal(t, 100*time.Millisecond, decision.Selected.Latency)
+	assert.Equal(t, SelectReasonHeight, decision.Reason)
+	assert.Equal(t, 5, decision.Candidates)
+	require.Len(t, decision.RunnersUp, selectRunnersUp)
+	for i, c := range decision.RunnersUp {
+		assert.EqualValues(t, 4-i, c.Height)
+	}
+
+	// Equal heights and formats are decided by the peer count.
+	_, err := pool.Add(simplePeer("a"), &snapshot{Height: 5, Format: 1, Chunks: 2, Hash: []byte{5}})
+	require.NoError(t, err)
+	_, err = pool.Add(simplePeer("b"), s5)
+	require.NoError(t, err)
+	_, decision = pool.Select()
+	assert.Equal(t, SelectReasonPeers, decision.Reason)
+
+	// A single candidate is selected as the only one.
+	for _, s := range pool.Ranked()[1:] {
+		pool.Reject(s, RejectReasonApp)
+	}
+	best, decision = pool.Select()
+	assert.Equal(t, s5, best)
+	assert.Equal(t, SelectReasonOnly, decision.Reason)
+	assert.Empty(t, decision.RunnersUp)
+}
+
+func TestSnapshotPool_Ranked_Preferred(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	pool := newSnapshotPool(stateProvider)
+
+	peerA := &p2pmocks.Peer{}
+	peerA.On("ID").Return(p2p.ID("a"))
+	peerB := &p2pmocks.Peer{}
+	peerB.On("ID").Return(p2p.ID("b"))
+
+	newest := &snapshot{Height: 3, Format: 1, Chunks: 1, Hash: []byte{3}}
+	verified := &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}}
+	oldest := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+
+	// A snapshot preferred by any peer ranks first, even if other peers don't prefer it.
+	for _, s := range []*snapshot{newest, verified, oldest} {
+		_, err := pool.Add(peerA, s)
+		require.NoError(t, err)
+	}
+	_, err := pool.Add(peerB, &snapshot{Height: 2, Format: 1, Chunks: 1, Hash: []byte{2}, Preferred: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, []*snapshot{verified, newest, oldest}, pool.Ranked())
+	catalog := pool.Catalog()
+	require.Len(t, catalog, 3)
+	assert.True(t, catalog[0].Preferred)
+	assert.False(t, catalog[1].Preferred)
+
+	// The hint is advisory, so other snapshots are used once the preferred one is rejected.
+	pool.Reject(verified, RejectReasonApp)
+	assert.Equal(t, newest, pool.Best())
+}
+
 func TestSnapshotPool_Reject(t *testing.T) {
 	stateProvider := &mocks.StateProvider{}
 	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
@@ -201,7 +409,7 @@ func TestSnapshotPool_Reject(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	pool.Reject(snapshots[0])
+	pool.Reject(snapshots[0], RejectReasonApp)
 	assert.Equal(t, snapshots[1:], pool.Ranked())
 
 	added, err := pool.Add(peer, snapshots[0])
@@ -269,6 +477,8 @@ func TestSnapshotPool_RejectPeer(t *testing.T) {
 	require.NoError(t, err)
 
 	pool.RejectPeer(peerA.ID())
+	pool.RemovePeer(peerA.ID(), PeerRemovalDisconnected)
+	assert.Equal(t, map[p2p.ID]string{"a": PeerRemovalRejected}, pool.RemovedPeers())
 
 	assert.Empty(t, pool.GetPeers(s1))
 
@@ -286,6 +496,43 @@ func TestSnapshotPool_RejectPeer(t *testing.T) {
 	assert.Empty(t, pool.GetPeers(s1))
 }
 
+func TestSnapshotPool_Catalog(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	pool := newSnapshotPool(stateProvider)
+
+	peerA := &p2pmocks.Peer{}
+	peerA.On("ID").Return(p2p.ID("a"))
+	peerB := &p2pmocks.Peer{}
+	peerB.On("ID").Return(p2p.ID("b"))
+
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 2, Hash: []byte{2}}
+	s3 := &snapshot{Height: 3, Format: 1, Chunks: 3, Hash: []byte{3}}
+	s4 := &snapshot{Height: 3, Format: 2, Chunks: 4, Hash: []byte{4}}
+	s5 := &snapshot{Height: 4, Format: 1, Chunks: 5, Hash: []byte{5}}
+	for _, s := range []*snapshot{s1, s2, s3, s4} {
+		_, err := pool.Add(peerA, s)
+		require.NoError(t, err)
+	}
+	for _, s := range []*snapshot{s2, s5} {
+		_, err := pool.Add(peerB, s)
+		require.NoError(t, err)
+	}
+
+	pool.Reject(s3, RejectReasonTimeout)
+	pool.RejectFormat(2)
+	pool.RejectPeer(peerB.ID())
+
+	assert.Equal(t, []SnapshotInfo{
+		{Height: 2, Format: 1, Chunks: 2, Hash: []byte{2}, Peers: 1},
+		{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}, Peers: 1},
+		{Height: 4, Format: 1, Chunks: 5, Hash: []byte{5}, Peers: 1, Rejected: RejectReasonSenders},
+		{Height: 3, Format: 2, Chunks: 4, Hash: []byte{4}, Peers: 1, Rejected: RejectReasonFormat},
+		{Height: 3, Format: 1, Chunks: 3, Hash: []byte{3}, Peers: 1, Rejected: RejectReasonTimeout},
+	}, pool.Catalog())
+}
+
 func TestSnapshotPool_RemovePeer(t *testing.T) {
 	stateProvider := &mocks.StateProvider{}
 	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
@@ -306,7 +553,9 @@ func TestSnapshotPool_RemovePeer(t *testing.T) {
 	_, err = pool.Add(peerB, s1)
 	require.NoError(t, err)
 
-	pool.RemovePeer(peerA.ID())
+	pool.RemovePeer(peerA.ID(), PeerRemovalDisconnected)
+	pool.RemovePeer("unknown", PeerRemovalDisconnected)
+	assert.Equal(t, map[p2p.ID]string{"a": PeerRemovalDisconnected}, pool.RemovedPeers())
 
 	peers1 := pool.GetPeers(s1)
 	assert.Len(t, peers1, 1)
@@ -322,4 +571,5 @@ func TestSnapshotPool_RemovePeer(t *testing.T) {
 	assert.Len(t, peers1, 2)
 	assert.EqualValues(t, "a", peers1[0].ID())
 	assert.EqualValues(t, "b", peers1[1].ID())
+	assert.Empty(t, pool.RemovedPeers())
 }
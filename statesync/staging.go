@@ -0,0 +1,85 @@
+package statesync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tendermint/tendermint/proxy"
+)
+
+// With staging_restore, snapshots are restored into a staging app instance rather than the live
+// app, and the staging instance only replaces the live app state once the restored app hash and
+// commit have been verified. A bad snapshot thus never touches the live app state: the staging
+// instance is discarded instead, and the next snapshot restored into a fresh one. Once promoted,
+// the live app is verified to report the restored height and app hash before the sync completes.
+//
+// ABCI has no notion of staging instances, so the app's integration must provide one via
+// WithStagingApp(), or the node's StagingApp option. See the state sync docs for the app-side
+// requirements.
+
+var (
+	// errNoStagingApp is returned by the reactor on start when staging_restore is enabled without a
+	// staging app.
+	errNoStagingApp = errors.New("staging_restore is enabled, but no staging app was provided " +
+		"(see the node's StagingApp option)")
+)
+
+// StagingApp is a temporary app instance which snapshots are restored into when staging_restore is
+// enabled, such that the live app state is only replaced by verified snapshots. Each state sync
+// attempt opens the staging instance, and then either promotes or discards it.
+type StagingApp interface {
+	// Open returns connections to the staging instance, separate from the live app connections,
+	// starting it if needed. It must start with empty state, or a copy of the live app state if diff
+	// snapshots are restored. It is called again to reconnect if the connection is lost during a
+	// restore, see app_reconnect_attempts.
+	Open() (proxy.AppConnSnapshot, proxy.AppConnQuery, error)
+	// Promote replaces the live app state with the staging instance's restored state, such that the
+	// live app connections then report the restored height and app hash.
+	Promote() error
+	// Discard discards the staging instance's restored state, e.g. because the snapshot failed
+	// verification, such that the next Open() starts with empty state.
+	Discard() error
+}
+
+// openStaging opens the staging app, if any, and switches the syncer to its connections. It returns
+// a function which switches the syncer back to the live app connections, discarding the staging
+// app unless it was promoted.
+func (s *syncer) openStaging() (func(), error) {
+	if s.staging == nil {
+		return func() {}, nil
+	}
+	conn, connQuery, err := s.staging.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open staging app: %w", err)
+	}
+	live, liveQuery := s.conn, s.connQuery
+	s.conn, s.connQuery = conn, connQuery
+	s.live, s.liveQuery = live, liveQuery
+	return func() {
+		if s.live == nil {
+			return
+		}
+		s.conn, s.connQuery = s.live, s.liveQuery
+		s.live, s.liveQuery = nil, nil
+		if err := s.staging.Discard(); err != nil {
+			s.logger.Error("Failed to discard staging app", "err", err)
+		}
+	}, nil
+}
+
+// promoteStaging promotes the staging app, if any, once the snapshot restored into it has been
+// verified, switching the syncer back to the live app connections. It then verifies that the live
+// app reports the restored snapshot, and returns its app version.
+func (s *syncer) promoteStaging(snapshot *snapshot, appVersion uint64) (uint64, error) {
+	if s.staging == nil {
+		return appVersion, nil
+	}
+	if err := s.staging.Promote(); err != nil {
+		return 0, fmt.Errorf("failed to promote staging app: %w", err)
+	}
+	s.conn, s.connQuery = s.live, s.liveQuery
+	s.live, s.liveQuery = nil, nil
+	s.logger.Info("Promoted staging app", "height", snapshot.Height, "format", snapshot.Format,
+		"hash", fmt.Sprintf("%X", snapshot.Hash))
+	return s.verifyApp(snapshot)
+}
@@ -0,0 +1,135 @@
+package statesync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/proxy"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync/mocks"
+	"github.com/tendermint/tendermint/types"
+)
+
+// testStagingApp is a StagingApp backed by connection mocks, recording its lifecycle calls.
+type testStagingApp struct {
+	conn      *proxymocks.AppConnSnapshot
+	connQuery *proxymocks.AppConnQuery
+	calls     []string
+}
+
+var _ StagingApp = (*testStagingApp)(nil)
+
+func (a *testStagingApp) Open() (proxy.AppConnSnapshot, proxy.AppConnQuery, error) {
+	a.calls = append(a.calls, "open")
+	return a.conn, a.connQuery, nil
+}
+
+func (a *testStagingApp) Promote() error {
+	a.calls = append(a.calls, "promote")
+	return nil
+}
+
+func (a *testStagingApp) Discard() error {
+	a.calls = append(a.calls, "discard")
+	return nil
+}
+
+func TestSyncer_Sync_staging(t *testing.T) {
+	blockID := types.BlockID{
+		Hash:          tmhash.Sum([]byte("block")),
+		PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte("parts"))},
+	}
+	valSet, commit := makeSignedCommit(t, "chain", 1, blockID)
+	state := sm.State{ChainID: "chain", LastBlockHeight: 1, LastBlockID: blockID, LastValidators: valSet}
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1, 2, 3}}
+
+	testcases := map[string]struct {
+		stagingHash []byte
+		expectCalls []string
+		expectErr   error
+	}{
+		"verified snapshot is promoted": {[]byte("app_hash"), []string{"open", "promote"}, nil},
+		"bad snapshot is discarded":     {[]byte("bad_hash"), []string{"open", "discard"}, errAppHashMismatch},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			stateProvider := &mocks.StateProvider{}
+			stateProvider.On("AppHash", mock.Anything, uint64(1)).Return([]byte("app_hash"), nil)
+			stateProvider.On("State", mock.Anything, uint64(1)).Return(state, nil)
+			stateProvider.On("Commit", mock.Anything, uint64(1)).Return(commit, nil)
+
+			// The snapshot is restored into the staging app, and the live app is only queried once
+			// the staging app has been promoted.
+			staging := &testStagingApp{conn: &proxymocks.AppConnSnapshot{}, connQuery: &proxymocks.AppConnQuery{}}
+			staging.conn.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+				Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+			}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+			staging.conn.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+				Index: 0, Chunk: []byte{1}, Sender: "a",
+			}).Once().Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}, nil)
+			staging.connQuery.On("InfoSync", proxy.RequestInfo).Once().Return(&abci.ResponseInfo{
+				AppVersion:       8,
+				LastBlockHeight:  1,
+				LastBlockAppHash: tc.stagingHash,
+			}, nil)
+			liveConn := &proxymocks.AppConnSnapshot{}
+			liveQuery := &proxymocks.AppConnQuery{}
+			if tc.expectErr == nil {
+				liveQuery.On("InfoSync", proxy.RequestInfo).Once().Return(&abci.ResponseInfo{
+					AppVersion:       9,
+					LastBlockHeight:  1,
+					LastBlockAppHash: []byte("app_hash"),
+				}, nil)
+			}
+
+			config := cfg.TestStateSyncConfig()
+			config.StagingRestore = true
+			syncer := newSyncer(config, log.NewNopLogger(), liveConn, liveQuery, stateProvider, "",
+				withStagingApp(staging))
+			_, err := syncer.AddSnapshot(simplePeer("a"), s)
+			require.NoError(t, err)
+			chunks, err := newChunkQueue(s, "")
+			require.NoError(t, err)
+			defer chunks.Close()
+			_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}, Sender: "a"})
+			require.NoError(t, err)
+
+			newState, _, err := syncer.Sync(s, chunks)
+			if tc.expectErr != nil {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, tc.expectErr))
+			} else {
+				require.NoError(t, err)
+				assert.EqualValues(t, 9, newState.Version.Consensus.App)
+			}
+			assert.Equal(t, tc.expectCalls, staging.calls)
+			assert.Equal(t, liveConn, syncer.conn)
+			assert.Equal(t, liveQuery, syncer.connQuery)
+			staging.conn.AssertExpectations(t)
+			staging.connQuery.AssertExpectations(t)
+			liveConn.AssertExpectations(t)
+			liveQuery.AssertExpectations(t)
+		})
+	}
+}
+
+func TestReactor_OnStart_staging(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.StagingRestore = true
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "")
+	assert.Equal(t, errNoStagingApp, r.OnStart())
+
+	r = NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "", WithStagingApp(&testStagingApp{}))
+	require.NoError(t, r.OnStart())
+	r.OnStop()
+}
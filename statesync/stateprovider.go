@@ -2,7 +2,9 @@ package statesync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
@@ -23,6 +25,10 @@ import (
 
 //go:generate mockery --case underscore --name StateProvider
 
+// errOutsideTrustPeriod is returned by the light client state provider for heights that can't be
+// verified within the light client's trust period.
+var errOutsideTrustPeriod = errors.New("height is outside the trust period")
+
 // StateProvider is a provider of trusted state data for bootstrapping a node. This refers
 // to the state.State object, not the state machine.
 type StateProvider interface {
@@ -34,12 +40,29 @@ type StateProvider interface {
 	State(ctx context.Context, height uint64) (sm.State, error)
 }
 
+// StateProviderChecker can optionally be implemented by a StateProvider to check that it is able
+// to serve requests, allowing a state sync to fail fast rather than fetching snapshots that can
+// never be verified.
+type StateProviderChecker interface {
+	// CheckAvailable returns an error if the state provider is currently unable to serve requests.
+	CheckAvailable(ctx context.Context) error
+}
+
+// StateProviderNetworkHeight can optionally be implemented by a StateProvider to report the
+// best-known height of the network, such that the gap between the restored snapshot and the tip
+// of the chain, which block sync has to fill, can be reported once a state sync completes.
+type StateProviderNetworkHeight interface {
+	// NetworkHeight returns the best-known height of the network.
+	NetworkHeight(ctx context.Context) (uint64, error)
+}
+
 // lightClientStateProvider is a state provider using the light client.
 type lightClientStateProvider struct {
 	tmsync.Mutex  // light.Client is not concurrency-safe
 	lc            *light.Client
 	version       tmstate.Version
 	initialHeight int64
+	trustPeriod   time.Duration
 	providers     map[lightprovider.Provider]string
 }
 
@@ -70,7 +93,23 @@ func NewLightClientStateProvider(
 		// provider used by the light client and use it to fetch consensus parameters.
 		providerRemotes[provider] = server
 	}
+	return newLightClientStateProvider(ctx, chainID, version, initialHeight, providers, providerRemotes,
+		trustOptions, logger)
+}
 
+// newLightClientStateProvider creates a new StateProvider using a light client with the given
+// providers, the first of which is the primary. Remotes contains the RPC addresses of providers,
+// used to fetch consensus parameters.
+func newLightClientStateProvider(
+	ctx context.Context,
+	chainID string,
+	version tmstate.Version,
+	initialHeight int64,
+	providers []lightprovider.Provider,
+	remotes map[lightprovider.Provider]string,
+	trustOptions light.TrustOptions,
+	logger log.Logger,
+) (*lightClientStateProvider, error) {
 	lc, err := light.NewClient(ctx, chainID, trustOptions, providers[0], providers[1:],
 		lightdb.New(dbm.NewMemDB(), ""), light.Logger(logger), light.MaxRetryAttempts(5))
 	if err != nil {
@@ -80,17 +119,44 @@ func NewLightClientStateProvider(
 		lc:            lc,
 		version:       version,
 		initialHeight: initialHeight,
-		providers:     providerRemotes,
+		trustPeriod:   trustOptions.Period,
+		providers:     remotes,
 	}, nil
 }
 
+// verifyLightBlock verifies the light block at the given height. The light client verifies any
+// validator set changes between its trusted heights and the given height, by bisecting until each
+// step is signed by enough trusted validators, or by following the header hash chain for heights
+// below its first trusted height. Heights with a block time outside the trust period are
+// rejected even if their header verifies, since their validators may since have unbonded and
+// could no longer be held accountable for misbehavior.
+func (s *lightClientStateProvider) verifyLightBlock(ctx context.Context, height uint64) (*types.LightBlock, error) {
+	// Callers fetch heights following the snapshot height, which may have wrapped around.
+	if height == 0 || height > math.MaxInt64 {
+		return nil, fmt.Errorf("invalid light block height %v", height)
+	}
+	now := time.Now()
+	block, err := s.lc.VerifyLightBlockAtHeight(ctx, int64(height), now)
+	if errors.As(err, &light.ErrOldHeaderExpired{}) {
+		return nil, fmt.Errorf("%w: unable to verify height %v, the trusted height must be updated: %v",
+			errOutsideTrustPeriod, height, err)
+	} else if err != nil {
+		return nil, err
+	}
+	if expires := block.Time.Add(s.trustPeriod); !expires.After(now) {
+		return nil, fmt.Errorf("%w: block time %v at height %v expired at %v (trust period %v)",
+			errOutsideTrustPeriod, block.Time, height, expires, s.trustPeriod)
+	}
+	return block, nil
+}
+
 // AppHash implements StateProvider.
 func (s *lightClientStateProvider) AppHash(ctx context.Context, height uint64) ([]byte, error) {
 	s.Lock()
 	defer s.Unlock()
 
 	// We have to fetch the next height, which contains the app hash for the previous height.
-	header, err := s.lc.VerifyLightBlockAtHeight(ctx, int64(height+1), time.Now())
+	header, err := s.verifyLightBlock(ctx, height+1)
 	if err != nil {
 		return nil, err
 	}
@@ -102,22 +168,49 @@ func (s *lightClientStateProvider) AppHash(ctx context.Context, height uint64) (
 	// breaking it. We should instead have a Has(ctx, height) method which checks
 	// that the state provider has access to the necessary data for the height.
 	// We piggyback on AppHash() since it's called when adding snapshots to the pool.
-	_, err = s.lc.VerifyLightBlockAtHeight(ctx, int64(height+2), time.Now())
+	_, err = s.verifyLightBlock(ctx, height+2)
 	if err != nil {
 		return nil, err
 	}
-	_, err = s.lc.VerifyLightBlockAtHeight(ctx, int64(height), time.Now())
+	_, err = s.verifyLightBlock(ctx, height)
 	if err != nil {
 		return nil, err
 	}
 	return header.AppHash, nil
 }
 
+// CheckAvailable implements StateProviderChecker, by fetching the latest light block from the
+// light client's primary provider.
+func (s *lightClientStateProvider) CheckAvailable(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := s.lc.Primary().LightBlock(ctx, 0)
+	if err != nil {
+		return fmt.Errorf("light client primary %v is unavailable: %w", s.lc.Primary(), err)
+	}
+	return nil
+}
+
+// NetworkHeight implements StateProviderNetworkHeight, by fetching the latest light block from the
+// light client's primary provider. The height is not verified, and is only used for reporting.
+func (s *lightClientStateProvider) NetworkHeight(ctx context.Context) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	lightBlock, err := s.lc.Primary().LightBlock(ctx, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch latest light block from primary %v: %w", s.lc.Primary(), err)
+	}
+	if lightBlock.Height < 0 {
+		return 0, fmt.Errorf("invalid latest height %v from primary %v", lightBlock.Height, s.lc.Primary())
+	}
+	return uint64(lightBlock.Height), nil
+}
+
 // Commit implements StateProvider.
 func (s *lightClientStateProvider) Commit(ctx context.Context, height uint64) (*types.Commit, error) {
 	s.Lock()
 	defer s.Unlock()
-	header, err := s.lc.VerifyLightBlockAtHeight(ctx, int64(height), time.Now())
+	header, err := s.verifyLightBlock(ctx, height)
 	if err != nil {
 		return nil, err
 	}
@@ -146,15 +239,15 @@ func (s *lightClientStateProvider) State(ctx context.Context, height uint64) (sm
 	//
 	// We need to fetch the NextValidators from height+2 because if the application changed
 	// the validator set at the snapshot height then this only takes effect at height+2.
-	lastLightBlock, err := s.lc.VerifyLightBlockAtHeight(ctx, int64(height), time.Now())
+	lastLightBlock, err := s.verifyLightBlock(ctx, height)
 	if err != nil {
 		return sm.State{}, err
 	}
-	curLightBlock, err := s.lc.VerifyLightBlockAtHeight(ctx, int64(height+1), time.Now())
+	curLightBlock, err := s.verifyLightBlock(ctx, height+1)
 	if err != nil {
 		return sm.State{}, err
 	}
-	nextLightBlock, err := s.lc.VerifyLightBlockAtHeight(ctx, int64(height+2), time.Now())
+	nextLightBlock, err := s.verifyLightBlock(ctx, height+2)
 	if err != nil {
 		return sm.State{}, err
 	}
@@ -0,0 +1,143 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/light"
+	lightprovider "github.com/tendermint/tendermint/light/provider"
+	lightmock "github.com/tendermint/tendermint/light/provider/mock"
+	tmstate "github.com/tendermint/tendermint/proto/tendermint/state"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+	tmversion "github.com/tendermint/tendermint/proto/tendermint/version"
+	"github.com/tendermint/tendermint/types"
+	"github.com/tendermint/tendermint/version"
+)
+
+// makeLightChain generates signed headers and validator sets for heights 1 to n, with one block per
+// minute such that the last block is at the given time. The validator set is replaced by an entirely
+// new one every rotate heights.
+func makeLightChain(t *testing.T, chainID string, n, rotate int64, last time.Time) (
+	map[int64]*types.SignedHeader, map[int64]*types.ValidatorSet) {
+	vals := make(map[int64]*types.ValidatorSet, n+1)
+	privVals := make(map[int64][]types.PrivValidator, n+1)
+	for height := int64(1); height <= n+1; height++ {
+		if (height-1)%rotate == 0 {
+			vals[height], privVals[height] = types.RandValidatorSet(4, 10)
+		} else {
+			vals[height], privVals[height] = vals[height-1], privVals[height-1]
+		}
+	}
+
+	headers := make(map[int64]*types.SignedHeader, n)
+	lastBlockID := types.BlockID{}
+	for height := int64(1); height <= n; height++ {
+		header := &types.Header{
+			Version:            tmversion.Consensus{Block: version.BlockProtocol},
+			ChainID:            chainID,
+			Height:             height,
+			Time:               last.Add(-time.Duration(n-height) * time.Minute),
+			LastBlockID:        lastBlockID,
+			ValidatorsHash:     vals[height].Hash(),
+			NextValidatorsHash: vals[height+1].Hash(),
+			AppHash:            tmhash.Sum([]byte(fmt.Sprintf("app_hash %v", height))),
+			ConsensusHash:      tmhash.Sum([]byte("consensus_hash")),
+			LastResultsHash:    tmhash.Sum([]byte("results_hash")),
+			ProposerAddress:    vals[height].Validators[0].Address,
+		}
+		blockID := types.BlockID{
+			Hash:          header.Hash(),
+			PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte("parts"))},
+		}
+		voteSet := types.NewVoteSet(chainID, height, 0, tmproto.PrecommitType, vals[height])
+		commit, err := types.MakeCommit(blockID, height, 0, voteSet, privVals[height], header.Time)
+		require.NoError(t, err)
+		headers[height] = &types.SignedHeader{Header: header, Commit: commit}
+		lastBlockID = blockID
+	}
+	delete(vals, n+1)
+	return headers, vals
+}
+
+func TestLightClientStateProvider_validatorChanges(t *testing.T) {
+	const chainID = "chain"
+	headers, vals := makeLightChain(t, chainID, 100, 20, time.Now())
+
+	testcases := map[string]struct {
+		trustHeight int64
+		trustPeriod time.Duration
+		height      uint64
+		expectErr   error
+	}{
+		"forwards across validator sets":  {10, 4 * time.Hour, 90, nil},
+		"backwards across validator sets": {90, 4 * time.Hour, 5, nil},
+		"within trust period":             {90, 30 * time.Minute, 75, nil},
+		"outside trust period":            {90, 30 * time.Minute, 40, errOutsideTrustPeriod},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			providers := []lightprovider.Provider{
+				lightmock.New(chainID, headers, vals),
+				lightmock.New(chainID, headers, vals),
+			}
+			stateProvider, err := newLightClientStateProvider(ctx, chainID, tmstate.Version{}, 1, providers,
+				nil, light.TrustOptions{
+					Period: tc.trustPeriod,
+					Height: tc.trustHeight,
+					Hash:   headers[tc.trustHeight].Hash(),
+				}, log.NewNopLogger())
+			require.NoError(t, err)
+
+			// The validator set at the snapshot height differs entirely from the trusted one.
+			require.NotEqual(t, vals[tc.trustHeight].Hash(), vals[int64(tc.height)].Hash())
+
+			appHash, err := stateProvider.AppHash(ctx, tc.height)
+			if tc.expectErr != nil {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, tc.expectErr), "unexpected error %v", err)
+				return
+			}
+			require.NoError(t, err)
+			assert.EqualValues(t, headers[int64(tc.height)+1].AppHash, appHash)
+
+			commit, err := stateProvider.Commit(ctx, tc.height)
+			require.NoError(t, err)
+			assert.Equal(t, headers[int64(tc.height)].Commit.Hash(), commit.Hash())
+		})
+	}
+}
+
+func TestLightClientStateProvider_heightOverflow(t *testing.T) {
+	const chainID = "chain"
+	headers, vals := makeLightChain(t, chainID, 3, 3, time.Now())
+	ctx := context.Background()
+	providers := []lightprovider.Provider{
+		lightmock.New(chainID, headers, vals),
+		lightmock.New(chainID, headers, vals),
+	}
+	stateProvider, err := newLightClientStateProvider(ctx, chainID, tmstate.Version{}, 1, providers,
+		nil, light.TrustOptions{Period: time.Hour, Height: 1, Hash: headers[1].Hash()}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	// Heights whose successors overflow int64 or uint64 must error rather than panic or wrap
+	// around to valid heights.
+	for _, height := range []uint64{math.MaxInt64 - 1, math.MaxInt64, math.MaxUint64 - 1, math.MaxUint64} {
+		_, err := stateProvider.AppHash(ctx, height)
+		assert.Error(t, err, "height %v", height)
+		_, err = stateProvider.Commit(ctx, height)
+		assert.Error(t, err, "height %v", height)
+		_, err = stateProvider.State(ctx, height)
+		assert.Error(t, err, "height %v", height)
+	}
+}
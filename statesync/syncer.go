@@ -5,9 +5,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
 	"github.com/tendermint/tendermint/libs/log"
 	tmsync "github.com/tendermint/tendermint/libs/sync"
 	"github.com/tendermint/tendermint/p2p"
@@ -24,11 +32,32 @@ const (
 	chunkTimeout = 2 * time.Minute
 	// requestTimeout is the timeout before rerequesting a chunk, possibly from a different peer.
 	chunkRequestTimeout = 10 * time.Second
+	// stallCheckInterval is the maximum interval between checks for a stalled sync.
+	stallCheckInterval = 10 * time.Second
+	// appReconnectBackoff is the time to wait before each attempt to reconnect to the app.
+	appReconnectBackoff = time.Second
+	// appFlushPollInterval is the interval between app queries while waiting for the app to finish
+	// applying a snapshot.
+	appFlushPollInterval = 100 * time.Millisecond
+	// discoveryExtensionPoll is the interval between checks for discovered snapshots while
+	// discovery is extended.
+	discoveryExtensionPoll = 100 * time.Millisecond
+	// deadlinePacingSlack is how far the share of chunks applied may trail the share of the restore
+	// deadline elapsed before a warning is logged.
+	deadlinePacingSlack = 0.25
 )
 
 var (
+	// ErrStalled is returned by Sync() when no chunk has been applied within the configured stall
+	// timeout, even though chunk requests are outstanding and peers are available.
+	ErrStalled = errors.New("state sync stalled")
+	// ErrAdvertiseRateLimited is returned by Reactor.AdvertiseSnapshots() when called again within
+	// the advertisement interval.
+	ErrAdvertiseRateLimited = errors.New("snapshot advertisement rate limited")
 	// errAbort is returned by Sync() when snapshot restoration is aborted.
 	errAbort = errors.New("state sync aborted")
+	// errOfferLimit is returned by Sync() when the max_offers limit has been reached.
+	errOfferLimit = errors.New("snapshot offer limit reached")
 	// errRetrySnapshot is returned by Sync() when the snapshot should be retried.
 	errRetrySnapshot = errors.New("retry snapshot")
 	// errRejectSnapshot is returned by Sync() when the snapshot is rejected.
@@ -37,167 +66,935 @@ var (
 	errRejectFormat = errors.New("snapshot format was rejected")
 	// errRejectSender is returned by Sync() when the snapshot sender is rejected.
 	errRejectSender = errors.New("snapshot sender was rejected")
-	// errVerifyFailed is returned by Sync() when app hash or last height verification fails.
+	// errVerifyFailed is returned by Sync() when app hash, last height or commit verification fails.
 	errVerifyFailed = errors.New("verification failed")
+	// errAppHashMismatch is returned by Sync() when the restored app hash doesn't match the trusted
+	// app hash. It wraps errVerifyFailed.
+	errAppHashMismatch = fmt.Errorf("%w: restored app hash does not match trusted app hash", errVerifyFailed)
 	// errTimeout is returned by Sync() when we've waited too long to receive a chunk.
 	errTimeout = errors.New("timed out waiting for chunk")
+	// errChunkAborted is the outcome of chunk requests aborted via AbortChunk().
+	errChunkAborted = errors.New("chunk request aborted")
+	// errChunkNotInFlight is returned by AbortChunk() for chunks without a request in flight.
+	errChunkNotInFlight = errors.New("chunk has no request in flight")
+	// errLowThroughput is returned by Sync() when chunks are downloaded below min_throughput.
+	errLowThroughput = errors.New("chunk download throughput too low")
+	// errDeadline is returned by Sync() when the snapshot wasn't restored by its deadline.
+	errDeadline = errors.New("snapshot restore deadline exceeded")
+	// errBelowTrustHeight is returned by checkTrustHeight() when a snapshot is below the configured
+	// trust height, and thus can't be verified against the trust anchor.
+	errBelowTrustHeight = errors.New("snapshot is below the trusted height")
 	// errNoSnapshots is returned by SyncAny() if no snapshots are found and discovery is disabled.
 	errNoSnapshots = errors.New("no suitable snapshots found")
+	// errChunkTooLarge is returned by AddChunk() when a chunk exceeds the maximum chunk size.
+	errChunkTooLarge = errors.New("chunk too large")
+	// errUnknownMessage is returned when decoding messages of unknown types, e.g. from peers running
+	// a newer protocol version, and describes known messages received on the wrong channel.
+	errUnknownMessage = errors.New("unknown message type")
+	// errMetadataTooLarge is returned when snapshot metadata exceeds the maximum metadata size.
+	errMetadataTooLarge = errors.New("snapshot metadata too large")
+	// errAppConnection is returned by applyChunks() when the connection to the app was lost.
+	errAppConnection = errors.New("lost connection to ABCI app")
+	// errNoStateProvider is returned by SyncAny() if no state provider is given.
+	errNoStateProvider = errors.New("no state provider given, unable to verify snapshots")
+	// errSyncEnded is returned by syncer methods called after the syncer was closed via Close().
+	errSyncEnded = errors.New("state sync has ended")
+	// errExistingState is returned by Reactor.Sync() if the app already has state.
+	errExistingState = errors.New("refusing to state sync over existing app state")
 )
 
+// AppReconnectFunc re-establishes the snapshot and query connections to the app being restored into,
+// after the connection was lost mid-restore, e.g. because the app restarted. It should return
+// an error if the app is not yet available, in which case it is retried.
+type AppReconnectFunc func() (proxy.AppConnSnapshot, proxy.AppConnQuery, error)
+
+// PeerSelector selects the peer to request a snapshot chunk from. It allows external components to
+// observe or override the syncer's choice, e.g. to prefer peers in the same datacenter.
+type PeerSelector interface {
+	// SelectPeer returns the peer to request the given chunk from. The candidates are the peers
+	// currently known to have the snapshot, sorted by ID, and are never empty. Returning nil or
+	// a peer that is not among the candidates falls back to the default selection.
+	SelectPeer(height uint64, format uint32, index uint32, candidates []p2p.Peer) p2p.Peer
+}
+
+// randomPeerSelector is the default PeerSelector, picking a random candidate peer.
+type randomPeerSelector struct{}
+
+// SelectPeer implements PeerSelector.
+func (randomPeerSelector) SelectPeer(height uint64, format uint32, index uint32, candidates []p2p.Peer) p2p.Peer {
+	return candidates[rand.Intn(len(candidates))] // nolint:gosec // G404: Use of weak random number generator
+}
+
+// PeerPreference is a PeerFilter's verdict on whether and how a peer is used by a state sync.
+type PeerPreference int
+
+const (
+	// PeerAccepted peers are used as usual.
+	PeerAccepted PeerPreference = iota
+	// PeerPreferred peers are used to fetch chunks in favor of accepted peers, whenever any of the
+	// snapshot's peers are preferred.
+	PeerPreferred
+	// PeerExcluded peers are never used: their snapshots are ignored, and chunks are never
+	// requested from them.
+	PeerExcluded
+)
+
+// PeerFilter decides which peers a state sync uses, based on peer attributes, e.g. to prefer peers
+// in the same region or exclude peers flagged as untrusted. Attributes can be taken from the peer's
+// NodeInfo, or from peer data set via p2p.Peer.Set() by other components. It is consulted when a
+// peer advertises a snapshot and when scheduling each chunk request, and must not block.
+type PeerFilter interface {
+	// FilterPeer returns the preference for using the given peer.
+	FilterPeer(peer p2p.Peer) PeerPreference
+}
+
+// acceptAllPeers is the default PeerFilter, accepting all peers.
+type acceptAllPeers struct{}
+
+// FilterPeer implements PeerFilter.
+func (acceptAllPeers) FilterPeer(peer p2p.Peer) PeerPreference {
+	return PeerAccepted
+}
+
+// SnapshotStreamFunc consumes a snapshot as a continuous stream while it is being restored, for
+// applications that restore from a stream rather than discrete chunks. The reader yields the
+// snapshot's chunk contents in order as each chunk is accepted by the app, and returns io.EOF
+// once the entire snapshot has been read, or an error if the restoration is abandoned. It is
+// called in a separate goroutine for each snapshot restoration attempt, and a successful sync
+// will not complete until it returns.
+type SnapshotStreamFunc func(height uint64, format uint32, reader io.Reader)
+
+// SnapshotAvailableFunc is notified when the first usable snapshot is discovered during a state
+// sync, i.e. the first snapshot whose app hash was verified by the state provider. This allows
+// callers to decide early whether to proceed with state sync, rather than waiting for the
+// discovery time to elapse. It is called at most once per sync, and must not block.
+type SnapshotAvailableFunc func(height uint64, format uint32)
+
+// SnapshotConfirmFunc is called with the snapshot selected for restoration, once it has been
+// verified and before any chunks are fetched, e.g. for an operator to approve it. The snapshot is
+// only restored if it returns true, otherwise it is rejected and the next candidate is selected.
+// It may block, e.g. while awaiting approval, in which case the sync waits for it.
+type SnapshotConfirmFunc func(snapshot SnapshotInfo) bool
+
+// SyncLifecycle is notified when a state sync ends, such that the app can clean up after it, e.g.
+// by removing scratch state left behind by partially restored snapshots or releasing resources it
+// held for the restore. The sync doesn't return until the relevant method returns.
+type SyncLifecycle interface {
+	// SyncCompleted is called with the result of a successful state sync.
+	SyncCompleted(result *SyncResult)
+	// SyncAborting is called with the error a failed state sync is about to return.
+	SyncAborting(err error)
+}
+
 // syncer runs a state sync against an ABCI app. Use either SyncAny() to automatically attempt to
 // sync all snapshots in the pool (pausing to discover new ones), or Sync() to sync a specific
 // snapshot. Snapshots and chunks are fed via AddSnapshot() and AddChunk() as appropriate.
 type syncer struct {
+	config        *cfg.StateSyncConfig
 	logger        log.Logger
 	stateProvider StateProvider
 	conn          proxy.AppConnSnapshot
 	connQuery     proxy.AppConnQuery
 	snapshots     *snapshotPool
 	tempDir       string
+	peerSelector  PeerSelector
+	peerFilter    PeerFilter
+	verifier      ChunkVerifier
+	proofVerifier ChunkProofVerifier
+	chunkHashes   ChunkHashesFunc
+	snapshotSize  SnapshotSizeFunc
+	streamFunc    SnapshotStreamFunc
+	metrics       *Metrics
+	peerCount     func() int               // number of connected peers, for adaptive discovery
+	rediscover    func()                   // requests snapshots from all connected peers again
+	latencies     *peerLatencies           // peer latency estimates, fed by chunk fetch times
+	verifiers     map[string]StateProvider // additional state providers to verify app hashes with
+	quorum        int                      // number of state providers which must agree on app hashes
+	reconnect     AppReconnectFunc
+	onAvailable   SnapshotAvailableFunc
+	confirm       SnapshotConfirmFunc
+	lifecycle     SyncLifecycle
+	tracer        Tracer
+	ctx           context.Context       // interrupts state syncs when cancelled
+	traceRoot     context.Context       // the sync span context, set by SyncAny()
+	breaker       *breakerStateProvider // wraps stateProvider, if enabled
+	verified      *verificationCache    // states verified across state syncs, if enabled
+	verboseChunks *int32                // enables verbose per-chunk logging, if non-zero
+	downloads     *downloadLimiter      // caps the chunk download rate, if enabled
+	reputation    *peerReputation       // peer quality across state syncs, if enabled
+	grace         *peerGrace            // disconnected peers which may reconnect, if enabled
+	readvertised  *readvertisementFilter
+	diskFree      func(dir string) (uint64, error) // free disk space in a dir, for check_disk_space
+	formats       *formatHorizon                   // the highest format supported by the app
+	stale         *staleChunks                     // chunk requests left in flight by finished restores
+	expected      *expectedSnapshot                // the snapshot set via expected_snapshot_hash, if any
+
+	// staging is the staging app instance snapshots are restored into, if staging_restore is
+	// enabled. While restoring into it, live and liveQuery are the live app connections.
+	staging   StagingApp
+	live      proxy.AppConnSnapshot
+	liveQuery proxy.AppConnQuery
+	// verifyOnly discards snapshots restored into the staging app once verified, rather than
+	// promoting them, for VerifySnapshot().
+	verifyOnly bool
+
+	// peerSupports checks whether a peer has advertised a protocol feature, and hello builds the
+	// Hello embedded in snapshot requests.
+	peerSupports func(p2p.ID, string) bool
+	hello        func() *ssproto.Hello
+
+	// resumedDiscovery is the discovery time which elapsed before a restart, if the sync resumes
+	// a discovery interrupted by a restart, which the initial discovery doesn't wait for again.
+	resumedDiscovery time.Duration
+
+	restore        *restoreRecord // the snapshot currently accepted by the app, if any
+	restoreLoaded  bool           // whether any persisted restore record has been loaded
+	restoreResumed bool           // whether the restore record was persisted by a previous run
+
+	mtx         tmsync.RWMutex
+	chunks      *chunkQueue
+	budget      *retryBudget    // chunk retry budget for the current snapshot
+	active      *activePeerSet  // peers chunks of the current snapshot are requested from
+	pipeline    *pipelineStats  // chunk pipeline stats for the current sync
+	requests    *chunkRequests  // chunk requests in flight for the current sync
+	trace       context.Context // the snapshot span context for the current sync
+	lastApplied time.Time       // time of the last applied chunk, or start of chunk application
+	lastOffer   time.Time       // time of the last snapshot offer, for offer_interval
+	progress    SyncProgress    // progress made by SyncAny(), for diagnostics
+
+	available       bool      // whether onAvailable has been notified
+	appHeight       *uint64   // the app's height before restoring, once queried for diff snapshots
+	highestSeen     uint64    // height of the highest snapshot discovered
+	lastRediscovery time.Time // time of the last snapshot request re-broadcast
+	closed          bool      // whether the syncer was closed via Close()
+}
+
+// syncerOption sets an optional parameter on the syncer.
+type syncerOption func(*syncer)
+
+// withPeerSelector sets the PeerSelector used to pick peers for chunk requests.
+func withPeerSelector(selector PeerSelector) syncerOption {
+	return func(s *syncer) { s.peerSelector = selector }
+}
+
+// withPeerFilter sets the PeerFilter used to exclude or prefer peers.
+func withPeerFilter(filter PeerFilter) syncerOption {
+	return func(s *syncer) { s.peerFilter = filter }
+}
+
+// withChunkVerifier sets the ChunkVerifier used to check buffered chunks.
+func withChunkVerifier(verifier ChunkVerifier) syncerOption {
+	return func(s *syncer) { s.verifier = verifier }
+}
+
+// withChunkProofVerifier sets the ChunkProofVerifier used to verify chunks against their proofs.
+func withChunkProofVerifier(verifier ChunkProofVerifier) syncerOption {
+	return func(s *syncer) { s.proofVerifier = verifier }
+}
+
+// withChunkHashes sets the function returning the expected chunk hashes of snapshots.
+func withChunkHashes(fn ChunkHashesFunc) syncerOption {
+	return func(s *syncer) { s.chunkHashes = fn }
+}
+
+// withPeerGrace sets the tracker of disconnected peers which may reconnect.
+func withPeerGrace(grace *peerGrace) syncerOption {
+	return func(s *syncer) { s.grace = grace }
+}
+
+// withStaleChunks sets the tracker of chunk requests left in flight by finished restores.
+func withStaleChunks(stale *staleChunks) syncerOption {
+	return func(s *syncer) { s.stale = stale }
+}
+
+// withAppFormats sets the snapshot formats supported by the app.
+func withAppFormats(formats []uint32) syncerOption {
+	return func(s *syncer) { s.formats = newFormatHorizon(formats) }
+}
+
+// withSnapshotSize sets the function estimating the size of snapshots.
+func withSnapshotSize(fn SnapshotSizeFunc) syncerOption {
+	return func(s *syncer) { s.snapshotSize = fn }
+}
+
+// withStagingApp sets the staging app instance snapshots are restored into.
+func withStagingApp(app StagingApp) syncerOption {
+	return func(s *syncer) { s.staging = app }
+}
+
+// withPeerFeatures sets a function checking whether a peer has advertised a protocol feature.
+func withPeerFeatures(fn func(p2p.ID, string) bool) syncerOption {
+	return func(s *syncer) { s.peerSupports = fn }
+}
+
+// withHello sets a function building the Hello embedded in snapshot requests.
+func withHello(fn func() *ssproto.Hello) syncerOption {
+	return func(s *syncer) { s.hello = fn }
+}
+
+// withSnapshotStream sets a function that consumes restored snapshots as a stream.
+func withSnapshotStream(fn SnapshotStreamFunc) syncerOption {
+	return func(s *syncer) { s.streamFunc = fn }
+}
+
+// withMetrics sets the metrics.
+func withMetrics(metrics *Metrics) syncerOption {
+	return func(s *syncer) { s.metrics = metrics }
+}
+
+// withRediscovery sets a function requesting snapshots from all connected peers again.
+func withRediscovery(fn func()) syncerOption {
+	return func(s *syncer) { s.rediscover = fn }
+}
+
+// withPeerCount sets a function returning the number of connected peers.
+func withPeerCount(fn func() int) syncerOption {
+	return func(s *syncer) { s.peerCount = fn }
+}
+
+// withPeerLatencies sets the peer latency estimator, fed by chunk fetch times.
+func withPeerLatencies(latencies *peerLatencies) syncerOption {
+	return func(s *syncer) { s.latencies = latencies }
+}
+
+// withPeerReputation sets the peer reputation store, which is fed chunk fetch outcomes.
+func withPeerReputation(reputation *peerReputation) syncerOption {
+	return func(s *syncer) { s.reputation = reputation }
+}
+
+// withAppReconnect sets a function which re-establishes lost app connections.
+func withAppReconnect(fn AppReconnectFunc) syncerOption {
+	return func(s *syncer) { s.reconnect = fn }
+}
+
+// withSnapshotAvailable sets a function which is notified of the first usable snapshot.
+func withSnapshotAvailable(fn SnapshotAvailableFunc) syncerOption {
+	return func(s *syncer) { s.onAvailable = fn }
+}
+
+// withSnapshotConfirm sets a function which must confirm the selected snapshot before restoring it.
+func withSnapshotConfirm(fn SnapshotConfirmFunc) syncerOption {
+	return func(s *syncer) { s.confirm = fn }
+}
+
+// withSyncLifecycle sets the lifecycle notified when a sync ends.
+func withSyncLifecycle(lifecycle SyncLifecycle) syncerOption {
+	return func(s *syncer) { s.lifecycle = lifecycle }
+}
+
+// withVerificationCache sets the cache of states verified across state syncs.
+func withVerificationCache(cache *verificationCache) syncerOption {
+	return func(s *syncer) { s.verified = cache }
+}
 
-	mtx    tmsync.RWMutex
-	chunks *chunkQueue
+// withChunkLogging sets the flag enabling verbose per-chunk logging, accessed atomically.
+func withChunkLogging(verbose *int32) syncerOption {
+	return func(s *syncer) { s.verboseChunks = verbose }
+}
+
+// withTracer sets the tracer.
+func withTracer(tracer Tracer) syncerOption {
+	return func(s *syncer) { s.tracer = tracer }
 }
 
 // newSyncer creates a new syncer.
-func newSyncer(logger log.Logger, conn proxy.AppConnSnapshot, connQuery proxy.AppConnQuery,
-	stateProvider StateProvider, tempDir string) *syncer {
-	return &syncer{
+func newSyncer(config *cfg.StateSyncConfig, logger log.Logger, conn proxy.AppConnSnapshot,
+	connQuery proxy.AppConnQuery, stateProvider StateProvider, tempDir string,
+	options ...syncerOption) *syncer {
+	s := &syncer{
+		config:        config,
 		logger:        logger,
 		stateProvider: stateProvider,
 		conn:          conn,
 		connQuery:     connQuery,
 		snapshots:     newSnapshotPool(stateProvider),
 		tempDir:       tempDir,
+		peerSelector:  randomPeerSelector{},
+		peerFilter:    acceptAllPeers{},
+		verifier:      sha256ChunkVerifier{},
+		hello:         func() *ssproto.Hello { return makeHello(config) },
+		metrics:       NopMetrics(),
+		tracer:        NopTracer(),
+		ctx:           context.Background(),
+		traceRoot:     context.Background(),
+		downloads:     newDownloadLimiter(config.MaxDownloadRate),
+		readvertised:  newReadvertisementFilter(),
+		diskFree:      freeDiskSpace,
+		formats:       newFormatHorizon(nil),
+		stale:         newStaleChunks(config.StragglerChunkWindow),
+		expected:      newExpectedSnapshot(config),
+	}
+	if stateProvider != nil && config.StateProviderFailureThreshold > 0 {
+		s.breaker = newBreakerStateProvider(stateProvider, config.StateProviderFailureThreshold,
+			config.StateProviderCooldown, logger)
+		s.stateProvider = s.breaker
+		s.snapshots = newSnapshotPool(s.breaker)
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if config.LatencyTieBreak {
+		s.snapshots.latencies = s.latencies
+	}
+	s.snapshots.expected = s.expected
+	if config.MaxSnapshotsPerPeer > 0 {
+		s.snapshots.maxPerPeer = config.MaxSnapshotsPerPeer
+	}
+	if len(config.FormatPriority) > 0 {
+		s.snapshots.formatRank = make(map[uint32]int, len(config.FormatPriority))
+		for rank, format := range config.FormatPriority {
+			s.snapshots.formatRank[format] = rank
+		}
 	}
+	return s
 }
 
 // AddChunk adds a chunk to the chunk queue, if any. It returns false if the chunk has already
-// been added to the queue, or an error if there's no sync in progress.
+// been added to the queue, or an error if there's no sync in progress. Duplicate chunks, e.g. when
+// several peers respond to a retried chunk request, are ignored: the first one received is kept,
+// and will be applied once.
 func (s *syncer) AddChunk(chunk *chunk) (bool, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
+	if s.closed {
+		return false, errSyncEnded
+	}
 	if s.chunks == nil {
 		return false, errors.New("no state sync in progress")
 	}
+	if max := maxChunkSize(s.config); len(chunk.Chunk) > max {
+		return false, fmt.Errorf("%w: %v bytes exceeds limit %v", errChunkTooLarge, len(chunk.Chunk), max)
+	}
+	s.downloads.Consume(len(chunk.Chunk))
+	if s.stale.Discard(chunk) {
+		s.chunkLogger().Debug("Discarding chunk requested by a previous restore", "height", chunk.Height,
+			"format", chunk.Format, "chunk", chunk.Index, "peer", chunk.Sender)
+		s.metrics.StragglerChunks.Add(1)
+		return false, nil
+	}
+	if err := s.verifyChunkProof(chunk); err != nil {
+		return false, err
+	}
 	added, err := s.chunks.Add(chunk)
 	if err != nil {
 		return false, err
 	}
 	if added {
-		s.logger.Debug("Added chunk to queue", "height", chunk.Height, "format", chunk.Format,
+		s.pipeline.Downloaded(len(chunk.Chunk))
+		if fetchTime, ok := s.pipeline.Received(chunk.Index); ok {
+			s.latencies.Observe(chunk.Sender, fetchTime)
+			s.reputation.Succeeded(chunk.Sender, fetchTime)
+		}
+		s.chunkLogger().Debug("Added chunk to queue", "height", chunk.Height, "format", chunk.Format,
 			"chunk", chunk.Index)
 	} else {
-		s.logger.Debug("Ignoring duplicate chunk in queue", "height", chunk.Height, "format", chunk.Format,
-			"chunk", chunk.Index)
+		s.chunkLogger().Debug("Ignoring duplicate chunk in queue", "height", chunk.Height, "format", chunk.Format,
+			"chunk", chunk.Index, "peer", chunk.Sender)
+		s.metrics.DuplicateChunks.Add(1)
+		s.metrics.DuplicateChunkBytes.Add(float64(len(chunk.Chunk)))
 	}
 	return added, nil
 }
 
+// Close closes the syncer once its state sync has ended, waiting for any chunks being added to
+// return. Snapshots, chunks and peer changes fed to a closed syncer are then ignored, such that
+// callers still holding it, e.g. message handlers racing the end of the sync, don't act on the
+// state of a sync which has been torn down.
+func (s *syncer) Close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+}
+
+// isClosed checks whether the syncer was closed via Close().
+func (s *syncer) isClosed() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.closed
+}
+
+// HasChunks checks whether the syncer is currently restoring the given snapshot, and thus
+// accepting chunks for it.
+func (s *syncer) HasChunks(height uint64, format uint32) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return !s.closed && s.chunks != nil && s.chunks.Matches(height, format)
+}
+
+// IsRestoring checks whether the syncer is currently restoring a snapshot at the given height.
+func (s *syncer) IsRestoring(height uint64) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.chunks == nil {
+		return false
+	}
+	snapshot := s.chunks.Snapshot()
+	return snapshot != nil && snapshot.Height == height
+}
+
 // AddSnapshot adds a snapshot to the snapshot pool. It returns true if a new, previously unseen
-// snapshot was accepted and added.
+// snapshot was accepted and added. Snapshots in formats not enabled via restore_formats are ignored,
+// as are advertisements which the peer re-sent unchanged since they were recently processed.
 func (s *syncer) AddSnapshot(peer p2p.Peer, snapshot *snapshot) (bool, error) {
+	if s.isClosed() {
+		return false, errSyncEnded
+	}
+	if s.readvertised.Redundant(peer.ID(), snapshot) {
+		s.metrics.RedundantSnapshots.Add(1)
+		s.logger.Debug("Skipping snapshot recently advertised by peer", "height", snapshot.Height,
+			"format", snapshot.Format, "peer", peer.ID())
+		return false, nil
+	}
+	if !s.config.RestoresFormat(snapshot.Format) {
+		s.logger.Debug("Ignoring snapshot in format not enabled for restore", "height", snapshot.Height,
+			"format", snapshot.Format, "peer", peer.ID())
+		return false, nil
+	}
+	if s.skipsFutureFormat(snapshot.Format) {
+		s.logger.Debug("Ignoring snapshot in format newer than app", "height", snapshot.Height,
+			"format", snapshot.Format, "peer", peer.ID())
+		return false, nil
+	}
+	if s.expected.Required() && !s.expected.Matches(snapshot) {
+		s.logger.Debug("Ignoring snapshot not matching expected snapshot", "height", snapshot.Height,
+			"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash), "peer", peer.ID())
+		return false, nil
+	}
+	if s.peerFilter.FilterPeer(peer) == PeerExcluded {
+		s.logger.Debug("Ignoring snapshot from excluded peer", "height", snapshot.Height,
+			"format", snapshot.Format, "peer", peer.ID())
+		return false, nil
+	}
+	if snapshot.BaseHeight > 0 && !s.usableDiff(snapshot) {
+		return false, nil
+	}
 	added, err := s.snapshots.Add(peer, snapshot)
 	if err != nil {
 		return false, err
 	}
+	s.readvertised.Processed(peer.ID(), snapshot)
 	if added {
 		s.logger.Info("Discovered new snapshot", "height", snapshot.Height, "format", snapshot.Format,
 			"hash", fmt.Sprintf("%X", snapshot.Hash))
+		s.notifyAvailable(snapshot)
 	}
 	return added, nil
 }
 
+// notifyAvailable notifies onAvailable of a usable snapshot, if not already done for this sync.
+func (s *syncer) notifyAvailable(snapshot *snapshot) {
+	if s.onAvailable == nil {
+		return
+	}
+	s.mtx.Lock()
+	notify := !s.available
+	s.available = true
+	s.mtx.Unlock()
+	if notify {
+		s.onAvailable(snapshot.Height, snapshot.Format)
+	}
+}
+
+// usableDiff checks whether a differential snapshot can be restored, i.e. whether diff snapshots
+// are enabled and the app is at the diff's base height, as queried by loadAppHeight(). This is
+// called from the reactor's message handler, so it mustn't query the app itself.
+func (s *syncer) usableDiff(snapshot *snapshot) bool {
+	if !s.config.DiffSnapshots {
+		return false
+	}
+	s.mtx.RLock()
+	appHeight := s.appHeight
+	s.mtx.RUnlock()
+	if appHeight == nil {
+		s.logger.Debug("Ignoring diff snapshot, app height not known", "height", snapshot.Height,
+			"format", snapshot.Format, "base", snapshot.BaseHeight)
+		return false
+	}
+	if *appHeight != snapshot.BaseHeight {
+		s.logger.Debug("Ignoring diff snapshot for other base height", "height", snapshot.Height,
+			"format", snapshot.Format, "base", snapshot.BaseHeight, "appHeight", *appHeight)
+		return false
+	}
+	return true
+}
+
+// loadAppHeight queries the app for its height, which diff snapshots must be based on, if diff
+// snapshots are enabled and the height wasn't queried yet. It must be called before snapshots are
+// discovered, since usableDiff() ignores diff snapshots until then.
+func (s *syncer) loadAppHeight() error {
+	if !s.config.DiffSnapshots || s.connQuery == nil {
+		return nil
+	}
+	s.mtx.RLock()
+	loaded := s.appHeight != nil
+	s.mtx.RUnlock()
+	if loaded {
+		return nil
+	}
+	resp, err := s.connQuery.InfoSync(proxy.RequestInfo)
+	if err != nil {
+		return fmt.Errorf("failed to query ABCI app for height: %w", err)
+	}
+	if resp.LastBlockHeight < 0 {
+		return fmt.Errorf("ABCI app reported negative height %v", resp.LastBlockHeight)
+	}
+	height := uint64(resp.LastBlockHeight)
+	s.mtx.Lock()
+	s.appHeight = &height
+	s.mtx.Unlock()
+	return nil
+}
+
+// Rediscover checks whether snapshot requests should be re-broadcast to all peers after
+// discovering a new snapshot at the given height. This is the case if the height is higher than
+// any snapshot discovered so far and no snapshot is being restored, unless a re-broadcast was
+// already done within the rebroadcast interval.
+func (s *syncer) Rediscover(height uint64) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return false
+	}
+	higher := s.highestSeen > 0 && height > s.highestSeen
+	if height > s.highestSeen {
+		s.highestSeen = height
+	}
+	interval := s.config.DiscoveryRebroadcastInterval
+	switch {
+	case !higher || interval == 0 || s.chunks != nil:
+		return false
+	case !s.lastRediscovery.IsZero() && time.Since(s.lastRediscovery) < interval:
+		return false
+	}
+	s.lastRediscovery = time.Now()
+	return true
+}
+
+// discoveryTime returns the time to spend discovering snapshots. If adaptive discovery is enabled,
+// this depends on the number of connected peers, otherwise the given fixed time is used.
+func (s *syncer) discoveryTime(fixed time.Duration) time.Duration {
+	if !s.config.DiscoveryTimeAdaptive {
+		return fixed
+	}
+	peers := 0
+	if s.peerCount != nil {
+		peers = s.peerCount()
+	}
+	return adaptiveDiscoveryTime(peers, s.config.DiscoveryTimeMin, s.config.DiscoveryTimeMax)
+}
+
+// discover waits for the given time to discover snapshots.
+func (s *syncer) discover(discoveryTime time.Duration) {
+	_, span := s.tracer.StartSpan(s.traceRoot, SpanDiscovery, "duration", discoveryTime)
+	s.logger.Info(fmt.Sprintf("Discovering snapshots for %v", discoveryTime))
+	timer := time.NewTimer(discoveryTime)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		span.End(nil)
+	case <-s.ctx.Done():
+		span.End(s.ctx.Err())
+	}
+}
+
+// extendDiscovery keeps discovering snapshots for up to discovery_extension_max, returning as soon
+// as a snapshot is discovered. It returns false if the extension is disabled, or if the state
+// provider's breaker is open such that discovered snapshots couldn't be verified anyway.
+func (s *syncer) extendDiscovery() bool {
+	max := s.config.DiscoveryExtensionMax
+	if max == 0 || s.breaker.Err() != nil {
+		return false
+	}
+	peers := 0
+	if s.peerCount != nil {
+		peers = s.peerCount()
+	}
+	s.logger.Info(fmt.Sprintf("No snapshots discovered yet, extending discovery for up to %v while peers connect",
+		max), "peers", peers)
+	_, span := s.tracer.StartSpan(s.traceRoot, SpanDiscovery, "duration", max, "extended", true)
+	deadline := time.Now().Add(max)
+	for s.snapshots.Best() == nil && time.Now().Before(deadline) && s.ctx.Err() == nil {
+		time.Sleep(discoveryExtensionPoll)
+	}
+	span.End(nil)
+	return true
+}
+
+// adaptiveDiscoveryTime scales the discovery time inversely with the number of peers, as max
+// divided by the peer count but no less than min.
+func adaptiveDiscoveryTime(peers int, min, max time.Duration) time.Duration {
+	discoveryTime := max
+	if peers > 1 {
+		discoveryTime = max / time.Duration(peers)
+	}
+	if discoveryTime < min {
+		discoveryTime = min
+	}
+	return discoveryTime
+}
+
 // AddPeer adds a peer to the pool. For now we just keep it simple and send a single request
 // to discover snapshots, later we may want to do retries and stuff.
 func (s *syncer) AddPeer(peer p2p.Peer) {
 	s.logger.Debug("Requesting snapshots from peer", "peer", peer.ID())
-	peer.Send(SnapshotChannel, mustEncodeMsg(&ssproto.SnapshotsRequest{}))
+	peer.Send(SnapshotChannel, mustEncodeMsg(&ssproto.SnapshotsRequest{Hello: s.hello()}))
 }
 
-// RemovePeer removes a peer from the pool.
-func (s *syncer) RemovePeer(peer p2p.Peer) {
-	s.logger.Debug("Removing peer from sync", "peer", peer.ID())
-	s.snapshots.RemovePeer(peer.ID())
+// RemovePeer removes a peer from the pool for the given reason.
+func (s *syncer) RemovePeer(peer p2p.Peer, reason string) {
+	if s.isClosed() {
+		return
+	}
+	s.logger.Debug("Removing peer from sync", "peer", peer.ID(), "reason", reason)
+	s.snapshots.RemovePeer(peer.ID(), reason)
+	s.readvertised.RemovePeer(peer.ID())
+}
+
+// ReturnPeer resumes a peer which reconnected within peer_reconnect_grace, retaining its snapshots
+// and active peer slot. Its chunk requests in flight were lost with the connection, so they are
+// sent again to the reconnected peer, rather than timing out and being rescheduled.
+func (s *syncer) ReturnPeer(peer p2p.Peer) {
+	s.mtx.RLock()
+	chunks, requests, closed := s.chunks, s.requests, s.closed
+	s.mtx.RUnlock()
+	if closed {
+		return
+	}
+	s.snapshots.ReplacePeer(peer)
+	if chunks == nil {
+		return
+	}
+	snapshot := chunks.Snapshot()
+	if snapshot == nil {
+		return
+	}
+	for _, request := range requests.Inspect() {
+		if request.Peer != peer.ID() {
+			continue
+		}
+		s.chunkLogger().Debug("Requesting snapshot chunk again from reconnected peer", "height", snapshot.Height,
+			"format", snapshot.Format, "chunk", request.Index, "peer", peer.ID())
+		peer.Send(ChunkChannel, mustEncodeMsg(&ssproto.ChunkRequest{
+			Height: snapshot.Height,
+			Format: snapshot.Format,
+			Index:  request.Index,
+			Proof:  s.requestsProof(snapshot, peer.ID()),
+		}))
+	}
 }
 
 // SyncAny tries to sync any of the snapshots in the snapshot pool, waiting to discover further
-// snapshots if none were found and discoveryTime > 0. It returns the latest state and block commit
-// which the caller must use to bootstrap the node.
-func (s *syncer) SyncAny(discoveryTime time.Duration) (sm.State, *types.Commit, error) {
-	if discoveryTime > 0 {
-		s.logger.Info(fmt.Sprintf("Discovering snapshots for %v", discoveryTime))
-		time.Sleep(discoveryTime)
+// snapshots if none were found and discoveryTime > 0. If discovery_extension_max is set, discovery
+// is first extended once if no snapshots were found, even if discoveryTime is 0. It returns the
+// latest state and block commit which the caller must use to bootstrap the node, along with
+// details about the restored snapshot. Snapshots below the configured trust height are never
+// restored.
+func (s *syncer) SyncAny(discoveryTime time.Duration) (result *SyncResult, err error) {
+	if s.lifecycle != nil {
+		defer func() {
+			if err != nil {
+				s.lifecycle.SyncAborting(err)
+			} else {
+				s.lifecycle.SyncCompleted(result)
+			}
+		}()
+	}
+	if err := s.checkStateProvider(); err != nil {
+		return nil, err
+	}
+	if err := s.checkQuorum(); err != nil {
+		return nil, err
+	}
+	if err := s.loadAppHeight(); err != nil {
+		return nil, err
+	}
+	ctx, span := s.tracer.StartSpan(s.ctx, SpanSync)
+	defer func() { span.End(err) }()
+	s.traceRoot = ctx
+
+	if discoveryTime = s.discoveryTime(discoveryTime); discoveryTime > s.resumedDiscovery {
+		s.discover(discoveryTime - s.resumedDiscovery)
 	}
 
 	// The app may ask us to retry a snapshot restoration, in which case we need to reuse
 	// the snapshot and chunk queue from the previous loop iteration.
 	var (
-		snapshot *snapshot
-		chunks   *chunkQueue
-		err      error
+		snapshot   *snapshot
+		decision   *SelectDecision
+		chunks     *chunkQueue
+		streamDone <-chan struct{}
+		extended   bool
+		belowTrust error // the last snapshot rejected for being below the trust height, if any
 	)
 	for {
+		if err := s.ctx.Err(); err != nil {
+			s.suspendChunks(chunks)
+			return nil, fmt.Errorf("%v: %w", errInterrupted, err)
+		}
 		// If not nil, we're going to retry restoration of the same snapshot.
 		if snapshot == nil {
-			snapshot = s.snapshots.Best()
+			snapshot, decision = s.snapshots.Select()
 			chunks = nil
 		}
 		if snapshot == nil {
+			if !extended {
+				extended = true
+				if s.extendDiscovery() {
+					continue
+				}
+			}
+			// The expected snapshot is only required once discovery, including any extension, has
+			// had a chance to find it.
+			if s.expected.Required() {
+				return nil, fmt.Errorf("%w: %v", errExpectedSnapshotNotFound, s.expected)
+			}
+			if discoveryTime == 0 && belowTrust != nil {
+				return nil, fmt.Errorf("%v: %w", errNoSnapshots, belowTrust)
+			}
 			if discoveryTime == 0 {
-				return sm.State{}, nil, errNoSnapshots
+				return nil, errNoSnapshots
 			}
-			s.logger.Info(fmt.Sprintf("Discovering snapshots for %v", discoveryTime))
-			time.Sleep(discoveryTime)
+			// Snapshots can't be verified while the state provider's breaker is open, so fail
+			// fast rather than waiting to discover snapshots in vain.
+			if err := s.breaker.Err(); err != nil {
+				return nil, fmt.Errorf("%v: %w", errNoSnapshots, err)
+			}
+			s.discover(s.discoveryTime(discoveryTime))
 			continue
 		}
 		if chunks == nil {
-			chunks, err = newChunkQueue(snapshot, s.tempDir)
+			if err := s.checkTrustHeight(snapshot); err != nil {
+				s.snapshots.Reject(snapshot, RejectReasonBelowTrust)
+				s.logger.Error("Snapshot is below the trusted height, rejected snapshot", "height", snapshot.Height,
+					"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash),
+					"trust_height", s.config.TrustHeight)
+				belowTrust = err
+				snapshot = nil
+				continue
+			}
+			_, vspan := s.tracer.StartSpan(ctx, SpanVerify, "height", snapshot.Height,
+				"format", snapshot.Format, "stage", "quorum")
+			err = s.verifyQuorum(snapshot)
+			vspan.End(err)
+			if err != nil {
+				return nil, err
+			}
+			if s.confirm != nil && !s.confirm(s.snapshots.Info(snapshot)) {
+				s.snapshots.Reject(snapshot, RejectReasonDeclined)
+				s.logger.Info("Snapshot declined by confirmation hook", "height", snapshot.Height,
+					"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash))
+				snapshot = nil
+				continue
+			}
+			s.logSelection(decision)
+			s.startProgress(snapshot, decision)
+			chunks, err = s.newChunkQueue(snapshot)
 			if err != nil {
-				return sm.State{}, nil, fmt.Errorf("failed to create chunk queue: %w", err)
+				return nil, fmt.Errorf("failed to create chunk queue: %w", err)
 			}
 			defer chunks.Close() // in case we forget to close it elsewhere
+			streamDone = s.startStream(snapshot, chunks)
 		}
 
 		newState, commit, err := s.Sync(snapshot, chunks)
 		switch {
 		case err == nil:
-			return newState, commit, nil
+			<-streamDone
+			s.clearRestore()
+			s.logRemovedPeers()
+			return &SyncResult{
+				State:     newState,
+				Commit:    commit,
+				Height:    snapshot.Height,
+				Format:    snapshot.Format,
+				Chunks:    snapshot.Chunks,
+				Hash:      snapshot.Hash,
+				AppHash:   snapshot.trustedAppHash,
+				Peers:     len(s.snapshots.GetPeers(snapshot)),
+				Time:      newState.LastBlockTime,
+				Offers:    s.Progress().Offers,
+				Selection: decision,
+
+				NetworkHeight: s.networkHeight(),
+			}, nil
+
+		case s.ctx.Err() != nil:
+			// Keep the restore record and buffered chunks, for the restore to be resumed.
+			s.suspendChunks(chunks)
+			return nil, fmt.Errorf("%v: %w", errInterrupted, s.ctx.Err())
 
 		case errors.Is(err, errAbort):
-			return sm.State{}, nil, err
+			s.clearRestore()
+			return nil, err
 
 		case errors.Is(err, errRetrySnapshot):
 			chunks.RetryAll()
+			s.resetProgress()
 			s.logger.Info("Retrying snapshot", "height", snapshot.Height, "format", snapshot.Format,
 				"hash", fmt.Sprintf("%X", snapshot.Hash))
 			continue
 
 		case errors.Is(err, errTimeout):
-			s.snapshots.Reject(snapshot)
+			s.snapshots.Reject(snapshot, RejectReasonTimeout)
 			s.logger.Error("Timed out waiting for snapshot chunks, rejected snapshot",
 				"height", snapshot.Height, "format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash))
 
+		case errors.Is(err, errLowThroughput):
+			// The snapshot may well be fine, but its peers are too slow, so look for a better
+			// peer set, which will usually serve other snapshots.
+			s.snapshots.Reject(snapshot, RejectReasonThroughput)
+			s.logger.Error("Snapshot chunk download throughput too low, rejected snapshot and rediscovering",
+				"height", snapshot.Height, "format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash))
+			if s.rediscover != nil {
+				s.rediscover()
+			}
+			if discoveryTime > 0 {
+				s.discover(s.discoveryTime(discoveryTime))
+			}
+
+		case errors.Is(err, errDeadline):
+			s.snapshots.Reject(snapshot, RejectReasonDeadline)
+			s.logger.Error("Snapshot restore deadline exceeded, rejected snapshot", "height", snapshot.Height,
+				"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash))
+
+		case errors.Is(err, errRetryBudget):
+			s.snapshots.Reject(snapshot, RejectReasonRetryBudget)
+			s.metrics.RetryBudgetExhausted.Add(1)
+			s.logger.Error("Snapshot chunk retry budget exhausted, rejected snapshot", "height", snapshot.Height,
+				"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash), "err", err)
+
+		case errors.Is(err, errRefetchLimit):
+			s.snapshots.Reject(snapshot, RejectReasonRefetchLimit)
+			s.logger.Error("Snapshot chunk refetched too many times, rejected snapshot", "height", snapshot.Height,
+				"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash), "err", err)
+
+		case errors.Is(err, errAppHashMismatch) && s.config.AppHashMismatch != "abort":
+			// A bad snapshot is more likely than a bad trust anchor, so try the next one.
+			s.snapshots.Reject(snapshot, RejectReasonAppHash)
+			s.logger.Error("Restored app hash does not match trusted app hash, rejected snapshot",
+				"height", snapshot.Height, "format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash))
+
 		case errors.Is(err, errRejectSnapshot):
-			s.snapshots.Reject(snapshot)
+			s.snapshots.Reject(snapshot, RejectReasonApp)
 			s.logger.Info("Snapshot rejected", "height", snapshot.Height, "format", snapshot.Format,
 				"hash", fmt.Sprintf("%X", snapshot.Hash))
 
 		case errors.Is(err, errRejectFormat):
 			s.snapshots.RejectFormat(snapshot.Format)
 			s.logger.Info("Snapshot format rejected", "format", snapshot.Format)
+			s.rejectFutureFormats(snapshot.Format)
 
 		case errors.Is(err, errRejectSender):
 			s.logger.Info("Snapshot senders rejected", "height", snapshot.Height, "format", snapshot.Format,
 				"hash", fmt.Sprintf("%X", snapshot.Hash))
 			for _, peer := range s.snapshots.GetPeers(snapshot) {
 				s.snapshots.RejectPeer(peer.ID())
+				s.reputation.Failed(peer.ID())
 				s.logger.Info("Snapshot sender rejected", "peer", peer.ID())
 			}
 
 		default:
-			return sm.State{}, nil, fmt.Errorf("snapshot restoration failed: %w", err)
+			return nil, fmt.Errorf("snapshot restoration failed: %w", err)
 		}
 
 		// Discard snapshot and chunks for next iteration
@@ -205,65 +1002,311 @@ func (s *syncer) SyncAny(discoveryTime time.Duration) (sm.State, *types.Commit,
 		if err != nil {
 			s.logger.Error("Failed to clean up chunk queue", "err", err)
 		}
+		s.clearRestore()
 		snapshot = nil
 		chunks = nil
 	}
 }
 
+// logRemovedPeers logs a summary of the peers removed from the sync, by reason.
+func (s *syncer) logRemovedPeers() {
+	counts := make(map[string]int)
+	for _, reason := range s.snapshots.RemovedPeers() {
+		counts[reason]++
+	}
+	if len(counts) == 0 {
+		return
+	}
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	keyvals := make([]interface{}, 0, 2*len(reasons))
+	for _, reason := range reasons {
+		keyvals = append(keyvals, reason, counts[reason])
+	}
+	s.logger.Info("Peers removed during state sync", keyvals...)
+}
+
+// chunkLogger returns the logger for per-chunk events, which logs them at info level while
+// verbose chunk logging is enabled.
+func (s *syncer) chunkLogger() log.Logger {
+	return verboseLogger{Logger: s.logger, verbose: s.verboseChunks}
+}
+
+// checkTrustHeight checks that a snapshot isn't below the configured trust height, if any. Such
+// snapshots can't be verified against the trust anchor, and may be part of a long-range attack.
+func (s *syncer) checkTrustHeight(snapshot *snapshot) error {
+	if s.config.TrustHeight <= 0 || snapshot.Height >= uint64(s.config.TrustHeight) {
+		return nil
+	}
+	return fmt.Errorf("%w: snapshot height %v, trust height %v", errBelowTrustHeight, snapshot.Height,
+		s.config.TrustHeight)
+}
+
+// checkStateProvider checks that the state provider is present and, if it supports it, available.
+// The state provider is needed both to verify snapshots and to bootstrap the node from them, so
+// there's no point in syncing without it.
+func (s *syncer) checkStateProvider() error {
+	if s.stateProvider == nil {
+		return errNoStateProvider
+	}
+	checker, ok := s.stateProvider.(StateProviderChecker)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+	err := checker.CheckAvailable(ctx)
+	switch {
+	case err == nil:
+		return nil
+	case s.ctx.Err() != nil:
+		return fmt.Errorf("%v: %w", errInterrupted, s.ctx.Err())
+	default:
+		return fmt.Errorf("state provider is unavailable, refusing to sync since snapshots can't be "+
+			"verified against the trusted chain and could contain arbitrary application state: %w", err)
+	}
+}
+
+// networkHeight returns the best-known network height from the state provider, or 0 if the
+// provider doesn't report it or failed to.
+func (s *syncer) networkHeight() uint64 {
+	reporter, ok := s.stateProvider.(StateProviderNetworkHeight)
+	if !ok {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	height, err := reporter.NetworkHeight(ctx)
+	if err != nil {
+		s.logger.Debug("Failed to fetch network height from state provider", "err", err)
+		return 0
+	}
+	return height
+}
+
+// newChunkQueue creates a chunk queue for a snapshot. If a temp dir is configured, chunks are
+// buffered in a fixed directory within it, such that a restore of the same snapshot can resume
+// with the chunks fetched before a restart. These are verified against their checksums first, and
+// corrupt chunks are discarded to be refetched.
+func (s *syncer) newChunkQueue(snapshot *snapshot) (*chunkQueue, error) {
+	if s.tempDir == "" {
+		return newChunkQueue(snapshot, "")
+	}
+	dir := filepath.Join(s.tempDir, restoreChunksDir)
+	record, err := s.loadRestore()
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || !record.Matches(snapshot) {
+		// Chunks for any other snapshot are useless, so start from scratch.
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, fmt.Errorf("failed to remove buffered chunks: %w", err)
+		}
+	}
+	chunks, corrupt, err := resumeChunkQueue(snapshot, dir, s.verifier)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range corrupt {
+		s.logger.Error("Discarded corrupt buffered snapshot chunk, refetching", "height", snapshot.Height,
+			"format", snapshot.Format, "chunk", index)
+	}
+	if resumed := len(chunks.chunkFiles); resumed > 0 || len(corrupt) > 0 {
+		s.logger.Info("Resuming snapshot restore with buffered chunks", "height", snapshot.Height,
+			"format", snapshot.Format, "chunks", resumed, "corrupt", len(corrupt))
+	}
+	return chunks, nil
+}
+
+// startStream starts streaming the snapshot to the stream function, if any. It returns a channel
+// that is closed when the stream function returns, which is already closed if there is none.
+func (s *syncer) startStream(snapshot *snapshot, chunks *chunkQueue) <-chan struct{} {
+	done := make(chan struct{})
+	if s.streamFunc == nil {
+		close(done)
+		return done
+	}
+	reader := chunks.NewReader()
+	go func() {
+		defer close(done)
+		s.streamFunc(snapshot.Height, snapshot.Format, reader)
+	}()
+	return done
+}
+
 // Sync executes a sync for a specific snapshot, returning the latest state and block commit which
 // the caller must use to bootstrap the node.
-func (s *syncer) Sync(snapshot *snapshot, chunks *chunkQueue) (sm.State, *types.Commit, error) {
+func (s *syncer) Sync(snapshot *snapshot, chunks *chunkQueue) (_ sm.State, _ *types.Commit, err error) {
 	s.mtx.Lock()
 	if s.chunks != nil {
 		s.mtx.Unlock()
 		return sm.State{}, nil, errors.New("a state sync is already in progress")
 	}
+	trace, span := s.tracer.StartSpan(s.traceRoot, SpanSnapshot, "height", snapshot.Height,
+		"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash))
+	defer func() { span.End(err) }()
+	s.trace = trace
 	s.chunks = chunks
+	if s.budget == nil || s.budget.key != snapshot.Key() {
+		s.budget = newRetryBudget(snapshot, s.config.ChunkRetryBudget, s.config.ChunkRefetchLimit)
+		s.active = newActivePeerSet(s.config.MaxActivePeers, s.latencies)
+	}
+	budget := s.budget
+	pipeline := newPipelineStats(s.metrics)
+	s.pipeline = pipeline
+	s.requests = newChunkRequests()
 	s.mtx.Unlock()
 	defer func() {
 		s.mtx.Lock()
 		s.chunks = nil
+		s.pipeline = nil
+		s.requests = nil
+		s.trace = nil
 		s.mtx.Unlock()
+		s.metrics.ChunkRequestsInFlight.Set(0)
+		s.metrics.RestoreThroughput.Set(0)
 	}()
 
+	// Never restore into the live app when only verifying the snapshot.
+	if s.verifyOnly && s.staging == nil {
+		return sm.State{}, nil, errVerifyNoStagingApp
+	}
+
+	// Refuse to restore the snapshot if it won't fit on disk, if its size can be estimated.
+	diskChecked, err := s.checkDiskSpace(snapshot, chunks)
+	if err != nil {
+		return sm.State{}, nil, err
+	}
+
+	// Restore into the staging app instead of the live app, if enabled.
+	closeStaging, err := s.openStaging()
+	if err != nil {
+		return sm.State{}, nil, err
+	}
+	defer closeStaging()
+
 	// Offer snapshot to ABCI app.
-	err := s.offerSnapshot(snapshot)
+	err = s.offerSnapshot(snapshot)
 	if err != nil {
 		return sm.State{}, nil, err
 	}
 
-	// Spawn chunk fetchers. They will terminate when the chunk queue is closed or context cancelled.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Spawn chunk fetchers. They will terminate when the chunk queue is closed or context cancelled,
+	// which happens when the restore is finalized.
+	ctx, cancel := context.WithCancel(trace)
+	var fetchers sync.WaitGroup
+	defer s.finalizeRestore(snapshot, cancel, &fetchers)
 	for i := int32(0); i < chunkFetchers; i++ {
-		go s.fetchChunks(ctx, snapshot, chunks)
+		fetchers.Add(1)
+		go func() {
+			defer fetchers.Done()
+			s.fetchChunks(ctx, snapshot, chunks)
+		}()
 	}
 
-	pctx, pcancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer pcancel()
-
 	// Optimistically build new state, so we don't discover any light client failures at the end.
-	state, err := s.stateProvider.State(pctx, snapshot.Height)
-	if err != nil {
-		return sm.State{}, nil, fmt.Errorf("failed to build new state: %w", err)
-	}
-	commit, err := s.stateProvider.Commit(pctx, snapshot.Height)
+	state, commit, err := s.fetchState(trace, snapshot)
 	if err != nil {
-		return sm.State{}, nil, fmt.Errorf("failed to fetch commit: %w", err)
+		return sm.State{}, nil, err
 	}
 
-	// Restore snapshot
-	err = s.applyChunks(chunks)
+	// Restore snapshot, giving up if the watchdogs find that the restoration has stalled or missed
+	// its deadline. The chunk applier terminates once the chunk queue is closed, which is done
+	// when giving up, waiting for it to return.
+	// If the app connection is lost, we reconnect and re-offer the snapshot, resuming with the
+	// chunk that failed to apply.
+	s.markApplied()
+	pipeline.Start()
+	stalled := s.watchStalls(ctx, snapshot, chunks)
+	expired := s.watchDeadline(ctx, snapshot)
+	slow := s.watchThroughput(ctx, snapshot, chunks, pipeline)
+	diskFull := s.watchDiskSpace(ctx, snapshot, chunks, diskChecked)
+	// If the app hash doesn't match, we try to heal the snapshot by refetching the chunks which
+	// don't match their expected hashes, if any, and re-applying it.
+	reconnects, heals := 0, 0
+	for {
+		for {
+			applied := make(chan error, 1)
+			go func() {
+				applied <- s.applyChunks(chunks)
+			}()
+			running := true
+			select {
+			case err = <-applied:
+				running = false
+			case <-stalled:
+				s.logger.Error("State sync stalled, no chunks applied", "height", snapshot.Height,
+					"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash),
+					"timeout", s.config.StallTimeout)
+				err = ErrStalled
+			case <-expired:
+				err = errDeadline
+			case <-slow:
+				err = errLowThroughput
+			case err = <-diskFull:
+			case <-ctx.Done():
+				err = s.interruptRestore(ctx, snapshot, chunks, applied)
+				running = false
+			case <-budget.Exhausted():
+				err = budget.Err()
+			}
+			if running {
+				s.stopApplier(chunks, cancel, applied)
+			}
+			if !errors.Is(err, errAppConnection) {
+				break
+			}
+			if err = s.reconnectApp(snapshot, err, &reconnects); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			return sm.State{}, nil, err
+		}
+		pipeline.Log(s.logger, snapshot)
+
+		// Verify app and update app version, and verify that the commit matches the state, so the
+		// caller doesn't store an inconsistent pair.
+		_, vspan := s.tracer.StartSpan(trace, SpanVerify, "height", snapshot.Height,
+			"format", snapshot.Format, "stage", "app")
+		var appVersion uint64
+		appVersion, err = s.verifyApp(snapshot)
+		if err == nil {
+			state.Version.Consensus.App = appVersion
+			err = s.verifyCommit(snapshot, state, commit)
+		}
+		vspan.End(err)
+		if !errors.Is(err, errAppHashMismatch) || heals >= chunkHealAttempts {
+			break
+		}
+		heals++
+		healed, herr := s.healChunks(snapshot, chunks)
+		if herr != nil {
+			s.logger.Error("Failed to heal snapshot", "height", snapshot.Height, "format", snapshot.Format,
+				"hash", fmt.Sprintf("%X", snapshot.Hash), "err", herr)
+		}
+		if !healed {
+			break
+		}
+	}
 	if err != nil {
+		if s.verified != nil {
+			s.verified.Remove(snapshot.Height, snapshot.trustedAppHash)
+		}
 		return sm.State{}, nil, err
 	}
-
-	// Verify app and update app version
-	appVersion, err := s.verifyApp(snapshot)
+	if s.verifyOnly {
+		s.logger.Info("Snapshot verified, discarding it", "height", snapshot.Height, "format", snapshot.Format,
+			"hash", fmt.Sprintf("%X", snapshot.Hash))
+		return state, commit, nil
+	}
+	state.Version.Consensus.App, err = s.promoteStaging(snapshot, state.Version.Consensus.App)
 	if err != nil {
 		return sm.State{}, nil, err
 	}
-	state.Version.Consensus.App = appVersion
 
 	// Done! 🎉
 	s.logger.Info("Snapshot restored", "height", snapshot.Height, "format", snapshot.Format,
@@ -272,28 +1315,90 @@ func (s *syncer) Sync(snapshot *snapshot, chunks *chunkQueue) (sm.State, *types.
 	return state, commit, nil
 }
 
+// fetchState fetches the state and commit at the snapshot height from the state provider, or
+// reuses them if already verified by a previous sync.
+func (s *syncer) fetchState(trace context.Context, snapshot *snapshot) (_ sm.State, _ *types.Commit, err error) {
+	trust := verificationTrust{
+		height: s.config.TrustHeight,
+		hash:   s.config.TrustHash,
+		period: s.config.TrustPeriod,
+	}
+	if s.verified != nil {
+		if state, commit, ok := s.verified.Get(trust, snapshot.Height, snapshot.trustedAppHash); ok {
+			s.metrics.VerificationCacheHits.Add(1)
+			s.logger.Info("Reusing previously verified state", "height", snapshot.Height)
+			return state, commit, nil
+		}
+		s.metrics.VerificationCacheMisses.Add(1)
+	}
+
+	ctx, span := s.tracer.StartSpan(trace, SpanVerify, "height", snapshot.Height,
+		"format", snapshot.Format, "stage", "state")
+	defer func() { span.End(err) }()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	state, err := s.stateProvider.State(ctx, snapshot.Height)
+	if err != nil {
+		return sm.State{}, nil, fmt.Errorf("failed to build new state: %w", err)
+	}
+	commit, err := s.stateProvider.Commit(ctx, snapshot.Height)
+	if err != nil {
+		return sm.State{}, nil, fmt.Errorf("failed to fetch commit: %w", err)
+	}
+	if s.verified != nil {
+		s.verified.Put(trust, snapshot.Height, snapshot.trustedAppHash, state, commit)
+	}
+	return state, commit, nil
+}
+
 // offerSnapshot offers a snapshot to the app. It returns various errors depending on the app's
 // response, or nil if the snapshot was accepted.
+//
+// If the snapshot was accepted by the app before a restart, i.e. when resuming a restore, we
+// verify that the trusted app hash is unchanged and that the app accepts it again, aborting if not
+// since the app's partial state may otherwise be inconsistent with the restore. The restore record
+// is kept in this case, such that the operator must explicitly clear the temp dir. Snapshots
+// re-offered within the same run, e.g. when retrying or healing a restore, are handled as usual.
 func (s *syncer) offerSnapshot(snapshot *snapshot) error {
+	record, err := s.loadRestore()
+	if err != nil {
+		return err
+	}
+	reoffer := record != nil && record.Matches(snapshot)
+	resumed := reoffer && s.restoreResumed
+	if resumed {
+		if err := record.Verify(snapshot); err != nil {
+			return err
+		}
+	}
+
+	if err := s.throttleOffer(); err != nil {
+		return err
+	}
 	s.logger.Info("Offering snapshot to ABCI app", "height", snapshot.Height,
-		"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash))
+		"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash), "base", snapshot.BaseHeight,
+		"reoffer", reoffer)
 	resp, err := s.conn.OfferSnapshotSync(abci.RequestOfferSnapshot{
-		Snapshot: &abci.Snapshot{
-			Height:   snapshot.Height,
-			Format:   snapshot.Format,
-			Chunks:   snapshot.Chunks,
-			Hash:     snapshot.Hash,
-			Metadata: snapshot.Metadata,
-		},
-		AppHash: snapshot.trustedAppHash,
+		Snapshot: snapshot.abciSnapshot(),
+		AppHash:  snapshot.trustedAppHash,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to offer snapshot: %w", err)
 	}
+	if resumed && resp.Result != abci.ResponseOfferSnapshot_ACCEPT {
+		return fmt.Errorf("%w: app responded %v to re-offered snapshot, its state may have been "+
+			"wiped or modified", errRestoreMismatch, resp.Result)
+	}
 	switch resp.Result {
 	case abci.ResponseOfferSnapshot_ACCEPT:
 		s.logger.Info("Snapshot accepted, restoring", "height", snapshot.Height,
 			"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash))
+		s.formats.Accepted(snapshot.Format)
+		s.restoreResumed = false
+		if !reoffer {
+			return s.saveRestore(newRestoreRecord(snapshot))
+		}
 		return nil
 	case abci.ResponseOfferSnapshot_ABORT:
 		return errAbort
@@ -308,6 +1413,76 @@ func (s *syncer) offerSnapshot(snapshot *snapshot) error {
 	}
 }
 
+// loadRestore returns the current restore record, loading it from the temp dir on first use.
+func (s *syncer) loadRestore() (*restoreRecord, error) {
+	if !s.restoreLoaded {
+		record, err := loadRestoreRecord(s.tempDir)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			s.logger.Info("Found previous snapshot restore", "height", record.Height,
+				"format", record.Format, "hash", fmt.Sprintf("%X", record.Hash))
+		}
+		s.restore = record
+		s.restoreLoaded = true
+		s.restoreResumed = record != nil
+	}
+	return s.restore, nil
+}
+
+// saveRestore sets and persists the current restore record.
+func (s *syncer) saveRestore(record *restoreRecord) error {
+	s.restore = record
+	s.restoreLoaded = true
+	s.restoreResumed = false
+	return saveRestoreRecord(s.tempDir, record)
+}
+
+// throttleOffer is called before each snapshot offer. It waits for offer_interval to pass since
+// the previous offer, and fails once max_offers offers have been made.
+func (s *syncer) throttleOffer() error {
+	s.mtx.RLock()
+	offers, lastOffer := s.progress.Offers, s.lastOffer
+	s.mtx.RUnlock()
+	if s.config.MaxOffers > 0 && offers >= s.config.MaxOffers {
+		return fmt.Errorf("%w: %v snapshots offered to the app", errOfferLimit, offers)
+	}
+	if wait := time.Until(lastOffer.Add(s.config.OfferInterval)); offers > 0 && wait > 0 {
+		s.logger.Debug("Waiting before offering next snapshot", "wait", wait)
+		time.Sleep(wait)
+	}
+	s.mtx.Lock()
+	s.progress.Offers++
+	s.lastOffer = time.Now()
+	s.mtx.Unlock()
+	return nil
+}
+
+// clearRestore clears the current restore record, once the restore is complete or abandoned.
+func (s *syncer) clearRestore() {
+	s.restore = nil
+	s.restoreLoaded = true
+	s.restoreResumed = false
+	if err := removeRestoreRecord(s.tempDir); err != nil {
+		s.logger.Error("Failed to remove snapshot restore record", "err", err)
+	}
+}
+
+// stopApplier stops the chunk applier of a restore given up on by a watchdog, by closing the chunk
+// queue, and waits for it to return. The chunk being applied by the app, if any, is applied in
+// full, but no further chunks are, such that chunks of an abandoned snapshot can't be applied on
+// top of the next snapshot offered on the same connection. The chunk fetchers are cancelled first,
+// such that their requests in flight are left to be recorded as stale rather than completed by
+// the queue closing.
+func (s *syncer) stopApplier(chunks *chunkQueue, cancelFetchers func(), applied <-chan error) {
+	cancelFetchers()
+	if err := chunks.Close(); err != nil {
+		s.logger.Error("Failed to clean up chunk queue", "err", err)
+	}
+	<-applied
+}
+
 // applyChunks applies chunks to the app. It returns various errors depending on the app's
 // response, or nil once the snapshot is fully restored.
 func (s *syncer) applyChunks(chunks *chunkQueue) error {
@@ -319,29 +1494,60 @@ func (s *syncer) applyChunks(chunks *chunkQueue) error {
 			return fmt.Errorf("failed to fetch chunk: %w", err)
 		}
 
+		pipeline := s.currentPipeline()
+		pipeline.Applying(chunk.Index)
+		_, span := s.tracer.StartSpan(s.currentTrace(), SpanChunkApply, "chunk", chunk.Index,
+			"size", len(chunk.Chunk))
+		start := time.Now()
 		resp, err := s.conn.ApplySnapshotChunkSync(abci.RequestApplySnapshotChunk{
 			Index:  chunk.Index,
 			Chunk:  chunk.Chunk,
 			Sender: string(chunk.Sender),
 		})
-		if err != nil {
+		applyTime := time.Since(start)
+		if slow, average := pipeline.Applied(chunk.Index, applyTime); slow {
+			s.logger.Error("App is applying snapshot chunks much slower than before, it may be struggling "+
+				"e.g. due to I/O pressure", "chunk", chunk.Index, "apply_time", applyTime, "avg_apply", average)
+		}
+		if err == nil && resp.Result != abci.ResponseApplySnapshotChunk_ACCEPT {
+			span.End(fmt.Errorf("app responded %v", resp.Result))
+		} else {
+			span.End(err)
+		}
+		if err != nil && s.conn.Error() != nil {
+			chunks.Retry(chunk.Index)
+			return fmt.Errorf("%w: failed to apply chunk %v: %v", errAppConnection, chunk.Index, err)
+		} else if err != nil {
 			return fmt.Errorf("failed to apply chunk %v: %w", chunk.Index, err)
 		}
 		s.logger.Info("Applied snapshot chunk to ABCI app", "height", chunk.Height,
 			"format", chunk.Format, "chunk", chunk.Index, "total", chunks.Size())
+		if resp.Result == abci.ResponseApplySnapshotChunk_ACCEPT {
+			chunks.Accept(chunk.Index)
+			pipeline.Accepted(len(chunk.Chunk))
+			s.markAccepted()
+		}
 
 		// Discard and refetch any chunks as requested by the app
 		for _, index := range resp.RefetchChunks {
+			sender := chunks.GetSender(index)
 			err := chunks.Discard(index)
 			if err != nil {
 				return fmt.Errorf("failed to discard chunk %v: %w", index, err)
 			}
+			if err := s.currentBudget().Refetch(index, sender); err != nil {
+				return err
+			}
+			if err := s.spendRetry(retryReasonRefetch); err != nil {
+				return err
+			}
 		}
 
 		// Reject any senders as requested by the app
 		for _, sender := range resp.RejectSenders {
 			if sender != "" {
 				s.snapshots.RejectPeer(p2p.ID(sender))
+				s.reputation.Failed(p2p.ID(sender))
 				err := chunks.DiscardSender(p2p.ID(sender))
 				if err != nil {
 					return fmt.Errorf("failed to reject sender: %w", err)
@@ -354,6 +1560,9 @@ func (s *syncer) applyChunks(chunks *chunkQueue) error {
 		case abci.ResponseApplySnapshotChunk_ABORT:
 			return errAbort
 		case abci.ResponseApplySnapshotChunk_RETRY:
+			if err := s.spendRetry(retryReasonApply); err != nil {
+				return err
+			}
 			chunks.Retry(chunk.Index)
 		case abci.ResponseApplySnapshotChunk_RETRY_SNAPSHOT:
 			return errRetrySnapshot
@@ -365,10 +1574,295 @@ func (s *syncer) applyChunks(chunks *chunkQueue) error {
 	}
 }
 
+// spendRetry records a chunk retry against the current snapshot's retry budget, returning an
+// error if the budget is exhausted.
+func (s *syncer) spendRetry(reason string) error {
+	s.metrics.ChunkRetries.With("reason", reason).Add(1)
+	return s.currentBudget().Spend(reason)
+}
+
+// currentBudget returns the retry budget for the current snapshot, if any.
+func (s *syncer) currentBudget() *retryBudget {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.budget
+}
+
+// currentTrace returns the tracing context of the current sync, if any.
+func (s *syncer) currentTrace() context.Context {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.trace == nil {
+		return s.traceRoot
+	}
+	return s.trace
+}
+
+// currentActive returns the active peer set for the current snapshot, if any.
+func (s *syncer) currentActive() *activePeerSet {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.active
+}
+
+// currentRequests returns the chunk requests in flight for the sync in progress, if any.
+func (s *syncer) currentRequests() *chunkRequests {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.requests
+}
+
+// AbortChunk aborts the request in flight for a chunk of the snapshot being restored, e.g. when
+// it's stuck on a flaky peer, such that the chunk is requested again, from another peer if
+// possible. The peer is demoted to a backup if max_active_peers is set. Chunks which have already
+// been received or applied can't be aborted, nor can chunks which haven't been requested yet.
+func (s *syncer) AbortChunk(index uint32) error {
+	s.mtx.RLock()
+	chunks, requests, closed := s.chunks, s.requests, s.closed
+	s.mtx.RUnlock()
+	if closed {
+		return errSyncEnded
+	}
+	var snapshot *snapshot
+	if chunks != nil {
+		snapshot = chunks.Snapshot()
+	}
+	if snapshot == nil {
+		return errors.New("no snapshot is being restored")
+	}
+	if index >= snapshot.Chunks {
+		return fmt.Errorf("invalid chunk %v, snapshot has %v chunks", index, snapshot.Chunks)
+	}
+	if chunks.Has(index) {
+		return fmt.Errorf("%w: chunk %v has already been received", errChunkNotInFlight, index)
+	}
+	peerID, ok := requests.Abort(index)
+	if !ok {
+		return fmt.Errorf("%w: chunk %v", errChunkNotInFlight, index)
+	}
+	s.logger.Info("Aborted snapshot chunk request", "height", snapshot.Height, "format", snapshot.Format,
+		"chunk", index, "peer", peerID)
+	return nil
+}
+
+// currentPipeline returns the pipeline stats of the sync in progress, if any.
+func (s *syncer) currentPipeline() *pipelineStats {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.pipeline
+}
+
+// markApplied records that chunk application made progress, resetting the stall watchdog.
+func (s *syncer) markApplied() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lastApplied = time.Now()
+}
+
+// markAccepted records that the app accepted a chunk, resetting the stall watchdog.
+func (s *syncer) markAccepted() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lastApplied = time.Now()
+	s.progress.ChunksApplied++
+}
+
+// startProgress records that a snapshot was selected for restoration.
+func (s *syncer) startProgress(snapshot *snapshot, decision *SelectDecision) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.progress = SyncProgress{
+		Height:         snapshot.Height,
+		Format:         snapshot.Format,
+		Chunks:         snapshot.Chunks,
+		Hash:           snapshot.Hash,
+		SnapshotsTried: s.progress.SnapshotsTried + 1,
+		Offers:         s.progress.Offers,
+		Selection:      decision,
+	}
+}
+
+// logSelection logs why a snapshot was selected for restoration over the runners-up.
+func (s *syncer) logSelection(decision *SelectDecision) {
+	runnersUp := make([]string, 0, len(decision.RunnersUp))
+	for _, c := range decision.RunnersUp {
+		runnersUp = append(runnersUp, fmt.Sprintf("%v/%v (%v peers)", c.Height, c.Format, c.Peers))
+	}
+	s.logger.Info("Selected snapshot", "height", decision.Selected.Height,
+		"format", decision.Selected.Format, "hash", fmt.Sprintf("%X", decision.Selected.Hash),
+		"peers", decision.Selected.Peers, "preferred", decision.Selected.Preferred,
+		"latency", decision.Selected.Latency, "reason", decision.Reason,
+		"candidates", decision.Candidates, "runners_up", runnersUp)
+}
+
+// resetProgress resets the applied chunk count, when the app restarts the snapshot restoration.
+func (s *syncer) resetProgress() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.progress.ChunksApplied = 0
+}
+
+// Progress returns the progress made by SyncAny().
+func (s *syncer) Progress() SyncProgress {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.progress
+}
+
+// EstimatedTimeRemaining estimates the time remaining until the snapshot being restored is
+// restored. See Reactor.EstimatedTimeRemaining().
+func (s *syncer) EstimatedTimeRemaining() (time.Duration, ETAConfidence) {
+	s.mtx.RLock()
+	pipeline := s.pipeline
+	total, applied := s.progress.Chunks, s.progress.ChunksApplied
+	s.mtx.RUnlock()
+	if applied > total {
+		applied = total
+	}
+	return pipeline.Estimate(total-applied, total)
+}
+
+// watchStalls spawns a watchdog which closes the returned channel if no chunk has been applied
+// within the stall timeout while chunk requests are outstanding and the snapshot has peers. The
+// watchdog terminates when the context is cancelled. If the stall timeout is 0, it returns a nil
+// channel which is never closed.
+func (s *syncer) watchStalls(ctx context.Context, snapshot *snapshot, chunks *chunkQueue) <-chan struct{} {
+	timeout := s.config.StallTimeout
+	if timeout <= 0 {
+		return nil
+	}
+	interval := timeout / 4
+	if interval > stallCheckInterval {
+		interval = stallCheckInterval
+	}
+
+	stalled := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			s.mtx.RLock()
+			idle := time.Since(s.lastApplied)
+			s.mtx.RUnlock()
+			if idle >= timeout && chunks.Outstanding() > 0 && len(s.snapshots.GetPeers(snapshot)) > 0 {
+				close(stalled)
+				return
+			}
+		}
+	}()
+	return stalled
+}
+
+// watchDeadline sets the deadline for restoring the snapshot, allowing chunk_time_budget per chunk,
+// and spawns a watchdog which logs a warning if the restore is pacing well behind the deadline,
+// and closes the returned channel once the deadline passes. The watchdog terminates when the
+// context is cancelled. If no deadline applies, it returns a nil channel which is never closed.
+func (s *syncer) watchDeadline(ctx context.Context, snapshot *snapshot) <-chan struct{} {
+	budget := s.config.ChunkTimeBudget
+	if budget <= 0 || snapshot.Chunks == 0 || int64(snapshot.Chunks) > math.MaxInt64/int64(budget) {
+		return nil
+	}
+	total := time.Duration(snapshot.Chunks) * budget
+	start := time.Now()
+	deadline := start.Add(total)
+	s.mtx.Lock()
+	s.progress.Deadline = deadline
+	s.mtx.Unlock()
+	interval := total / 20
+	if interval > stallCheckInterval {
+		interval = stallCheckInterval
+	}
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	expired := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		behind := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := time.Now()
+			if !now.Before(deadline) {
+				close(expired)
+				return
+			}
+			applied := s.Progress().ChunksApplied
+			pacing := float64(now.Sub(start))/float64(total) - float64(applied)/float64(snapshot.Chunks)
+			if pacing > deadlinePacingSlack && !behind {
+				s.logger.Error("State sync is pacing behind the snapshot restore deadline", "height", snapshot.Height,
+					"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash), "applied", applied,
+					"chunks", snapshot.Chunks, "deadline", deadline)
+			}
+			behind = pacing > deadlinePacingSlack
+		}
+	}()
+	return expired
+}
+
+// watchThroughput spawns a watchdog which closes the returned channel if the chunk download
+// throughput stays below min_throughput for a min_throughput_window during which chunk requests
+// were outstanding throughout. The watchdog terminates when the context is cancelled. If no
+// minimum is set, it returns a nil channel which is never closed.
+func (s *syncer) watchThroughput(ctx context.Context, snapshot *snapshot, chunks *chunkQueue,
+	pipeline *pipelineStats) <-chan struct{} {
+	min, window := s.config.MinThroughput, s.config.MinThroughputWindow
+	if min <= 0 || window <= 0 {
+		return nil
+	}
+
+	slow := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		bytes := pipeline.DownloadedBytes()
+		outstanding := chunks.Outstanding() > 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// Once all chunks have been downloaded, e.g. while the app is still applying them,
+			// no throughput is expected.
+			prevBytes, prevOutstanding := bytes, outstanding
+			bytes, outstanding = pipeline.DownloadedBytes(), chunks.Outstanding() > 0
+			if !prevOutstanding || !outstanding {
+				continue
+			}
+			throughput := float64(bytes-prevBytes) / window.Seconds()
+			if throughput < float64(min) {
+				s.logger.Error("Snapshot chunk download throughput below minimum", "height", snapshot.Height,
+					"format", snapshot.Format, "hash", fmt.Sprintf("%X", snapshot.Hash),
+					"throughput", fmt.Sprintf("%.0f B/s", throughput), "min", fmt.Sprintf("%v B/s", min),
+					"window", window, "peers", len(s.snapshots.GetPeers(snapshot)))
+				close(slow)
+				return
+			}
+		}
+	}()
+	return slow
+}
+
 // fetchChunks requests chunks from peers, receiving allocations from the chunk queue. Chunks
-// will be received from the reactor via syncer.AddChunks() to chunkQueue.Add().
+// will be received from the reactor via syncer.AddChunks() to chunkQueue.Add(). Several fetchers
+// run concurrently, and the queue makes sure they never fetch the same chunk at the same time.
 func (s *syncer) fetchChunks(ctx context.Context, snapshot *snapshot, chunks *chunkQueue) {
 	for {
+		// Hold off on further chunk requests while over the download rate cap, if any.
+		if err := s.downloads.Wait(ctx); err != nil {
+			return
+		}
 		index, err := chunks.Allocate()
 		if err == errDone {
 			// Keep checking until the context is cancelled (restore is done), in case any
@@ -376,9 +1870,8 @@ func (s *syncer) fetchChunks(ctx context.Context, snapshot *snapshot, chunks *ch
 			select {
 			case <-ctx.Done():
 				return
-			default:
+			case <-time.After(2 * time.Second):
 			}
-			time.Sleep(2 * time.Second)
 			continue
 		}
 		if err != nil {
@@ -388,56 +1881,282 @@ func (s *syncer) fetchChunks(ctx context.Context, snapshot *snapshot, chunks *ch
 		s.logger.Info("Fetching snapshot chunk", "height", snapshot.Height,
 			"format", snapshot.Format, "chunk", index, "total", chunks.Size())
 
-		ticker := time.NewTicker(chunkRequestTimeout)
-		defer ticker.Stop()
-		s.requestChunk(snapshot, index)
+		timer := time.NewTimer(chunkRequestTimeout)
+		_, span := s.tracer.StartSpan(ctx, SpanChunkFetch, "chunk", index)
+		peerID := s.requestChunk(snapshot, index)
+		requests := s.currentRequests()
+		abort := requests.Start(index, peerID)
 		select {
 		case <-chunks.WaitFor(index):
-		case <-ticker.C:
-			s.requestChunk(snapshot, index)
+			span.End(nil)
+		case <-abort:
+			// Aborted by an operator, so request the chunk again right away without spending the
+			// retry budget.
+			span.End(errChunkAborted)
+			s.currentActive().Fail(peerID)
+			chunks.Release(index)
+		case <-timer.C:
+			span.End(errTimeout)
+			s.reputation.Failed(peerID)
+			if s.currentActive().Fail(peerID) {
+				s.logger.Info("Demoting peer which timed out chunk request to backup", "height", snapshot.Height,
+					"format", snapshot.Format, "chunk", index, "peer", peerID)
+			}
+			if err := s.spendRetry(retryReasonTimeout); err != nil {
+				return
+			}
+			// Release the chunk, such that the next free fetcher claims it and requests it again,
+			// possibly from a different peer. Chunks are claimed lowest index first, so it's
+			// claimed before any chunks following it.
+			chunks.Release(index)
 		case <-ctx.Done():
+			// The request is left in flight, to be recorded as stale when the restore is finalized.
+			timer.Stop()
+			span.End(ctx.Err())
 			return
 		}
-		ticker.Stop()
+		timer.Stop()
+		requests.Done(index, abort)
 	}
 }
 
-// requestChunk requests a chunk from a peer.
-func (s *syncer) requestChunk(snapshot *snapshot, chunk uint32) {
-	peer := s.snapshots.GetPeer(snapshot)
+// requestChunk requests a chunk from a peer, returning the peer's ID, or empty if the snapshot
+// has no peers.
+func (s *syncer) requestChunk(snapshot *snapshot, chunk uint32) p2p.ID {
+	peer := s.selectPeer(snapshot, chunk)
 	if peer == nil {
 		s.logger.Error("No valid peers found for snapshot", "height", snapshot.Height,
 			"format", snapshot.Format, "hash", snapshot.Hash)
-		return
+		return ""
 	}
-	s.logger.Debug("Requesting snapshot chunk", "height", snapshot.Height,
+	s.chunkLogger().Debug("Requesting snapshot chunk", "height", snapshot.Height,
 		"format", snapshot.Format, "chunk", chunk, "peer", peer.ID())
+	s.currentPipeline().Requested(chunk)
+	s.stale.Requested(snapshot, chunk, peer.ID())
 	peer.Send(ChunkChannel, mustEncodeMsg(&ssproto.ChunkRequest{
 		Height: snapshot.Height,
 		Format: snapshot.Format,
 		Index:  chunk,
+		Proof:  s.requestsProof(snapshot, peer.ID()),
 	}))
+	return peer.ID()
+}
+
+// requestsProof checks whether chunks of a snapshot are requested from a peer along with proofs,
+// i.e. whether the chunk proof verifier proves the snapshot and the peer can serve chunk proofs.
+func (s *syncer) requestsProof(snapshot *snapshot, peerID p2p.ID) bool {
+	return s.proofVerifier != nil && s.peerSupports != nil && s.peerSupports(peerID, featureChunkProofs) &&
+		s.proofVerifier.Proves(snapshot.abciSnapshot())
+}
+
+// verifyChunkProof verifies a received chunk against its proof, if it was requested with one. If
+// the proof is missing or invalid, the sender is rejected. The caller must hold the mutex.
+func (s *syncer) verifyChunkProof(chunk *chunk) error {
+	snapshot := s.chunks.Snapshot()
+	if snapshot == nil || chunk.Chunk == nil || chunk.Index >= snapshot.Chunks ||
+		!s.requestsProof(snapshot, chunk.Sender) {
+		return nil
+	}
+	err := errors.New("missing proof")
+	if len(chunk.Proof) > 0 {
+		err = s.proofVerifier.VerifyChunkProof(snapshot.abciSnapshot(), chunk.Index, chunk.Chunk, chunk.Proof)
+	}
+	if err == nil {
+		return nil
+	}
+	s.metrics.InvalidChunkProofs.Add(1)
+	s.snapshots.RejectPeer(chunk.Sender)
+	s.reputation.Failed(chunk.Sender)
+	return fmt.Errorf("%w: chunk %v: %v", errInvalidChunkProof, chunk.Index, err)
+}
+
+// selectPeer selects a peer to request a chunk from using the peer selector, or nil if the
+// snapshot has no peers. Selections outside of the snapshot's peer set are ignored. Peers excluded
+// by the peer filter are never selected, and preferred peers are selected if the snapshot has any.
+// Peers that have already sent a copy of the chunk which the app asked to refetch, or whose request
+// for the chunk was aborted, are avoided if possible, as are peers with a bad reputation if
+// peer_reputation_ttl is set. If max_active_peers is set, only the snapshot's active peers are
+// selected.
+func (s *syncer) selectPeer(snapshot *snapshot, chunk uint32) p2p.Peer {
+	peers := s.reliablePeers(s.filterPeers(s.snapshots.GetPeers(snapshot)))
+	candidates, promoted := s.currentActive().Select(peers)
+	for _, peerID := range promoted {
+		s.logger.Debug("Requesting snapshot chunks from peer", "height", snapshot.Height,
+			"format", snapshot.Format, "peer", peerID)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	budget, requests := s.currentBudget(), s.currentRequests()
+	fresh := make([]p2p.Peer, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !budget.Refetched(chunk, candidate.ID()) && !requests.Aborted(chunk, candidate.ID()) {
+			fresh = append(fresh, candidate)
+		}
+	}
+	if len(fresh) > 0 {
+		candidates = fresh
+	}
+	// Peers which are away, i.e. disconnected within the reconnect grace, are filtered after
+	// selecting the active peers, such that they keep their active slot.
+	present := make([]p2p.Peer, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !s.grace.Away(candidate.ID()) {
+			present = append(present, candidate)
+		}
+	}
+	if len(present) == 0 {
+		return nil
+	}
+	candidates = present
+	peer := s.peerSelector.SelectPeer(snapshot.Height, snapshot.Format, chunk, candidates)
+	if peer != nil {
+		for _, candidate := range candidates {
+			if candidate.ID() == peer.ID() {
+				return candidate
+			}
+		}
+		s.logger.Debug("Peer selector returned unknown peer, using default selection",
+			"height", snapshot.Height, "format", snapshot.Format, "chunk", chunk, "peer", peer.ID())
+	}
+	return randomPeerSelector{}.SelectPeer(snapshot.Height, snapshot.Format, chunk, candidates)
+}
+
+// filterPeers applies the peer filter to the given peers, returning the preferred peers if there
+// are any, otherwise the accepted ones.
+func (s *syncer) filterPeers(peers []p2p.Peer) []p2p.Peer {
+	accepted := make([]p2p.Peer, 0, len(peers))
+	preferred := make([]p2p.Peer, 0, len(peers))
+	for _, peer := range peers {
+		switch s.peerFilter.FilterPeer(peer) {
+		case PeerPreferred:
+			preferred = append(preferred, peer)
+		case PeerAccepted:
+			accepted = append(accepted, peer)
+		}
+	}
+	if len(preferred) > 0 {
+		return preferred
+	}
+	return accepted
+}
+
+// reliablePeers omits peers with a bad reputation, i.e. which failed most of their chunk requests
+// in this or earlier state syncs, unless all of the peers have a bad reputation.
+func (s *syncer) reliablePeers(peers []p2p.Peer) []p2p.Peer {
+	if s.reputation == nil {
+		return peers
+	}
+	reliable := make([]p2p.Peer, 0, len(peers))
+	for _, peer := range peers {
+		if !s.reputation.Unreliable(peer.ID()) {
+			reliable = append(reliable, peer)
+		}
+	}
+	if len(reliable) == 0 {
+		return peers
+	}
+	return reliable
+}
+
+// reconnectApp re-establishes a lost app connection and re-offers the snapshot to the app, such
+// that restoration can resume. It retries until the app accepts the snapshot again, or the number
+// of reconnect attempts for the sync (tracked by attempts) reaches the configured limit, in which
+// case an error is returned. If no reconnect function is given, the existing connections are
+// reused, e.g. for clients which reconnect by themselves.
+func (s *syncer) reconnectApp(snapshot *snapshot, connErr error, attempts *int) error {
+	err := connErr
+	for *attempts < s.config.AppReconnectAttempts {
+		*attempts++
+		s.logger.Error("Lost connection to ABCI app, reconnecting", "height", snapshot.Height,
+			"format", snapshot.Format, "attempt", *attempts, "max", s.config.AppReconnectAttempts,
+			"err", err)
+		time.Sleep(appReconnectBackoff)
+
+		if s.staging != nil {
+			conn, connQuery, rerr := s.staging.Open()
+			if rerr != nil {
+				err = fmt.Errorf("failed to reconnect to staging app: %w", rerr)
+				continue
+			}
+			s.conn, s.connQuery = conn, connQuery
+		} else if s.reconnect != nil {
+			conn, connQuery, rerr := s.reconnect()
+			if rerr != nil {
+				err = fmt.Errorf("failed to reconnect to ABCI app: %w", rerr)
+				continue
+			}
+			s.conn, s.connQuery = conn, connQuery
+		}
+		err = s.offerSnapshot(snapshot)
+		if err != nil && s.conn.Error() != nil {
+			continue
+		} else if err != nil {
+			return err
+		}
+		s.logger.Info("Reconnected to ABCI app, resuming restore", "height", snapshot.Height,
+			"format", snapshot.Format)
+		s.markApplied()
+		return nil
+	}
+	if *attempts > 0 {
+		return fmt.Errorf("failed to reconnect to ABCI app after %v attempts: %w", *attempts, err)
+	}
+	return err
 }
 
 // verifyApp verifies the sync, checking the app hash and last block height. It returns the
 // app version, which should be returned as part of the initial state.
+//
+// This is a barrier ensuring the app considers the snapshot fully applied before the sync returns,
+// such that the caller doesn't persist the state while the app hasn't. The app may still be
+// flushing the restored state after accepting the last chunk, so while it reports a lower height
+// we keep querying it, for up to app_flush_timeout.
 func (s *syncer) verifyApp(snapshot *snapshot) (uint64, error) {
+	deadline := time.Now().Add(s.config.AppFlushTimeout)
 	resp, err := s.connQuery.InfoSync(proxy.RequestInfo)
+	for err == nil && resp.LastBlockHeight >= 0 && uint64(resp.LastBlockHeight) < snapshot.Height &&
+		time.Now().Before(deadline) {
+		s.logger.Debug("Waiting for ABCI app to finish applying snapshot", "height", snapshot.Height,
+			"appHeight", resp.LastBlockHeight)
+		time.Sleep(appFlushPollInterval)
+		resp, err = s.connQuery.InfoSync(proxy.RequestInfo)
+	}
 	if err != nil {
 		return 0, fmt.Errorf("failed to query ABCI app for appHash: %w", err)
 	}
+	// The height is checked first, such that an app which hasn't finished restoring isn't mistaken
+	// for a bad snapshot.
+	if resp.LastBlockHeight < 0 || uint64(resp.LastBlockHeight) != snapshot.Height {
+		s.logger.Error("ABCI app reported unexpected last block height",
+			"expected", snapshot.Height, "actual", resp.LastBlockHeight)
+		return 0, errVerifyFailed
+	}
 	if !bytes.Equal(snapshot.trustedAppHash, resp.LastBlockAppHash) {
 		s.logger.Error("appHash verification failed",
 			"expected", fmt.Sprintf("%X", snapshot.trustedAppHash),
 			"actual", fmt.Sprintf("%X", resp.LastBlockAppHash))
-		return 0, errVerifyFailed
-	}
-	if uint64(resp.LastBlockHeight) != snapshot.Height {
-		s.logger.Error("ABCI app reported unexpected last block height",
-			"expected", snapshot.Height, "actual", resp.LastBlockHeight)
-		return 0, errVerifyFailed
+		return 0, errAppHashMismatch
 	}
 	s.logger.Info("Verified ABCI app", "height", snapshot.Height,
 		"appHash", fmt.Sprintf("%X", snapshot.trustedAppHash))
 	return resp.AppVersion, nil
 }
+
+// verifyCommit verifies that the commit at the snapshot height, as returned by the state provider,
+// was signed by the state's last validator set for the state's last block ID.
+func (s *syncer) verifyCommit(snapshot *snapshot, state sm.State, commit *types.Commit) error {
+	if state.LastValidators == nil {
+		s.logger.Error("Commit verification failed, state has no last validator set",
+			"height", snapshot.Height)
+		return errVerifyFailed
+	}
+	err := state.LastValidators.VerifyCommitLight(state.ChainID, state.LastBlockID,
+		int64(snapshot.Height), commit)
+	if err != nil {
+		s.logger.Error("Commit verification failed, commit does not match state",
+			"height", snapshot.Height, "err", err)
+		return fmt.Errorf("%w: %v", errVerifyFailed, err)
+	}
+	return nil
+}
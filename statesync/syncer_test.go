@@ -1,21 +1,26 @@
 package statesync
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/metrics/generic"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
 	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto/tmhash"
 	"github.com/tendermint/tendermint/libs/log"
 	tmsync "github.com/tendermint/tendermint/libs/sync"
 	"github.com/tendermint/tendermint/p2p"
 	p2pmocks "github.com/tendermint/tendermint/p2p/mocks"
 	tmstate "github.com/tendermint/tendermint/proto/tendermint/state"
 	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
 	tmversion "github.com/tendermint/tendermint/proto/tendermint/version"
 	"github.com/tendermint/tendermint/proxy"
 	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
@@ -31,7 +36,7 @@ func setupOfferSyncer(t *testing.T) (*syncer, *proxymocks.AppConnSnapshot) {
 	connSnapshot := &proxymocks.AppConnSnapshot{}
 	stateProvider := &mocks.StateProvider{}
 	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
-	syncer := newSyncer(log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
 	return syncer, connSnapshot
 }
 
@@ -42,7 +47,22 @@ func simplePeer(id string) *p2pmocks.Peer {
 	return peer
 }
 
+// Creates a random validator set and a commit for the given block signed by all of its validators
+func makeSignedCommit(t *testing.T, chainID string, height int64,
+	blockID types.BlockID) (*types.ValidatorSet, *types.Commit) {
+	valSet, privVals := types.RandValidatorSet(3, 10)
+	voteSet := types.NewVoteSet(chainID, height, 0, tmproto.PrecommitType, valSet)
+	commit, err := types.MakeCommit(blockID, height, 0, voteSet, privVals, time.Now())
+	require.NoError(t, err)
+	return valSet, commit
+}
+
 func TestSyncer_SyncAny(t *testing.T) {
+	blockID := types.BlockID{
+		Hash:          tmhash.Sum([]byte("blockhash")),
+		PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte("parts"))},
+	}
+	lastValidators, commit := makeSignedCommit(t, "chain", 1, blockID)
 	state := sm.State{
 		ChainID: "chain",
 		Version: tmstate.Version{
@@ -55,20 +75,18 @@ func TestSyncer_SyncAny(t *testing.T) {
 		},
 
 		LastBlockHeight: 1,
-		LastBlockID:     types.BlockID{Hash: []byte("blockhash")},
+		LastBlockID:     blockID,
 		LastBlockTime:   time.Now(),
 		LastResultsHash: []byte("last_results_hash"),
 		AppHash:         []byte("app_hash"),
 
-		LastValidators: &types.ValidatorSet{Proposer: &types.Validator{Address: []byte("val1")}},
+		LastValidators: lastValidators,
 		Validators:     &types.ValidatorSet{Proposer: &types.Validator{Address: []byte("val2")}},
 		NextValidators: &types.ValidatorSet{Proposer: &types.Validator{Address: []byte("val3")}},
 
 		ConsensusParams:                  *types.DefaultConsensusParams(),
 		LastHeightConsensusParamsChanged: 1,
 	}
-	commit := &types.Commit{BlockID: types.BlockID{Hash: []byte("blockhash")}}
-
 	chunks := []*chunk{
 		{Height: 1, Format: 1, Index: 0, Chunk: []byte{1, 1, 0}},
 		{Height: 1, Format: 1, Index: 1, Chunk: []byte{1, 1, 1}},
@@ -84,22 +102,25 @@ func TestSyncer_SyncAny(t *testing.T) {
 	connSnapshot := &proxymocks.AppConnSnapshot{}
 	connQuery := &proxymocks.AppConnQuery{}
 
-	syncer := newSyncer(log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
+	lifecycle := &recordingLifecycle{}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "",
+		withSyncLifecycle(lifecycle))
 
 	// Adding a chunk should error when no sync is in progress
 	_, err := syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}})
 	require.Error(t, err)
 
 	// Adding a couple of peers should trigger snapshot discovery messages
+	request := mustEncodeMsg(&ssproto.SnapshotsRequest{Hello: makeHello(syncer.config)})
 	peerA := &p2pmocks.Peer{}
 	peerA.On("ID").Return(p2p.ID("a"))
-	peerA.On("Send", SnapshotChannel, mustEncodeMsg(&ssproto.SnapshotsRequest{})).Return(true)
+	peerA.On("Send", SnapshotChannel, request).Return(true)
 	syncer.AddPeer(peerA)
 	peerA.AssertExpectations(t)
 
 	peerB := &p2pmocks.Peer{}
 	peerB.On("ID").Return(p2p.ID("b"))
-	peerB.On("Send", SnapshotChannel, mustEncodeMsg(&ssproto.SnapshotsRequest{})).Return(true)
+	peerB.On("Send", SnapshotChannel, request).Return(true)
 	syncer.AddPeer(peerB)
 	peerB.AssertExpectations(t)
 
@@ -186,8 +207,19 @@ func TestSyncer_SyncAny(t *testing.T) {
 		LastBlockAppHash: []byte("app_hash"),
 	}, nil)
 
-	newState, lastCommit, err := syncer.SyncAny(0)
+	result, err := syncer.SyncAny(0)
 	require.NoError(t, err)
+	newState, lastCommit := result.State, result.Commit
+	assert.EqualValues(t, 1, result.Height)
+	assert.EqualValues(t, 1, result.Format)
+	assert.EqualValues(t, 3, result.Chunks)
+	assert.Equal(t, []byte{1, 2, 3}, result.Hash)
+	assert.Equal(t, []byte("app_hash"), result.AppHash)
+	assert.Equal(t, 2, result.Peers)
+	assert.Equal(t, state.LastBlockTime, result.Time)
+	assert.Equal(t, 3, result.Offers)
+	assert.Equal(t, []*SyncResult{result}, lifecycle.completed)
+	assert.Empty(t, lifecycle.aborted)
 
 	time.Sleep(50 * time.Millisecond) // wait for peers to receive requests
 
@@ -210,8 +242,134 @@ func TestSyncer_SyncAny(t *testing.T) {
 
 func TestSyncer_SyncAny_noSnapshots(t *testing.T) {
 	syncer, _ := setupOfferSyncer(t)
-	_, _, err := syncer.SyncAny(0)
+	_, err := syncer.SyncAny(0)
+	assert.Equal(t, errNoSnapshots, err)
+	assert.Equal(t, SyncProgress{}, syncer.Progress())
+}
+
+func TestSyncer_SyncAny_discoveryExtension(t *testing.T) {
+	// With discovery disabled, the extension is waited out before failing.
+	syncer, _ := setupOfferSyncer(t)
+	syncer.config.DiscoveryExtensionMax = 200 * time.Millisecond
+	start := time.Now()
+	_, err := syncer.SyncAny(0)
 	assert.Equal(t, errNoSnapshots, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+
+	// The extension ends as soon as a snapshot is discovered.
+	syncer, _ = setupOfferSyncer(t)
+	syncer.config.DiscoveryExtensionMax = time.Minute
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, err := syncer.AddSnapshot(simplePeer("a"), &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}})
+		assert.NoError(t, err)
+	}()
+	start = time.Now()
+	assert.True(t, syncer.extendDiscovery())
+	assert.NotNil(t, syncer.snapshots.Best())
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+
+	syncer.config.DiscoveryExtensionMax = 0
+	assert.False(t, syncer.extendDiscovery())
+}
+
+func TestSyncer_SyncAny_resumedDiscovery(t *testing.T) {
+	// A discovery resumed after a restart only waits for the remainder of the discovery time.
+	syncer, connSnapshot := setupOfferSyncer(t)
+	syncer.resumedDiscovery = time.Minute
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	_, err := syncer.AddSnapshot(simplePeer("id"), s)
+	require.NoError(t, err)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ABORT}, nil)
+
+	start := time.Now()
+	_, err = syncer.SyncAny(time.Minute)
+	assert.Equal(t, errAbort, err)
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+	connSnapshot.AssertExpectations(t)
+}
+
+// checkedStateProvider is a mock state provider which implements StateProviderChecker.
+type checkedStateProvider struct {
+	mocks.StateProvider
+	err error
+}
+
+func (p *checkedStateProvider) CheckAvailable(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.err
+}
+
+func TestSyncer_SyncAny_stateProvider(t *testing.T) {
+	boom := errors.New("boom")
+
+	testcases := map[string]struct {
+		stateProvider StateProvider
+		cancelled     bool
+		expectErr     error
+	}{
+		"nil provider":         {nil, false, errNoStateProvider},
+		"unchecked provider":   {&mocks.StateProvider{}, false, errNoSnapshots},
+		"available provider":   {&checkedStateProvider{}, false, errNoSnapshots},
+		"unavailable provider": {&checkedStateProvider{err: boom}, false, boom},
+		"interrupted check":    {&checkedStateProvider{err: boom}, true, context.Canceled},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if tc.cancelled {
+				cancel()
+			}
+			defer cancel()
+			syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+				&proxymocks.AppConnQuery{}, tc.stateProvider, "", withContext(ctx))
+			_, err := syncer.SyncAny(0)
+			assert.True(t, errors.Is(err, tc.expectErr), "unexpected error %v", err)
+		})
+	}
+}
+
+// heightStateProvider is a mock state provider which implements StateProviderNetworkHeight.
+type heightStateProvider struct {
+	mocks.StateProvider
+	height uint64
+	err    error
+}
+
+func (p *heightStateProvider) NetworkHeight(ctx context.Context) (uint64, error) {
+	return p.height, p.err
+}
+
+func TestSyncer_networkHeight(t *testing.T) {
+	testcases := map[string]struct {
+		stateProvider StateProvider
+		expect        uint64
+	}{
+		"unsupported provider": {&mocks.StateProvider{}, 0},
+		"supported provider":   {&heightStateProvider{height: 10}, 10},
+		"failed provider":      {&heightStateProvider{height: 10, err: errors.New("boom")}, 0},
+		"breaker provider": {newBreakerStateProvider(&heightStateProvider{height: 10}, 1, time.Minute,
+			log.NewNopLogger()), 10},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+				&proxymocks.AppConnQuery{}, tc.stateProvider, "")
+			assert.Equal(t, tc.expect, syncer.networkHeight())
+		})
+	}
+}
+
+func TestSyncResult_Gap(t *testing.T) {
+	assert.EqualValues(t, 0, (&SyncResult{Height: 5}).Gap())
+	assert.EqualValues(t, 0, (&SyncResult{Height: 5, NetworkHeight: 3}).Gap())
+	assert.EqualValues(t, 7, (&SyncResult{Height: 5, NetworkHeight: 12}).Gap())
 }
 
 func TestSyncer_SyncAny_abort(t *testing.T) {
@@ -223,10 +381,103 @@ func TestSyncer_SyncAny_abort(t *testing.T) {
 	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
 		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
 	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ABORT}, nil)
+	lifecycle := &recordingLifecycle{}
+	syncer.lifecycle = lifecycle
+
+	_, err = syncer.SyncAny(0)
+	assert.Equal(t, errAbort, err)
+	connSnapshot.AssertExpectations(t)
+	assert.Empty(t, lifecycle.completed)
+	assert.Equal(t, []error{errAbort}, lifecycle.aborted)
+}
+
+// recordingLifecycle is a SyncLifecycle which records its notifications.
+type recordingLifecycle struct {
+	completed []*SyncResult
+	aborted   []error
+}
+
+func (l *recordingLifecycle) SyncCompleted(result *SyncResult) {
+	l.completed = append(l.completed, result)
+}
+
+func (l *recordingLifecycle) SyncAborting(err error) {
+	l.aborted = append(l.aborted, err)
+}
+
+func TestSyncer_SyncAny_confirm(t *testing.T) {
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	confirmed := []SnapshotInfo{}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{},
+		stateProvider, "", withSnapshotConfirm(func(snapshot SnapshotInfo) bool {
+			confirmed = append(confirmed, snapshot)
+			return snapshot.Height == 1
+		}))
+
+	// s2 is declined by the hook without being offered to the app, then s1 is confirmed.
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 3, Hash: []byte{2}}
+	s1 := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}}
+	for _, id := range []string{"a", "b"} {
+		_, err := syncer.AddSnapshot(simplePeer(id), s2)
+		require.NoError(t, err)
+	}
+	_, err := syncer.AddSnapshot(simplePeer("a"), s1)
+	require.NoError(t, err)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s1), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ABORT}, nil)
 
-	_, _, err = syncer.SyncAny(0)
+	_, err = syncer.SyncAny(0)
 	assert.Equal(t, errAbort, err)
 	connSnapshot.AssertExpectations(t)
+	assert.Equal(t, []SnapshotInfo{
+		{Height: 2, Format: 1, Chunks: 3, Hash: []byte{2}, Peers: 2},
+		{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}, Peers: 1},
+	}, confirmed)
+	catalog := syncer.snapshots.Catalog()
+	require.Len(t, catalog, 2)
+	assert.EqualValues(t, 2, catalog[1].Height)
+	assert.Equal(t, RejectReasonDeclined, catalog[1].Rejected)
+}
+
+func TestSyncer_SyncAny_belowTrustHeight(t *testing.T) {
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	config := cfg.TestStateSyncConfig()
+	config.TrustHeight = 3
+	syncer := newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{}, stateProvider, "")
+
+	// The preferred s2 is below the trust height, so it's rejected without being offered to the
+	// app, and s4 is restored instead.
+	s2 := &snapshot{Height: 2, Format: 1, Chunks: 3, Hash: []byte{2}, Preferred: true}
+	s4 := &snapshot{Height: 4, Format: 1, Chunks: 3, Hash: []byte{4}}
+	for _, s := range []*snapshot{s2, s4} {
+		_, err := syncer.AddSnapshot(simplePeer("a"), s)
+		require.NoError(t, err)
+	}
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s4), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ABORT}, nil)
+
+	_, err := syncer.SyncAny(0)
+	assert.Equal(t, errAbort, err)
+	connSnapshot.AssertExpectations(t)
+	catalog := syncer.snapshots.Catalog()
+	require.Len(t, catalog, 2)
+	assert.EqualValues(t, 2, catalog[1].Height)
+	assert.Equal(t, RejectReasonBelowTrust, catalog[1].Rejected)
+
+	// If only snapshots below the trust height are found, the sync fails with a specific error.
+	syncer = newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{}, stateProvider, "")
+	_, err = syncer.AddSnapshot(simplePeer("a"), s2)
+	require.NoError(t, err)
+	_, err = syncer.SyncAny(0)
+	assert.True(t, errors.Is(err, errBelowTrustHeight), err)
+	assert.Contains(t, err.Error(), errNoSnapshots.Error())
+	connSnapshot.AssertExpectations(t)
 }
 
 func TestSyncer_SyncAny_reject(t *testing.T) {
@@ -255,9 +506,51 @@ func TestSyncer_SyncAny_reject(t *testing.T) {
 		Snapshot: toABCI(s11), AppHash: []byte("app_hash"),
 	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}, nil)
 
-	_, _, err = syncer.SyncAny(0)
+	_, err = syncer.SyncAny(0)
 	assert.Equal(t, errNoSnapshots, err)
 	connSnapshot.AssertExpectations(t)
+	progress := syncer.Progress()
+	require.NotNil(t, progress.Selection)
+	assert.EqualValues(t, 1, progress.Selection.Selected.Format)
+	assert.Equal(t, SelectReasonOnly, progress.Selection.Reason)
+	progress.Selection = nil
+	assert.Equal(t, SyncProgress{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}, SnapshotsTried: 3,
+		Offers: 3}, progress)
+}
+
+func TestSyncer_SyncAny_offerThrottle(t *testing.T) {
+	syncer, connSnapshot := setupOfferSyncer(t)
+	syncer.config.OfferInterval = 50 * time.Millisecond
+	syncer.config.MaxOffers = 3
+
+	// Offers are spaced by the offer interval, and the sync fails once the offer limit is reached
+	// without offering the remaining snapshots.
+	offerTimes := []time.Time{}
+	for height := uint64(1); height <= 4; height++ {
+		s := &snapshot{Height: height, Format: 1, Chunks: 1, Hash: []byte{1}}
+		_, err := syncer.AddSnapshot(simplePeer("id"), s)
+		require.NoError(t, err)
+		if height == 1 {
+			continue
+		}
+		connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+			Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+		}).Once().Run(func(args mock.Arguments) {
+			offerTimes = append(offerTimes, time.Now())
+		}).Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}, nil)
+	}
+
+	_, err := syncer.SyncAny(0)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errOfferLimit), "unexpected error %v", err)
+	connSnapshot.AssertExpectations(t)
+	assert.Equal(t, 3, syncer.Progress().Offers)
+	require.Len(t, offerTimes, 3)
+	// The offer times are taken by the app after the syncer's own, allowing for some scheduling
+	// jitter between the two.
+	for i := 1; i < len(offerTimes); i++ {
+		assert.GreaterOrEqual(t, int64(offerTimes[i].Sub(offerTimes[i-1])), int64(45*time.Millisecond))
+	}
 }
 
 func TestSyncer_SyncAny_reject_format(t *testing.T) {
@@ -282,7 +575,7 @@ func TestSyncer_SyncAny_reject_format(t *testing.T) {
 		Snapshot: toABCI(s11), AppHash: []byte("app_hash"),
 	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ABORT}, nil)
 
-	_, _, err = syncer.SyncAny(0)
+	_, err = syncer.SyncAny(0)
 	assert.Equal(t, errAbort, err)
 	connSnapshot.AssertExpectations(t)
 }
@@ -320,7 +613,7 @@ func TestSyncer_SyncAny_reject_sender(t *testing.T) {
 		Snapshot: toABCI(sa), AppHash: []byte("app_hash"),
 	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}, nil)
 
-	_, _, err = syncer.SyncAny(0)
+	_, err = syncer.SyncAny(0)
 	assert.Equal(t, errNoSnapshots, err)
 	connSnapshot.AssertExpectations(t)
 }
@@ -336,11 +629,325 @@ func TestSyncer_SyncAny_abciError(t *testing.T) {
 		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
 	}).Once().Return(nil, errBoom)
 
-	_, _, err = syncer.SyncAny(0)
+	_, err = syncer.SyncAny(0)
 	assert.True(t, errors.Is(err, errBoom))
 	connSnapshot.AssertExpectations(t)
 }
 
+func TestSyncer_Sync_stalled(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.StallTimeout = 200 * time.Millisecond
+
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(sm.State{}, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(&types.Commit{}, nil)
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	syncer := newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{},
+		stateProvider, "")
+
+	// The peer accepts chunk requests, but never responds to them.
+	peer := simplePeer("a")
+	peer.On("Send", ChunkChannel, mock.Anything).Return(true)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	_, err := syncer.AddSnapshot(peer, s)
+	require.NoError(t, err)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+
+	start := time.Now()
+	_, _, err = syncer.Sync(s, chunks)
+	assert.Equal(t, ErrStalled, err)
+	assert.Less(t, int64(time.Since(start)), int64(chunkTimeout))
+}
+
+func TestSyncer_Sync_stalledWhileApplying(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.StallTimeout = 200 * time.Millisecond
+
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(sm.State{}, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(&types.Commit{}, nil)
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	syncer := newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{},
+		stateProvider, "")
+
+	peer := simplePeer("a")
+	peer.On("Send", ChunkChannel, mock.Anything).Return(true)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	_, err := syncer.AddSnapshot(peer, s)
+	require.NoError(t, err)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+
+	// The app blocks applying chunk 0 until the sync has stalled.
+	applyMtx := tmsync.Mutex{}
+	applies := 0
+	release := make(chan struct{})
+	connSnapshot.On("ApplySnapshotChunkSync", mock.Anything).Run(func(args mock.Arguments) {
+		applyMtx.Lock()
+		applies++
+		first := applies == 1
+		applyMtx.Unlock()
+		if first {
+			<-release
+		}
+	}).Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}, nil)
+
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{0}, Sender: "a"})
+	require.NoError(t, err)
+
+	synced := make(chan error, 1)
+	go func() {
+		_, _, err := syncer.Sync(s, chunks)
+		synced <- err
+	}()
+
+	// The sync waits for the chunk being applied, even once stalled.
+	select {
+	case err := <-synced:
+		require.Fail(t, "sync returned while applying chunk", "err", err)
+	case <-time.After(2 * config.StallTimeout):
+	}
+	_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 1, Chunk: []byte{1}, Sender: "a"})
+	require.NoError(t, err)
+	close(release)
+	select {
+	case err = <-synced:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "sync did not return")
+	}
+	assert.Equal(t, ErrStalled, err)
+
+	// No further chunks are applied once the sync has returned.
+	time.Sleep(100 * time.Millisecond)
+	applyMtx.Lock()
+	assert.Equal(t, 1, applies)
+	applyMtx.Unlock()
+}
+
+func TestSyncer_SyncAny_lowThroughput(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.MinThroughput = 1024
+	config.MinThroughputWindow = 100 * time.Millisecond
+
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(sm.State{}, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(&types.Commit{}, nil)
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	rediscovered := 0
+	syncer := newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{},
+		stateProvider, "", withRediscovery(func() { rediscovered++ }))
+
+	// The peer accepts chunk requests, but never responds to them, so no chunks are downloaded.
+	peer := simplePeer("a")
+	peer.On("Send", ChunkChannel, mock.Anything).Return(true)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	_, err := syncer.AddSnapshot(peer, s)
+	require.NoError(t, err)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+
+	start := time.Now()
+	_, err = syncer.SyncAny(0)
+	assert.Equal(t, errNoSnapshots, err)
+	assert.Less(t, int64(time.Since(start)), int64(chunkTimeout))
+	assert.Equal(t, 1, rediscovered)
+	catalog := syncer.snapshots.Catalog()
+	require.Len(t, catalog, 1)
+	assert.Equal(t, RejectReasonThroughput, catalog[0].Rejected)
+}
+
+func TestSyncer_Sync_deadline(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.ChunkTimeBudget = 100 * time.Millisecond
+
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(sm.State{}, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(&types.Commit{}, nil)
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	syncer := newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{},
+		stateProvider, "")
+
+	// The peer accepts chunk requests, but never responds to them, so the 3 chunks are not
+	// restored within their 300ms deadline.
+	peer := simplePeer("a")
+	peer.On("Send", ChunkChannel, mock.Anything).Return(true)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	_, err := syncer.AddSnapshot(peer, s)
+	require.NoError(t, err)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+
+	start := time.Now()
+	_, _, err = syncer.Sync(s, chunks)
+	assert.Equal(t, errDeadline, err)
+	assert.Less(t, int64(time.Since(start)), int64(chunkTimeout))
+	deadline := syncer.Progress().Deadline
+	assert.False(t, deadline.Before(start.Add(300*time.Millisecond)))
+	assert.True(t, deadline.Before(time.Now()))
+}
+
+func TestSyncer_Close(t *testing.T) {
+	syncer, _ := setupOfferSyncer(t)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}}
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	syncer.chunks = chunks
+
+	// A closed syncer ignores snapshots, chunks and peer changes.
+	syncer.Close()
+	peer := simplePeer("a")
+	_, err = syncer.AddSnapshot(peer, s)
+	assert.Equal(t, errSyncEnded, err)
+	assert.False(t, syncer.HasChunks(1, 1))
+	_, err = syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}, Sender: "a"})
+	assert.Equal(t, errSyncEnded, err)
+	assert.Equal(t, errSyncEnded, syncer.AbortChunk(0))
+	assert.False(t, syncer.Rediscover(2))
+	syncer.ReturnPeer(peer)
+	syncer.RemovePeer(peer, PeerRemovalDisconnected)
+	assert.False(t, chunks.Has(0))
+	assert.Empty(t, syncer.snapshots.GetPeers(s))
+}
+
+func TestSyncer_AddChunk_duplicate(t *testing.T) {
+	duplicates := generic.NewCounter("duplicate_chunks")
+	duplicateBytes := generic.NewCounter("duplicate_chunk_bytes")
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, &mocks.StateProvider{}, "", withMetrics(&Metrics{
+			DuplicateChunks:     duplicates,
+			DuplicateChunkBytes: duplicateBytes,
+		}))
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1}}
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	syncer.chunks = chunks
+
+	// Two peers respond to a request for the same chunk, only the first response is kept.
+	added, err := syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1, 1}, Sender: "a"})
+	require.NoError(t, err)
+	assert.True(t, added)
+	added, err = syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{2, 2, 2}, Sender: "b"})
+	require.NoError(t, err)
+	assert.False(t, added)
+
+	assert.EqualValues(t, 1, duplicates.Value())
+	assert.EqualValues(t, 3, duplicateBytes.Value())
+
+	// The chunk is only returned once, from the first sender.
+	next, err := chunks.Next()
+	require.NoError(t, err)
+	assert.Equal(t, &chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1, 1}, Sender: "a"}, next)
+	assert.Equal(t, p2p.ID("a"), chunks.GetSender(0))
+	_, err = syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 1, Chunk: []byte{3}, Sender: "b"})
+	require.NoError(t, err)
+	next, err = chunks.Next()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, next.Index)
+	assert.EqualValues(t, 1, duplicates.Value())
+}
+
+func TestSyncer_AddChunk_proofs(t *testing.T) {
+	invalidProofs := generic.NewCounter("invalid_chunk_proofs")
+	metrics := NopMetrics()
+	metrics.InvalidChunkProofs = invalidProofs
+	supports := func(peerID p2p.ID, feature string) bool { return feature == featureChunkProofs && peerID != "legacy" }
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, &mocks.StateProvider{}, "", withMetrics(metrics),
+		withChunkProofVerifier(MerkleChunkVerifier{Formats: []uint32{1}}), withPeerFeatures(supports))
+
+	chunkData := [][]byte{{1}, {2}, {3}}
+	root, proofs, err := MerkleChunkProofs(chunkData)
+	require.NoError(t, err)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: root}
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	syncer.chunks = chunks
+
+	// Proofs are only requested from peers supporting them, for snapshots the verifier proves.
+	assert.True(t, syncer.requestsProof(s, "a"))
+	assert.False(t, syncer.requestsProof(s, "legacy"))
+	assert.False(t, syncer.requestsProof(&snapshot{Height: 1, Format: 2, Chunks: 3, Hash: root}, "a"))
+
+	// Chunks with valid proofs, and chunks from peers that weren't asked for proofs, are added.
+	added, err := syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}, Sender: "a",
+		Proof: proofs[0]})
+	require.NoError(t, err)
+	assert.True(t, added)
+	added, err = syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 1, Chunk: []byte{2}, Sender: "legacy"})
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	// Chunks with invalid or missing proofs are discarded, and their senders rejected.
+	added, err = syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 2, Chunk: []byte{9}, Sender: "b",
+		Proof: proofs[2]})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errInvalidChunkProof))
+	assert.False(t, added)
+	added, err = syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 2, Chunk: []byte{3}, Sender: "c"})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errInvalidChunkProof))
+	assert.False(t, added)
+	assert.False(t, chunks.Has(2))
+	assert.True(t, syncer.snapshots.peerBlacklist["b"])
+	assert.True(t, syncer.snapshots.peerBlacklist["c"])
+	assert.False(t, syncer.snapshots.peerBlacklist["a"])
+	assert.EqualValues(t, 2, invalidProofs.Value())
+}
+
+func TestSyncer_AddChunk_oversized(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.MaxChunkBytes = 4
+	syncer := newSyncer(config, log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, &mocks.StateProvider{}, "")
+
+	s := &snapshot{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1}}
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	syncer.chunks = chunks
+
+	// Oversized chunks are rejected before being added to the queue.
+	added, err := syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1, 2, 3, 4, 5}})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errChunkTooLarge))
+	assert.False(t, added)
+	assert.False(t, chunks.Has(0))
+
+	added, err = syncer.AddChunk(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1, 2, 3, 4}})
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	// The configured limit is capped by the channel's message size.
+	config.MaxChunkBytes = 2 * chunkMsgSize
+	assert.Equal(t, chunkMsgSize, maxChunkSize(config))
+	config.MaxChunkBytes = 0
+	assert.Equal(t, chunkMsgSize, maxChunkSize(config))
+}
+
 func TestSyncer_offerSnapshot(t *testing.T) {
 	unknownErr := errors.New("unknown error")
 	boom := errors.New("boom")
@@ -407,7 +1014,7 @@ func TestSyncer_applyChunks_Results(t *testing.T) {
 			connSnapshot := &proxymocks.AppConnSnapshot{}
 			stateProvider := &mocks.StateProvider{}
 			stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
-			syncer := newSyncer(log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
+			syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
 
 			body := []byte{1, 2, 3}
 			chunks, err := newChunkQueue(&snapshot{Height: 1, Format: 1, Chunks: 1}, "")
@@ -418,6 +1025,7 @@ func TestSyncer_applyChunks_Results(t *testing.T) {
 			connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
 				Index: 0, Chunk: body,
 			}).Once().Return(&abci.ResponseApplySnapshotChunk{Result: tc.result}, tc.err)
+			connSnapshot.On("Error").Maybe().Return(nil)
 			if tc.result == abci.ResponseApplySnapshotChunk_RETRY {
 				connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
 					Index: 0, Chunk: body,
@@ -440,6 +1048,35 @@ func TestSyncer_applyChunks_Results(t *testing.T) {
 	}
 }
 
+func TestSyncer_applyChunks_Progress(t *testing.T) {
+	syncer, connSnapshot := setupOfferSyncer(t)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}}
+	syncer.startProgress(s, nil)
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	for i := uint32(0); i < s.Chunks; i++ {
+		_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: i, Chunk: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+
+	// Only chunks accepted by the app count as applied, and a snapshot retry resets the count.
+	connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{Index: 0, Chunk: []byte{0}}).
+		Once().Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}, nil)
+	connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{Index: 1, Chunk: []byte{1}}).
+		Once().Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}, nil)
+	connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{Index: 2, Chunk: []byte{2}}).
+		Once().Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ABORT}, nil)
+	err = syncer.applyChunks(chunks)
+	assert.Equal(t, errAbort, err)
+	connSnapshot.AssertExpectations(t)
+	assert.Equal(t, SyncProgress{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1}, ChunksApplied: 2,
+		SnapshotsTried: 1}, syncer.Progress())
+
+	syncer.resetProgress()
+	assert.EqualValues(t, 0, syncer.Progress().ChunksApplied)
+}
+
 func TestSyncer_applyChunks_RefetchChunks(t *testing.T) {
 	// Discarding chunks via refetch_chunks should work the same for all results
 	testcases := map[string]struct {
@@ -458,7 +1095,7 @@ func TestSyncer_applyChunks_RefetchChunks(t *testing.T) {
 			connSnapshot := &proxymocks.AppConnSnapshot{}
 			stateProvider := &mocks.StateProvider{}
 			stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
-			syncer := newSyncer(log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
+			syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
 
 			chunks, err := newChunkQueue(&snapshot{Height: 1, Format: 1, Chunks: 3}, "")
 			require.NoError(t, err)
@@ -521,7 +1158,7 @@ func TestSyncer_applyChunks_RejectSenders(t *testing.T) {
 			connSnapshot := &proxymocks.AppConnSnapshot{}
 			stateProvider := &mocks.StateProvider{}
 			stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
-			syncer := newSyncer(log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
+			syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
 
 			// Set up three peers across two snapshots, and ask for one of them to be banned.
 			// It should be banned from all snapshots.
@@ -602,6 +1239,126 @@ func TestSyncer_applyChunks_RejectSenders(t *testing.T) {
 	}
 }
 
+// peerSelectorFunc is a PeerSelector backed by a function.
+type peerSelectorFunc func(height uint64, format uint32, index uint32, candidates []p2p.Peer) p2p.Peer
+
+func (f peerSelectorFunc) SelectPeer(height uint64, format uint32, index uint32, candidates []p2p.Peer) p2p.Peer {
+	return f(height, format, index, candidates)
+}
+
+func TestSyncer_requestChunk_PeerSelector(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	request := mustEncodeMsg(&ssproto.ChunkRequest{Height: 1, Format: 1, Index: 2})
+
+	testcases := map[string]struct {
+		selected  p2p.Peer
+		expectIDs []p2p.ID // acceptable peers to receive the request
+	}{
+		"selected peer":                      {simplePeer("b"), []p2p.ID{"b"}},
+		"nil falls back to default":          {nil, []p2p.ID{"a", "b"}},
+		"unknown peer falls back to default": {simplePeer("x"), []p2p.ID{"a", "b"}},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var observed []p2p.ID
+			selector := peerSelectorFunc(func(height uint64, format uint32, index uint32,
+				candidates []p2p.Peer) p2p.Peer {
+				assert.EqualValues(t, 1, height)
+				assert.EqualValues(t, 1, format)
+				assert.EqualValues(t, 2, index)
+				for _, peer := range candidates {
+					observed = append(observed, peer.ID())
+				}
+				return tc.selected
+			})
+
+			stateProvider := &mocks.StateProvider{}
+			stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+			syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{}, &proxymocks.AppConnQuery{},
+				stateProvider, "", withPeerSelector(selector))
+
+			var received []p2p.ID
+			for _, id := range []string{"a", "b"} {
+				peer := simplePeer(id)
+				peer.On("Send", ChunkChannel, request).Maybe().Run(func(args mock.Arguments) {
+					received = append(received, peer.ID())
+				}).Return(true)
+				_, err := syncer.AddSnapshot(peer, s)
+				require.NoError(t, err)
+			}
+
+			syncer.requestChunk(s, 2)
+			assert.Equal(t, []p2p.ID{"a", "b"}, observed)
+			require.Len(t, received, 1)
+			assert.Contains(t, tc.expectIDs, received[0])
+		})
+	}
+}
+
+func TestSyncer_selectPeer_activePeers(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, stateProvider, "")
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := syncer.AddSnapshot(simplePeer(id), s)
+		require.NoError(t, err)
+	}
+	syncer.active = newActivePeerSet(1, nil)
+
+	// Only the active peer is selected, until it leaves and a backup is promoted.
+	selected := syncer.selectPeer(s, 0).ID()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, selected, syncer.selectPeer(s, 0).ID())
+	}
+	syncer.RemovePeer(simplePeer(string(selected)), PeerRemovalDisconnected)
+	promoted := syncer.selectPeer(s, 0).ID()
+	assert.NotEqual(t, selected, promoted)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, promoted, syncer.selectPeer(s, 0).ID())
+	}
+}
+
+// peerFilterMap is a PeerFilter returning the preference stored for each peer ID, accepting
+// unknown peers.
+type peerFilterMap map[p2p.ID]PeerPreference
+
+func (m peerFilterMap) FilterPeer(peer p2p.Peer) PeerPreference {
+	return m[peer.ID()]
+}
+
+func TestSyncer_PeerFilter(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 3, Hash: []byte{1, 2, 3}}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	filter := peerFilterMap{"a": PeerExcluded, "c": PeerPreferred}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, stateProvider, "", withPeerFilter(filter))
+
+	// Snapshots from excluded peers are ignored.
+	added, err := syncer.AddSnapshot(simplePeer("a"), s)
+	require.NoError(t, err)
+	assert.False(t, added)
+	assert.Empty(t, syncer.snapshots.GetPeers(s))
+
+	// Accepted peers are used until a preferred peer has the snapshot.
+	for _, id := range []string{"b", "c"} {
+		_, err := syncer.AddSnapshot(simplePeer(id), s)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			assert.EqualValues(t, id, syncer.selectPeer(s, 0).ID())
+		}
+	}
+
+	// Peers excluded after advertising the snapshot are no longer used.
+	filter["c"] = PeerExcluded
+	assert.EqualValues(t, "b", syncer.selectPeer(s, 0).ID())
+	filter["b"] = PeerExcluded
+	assert.Nil(t, syncer.selectPeer(s, 0))
+}
+
 func TestSyncer_verifyApp(t *testing.T) {
 	boom := errors.New("boom")
 	s := &snapshot{Height: 3, Format: 1, Chunks: 5, Hash: []byte{1, 2, 3}, trustedAppHash: []byte("app_hash")}
@@ -626,6 +1383,11 @@ func TestSyncer_verifyApp(t *testing.T) {
 			LastBlockAppHash: []byte("xxx"),
 			AppVersion:       9,
 		}, nil, errVerifyFailed},
+		"negative height": {&abci.ResponseInfo{
+			LastBlockHeight:  -1,
+			LastBlockAppHash: []byte("app_hash"),
+			AppVersion:       9,
+		}, nil, errVerifyFailed},
 		"error": {nil, boom, boom},
 	}
 	for name, tc := range testcases {
@@ -634,7 +1396,7 @@ func TestSyncer_verifyApp(t *testing.T) {
 			connQuery := &proxymocks.AppConnQuery{}
 			connSnapshot := &proxymocks.AppConnSnapshot{}
 			stateProvider := &mocks.StateProvider{}
-			syncer := newSyncer(log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
+			syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery, stateProvider, "")
 
 			connQuery.On("InfoSync", proxy.RequestInfo).Return(tc.response, tc.err)
 			version, err := syncer.verifyApp(s)
@@ -650,6 +1412,214 @@ func TestSyncer_verifyApp(t *testing.T) {
 	}
 }
 
+func TestSyncer_verifyApp_flush(t *testing.T) {
+	s := &snapshot{Height: 3, Format: 1, Chunks: 5, Hash: []byte{1, 2, 3}, trustedAppHash: []byte("app_hash")}
+	flushing := &abci.ResponseInfo{LastBlockHeight: 2, LastBlockAppHash: []byte("old_hash")}
+	flushed := &abci.ResponseInfo{LastBlockHeight: 3, LastBlockAppHash: []byte("app_hash"), AppVersion: 9}
+
+	// The app is queried until it reports the snapshot height.
+	connQuery := &proxymocks.AppConnQuery{}
+	connQuery.On("InfoSync", proxy.RequestInfo).Twice().Return(flushing, nil)
+	connQuery.On("InfoSync", proxy.RequestInfo).Once().Return(flushed, nil)
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		connQuery, &mocks.StateProvider{}, "")
+	version, err := syncer.verifyApp(s)
+	require.NoError(t, err)
+	assert.EqualValues(t, 9, version)
+	connQuery.AssertExpectations(t)
+
+	// Verification fails if it doesn't within the flush timeout.
+	config := cfg.TestStateSyncConfig()
+	config.AppFlushTimeout = 250 * time.Millisecond
+	connQuery = &proxymocks.AppConnQuery{}
+	connQuery.On("InfoSync", proxy.RequestInfo).Return(flushing, nil)
+	syncer = newSyncer(config, log.NewNopLogger(), &proxymocks.AppConnSnapshot{}, connQuery,
+		&mocks.StateProvider{}, "")
+	_, err = syncer.verifyApp(s)
+	assert.Equal(t, errVerifyFailed, err)
+	assert.Greater(t, len(connQuery.Calls), 1)
+}
+
+func TestSyncer_verifyCommit(t *testing.T) {
+	s := &snapshot{Height: 3, Format: 1, Chunks: 5, Hash: []byte{1, 2, 3}}
+	blockID := types.BlockID{
+		Hash:          tmhash.Sum([]byte("block")),
+		PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte("parts"))},
+	}
+	otherBlockID := types.BlockID{
+		Hash:          tmhash.Sum([]byte("other")),
+		PartSetHeader: blockID.PartSetHeader,
+	}
+	valSet, commit := makeSignedCommit(t, "chain", 3, blockID)
+	otherValSet, otherCommit := makeSignedCommit(t, "chain", 3, blockID)
+	_, blockMismatch := makeSignedCommit(t, "chain", 3, otherBlockID)
+	_, heightMismatch := makeSignedCommit(t, "chain", 2, blockID)
+
+	testcases := map[string]struct {
+		validators *types.ValidatorSet
+		commit     *types.Commit
+		valid      bool
+	}{
+		"verified":          {valSet, commit, true},
+		"other validators":  {otherValSet, otherCommit, true},
+		"wrong validators":  {otherValSet, commit, false},
+		"wrong block":       {valSet, blockMismatch, false},
+		"wrong height":      {valSet, heightMismatch, false},
+		"nil commit":        {valSet, nil, false},
+		"nil validator set": {nil, commit, false},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			syncer, _ := setupOfferSyncer(t)
+			state := sm.State{ChainID: "chain", LastBlockHeight: 3, LastBlockID: blockID,
+				LastValidators: tc.validators}
+			err := syncer.verifyCommit(s, state, tc.commit)
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, errVerifyFailed))
+			}
+		})
+	}
+}
+
+func TestSyncer_Sync_commitMismatch(t *testing.T) {
+	blockID := types.BlockID{
+		Hash:          tmhash.Sum([]byte("block")),
+		PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte("parts"))},
+	}
+	valSet, _ := makeSignedCommit(t, "chain", 1, blockID)
+	_, commit := makeSignedCommit(t, "chain", 1, blockID)
+	state := sm.State{ChainID: "chain", LastBlockHeight: 1, LastBlockID: blockID, LastValidators: valSet}
+
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, uint64(1)).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(state, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(commit, nil)
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	connQuery := &proxymocks.AppConnQuery{}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery,
+		stateProvider, "")
+
+	peer := simplePeer("a")
+	peer.On("Send", ChunkChannel, mock.Anything).Maybe().Return(true)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1, 2, 3}}
+	_, err := syncer.AddSnapshot(peer, s)
+	require.NoError(t, err)
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+	connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+		Index: 0, Chunk: []byte{1}, Sender: "a",
+	}).Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}, nil)
+	connQuery.On("InfoSync", proxy.RequestInfo).Return(&abci.ResponseInfo{
+		LastBlockHeight:  1,
+		LastBlockAppHash: []byte("app_hash"),
+	}, nil)
+
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}, Sender: "a"})
+	require.NoError(t, err)
+
+	// The commit was signed by a different validator set than the state's, so it must be rejected.
+	_, _, err = syncer.Sync(s, chunks)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errVerifyFailed))
+	connSnapshot.AssertExpectations(t)
+}
+
+func TestSyncer_Sync_appReconnect(t *testing.T) {
+	blockID := types.BlockID{
+		Hash:          tmhash.Sum([]byte("block")),
+		PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte("parts"))},
+	}
+	valSet, commit := makeSignedCommit(t, "chain", 1, blockID)
+	state := sm.State{ChainID: "chain", LastBlockHeight: 1, LastBlockID: blockID, LastValidators: valSet}
+	s := &snapshot{Height: 1, Format: 1, Chunks: 2, Hash: []byte{1, 2, 3}}
+	offer := abci.RequestOfferSnapshot{Snapshot: toABCI(s), AppHash: []byte("app_hash")}
+	accept := &abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}
+
+	testcases := map[string]struct {
+		reconnectErr error
+		expectErr    bool
+	}{
+		"reconnected":     {nil, false},
+		"reconnect fails": {errors.New("connection refused"), true},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			stateProvider := &mocks.StateProvider{}
+			stateProvider.On("AppHash", mock.Anything, uint64(1)).Return([]byte("app_hash"), nil)
+			stateProvider.On("State", mock.Anything, uint64(1)).Return(state, nil)
+			stateProvider.On("Commit", mock.Anything, uint64(1)).Return(commit, nil)
+
+			// The app connection is lost after applying the first chunk.
+			connSnapshot := &proxymocks.AppConnSnapshot{}
+			connSnapshot.On("OfferSnapshotSync", offer).Once().Return(
+				&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+			connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+				Index: 0, Chunk: []byte{1, 0}, Sender: "a",
+			}).Once().Return(accept, nil)
+			connSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+				Index: 1, Chunk: []byte{1, 1}, Sender: "a",
+			}).Once().Return(nil, errors.New("broken pipe"))
+			connSnapshot.On("Error").Return(errors.New("connection reset"))
+
+			// Once reconnected, the snapshot is re-offered and the restore resumes with chunk 1.
+			newSnapshot := &proxymocks.AppConnSnapshot{}
+			newQuery := &proxymocks.AppConnQuery{}
+			if tc.reconnectErr == nil {
+				newSnapshot.On("OfferSnapshotSync", offer).Once().Return(
+					&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+				newSnapshot.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+					Index: 1, Chunk: []byte{1, 1}, Sender: "a",
+				}).Once().Return(accept, nil)
+				newQuery.On("InfoSync", proxy.RequestInfo).Return(&abci.ResponseInfo{
+					LastBlockHeight:  1,
+					LastBlockAppHash: []byte("app_hash"),
+				}, nil)
+			}
+			reconnects := 0
+			config := cfg.TestStateSyncConfig()
+			config.AppReconnectAttempts = 1
+			syncer := newSyncer(config, log.NewNopLogger(), connSnapshot, &proxymocks.AppConnQuery{},
+				stateProvider, "", withAppReconnect(func() (proxy.AppConnSnapshot, proxy.AppConnQuery, error) {
+					reconnects++
+					return newSnapshot, newQuery, tc.reconnectErr
+				}))
+
+			peer := simplePeer("a")
+			peer.On("Send", ChunkChannel, mock.Anything).Maybe().Return(true)
+			_, err := syncer.AddSnapshot(peer, s)
+			require.NoError(t, err)
+			chunks, err := newChunkQueue(s, "")
+			require.NoError(t, err)
+			defer chunks.Close()
+			for i := uint32(0); i < 2; i++ {
+				_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: i, Chunk: []byte{1, byte(i)}, Sender: "a"})
+				require.NoError(t, err)
+			}
+
+			_, _, err = syncer.Sync(s, chunks)
+			assert.Equal(t, 1, reconnects)
+			if tc.expectErr {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "after 1 attempts")
+			} else {
+				require.NoError(t, err)
+			}
+			connSnapshot.AssertExpectations(t)
+			newSnapshot.AssertExpectations(t)
+			newQuery.AssertExpectations(t)
+		})
+	}
+}
+
 func toABCI(s *snapshot) *abci.Snapshot {
 	return &abci.Snapshot{
 		Height:   s.Height,
@@ -659,3 +1629,148 @@ func toABCI(s *snapshot) *abci.Snapshot {
 		Metadata: s.Metadata,
 	}
 }
+
+func TestSyncer_Rediscover(t *testing.T) {
+	syncer, _ := setupOfferSyncer(t)
+	syncer.config.DiscoveryRebroadcastInterval = time.Hour
+
+	assert.False(t, syncer.Rediscover(2)) // nothing known yet
+	assert.False(t, syncer.Rediscover(1)) // lower
+	assert.False(t, syncer.Rediscover(2)) // same
+	assert.True(t, syncer.Rediscover(3))
+	assert.False(t, syncer.Rediscover(4)) // debounced
+
+	syncer.lastRediscovery = time.Now().Add(-2 * time.Hour)
+	assert.True(t, syncer.Rediscover(5))
+
+	// Snapshots are not rediscovered while restoring one.
+	syncer.lastRediscovery = time.Time{}
+	chunks, err := newChunkQueue(&snapshot{Height: 5, Format: 1, Chunks: 1, Hash: []byte{1}}, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	syncer.chunks = chunks
+	assert.False(t, syncer.Rediscover(6))
+	syncer.chunks = nil
+
+	// Rediscovery can be disabled.
+	syncer.config.DiscoveryRebroadcastInterval = 0
+	assert.False(t, syncer.Rediscover(7))
+}
+
+func TestSyncer_AddSnapshot_available(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, uint64(1)).Return(nil, errors.New("unverified"))
+	stateProvider.On("AppHash", mock.Anything, mock.Anything).Return([]byte("app_hash"), nil)
+	notified := []uint64{}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+		&proxymocks.AppConnQuery{}, stateProvider, "", withSnapshotAvailable(func(height uint64, format uint32) {
+			notified = append(notified, height)
+		}))
+
+	// Snapshots that fail verification don't count as available.
+	_, err := syncer.AddSnapshot(simplePeer("a"), &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}})
+	require.Error(t, err)
+	assert.Empty(t, notified)
+
+	// Only the first usable snapshot is notified.
+	for _, height := range []uint64{2, 3, 2} {
+		_, err = syncer.AddSnapshot(simplePeer("a"), &snapshot{Height: height, Format: 1, Chunks: 1, Hash: []byte{1}})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []uint64{2}, notified)
+}
+
+func TestSyncer_AddSnapshot_restoreFormats(t *testing.T) {
+	syncer, _ := setupOfferSyncer(t)
+	syncer.config.RestoreFormats = []uint32{2}
+
+	added, err := syncer.AddSnapshot(simplePeer("a"), &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}})
+	require.NoError(t, err)
+	assert.False(t, added)
+	added, err = syncer.AddSnapshot(simplePeer("a"), &snapshot{Height: 1, Format: 2, Chunks: 1, Hash: []byte{1}})
+	require.NoError(t, err)
+	assert.True(t, added)
+	assert.Len(t, syncer.snapshots.Ranked(), 1)
+}
+
+func TestSyncer_AddSnapshot_diff(t *testing.T) {
+	syncer, connSnapshot := setupOfferSyncer(t)
+	connQuery := &proxymocks.AppConnQuery{}
+	connQuery.On("InfoSync", proxy.RequestInfo).Once().Return(&abci.ResponseInfo{LastBlockHeight: 2}, nil)
+	syncer.connQuery = connQuery
+	diff := &snapshot{Height: 3, Format: 2, Chunks: 1, Hash: []byte{1}, Metadata: []byte{7}, BaseHeight: 2}
+	other := &snapshot{Height: 3, Format: 2, Chunks: 1, Hash: []byte{2}, BaseHeight: 1}
+
+	// Diffs are ignored unless enabled.
+	added, err := syncer.AddSnapshot(simplePeer("a"), diff)
+	require.NoError(t, err)
+	assert.False(t, added)
+
+	// Once enabled, diffs are ignored until the app height is loaded, without querying the app.
+	syncer.config.DiffSnapshots = true
+	added, err = syncer.AddSnapshot(simplePeer("a"), diff)
+	require.NoError(t, err)
+	assert.False(t, added)
+
+	// Then only diffs from the app's current height are used. The app is queried once.
+	require.NoError(t, syncer.loadAppHeight())
+	require.NoError(t, syncer.loadAppHeight())
+	added, err = syncer.AddSnapshot(simplePeer("a"), other)
+	require.NoError(t, err)
+	assert.False(t, added)
+	added, err = syncer.AddSnapshot(simplePeer("a"), diff)
+	require.NoError(t, err)
+	assert.True(t, added)
+	connQuery.AssertExpectations(t)
+
+	// The diff is offered to the app with its base height in the metadata.
+	connSnapshot.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: &abci.Snapshot{
+			Height:   3,
+			Format:   2,
+			Chunks:   1,
+			Hash:     []byte{1},
+			Metadata: DiffSnapshotMetadata(2, []byte{7}),
+		},
+		AppHash: []byte("app_hash"),
+	}).Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+	require.NoError(t, syncer.offerSnapshot(syncer.snapshots.Best()))
+	connSnapshot.AssertExpectations(t)
+}
+
+func TestAdaptiveDiscoveryTime(t *testing.T) {
+	testcases := []struct {
+		peers  int
+		expect time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 30 * time.Second},
+		{6, 10 * time.Second},
+		{12, 5 * time.Second},
+		{100, 5 * time.Second},
+	}
+	for _, tc := range testcases {
+		assert.Equal(t, tc.expect, adaptiveDiscoveryTime(tc.peers, 5*time.Second, time.Minute),
+			"peers=%v", tc.peers)
+	}
+}
+
+func TestSyncer_discoveryTime(t *testing.T) {
+	syncer, _ := setupOfferSyncer(t)
+	peers := 3
+	withPeerCount(func() int { return peers })(syncer)
+
+	// Adaptive discovery is disabled by default, using the fixed discovery time.
+	assert.Equal(t, 15*time.Second, syncer.discoveryTime(15*time.Second))
+	assert.Equal(t, time.Duration(0), syncer.discoveryTime(0))
+
+	syncer.config.DiscoveryTimeAdaptive = true
+	syncer.config.DiscoveryTimeMin = 5 * time.Second
+	syncer.config.DiscoveryTimeMax = time.Minute
+	assert.Equal(t, 20*time.Second, syncer.discoveryTime(15*time.Second))
+	peers = 30
+	assert.Equal(t, 5*time.Second, syncer.discoveryTime(15*time.Second))
+	peers = 0
+	assert.Equal(t, time.Minute, syncer.discoveryTime(0))
+}
@@ -0,0 +1,189 @@
+package statesynctest
+
+import (
+	"bytes"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+)
+
+// Snapshot is a snapshot served by an App.
+type Snapshot struct {
+	Height   uint64
+	Format   uint32
+	Chunks   [][]byte
+	Metadata []byte
+}
+
+// Hash returns the snapshot hash, i.e. the hash of its concatenated chunks. An App restoring the
+// snapshot verifies the restored chunks against it.
+func (s Snapshot) Hash() []byte {
+	return tmhash.Sum(bytes.Join(s.Chunks, nil))
+}
+
+// ABCI returns the snapshot as an ABCI snapshot.
+func (s Snapshot) ABCI() *abci.Snapshot {
+	return &abci.Snapshot{
+		Height:   s.Height,
+		Format:   s.Format,
+		Chunks:   uint32(len(s.Chunks)),
+		Hash:     s.Hash(),
+		Metadata: s.Metadata,
+	}
+}
+
+// App is a fake ABCI application implementing the state sync methods, for exercising state syncs
+// against real reactors. It serves the snapshots added via AddSnapshot(), and restores offered
+// snapshots by storing the applied chunks, verifying them against the snapshot hash once all have
+// been applied. It then reports the snapshot height and the app hash it was offered with via
+// Info(), like a real app would after restoring it.
+//
+// The hooks can be set before the App is used to override its responses, e.g. to reject snapshots
+// or request chunk refetches. A hook returning nil falls back to the default response.
+type App struct {
+	abci.BaseApplication
+
+	// OfferSnapshotHook is called for each snapshot offered to the app.
+	OfferSnapshotHook func(req abci.RequestOfferSnapshot) *abci.ResponseOfferSnapshot
+	// ApplySnapshotChunkHook is called for each chunk applied, before the chunk is stored.
+	ApplySnapshotChunkHook func(req abci.RequestApplySnapshotChunk) *abci.ResponseApplySnapshotChunk
+	// InfoHook is called for each Info request, e.g. to report a different app hash than the one
+	// restored, as if the snapshot was bad.
+	InfoHook func(req abci.RequestInfo) *abci.ResponseInfo
+
+	mtx       tmsync.Mutex
+	snapshots []Snapshot
+	offers    []abci.RequestOfferSnapshot
+	restoring *abci.RequestOfferSnapshot
+	chunks    [][]byte
+	applied   []bool
+	restored  *Snapshot
+	height    int64
+	appHash   []byte
+}
+
+var _ abci.Application = (*App)(nil)
+
+// NewApp creates a new fake app serving the given snapshots.
+func NewApp(snapshots ...Snapshot) *App {
+	return &App{snapshots: snapshots}
+}
+
+// AddSnapshot adds a snapshot for the app to serve.
+func (app *App) AddSnapshot(snapshot Snapshot) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	app.snapshots = append(app.snapshots, snapshot)
+}
+
+// Offers returns the snapshot offers made to the app, in order.
+func (app *App) Offers() []abci.RequestOfferSnapshot {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	return append([]abci.RequestOfferSnapshot{}, app.offers...)
+}
+
+// Restored returns the snapshot restored by the app, if any.
+func (app *App) Restored() *Snapshot {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	return app.restored
+}
+
+// Info implements abci.Application.
+func (app *App) Info(req abci.RequestInfo) abci.ResponseInfo {
+	if app.InfoHook != nil {
+		if resp := app.InfoHook(req); resp != nil {
+			return *resp
+		}
+	}
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	return abci.ResponseInfo{LastBlockHeight: app.height, LastBlockAppHash: app.appHash}
+}
+
+// ListSnapshots implements abci.Application.
+func (app *App) ListSnapshots(req abci.RequestListSnapshots) abci.ResponseListSnapshots {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	resp := abci.ResponseListSnapshots{}
+	for _, snapshot := range app.snapshots {
+		resp.Snapshots = append(resp.Snapshots, snapshot.ABCI())
+	}
+	return resp
+}
+
+// LoadSnapshotChunk implements abci.Application. Unknown chunks are returned as nil, i.e. missing.
+func (app *App) LoadSnapshotChunk(req abci.RequestLoadSnapshotChunk) abci.ResponseLoadSnapshotChunk {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	for _, snapshot := range app.snapshots {
+		if snapshot.Height == req.Height && snapshot.Format == req.Format &&
+			req.Chunk < uint32(len(snapshot.Chunks)) {
+			return abci.ResponseLoadSnapshotChunk{Chunk: snapshot.Chunks[req.Chunk]}
+		}
+	}
+	return abci.ResponseLoadSnapshotChunk{}
+}
+
+// OfferSnapshot implements abci.Application. By default, all snapshots are accepted.
+func (app *App) OfferSnapshot(req abci.RequestOfferSnapshot) abci.ResponseOfferSnapshot {
+	app.mtx.Lock()
+	app.offers = append(app.offers, req)
+	app.mtx.Unlock()
+	if app.OfferSnapshotHook != nil {
+		if resp := app.OfferSnapshotHook(req); resp != nil {
+			return *resp
+		}
+	}
+	if req.Snapshot == nil {
+		return abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}
+	}
+
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	app.restoring = &req
+	app.chunks = make([][]byte, req.Snapshot.Chunks)
+	app.applied = make([]bool, req.Snapshot.Chunks)
+	return abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}
+}
+
+// ApplySnapshotChunk implements abci.Application. By default, chunks are stored until all chunks
+// have been applied, after which the snapshot is verified and either restored or rejected.
+func (app *App) ApplySnapshotChunk(req abci.RequestApplySnapshotChunk) abci.ResponseApplySnapshotChunk {
+	if app.ApplySnapshotChunkHook != nil {
+		if resp := app.ApplySnapshotChunkHook(req); resp != nil {
+			return *resp
+		}
+	}
+
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	if app.restoring == nil || req.Index >= uint32(len(app.chunks)) {
+		return abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ABORT}
+	}
+	app.chunks[req.Index] = req.Chunk
+	app.applied[req.Index] = true
+	for _, applied := range app.applied {
+		if !applied {
+			return abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}
+		}
+	}
+
+	offer := app.restoring
+	app.restoring = nil
+	snapshot := Snapshot{
+		Height:   offer.Snapshot.Height,
+		Format:   offer.Snapshot.Format,
+		Chunks:   app.chunks,
+		Metadata: offer.Snapshot.Metadata,
+	}
+	if !bytes.Equal(snapshot.Hash(), offer.Snapshot.Hash) {
+		return abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_REJECT_SNAPSHOT}
+	}
+	app.restored = &snapshot
+	app.height = int64(snapshot.Height)
+	app.appHash = offer.AppHash
+	return abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}
+}
@@ -0,0 +1,124 @@
+package statesynctest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+)
+
+var testSnapshots = []Snapshot{
+	{Height: 3, Format: 1, Chunks: [][]byte{{3, 0}, {3, 1}, {3, 2}}},
+	{Height: 5, Format: 1, Chunks: [][]byte{{5, 0}, {5, 1}, {5, 2}, {5, 3}}, Metadata: []byte{5}},
+}
+
+func newTestStateProvider() *StateProvider {
+	stateProvider := NewStateProvider("chain")
+	stateProvider.SetAppHash(3, []byte("app_hash_3"))
+	stateProvider.SetAppHash(5, []byte("app_hash_5"))
+	return stateProvider
+}
+
+func TestNetwork_Sync(t *testing.T) {
+	client := NewApp()
+	network := NewNetwork(t, cfg.TestStateSyncConfig(), NewApp(testSnapshots...), client)
+
+	result, err := network.Nodes[1].Reactor.SyncSnapshot(newTestStateProvider(), time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, result.Height)
+	assert.EqualValues(t, 5, result.State.LastBlockHeight)
+	assert.Equal(t, []byte("app_hash_5"), result.State.AppHash)
+	assert.Equal(t, testSnapshots[1].Hash(), result.Hash)
+	assert.Equal(t, &testSnapshots[1], client.Restored())
+
+	resp := client.Info(abci.RequestInfo{})
+	assert.EqualValues(t, 5, resp.LastBlockHeight)
+	assert.Equal(t, []byte("app_hash_5"), resp.LastBlockAppHash)
+}
+
+func TestNetwork_Sync_refetchChunk(t *testing.T) {
+	// The app asks to refetch chunk 1 the first time it is applied.
+	var (
+		refetched bool
+		mtx       tmsync.Mutex
+	)
+	client := NewApp()
+	client.ApplySnapshotChunkHook = func(req abci.RequestApplySnapshotChunk) *abci.ResponseApplySnapshotChunk {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if req.Index != 1 || refetched {
+			return nil
+		}
+		refetched = true
+		return &abci.ResponseApplySnapshotChunk{
+			Result:        abci.ResponseApplySnapshotChunk_ACCEPT,
+			RefetchChunks: []uint32{1},
+		}
+	}
+	network := NewNetwork(t, cfg.TestStateSyncConfig(), NewApp(testSnapshots...), client)
+
+	result, err := network.Nodes[1].Reactor.SyncSnapshot(newTestStateProvider(), time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, result.Height)
+	assert.True(t, refetched)
+	assert.Equal(t, &testSnapshots[1], client.Restored())
+}
+
+func TestNetwork_Sync_appHashMismatch(t *testing.T) {
+	// The snapshot at height 5 restores to a different app hash than the trusted one.
+	newClient := func() *App {
+		client := NewApp()
+		client.InfoHook = func(req abci.RequestInfo) *abci.ResponseInfo {
+			if restored := client.Restored(); restored != nil && restored.Height == 5 {
+				return &abci.ResponseInfo{LastBlockHeight: 5, LastBlockAppHash: []byte("bad_app_hash")}
+			}
+			return nil
+		}
+		return client
+	}
+
+	// By default, the snapshot is rejected and the one at height 3 is restored instead.
+	client := newClient()
+	network := NewNetwork(t, cfg.TestStateSyncConfig(), NewApp(testSnapshots...), client)
+	result, err := network.Nodes[1].Reactor.SyncSnapshot(newTestStateProvider(), time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, result.Height)
+	assert.Equal(t, &testSnapshots[0], client.Restored())
+
+	// With app_hash_mismatch = "abort", the sync fails instead.
+	config := cfg.TestStateSyncConfig()
+	config.AppHashMismatch = "abort"
+	client = newClient()
+	network = NewNetwork(t, config, NewApp(testSnapshots...), client)
+	_, err = network.Nodes[1].Reactor.SyncSnapshot(newTestStateProvider(), time.Second)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "restored app hash does not match trusted app hash")
+	assert.Len(t, client.Offers(), 1)
+}
+
+func TestNetwork_Sync_rejectSnapshot(t *testing.T) {
+	// The app rejects the snapshot at height 5, so the one at height 3 is restored instead.
+	client := NewApp()
+	client.OfferSnapshotHook = func(req abci.RequestOfferSnapshot) *abci.ResponseOfferSnapshot {
+		if req.Snapshot.Height == 5 {
+			return &abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}
+		}
+		return nil
+	}
+	network := NewNetwork(t, cfg.TestStateSyncConfig(), NewApp(testSnapshots...), client)
+
+	result, err := network.Nodes[1].Reactor.SyncSnapshot(newTestStateProvider(), time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, result.Height)
+	assert.Equal(t, []byte("app_hash_3"), result.State.AppHash)
+	assert.Equal(t, &testSnapshots[0], client.Restored())
+	offers := client.Offers()
+	require.Len(t, offers, 2)
+	assert.EqualValues(t, 5, offers[0].Snapshot.Height)
+	assert.EqualValues(t, 3, offers[1].Snapshot.Height)
+}
@@ -0,0 +1,229 @@
+package statesynctest
+
+import (
+	"fmt"
+	"io"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+	"github.com/tendermint/tendermint/p2p/mock"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	"github.com/tendermint/tendermint/statesync"
+)
+
+// fakePeerQueueSize is the number of messages a FakePeer can queue for delivery to the reactor,
+// beyond which further messages are dropped as if the peer's send queue was full.
+const fakePeerQueueSize = 1024
+
+// PeerFeeder feeds synthetic peer updates into a state sync reactor, like the p2p switch does when
+// peers connect and disconnect, such that peer churn during a sync can be exercised
+// deterministically: peers come and go exactly when the test says so, and a peer's chunk requests
+// can be held in flight until the test answers them or disconnects the peer.
+type PeerFeeder struct {
+	reactor *statesync.Reactor
+}
+
+// NewPeerFeeder creates a new peer feeder for a reactor, which must be running but not attached
+// to a switch, e.g. the reactor of a node created via NewNode().
+func NewPeerFeeder(reactor *statesync.Reactor) *PeerFeeder {
+	return &PeerFeeder{reactor: reactor}
+}
+
+// Up connects a peer to the reactor. If a state sync is in progress, the reactor requests the
+// peer's snapshots, which the peer then advertises.
+func (f *PeerFeeder) Up(peer *FakePeer) {
+	peer.connect(f.reactor)
+	f.reactor.AddPeer(peer)
+}
+
+// Down disconnects a peer from the reactor, like a remote disconnect. Messages the peer hadn't delivered yet, including
+// answers to held chunk requests, are dropped, and the peer delivers no further messages once
+// Down returns.
+func (f *PeerFeeder) Down(peer *FakePeer) {
+	peer.disconnect()
+	f.reactor.RemovePeer(peer, io.EOF) // as the switch reports remote disconnects
+}
+
+// delivery is a message queued for delivery from a FakePeer to the reactor.
+type delivery struct {
+	chID byte
+	msg  []byte
+}
+
+// FakePeer is a synthetic peer for use with a PeerFeeder. It advertises and serves the given
+// snapshots in response to the reactor's requests, answering chunk requests for other snapshots
+// with missing chunks. Answers are delivered to the reactor in order, but asynchronously like
+// messages received from a real peer.
+type FakePeer struct {
+	*mock.Peer
+	snapshots []Snapshot
+
+	mtx      tmsync.Mutex
+	queue    chan delivery
+	quit     chan struct{}
+	done     chan struct{}
+	hold     bool
+	held     []*ssproto.ChunkRequest
+	requests []*ssproto.ChunkRequest
+}
+
+var _ p2p.Peer = (*FakePeer)(nil)
+
+// NewFakePeer creates a new fake peer serving the given snapshots.
+func NewFakePeer(snapshots ...Snapshot) *FakePeer {
+	return &FakePeer{Peer: mock.NewPeer(nil), snapshots: snapshots}
+}
+
+// HoldChunks makes the peer hold chunk requests in flight rather than answering them, until they
+// are released via ReleaseChunks() or dropped by disconnecting the peer.
+func (p *FakePeer) HoldChunks() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.hold = true
+}
+
+// ReleaseChunks answers the held chunk requests, and stops holding further ones.
+func (p *FakePeer) ReleaseChunks() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.hold = false
+	for _, req := range p.held {
+		p.answerChunk(req)
+	}
+	p.held = nil
+}
+
+// HeldChunks returns the indexes of the chunk requests being held in flight.
+func (p *FakePeer) HeldChunks() []uint32 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	indexes := make([]uint32, 0, len(p.held))
+	for _, req := range p.held {
+		indexes = append(indexes, req.Index)
+	}
+	return indexes
+}
+
+// ChunkRequests returns the indexes of all chunks requested from the peer, in order.
+func (p *FakePeer) ChunkRequests() []uint32 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	indexes := make([]uint32, 0, len(p.requests))
+	for _, req := range p.requests {
+		indexes = append(indexes, req.Index)
+	}
+	return indexes
+}
+
+// Send implements p2p.Peer, handling a message from the reactor.
+func (p *FakePeer) Send(chID byte, msgBytes []byte) bool {
+	return p.TrySend(chID, msgBytes)
+}
+
+// TrySend implements p2p.Peer, handling a message from the reactor.
+func (p *FakePeer) TrySend(chID byte, msgBytes []byte) bool {
+	msg := &ssproto.Message{}
+	if err := msg.Unmarshal(msgBytes); err != nil {
+		panic(fmt.Errorf("fake peer received invalid message: %w", err))
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.queue == nil {
+		return false
+	}
+	switch msg := msg.Sum.(type) {
+	case *ssproto.Message_SnapshotsRequest:
+		for _, snapshot := range p.snapshots {
+			abciSnapshot := snapshot.ABCI()
+			p.deliver(statesync.SnapshotChannel, &ssproto.Message{Sum: &ssproto.Message_SnapshotsResponse{
+				SnapshotsResponse: &ssproto.SnapshotsResponse{
+					Height:   abciSnapshot.Height,
+					Format:   abciSnapshot.Format,
+					Chunks:   abciSnapshot.Chunks,
+					Hash:     abciSnapshot.Hash,
+					Metadata: abciSnapshot.Metadata,
+				},
+			}})
+		}
+	case *ssproto.Message_ChunkRequest:
+		p.requests = append(p.requests, msg.ChunkRequest)
+		if p.hold {
+			p.held = append(p.held, msg.ChunkRequest)
+		} else {
+			p.answerChunk(msg.ChunkRequest)
+		}
+	}
+	return true
+}
+
+// answerChunk queues the answer to a chunk request. The caller must hold the mutex lock.
+func (p *FakePeer) answerChunk(req *ssproto.ChunkRequest) {
+	resp := &ssproto.ChunkResponse{Height: req.Height, Format: req.Format, Index: req.Index, Missing: true}
+	for _, snapshot := range p.snapshots {
+		if snapshot.Height == req.Height && snapshot.Format == req.Format &&
+			req.Index < uint32(len(snapshot.Chunks)) {
+			resp.Chunk, resp.Missing = append([]byte{}, snapshot.Chunks[req.Index]...), false
+		}
+	}
+	p.deliver(statesync.ChunkChannel, &ssproto.Message{Sum: &ssproto.Message_ChunkResponse{ChunkResponse: resp}})
+}
+
+// deliver queues a message for delivery to the reactor, dropping it if the queue is full. The
+// caller must hold the mutex lock.
+func (p *FakePeer) deliver(chID byte, msg *ssproto.Message) {
+	bz, err := msg.Marshal()
+	if err != nil {
+		panic(fmt.Errorf("fake peer failed to marshal message: %w", err))
+	}
+	select {
+	case p.queue <- delivery{chID: chID, msg: bz}:
+	default:
+	}
+}
+
+// connect connects the peer to a reactor, starting delivery of its messages.
+func (p *FakePeer) connect(reactor *statesync.Reactor) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.queue != nil {
+		panic("fake peer is already connected")
+	}
+	p.queue = make(chan delivery, fakePeerQueueSize)
+	p.quit = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.deliverRoutine(reactor, p.queue, p.quit, p.done)
+}
+
+// disconnect stops delivery of the peer's messages, dropping undelivered and held ones, and
+// waits for any delivery in progress to complete.
+func (p *FakePeer) disconnect() {
+	p.mtx.Lock()
+	if p.queue == nil {
+		p.mtx.Unlock()
+		return
+	}
+	close(p.quit)
+	done := p.done
+	p.queue, p.quit, p.done = nil, nil, nil
+	p.held = nil
+	p.mtx.Unlock()
+	<-done
+}
+
+// deliverRoutine delivers queued messages to the reactor until quit is closed.
+func (p *FakePeer) deliverRoutine(reactor *statesync.Reactor, queue <-chan delivery, quit, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case d := <-queue:
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			reactor.Receive(d.chID, p, d.msg)
+		case <-quit:
+			return
+		}
+	}
+}
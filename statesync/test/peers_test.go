@@ -0,0 +1,92 @@
+package statesynctest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/statesync"
+)
+
+// syncResult is the outcome of a state sync run in the background.
+type syncResult struct {
+	result *statesync.SyncResult
+	err    error
+}
+
+// startSync starts a state sync on a standalone node in the background, returning once the sync
+// is in progress, such that peers fed to the node are asked for snapshots.
+func startSync(t *testing.T, node *Node) <-chan syncResult {
+	done := make(chan syncResult, 1)
+	go func() {
+		result, err := node.Reactor.SyncSnapshot(newTestStateProvider(), 500*time.Millisecond)
+		done <- syncResult{result: result, err: err}
+	}()
+	require.Eventually(t, func() bool {
+		_, ok := node.Reactor.SyncerState()
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	return done
+}
+
+func TestPeerFeeder_releaseChunks(t *testing.T) {
+	app := NewApp()
+	client := NewNode(t, cfg.TestStateSyncConfig(), app)
+	feeder := NewPeerFeeder(client.Reactor)
+	done := startSync(t, client)
+
+	peer := NewFakePeer(testSnapshots[1])
+	peer.HoldChunks()
+	feeder.Up(peer)
+	require.Eventually(t, func() bool { return len(peer.HeldChunks()) == 4 }, 5*time.Second,
+		10*time.Millisecond)
+	assert.ElementsMatch(t, []uint32{0, 1, 2, 3}, peer.ChunkRequests())
+	_, confidence := client.Reactor.EstimatedTimeRemaining()
+	assert.Equal(t, statesync.ETAUnknown, confidence)
+
+	peer.ReleaseChunks()
+	res := <-done
+	require.NoError(t, res.err)
+	assert.EqualValues(t, 5, res.result.Height)
+	assert.Equal(t, &testSnapshots[1], app.Restored())
+	assert.Empty(t, peer.HeldChunks())
+	_, confidence = client.Reactor.EstimatedTimeRemaining()
+	assert.Equal(t, statesync.ETAUnknown, confidence)
+}
+
+func TestPeerFeeder_churn(t *testing.T) {
+	// A peer without the snapshot and a peer holding all chunk requests in flight connect first,
+	// then a serving peer connects and the holding peer disconnects. The dropped chunks are
+	// refetched from the serving peer once their requests time out.
+	app := NewApp()
+	client := NewNode(t, cfg.TestStateSyncConfig(), app)
+	feeder := NewPeerFeeder(client.Reactor)
+	done := startSync(t, client)
+
+	empty := NewFakePeer()
+	feeder.Up(empty)
+	holder := NewFakePeer(testSnapshots[1])
+	holder.HoldChunks()
+	feeder.Up(holder)
+	require.Eventually(t, func() bool { return len(holder.HeldChunks()) == 4 }, 5*time.Second,
+		10*time.Millisecond)
+
+	server := NewFakePeer(testSnapshots[1])
+	feeder.Up(server)
+	require.Eventually(t, func() bool {
+		state, ok := client.Reactor.SyncerState()
+		return ok && state.Restoring != nil && state.Restoring.Peers == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	feeder.Down(holder)
+	assert.Empty(t, holder.HeldChunks())
+
+	res := <-done
+	require.NoError(t, res.err)
+	assert.EqualValues(t, 5, res.result.Height)
+	assert.Equal(t, &testSnapshots[1], app.Restored())
+	assert.Empty(t, empty.ChunkRequests())
+	assert.ElementsMatch(t, []uint32{0, 1, 2, 3}, server.ChunkRequests())
+}
@@ -0,0 +1,101 @@
+package statesynctest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	tmstate "github.com/tendermint/tendermint/proto/tendermint/state"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+	tmversion "github.com/tendermint/tendermint/proto/tendermint/version"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync"
+	"github.com/tendermint/tendermint/types"
+	"github.com/tendermint/tendermint/version"
+)
+
+// StateProvider is a fake state provider, implementing statesync.StateProvider, which trusts the
+// app hashes set via SetAppHash(). It returns states and commits signed by a random validator
+// set, such that they pass state sync verification.
+type StateProvider struct {
+	chainID  string
+	valSet   *types.ValidatorSet
+	privVals []types.PrivValidator
+
+	mtx       tmsync.Mutex
+	appHashes map[uint64][]byte
+}
+
+var _ statesync.StateProvider = (*StateProvider)(nil)
+
+// NewStateProvider creates a new fake state provider for the given chain.
+func NewStateProvider(chainID string) *StateProvider {
+	valSet, privVals := types.RandValidatorSet(3, 10)
+	return &StateProvider{
+		chainID:   chainID,
+		valSet:    valSet,
+		privVals:  privVals,
+		appHashes: make(map[uint64][]byte),
+	}
+}
+
+// SetAppHash sets the trusted app hash at a height.
+func (p *StateProvider) SetAppHash(height uint64, appHash []byte) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.appHashes[height] = appHash
+}
+
+// AppHash implements statesync.StateProvider.
+func (p *StateProvider) AppHash(ctx context.Context, height uint64) ([]byte, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	appHash, ok := p.appHashes[height]
+	if !ok {
+		return nil, fmt.Errorf("no app hash at height %v", height)
+	}
+	return appHash, nil
+}
+
+// Commit implements statesync.StateProvider.
+func (p *StateProvider) Commit(ctx context.Context, height uint64) (*types.Commit, error) {
+	voteSet := types.NewVoteSet(p.chainID, int64(height), 0, tmproto.PrecommitType, p.valSet)
+	return types.MakeCommit(p.blockID(height), int64(height), 0, voteSet, p.privVals, time.Now())
+}
+
+// State implements statesync.StateProvider.
+func (p *StateProvider) State(ctx context.Context, height uint64) (sm.State, error) {
+	appHash, err := p.AppHash(ctx, height)
+	if err != nil {
+		return sm.State{}, err
+	}
+	return sm.State{
+		ChainID: p.chainID,
+		Version: tmstate.Version{
+			Consensus: tmversion.Consensus{Block: version.BlockProtocol},
+			Software:  version.TMCoreSemVer,
+		},
+		InitialHeight:   1,
+		LastBlockHeight: int64(height),
+		LastBlockID:     p.blockID(height),
+		LastBlockTime:   time.Now(),
+		AppHash:         appHash,
+
+		LastValidators: p.valSet.Copy(),
+		Validators:     p.valSet.Copy(),
+		NextValidators: p.valSet.Copy(),
+
+		ConsensusParams:                  *types.DefaultConsensusParams(),
+		LastHeightConsensusParamsChanged: int64(height),
+	}, nil
+}
+
+// blockID returns the fake ID of the block at a height.
+func (p *StateProvider) blockID(height uint64) types.BlockID {
+	return types.BlockID{
+		Hash:          tmhash.Sum([]byte(fmt.Sprintf("block %v", height))),
+		PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte(fmt.Sprintf("parts %v", height)))},
+	}
+}
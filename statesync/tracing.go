@@ -0,0 +1,46 @@
+package statesync
+
+import "context"
+
+// Span names used when tracing state syncs. A sync span contains discovery spans for each time
+// we wait to discover snapshots, and snapshot spans for each snapshot we attempt to restore. The
+// latter contain verify spans for snapshot verification, as well as chunk fetch and apply spans
+// for each chunk.
+const (
+	SpanSync       = "statesync"
+	SpanDiscovery  = "statesync.discovery"
+	SpanSnapshot   = "statesync.snapshot"
+	SpanVerify     = "statesync.verify"
+	SpanChunkFetch = "statesync.chunk.fetch"
+	SpanChunkApply = "statesync.chunk.apply"
+)
+
+// Tracer traces the phases of a state sync as nested spans, e.g. by exporting them to an
+// OpenTelemetry tracer, such that operators can see where sync time goes.
+type Tracer interface {
+	// StartSpan starts a span with the given name and key/value attributes, as a child of any
+	// span in the given context. It returns a context containing the new span, used to start
+	// child spans. It must be safe for concurrent use.
+	StartSpan(ctx context.Context, name string, keyvals ...interface{}) (context.Context, Span)
+}
+
+// Span is a tracing span started by a Tracer.
+type Span interface {
+	// End ends the span, recording the error, if any, as its outcome.
+	End(err error)
+}
+
+// NopTracer returns a Tracer which does nothing.
+func NopTracer() Tracer {
+	return nopTracer{}
+}
+
+type nopTracer struct{}
+
+func (nopTracer) StartSpan(ctx context.Context, name string, keyvals ...interface{}) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) End(error) {}
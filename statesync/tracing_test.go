@@ -0,0 +1,136 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	"github.com/tendermint/tendermint/libs/log"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/proxy"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync/mocks"
+	"github.com/tendermint/tendermint/types"
+)
+
+type spanKey struct{}
+
+// recordedSpan is a span recorded by recordingTracer.
+type recordedSpan struct {
+	name   string
+	parent string
+	ended  bool
+	err    error
+}
+
+func (s *recordedSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+// recordingTracer records started spans, along with the names of their parents.
+type recordingTracer struct {
+	mtx   tmsync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string, keyvals ...interface{}) (context.Context, Span) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	span := &recordedSpan{name: name}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *recordingTracer) Spans(name string) []*recordedSpan {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	spans := []*recordedSpan{}
+	for _, span := range t.spans {
+		if span.name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func TestNopTracer(t *testing.T) {
+	ctx := context.Background()
+	spanCtx, span := NopTracer().StartSpan(ctx, SpanSync, "height", 1)
+	assert.Equal(t, ctx, spanCtx)
+	span.End(errors.New("boom"))
+}
+
+func TestSyncer_Sync_tracing(t *testing.T) {
+	blockID := types.BlockID{
+		Hash:          tmhash.Sum([]byte("block")),
+		PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte("parts"))},
+	}
+	valSet, _ := makeSignedCommit(t, "chain", 1, blockID)
+	_, commit := makeSignedCommit(t, "chain", 1, blockID)
+	state := sm.State{ChainID: "chain", LastBlockHeight: 1, LastBlockID: blockID, LastValidators: valSet}
+
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, uint64(1)).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(state, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(commit, nil)
+	connSnapshot := &proxymocks.AppConnSnapshot{}
+	connQuery := &proxymocks.AppConnQuery{}
+	tracer := &recordingTracer{}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), connSnapshot, connQuery,
+		stateProvider, "", withTracer(tracer))
+
+	peer := simplePeer("a")
+	peer.On("Send", ChunkChannel, mock.Anything).Maybe().Return(true)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1, 2, 3}}
+	_, err := syncer.AddSnapshot(peer, s)
+	require.NoError(t, err)
+	connSnapshot.On("OfferSnapshotSync", mock.Anything).Return(
+		&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+	connSnapshot.On("ApplySnapshotChunkSync", mock.Anything).Return(
+		&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}, nil)
+	connQuery.On("InfoSync", proxy.RequestInfo).Return(&abci.ResponseInfo{
+		LastBlockHeight:  1,
+		LastBlockAppHash: []byte("app_hash"),
+	}, nil)
+
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}, Sender: "a"})
+	require.NoError(t, err)
+
+	// The commit doesn't match the state, so the sync fails in the final verification.
+	_, _, err = syncer.Sync(s, chunks)
+	require.Error(t, err)
+
+	snapshots := tracer.Spans(SpanSnapshot)
+	require.Len(t, snapshots, 1)
+	assert.True(t, snapshots[0].ended)
+	assert.Equal(t, err, snapshots[0].err)
+
+	verifies := tracer.Spans(SpanVerify)
+	require.Len(t, verifies, 2)
+	for _, span := range verifies {
+		assert.Equal(t, SpanSnapshot, span.parent)
+		assert.True(t, span.ended)
+	}
+	assert.NoError(t, verifies[0].err)
+	assert.True(t, errors.Is(verifies[1].err, errVerifyFailed))
+
+	applies := tracer.Spans(SpanChunkApply)
+	require.Len(t, applies, 1)
+	assert.Equal(t, SpanSnapshot, applies[0].parent)
+	assert.NoError(t, applies[0].err)
+}
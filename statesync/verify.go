@@ -0,0 +1,261 @@
+package statesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// VerifySnapshot lets operators check that a snapshot available on the network is restorable,
+// before committing a node to it. The snapshot is discovered from peers, downloaded, and restored
+// into the staging app like with staging_restore, and its app hash and commit verified against
+// the state provider. The staging app is then discarded rather than promoted, so the live app
+// state is never touched. Verification runs in the background, and is cancelled if a state sync
+// starts, such that it never competes with a real sync for the staging app or peers.
+
+var (
+	// errVerifyNoStagingApp is returned by VerifySnapshot() without a staging app.
+	errVerifyNoStagingApp = errors.New("snapshot verification requires a staging app")
+	// errVerifySyncing is returned by VerifySnapshot() while a state sync is in progress.
+	errVerifySyncing = errors.New("can't verify snapshots while a state sync is in progress")
+	// errVerifyInProgress is returned by VerifySnapshot() while another verification is running.
+	errVerifyInProgress = errors.New("a snapshot verification is already in progress")
+	// errVerifySnapshotNotFound is returned when no peer has the snapshot to verify.
+	errVerifySnapshotNotFound = errors.New("snapshot not found on any peer")
+	// errVerifyCancelled is returned when a verification is cancelled by a state sync starting.
+	errVerifyCancelled = errors.New("verification cancelled by state sync")
+)
+
+// Snapshot verification statuses, as reported in VerificationReport.Status.
+const (
+	VerificationRunning = "running"
+	VerificationPassed  = "passed"
+	VerificationFailed  = "failed"
+)
+
+// VerificationReport reports on a snapshot verification started via VerifySnapshot().
+type VerificationReport struct {
+	// Height and Format identify the snapshot to verify. Chunks and Hash are set once the snapshot
+	// has been discovered.
+	Height uint64
+	Format uint32
+	Chunks uint32
+	Hash   []byte
+	// Status is the verification status, i.e. VerificationRunning, Passed, or Failed.
+	Status string
+	// Error is the reason verification failed, if it did.
+	Error string
+	// Started and Ended are the start and end times of the verification. Ended is zero while
+	// running.
+	Started time.Time
+	Ended   time.Time
+	// ChunkResults are the results for each of the snapshot's chunks, in index order, once
+	// restoring it has started.
+	ChunkResults []ChunkVerification
+}
+
+// ChunkVerification is the verification result for a snapshot chunk.
+type ChunkVerification struct {
+	Index uint32
+	// Sender is the peer the chunk was received from, or empty if it wasn't received.
+	Sender p2p.ID
+	// Accepted is whether the app accepted the chunk.
+	Accepted bool
+	// Refetches is the number of times the app asked to refetch the chunk, e.g. because it failed
+	// verification.
+	Refetches int
+}
+
+// snapshotVerification is a snapshot verification run by the reactor.
+type snapshotVerification struct {
+	tmsync.Mutex
+	report VerificationReport
+	cancel func()
+	done   chan struct{} // closed when the verification ends
+}
+
+// Report returns the verification report.
+func (v *snapshotVerification) Report() VerificationReport {
+	v.Lock()
+	defer v.Unlock()
+	report := v.report
+	report.ChunkResults = append([]ChunkVerification{}, v.report.ChunkResults...)
+	return report
+}
+
+// withVerifyOnly makes the syncer verify restored snapshots without promoting them.
+func withVerifyOnly() syncerOption {
+	return func(s *syncer) { s.verifyOnly = true }
+}
+
+// VerifySnapshot starts verifying the snapshot at the given height and format, returning the
+// initial report. The verification runs in the background, reporting its result via
+// Verification(). It requires a staging app, see WithStagingApp(), and fails if a state sync or
+// another verification is in progress. The verification is cancelled if a state sync starts.
+func (r *Reactor) VerifySnapshot(stateProvider StateProvider, height uint64, format uint32) (
+	VerificationReport, error) {
+	if stateProvider == nil {
+		return VerificationReport{}, errNoStateProvider
+	}
+	if r.staging == nil {
+		return VerificationReport{}, errVerifyNoStagingApp
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.verification != nil {
+		select {
+		case <-r.verification.done:
+		default:
+			return VerificationReport{}, errVerifyInProgress
+		}
+	}
+	if len(r.syncers) > 0 {
+		return VerificationReport{}, errVerifySyncing
+	}
+
+	// The syncer doesn't record restores, report snapshot availability, or feed metrics and peer
+	// reputation, which are for real state syncs only.
+	options := append(append([]syncerOption{}, r.syncerOptions...), withStagingApp(r.staging), withVerifyOnly(),
+		withSnapshotAvailable(nil), withMetrics(NopMetrics()), withPeerReputation(nil))
+	syncer := newSyncer(r.config, r.Logger.With("verify", height), r.conn, r.connQuery, stateProvider, "",
+		options...)
+	ctx, cancel := context.WithCancel(r.ctx)
+	syncer.traceRoot = ctx
+	v := &snapshotVerification{
+		report: VerificationReport{
+			Height:  height,
+			Format:  format,
+			Status:  VerificationRunning,
+			Started: time.Now(),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	r.verification = v
+	r.syncers[syncer] = struct{}{}
+	go r.runVerification(ctx, v, syncer)
+	return v.Report(), nil
+}
+
+// Verification returns the report of the snapshot verification in progress, or of the last one,
+// or false if no snapshot has been verified.
+func (r *Reactor) Verification() (VerificationReport, bool) {
+	r.mtx.RLock()
+	v := r.verification
+	r.mtx.RUnlock()
+	if v == nil {
+		return VerificationReport{}, false
+	}
+	return v.Report(), true
+}
+
+// cancelVerification cancels the snapshot verification in progress, if any, and waits for it to
+// end.
+func (r *Reactor) cancelVerification() {
+	r.mtx.RLock()
+	v := r.verification
+	r.mtx.RUnlock()
+	if v == nil {
+		return
+	}
+	v.cancel()
+	<-v.done
+}
+
+// runVerification runs a snapshot verification to completion, recording the result in its report.
+func (r *Reactor) runVerification(ctx context.Context, v *snapshotVerification, syncer *syncer) {
+	err := r.verify(ctx, v, syncer)
+	if ctx.Err() != nil {
+		err = errVerifyCancelled
+	}
+
+	r.mtx.Lock()
+	delete(r.syncers, syncer)
+	r.mtx.Unlock()
+	syncer.Close()
+	v.cancel()
+
+	v.Lock()
+	v.report.Ended = time.Now()
+	if err != nil {
+		v.report.Status = VerificationFailed
+		v.report.Error = err.Error()
+		r.Logger.Info("Snapshot verification failed", "height", v.report.Height, "format",
+			v.report.Format, "err", err)
+	} else {
+		v.report.Status = VerificationPassed
+		r.Logger.Info("Snapshot verification passed", "height", v.report.Height, "format",
+			v.report.Format, "hash", fmt.Sprintf("%X", v.report.Hash))
+	}
+	v.Unlock()
+	close(v.done)
+}
+
+// verify discovers, restores, and verifies the snapshot to verify, discarding it afterwards.
+func (r *Reactor) verify(ctx context.Context, v *snapshotVerification, syncer *syncer) error {
+	snapshot, err := r.discoverVerification(ctx, syncer, v.report.Height, v.report.Format)
+	if err != nil {
+		return err
+	}
+	v.Lock()
+	v.report.Chunks = snapshot.Chunks
+	v.report.Hash = snapshot.Hash
+	v.Unlock()
+
+	chunks, err := newChunkQueue(snapshot, r.tempDir)
+	if err != nil {
+		return fmt.Errorf("failed to create chunk queue: %w", err)
+	}
+	defer chunks.Close()
+	_, _, err = syncer.Sync(snapshot, chunks)
+
+	results := make([]ChunkVerification, 0, snapshot.Chunks)
+	_, _, _, accepted := chunks.Inspect()
+	isAccepted := make(map[uint32]bool, len(accepted))
+	for _, index := range accepted {
+		isAccepted[index] = true
+	}
+	for index := uint32(0); index < snapshot.Chunks; index++ {
+		results = append(results, ChunkVerification{
+			Index:     index,
+			Sender:    chunks.GetSender(index),
+			Accepted:  isAccepted[index],
+			Refetches: syncer.currentBudget().Refetches(index),
+		})
+	}
+	v.Lock()
+	v.report.ChunkResults = results
+	v.Unlock()
+	return err
+}
+
+// discoverVerification requests snapshots from peers, and waits up to discovery_time for the
+// snapshot to verify to be discovered. If several snapshots have the height and format, the
+// highest-ranked one is verified.
+func (r *Reactor) discoverVerification(ctx context.Context, syncer *syncer, height uint64,
+	format uint32) (*snapshot, error) {
+	r.rediscover()
+	timeout := time.NewTimer(r.config.DiscoveryTime)
+	defer timeout.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		for _, s := range syncer.snapshots.Ranked() {
+			if s.Height == height && s.Format == format {
+				return s, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout.C:
+			return nil, fmt.Errorf("%w: height %v format %v", errVerifySnapshotNotFound, height, format)
+		case <-ticker.C:
+		}
+	}
+}
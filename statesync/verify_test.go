@@ -0,0 +1,179 @@
+package statesync
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	p2pmocks "github.com/tendermint/tendermint/p2p/mocks"
+	ssproto "github.com/tendermint/tendermint/proto/tendermint/statesync"
+	"github.com/tendermint/tendermint/proxy"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync/mocks"
+	"github.com/tendermint/tendermint/types"
+)
+
+// setupVerifyStateProvider sets up a state provider for a snapshot at height 1 with app hash
+// "app_hash", along with a matching staging app which restores the snapshot's single chunk.
+func setupVerifyStateProvider(t *testing.T, s *snapshot) (*mocks.StateProvider, *testStagingApp) {
+	blockID := types.BlockID{
+		Hash:          tmhash.Sum([]byte("block")),
+		PartSetHeader: types.PartSetHeader{Total: 1, Hash: tmhash.Sum([]byte("parts"))},
+	}
+	valSet, commit := makeSignedCommit(t, "chain", 1, blockID)
+	state := sm.State{ChainID: "chain", LastBlockHeight: 1, LastBlockID: blockID, LastValidators: valSet}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("AppHash", mock.Anything, uint64(1)).Return([]byte("app_hash"), nil)
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(state, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(commit, nil)
+
+	staging := &testStagingApp{conn: &proxymocks.AppConnSnapshot{}, connQuery: &proxymocks.AppConnQuery{}}
+	staging.conn.On("OfferSnapshotSync", abci.RequestOfferSnapshot{
+		Snapshot: toABCI(s), AppHash: []byte("app_hash"),
+	}).Once().Return(&abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}, nil)
+	staging.conn.On("ApplySnapshotChunkSync", abci.RequestApplySnapshotChunk{
+		Index: 0, Chunk: []byte{1}, Sender: "a",
+	}).Once().Return(&abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}, nil)
+	staging.connQuery.On("InfoSync", proxy.RequestInfo).Once().Return(&abci.ResponseInfo{
+		LastBlockHeight:  1,
+		LastBlockAppHash: []byte("app_hash"),
+	}, nil)
+	return stateProvider, staging
+}
+
+func TestSyncer_Sync_verifyOnly(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1, 2, 3}}
+	stateProvider, staging := setupVerifyStateProvider(t, s)
+
+	// The verified snapshot is discarded, and the live app is never used.
+	liveConn := &proxymocks.AppConnSnapshot{}
+	liveQuery := &proxymocks.AppConnQuery{}
+	syncer := newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), liveConn, liveQuery, stateProvider, "",
+		withStagingApp(staging), withVerifyOnly())
+	_, err := syncer.AddSnapshot(simplePeer("a"), s)
+	require.NoError(t, err)
+	chunks, err := newChunkQueue(s, "")
+	require.NoError(t, err)
+	defer chunks.Close()
+	_, err = chunks.Add(&chunk{Height: 1, Format: 1, Index: 0, Chunk: []byte{1}, Sender: "a"})
+	require.NoError(t, err)
+
+	_, _, err = syncer.Sync(s, chunks)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"open", "discard"}, staging.calls)
+	staging.conn.AssertExpectations(t)
+	staging.connQuery.AssertExpectations(t)
+	liveConn.AssertExpectations(t)
+	liveQuery.AssertExpectations(t)
+
+	// Without a staging app, nothing is restored.
+	syncer = newSyncer(cfg.TestStateSyncConfig(), log.NewNopLogger(), liveConn, liveQuery, stateProvider, "",
+		withVerifyOnly())
+	_, _, err = syncer.Sync(s, chunks)
+	assert.Equal(t, errVerifyNoStagingApp, err)
+}
+
+func TestReactor_VerifySnapshot(t *testing.T) {
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1, 2, 3}}
+	stateProvider, staging := setupVerifyStateProvider(t, s)
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, &proxymocks.AppConnQuery{}, "",
+		WithStagingApp(staging))
+	require.NoError(t, r.Start())
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	_, ok := r.Verification()
+	assert.False(t, ok)
+
+	// The peer responds to chunk requests via the reactor.
+	peer := &p2pmocks.Peer{}
+	peer.On("ID").Return(p2p.ID("a"))
+	peer.On("Send", ChunkChannel, mock.Anything).Run(func(args mock.Arguments) {
+		r.Receive(ChunkChannel, peer, mustEncodeMsg(&ssproto.ChunkResponse{
+			Height: 1, Format: 1, Index: 0, Chunk: []byte{1}}))
+	}).Return(true)
+
+	report, err := r.VerifySnapshot(stateProvider, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, VerificationRunning, report.Status)
+	_, err = r.VerifySnapshot(stateProvider, 1, 1)
+	assert.Equal(t, errVerifyInProgress, err)
+
+	r.Receive(SnapshotChannel, peer, mustEncodeMsg(&ssproto.SnapshotsResponse{
+		Height: 1, Format: 1, Chunks: 1, Hash: []byte{1, 2, 3}}))
+	require.Eventually(t, func() bool {
+		report, _ := r.Verification()
+		return report.Status != VerificationRunning
+	}, 5*time.Second, 10*time.Millisecond)
+
+	report, ok = r.Verification()
+	require.True(t, ok)
+	assert.Equal(t, VerificationPassed, report.Status, report.Error)
+	assert.EqualValues(t, 1, report.Chunks)
+	assert.Equal(t, s.Hash, report.Hash)
+	assert.False(t, report.Ended.IsZero())
+	assert.Equal(t, []ChunkVerification{{Index: 0, Sender: "a", Accepted: true}}, report.ChunkResults)
+	assert.Equal(t, []string{"open", "discard"}, staging.calls)
+	staging.conn.AssertExpectations(t)
+	staging.connQuery.AssertExpectations(t)
+}
+
+func TestReactor_VerifySnapshot_errors(t *testing.T) {
+	stateProvider := &mocks.StateProvider{}
+
+	r := NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, &proxymocks.AppConnQuery{}, "")
+	_, err := r.VerifySnapshot(stateProvider, 1, 1)
+	assert.Equal(t, errVerifyNoStagingApp, err)
+
+	staging := &testStagingApp{conn: &proxymocks.AppConnSnapshot{}, connQuery: &proxymocks.AppConnQuery{}}
+	r = NewReactor(cfg.TestStateSyncConfig(), &proxymocks.AppConnSnapshot{}, &proxymocks.AppConnQuery{}, "",
+		WithStagingApp(staging))
+	_, err = r.VerifySnapshot(nil, 1, 1)
+	assert.Equal(t, errNoStateProvider, err)
+
+	// Verification is refused while a state sync is in progress.
+	r.mtx.Lock()
+	r.syncers[&syncer{}] = struct{}{}
+	r.mtx.Unlock()
+	_, err = r.VerifySnapshot(stateProvider, 1, 1)
+	assert.Equal(t, errVerifySyncing, err)
+}
+
+func TestReactor_VerifySnapshot_cancelledBySync(t *testing.T) {
+	config := cfg.TestStateSyncConfig()
+	config.DiscoveryTime = time.Minute
+	stateProvider := &mocks.StateProvider{}
+	staging := &testStagingApp{conn: &proxymocks.AppConnSnapshot{}, connQuery: &proxymocks.AppConnQuery{}}
+	r := NewReactor(config, &proxymocks.AppConnSnapshot{}, nil, "", WithStagingApp(staging))
+	require.NoError(t, r.Start())
+	t.Cleanup(func() {
+		if err := r.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// The verification waits for the snapshot to be discovered, until a state sync starts.
+	_, err := r.VerifySnapshot(stateProvider, 1, 1)
+	require.NoError(t, err)
+	_, err = r.SyncSnapshot(stateProvider, 0)
+	assert.Equal(t, errNoSnapshots, err)
+
+	report, ok := r.Verification()
+	require.True(t, ok)
+	assert.Equal(t, VerificationFailed, report.Status)
+	assert.Equal(t, errVerifyCancelled.Error(), report.Error)
+	assert.Empty(t, staging.calls)
+	assert.True(t, errors.Is(err, errNoSnapshots))
+}
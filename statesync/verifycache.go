@@ -0,0 +1,102 @@
+package statesync
+
+import (
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/types"
+)
+
+// verificationKey identifies a verified snapshot state, by height and trusted app hash.
+type verificationKey struct {
+	height  uint64
+	appHash string
+}
+
+// verificationTrust is the set of trust assumptions a state was verified under.
+type verificationTrust struct {
+	height int64
+	hash   string
+	period time.Duration
+}
+
+// verificationEntry is a state and commit verified by the state provider, along with the time
+// they were verified.
+type verificationEntry struct {
+	state    sm.State
+	commit   *types.Commit
+	verified time.Time
+}
+
+// verificationCache retains the states and commits verified by the state provider across state
+// syncs within the reactor's lifetime, such that a sync retried after a failure which re-selects
+// a snapshot doesn't have to verify its header and validator sets via the light client again.
+// Entries expire after the TTL, and the cache is cleared when the trust assumptions change.
+type verificationCache struct {
+	tmsync.Mutex
+	ttl     time.Duration
+	trust   verificationTrust
+	entries map[verificationKey]*verificationEntry
+}
+
+// newVerificationCache creates a new verification cache.
+func newVerificationCache(ttl time.Duration) *verificationCache {
+	return &verificationCache{
+		ttl:     ttl,
+		entries: make(map[verificationKey]*verificationEntry),
+	}
+}
+
+// Get returns the verified state and commit for a height and trusted app hash, if verified under
+// the given trust assumptions within the TTL.
+func (c *verificationCache) Get(trust verificationTrust, height uint64, appHash []byte) (sm.State,
+	*types.Commit, bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.setTrust(trust)
+	key := verificationKey{height: height, appHash: string(appHash)}
+	entry, ok := c.entries[key]
+	if !ok {
+		return sm.State{}, nil, false
+	}
+	if time.Since(entry.verified) > c.ttl {
+		delete(c.entries, key)
+		return sm.State{}, nil, false
+	}
+	return entry.state.Copy(), entry.commit, true
+}
+
+// Put records a state and commit verified under the given trust assumptions.
+func (c *verificationCache) Put(trust verificationTrust, height uint64, appHash []byte, state sm.State,
+	commit *types.Commit) {
+	c.Lock()
+	defer c.Unlock()
+	c.setTrust(trust)
+	for key, entry := range c.entries {
+		if time.Since(entry.verified) > c.ttl {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[verificationKey{height: height, appHash: string(appHash)}] = &verificationEntry{
+		state:    state.Copy(),
+		commit:   commit,
+		verified: time.Now(),
+	}
+}
+
+// Remove removes the verified state for a height and trusted app hash, e.g. when the restored
+// snapshot failed verification against it.
+func (c *verificationCache) Remove(height uint64, appHash []byte) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, verificationKey{height: height, appHash: string(appHash)})
+}
+
+// setTrust clears the cache if the trust assumptions have changed. The caller must hold the mutex.
+func (c *verificationCache) setTrust(trust verificationTrust) {
+	if trust != c.trust {
+		c.trust = trust
+		c.entries = make(map[verificationKey]*verificationEntry)
+	}
+}
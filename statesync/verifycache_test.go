@@ -0,0 +1,98 @@
+package statesync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	proxymocks "github.com/tendermint/tendermint/proxy/mocks"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/statesync/mocks"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestVerificationCache(t *testing.T) {
+	trust := verificationTrust{height: 1, hash: "AB", period: time.Hour}
+	valSet, _ := types.RandValidatorSet(1, 10)
+	state := sm.State{LastBlockHeight: 5, AppHash: []byte("app_hash"), Validators: valSet,
+		NextValidators: valSet, LastValidators: valSet}
+	commit := &types.Commit{Height: 5}
+
+	c := newVerificationCache(time.Hour)
+	_, _, ok := c.Get(trust, 5, []byte("app_hash"))
+	assert.False(t, ok)
+	c.Put(trust, 5, []byte("app_hash"), state, commit)
+
+	// Entries are keyed by height and trusted app hash.
+	cached, cachedCommit, ok := c.Get(trust, 5, []byte("app_hash"))
+	require.True(t, ok)
+	assert.Equal(t, state, cached)
+	assert.Equal(t, commit, cachedCommit)
+	_, _, ok = c.Get(trust, 5, []byte("other"))
+	assert.False(t, ok)
+	_, _, ok = c.Get(trust, 6, []byte("app_hash"))
+	assert.False(t, ok)
+
+	// Removed and expired entries are gone.
+	c.Remove(5, []byte("app_hash"))
+	_, _, ok = c.Get(trust, 5, []byte("app_hash"))
+	assert.False(t, ok)
+	c.Put(trust, 5, []byte("app_hash"), state, commit)
+	c.entries[verificationKey{height: 5, appHash: "app_hash"}].verified = time.Now().Add(-2 * time.Hour)
+	_, _, ok = c.Get(trust, 5, []byte("app_hash"))
+	assert.False(t, ok)
+
+	// Changing the trust assumptions clears the cache.
+	c.Put(trust, 5, []byte("app_hash"), state, commit)
+	_, _, ok = c.Get(verificationTrust{height: 2, hash: "CD", period: time.Hour}, 5, []byte("app_hash"))
+	assert.False(t, ok)
+	_, _, ok = c.Get(trust, 5, []byte("app_hash"))
+	assert.False(t, ok)
+}
+
+func TestSyncer_fetchState_verificationCache(t *testing.T) {
+	valSet, _ := types.RandValidatorSet(1, 10)
+	state := sm.State{LastBlockHeight: 1, AppHash: []byte("app_hash"), Validators: valSet,
+		NextValidators: valSet, LastValidators: valSet}
+	commit := &types.Commit{Height: 1}
+	stateProvider := &mocks.StateProvider{}
+	stateProvider.On("State", mock.Anything, uint64(1)).Return(state, nil)
+	stateProvider.On("Commit", mock.Anything, uint64(1)).Return(commit, nil)
+
+	hits := generic.NewCounter("hits")
+	misses := generic.NewCounter("misses")
+	metrics := NopMetrics()
+	metrics.VerificationCacheHits = hits
+	metrics.VerificationCacheMisses = misses
+	config := cfg.TestStateSyncConfig()
+	config.StateProviderFailureThreshold = 0
+	cache := newVerificationCache(time.Hour)
+	s := &snapshot{Height: 1, Format: 1, Chunks: 1, Hash: []byte{1}, trustedAppHash: []byte("app_hash")}
+	fetch := func() {
+		syncer := newSyncer(config, log.NewNopLogger(), &proxymocks.AppConnSnapshot{},
+			&proxymocks.AppConnQuery{}, stateProvider, "", withMetrics(metrics), withVerificationCache(cache))
+		fetchedState, fetchedCommit, err := syncer.fetchState(syncer.traceRoot, s)
+		require.NoError(t, err)
+		assert.Equal(t, state, fetchedState)
+		assert.Equal(t, commit, fetchedCommit)
+	}
+
+	// A retried sync reuses the verified state, unless the trust options have changed.
+	fetch()
+	fetch()
+	stateProvider.AssertNumberOfCalls(t, "State", 1)
+	stateProvider.AssertNumberOfCalls(t, "Commit", 1)
+	assert.EqualValues(t, 1, hits.Value())
+	assert.EqualValues(t, 1, misses.Value())
+
+	config.TrustHeight = 2
+	fetch()
+	stateProvider.AssertNumberOfCalls(t, "State", 2)
+	assert.EqualValues(t, 2, misses.Value())
+}